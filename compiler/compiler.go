@@ -5,24 +5,255 @@
 package compiler
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/skx/assembler/elf"
+	"github.com/skx/assembler/format"
+	"github.com/skx/assembler/ihex"
+	"github.com/skx/assembler/instructions"
+	"github.com/skx/assembler/macho"
 	"github.com/skx/assembler/parser"
+	"github.com/skx/assembler/pe"
+	"github.com/skx/assembler/preprocessor"
 	"github.com/skx/assembler/token"
 )
 
+// Format is the type of output we generate.
+type Format int
+
+const (
+	// ELF is a statically-linked ELF executable, which is the default.
+	ELF Format = iota
+
+	// Raw is a flat binary, containing only our code followed by our
+	// data, suitable for bare-metal experiments.
+	Raw
+
+	// PE is a Windows executable.  Note that the Linux system-calls
+	// made via `int 0x80`, or `syscall`, are not available there.
+	PE
+
+	// MachO is a macOS executable, for x86-64 only.  Note that macOS
+	// system-call numbers differ from those of Linux.
+	MachO
+
+	// IntelHex is a textual representation of our code, followed by
+	// our data, as Intel HEX records.  Like Raw output it is assumed
+	// to be loaded at address zero.
+	IntelHex
+)
+
+// simple holds the encodings of the instructions which take no operands,
+// and so always generate the same output.
+var simple = map[string]Encoding{
+	"clc":   {Opcode: []byte{0xf8}},
+	"cld":   {Opcode: []byte{0xfc}},
+	"cli":   {Opcode: []byte{0xfa}},
+	"cmc":   {Opcode: []byte{0xf5}},
+	"cpuid": {Opcode: []byte{0x0f, 0xa2}},
+	"hlt":   {Opcode: []byte{0xf4}},
+	"nop":   {Opcode: []byte{0x90}},
+	"ret":   {Opcode: []byte{0xc3}},
+	"stc":   {Opcode: []byte{0xf9}},
+	"std":   {Opcode: []byte{0xfd}},
+	"sti":   {Opcode: []byte{0xfb}},
+
+	"syscall": {Opcode: []byte{0x0f, 0x05}},
+
+	// string instructions
+	"cmpsb": {Opcode: []byte{0xa6}},
+	"cmpsw": {Prefixes: []byte{0x66}, Opcode: []byte{0xa7}},
+	"cmpsd": {Opcode: []byte{0xa7}},
+	"cmpsq": {REX: 0x48, Opcode: []byte{0xa7}},
+	"lodsb": {Opcode: []byte{0xac}},
+	"lodsw": {Prefixes: []byte{0x66}, Opcode: []byte{0xad}},
+	"lodsd": {Opcode: []byte{0xad}},
+	"lodsq": {REX: 0x48, Opcode: []byte{0xad}},
+	"movsb": {Opcode: []byte{0xa4}},
+	"movsw": {Prefixes: []byte{0x66}, Opcode: []byte{0xa5}},
+	"movsd": {Opcode: []byte{0xa5}},
+	"movsq": {REX: 0x48, Opcode: []byte{0xa5}},
+	"scasb": {Opcode: []byte{0xae}},
+	"scasw": {Prefixes: []byte{0x66}, Opcode: []byte{0xaf}},
+	"scasd": {Opcode: []byte{0xaf}},
+	"scasq": {REX: 0x48, Opcode: []byte{0xaf}},
+	"stosb": {Opcode: []byte{0xaa}},
+	"stosw": {Prefixes: []byte{0x66}, Opcode: []byte{0xab}},
+	"stosd": {Opcode: []byte{0xab}},
+	"stosq": {REX: 0x48, Opcode: []byte{0xab}},
+}
+
+// prefixes holds the encodings of the repeat-prefixes, along with the
+// string instructions each may be applied to.
+//
+// `rep ret`, or `repz ret`, is also accepted, as it is commonly used to
+// avoid a branch-prediction penalty upon older AMD processors.
+var prefixes = map[string]struct {
+	value byte
+	valid []string
+}{
+	"rep":   {0xf3, []string{"lods", "movs", "stos", "ret"}},
+	"repe":  {0xf3, []string{"cmps", "scas"}},
+	"repz":  {0xf3, []string{"cmps", "scas", "ret"}},
+	"repne": {0xf2, []string{"cmps", "scas"}},
+	"repnz": {0xf2, []string{"cmps", "scas"}},
+}
+
+// destinations holds the instructions whose first operand cannot be an
+// immediate, as they write to it, or in the case of `mul` and `div` they
+// only accept a register or memory, along with a description of the
+// operation, used when reporting errors.
+var destinations = map[string]string{
+	"add":  "add to",
+	"and":  "and into",
+	"dec":  "decrement",
+	"div":  "divide by",
+	"idiv": "divide by",
+	"imul": "multiply into",
+	"inc":  "increment",
+	"lea":  "load an address into",
+	"mov":  "move into",
+	"mul":  "multiply by",
+	"neg":  "negate",
+	"not":  "invert",
+	"or":   "or into",
+	"pop":  "pop into",
+	"sub":  "subtract from",
+	"xchg": "exchange with",
+	"xor":  "xor into",
+}
+
+// addressing holds the instructions whose memory operands may use a
+// displacement, or a scaled index, such as `[rbx+rcx*4+8]`.
+var addressing = map[string]bool{
+	"add":   true,
+	"and":   true,
+	"call":  true,
+	"cmp":   true,
+	"dec":   true,
+	"div":   true,
+	"idiv":  true,
+	"imul":  true,
+	"inc":   true,
+	"jmp":   true,
+	"lea":   true,
+	"mov":   true,
+	"movsd": true,
+	"mul":   true,
+	"neg":   true,
+	"not":   true,
+	"or":    true,
+	"sub":   true,
+	"test":  true,
+	"xchg":  true,
+	"xor":   true,
+}
+
+// byteRegisters holds the instructions which support the use of the
+// 8-bit registers.
+var byteRegisters = map[string]bool{
+	"in":  true,
+	"out": true,
+}
+
+// setConditions holds the conditional set instructions, along with the
+// second byte of their opcodes, each of which follows 0x0f.
+var setConditions = map[string]byte{
+	"seta":  0x97,
+	"setae": 0x93,
+	"setb":  0x92,
+	"setbe": 0x96,
+	"sete":  0x94,
+	"setg":  0x9f,
+	"setge": 0x9d,
+	"setl":  0x9c,
+	"setle": 0x9e,
+	"setne": 0x95,
+	"setnz": 0x95,
+	"setz":  0x94,
+}
+
+// The conditional set instructions store a flag within an 8-bit register,
+// or a byte of memory.
+func init() {
+	for name := range setConditions {
+		byteRegisters[name] = true
+		addressing[name] = true
+		destinations[name] = "set"
+	}
+}
+
+// byteImmediates holds the instructions which support an 8-bit register
+// as their destination, when the source is an immediate.
+var byteImmediates = map[string]bool{
+	"add": true,
+	"and": true,
+	"cmp": true,
+	"or":  true,
+	"sub": true,
+	"xor": true,
+}
+
+// elfBase overrides the address at which ELF executables are loaded, it
+// is a variable so that large addresses may be simulated by our
+// test-cases.  When zero the default of the elf package is used.
+var elfBase int64
+
+// Version is the version of the assembler, which is recorded within the
+// ELF binaries we generate if SetEmitBuildID has been called.  It may be
+// set when building, via `-ldflags "-X ..."`.
+var Version = "unreleased"
+
+// output holds the details of a single output we generate.
+type output struct {
+	// format holds the type of the output.
+	format Format
+
+	// path holds the location to which the output is written.
+	path string
+}
+
 // Compiler holds our state
 type Compiler struct {
 
+	// src holds the source of the program we're compiling
+	src string
+
+	// defines holds the numeric constants which have been defined
+	defines map[string]int64
+
+	// strings holds the string constants which have been defined
+	strings map[string]string
+
 	// p holds the parser we use to generate AST
 	p *parser.Parser
 
 	// output holds the path to the binary we'll generate
 	output string
 
+	// arch holds the architecture we're generating code for, either
+	// "amd64" or "i386".
+	arch string
+
+	// format holds the type of output we generate.
+	format Format
+
+	// outputs holds any additional outputs which have been requested.
+	outputs []output
+
 	// code contains the code we generate
 	code []byte
 
@@ -32,928 +263,4114 @@ type Compiler struct {
 	// map of "data-name" to "data-offset"
 	dataOffsets map[string]int
 
-	// patches we have to make, post-compilation.  Don't ask
-	patches map[int]int
+	// bss is the size of the zero-filled data which follows our data,
+	// and bssOffsets maps the name of each piece of it to its offset
+	// from the end of the data.
+	bss        int
+	bssOffsets map[string]int
+
+	// dataSizes maps the name of each piece of data, within either
+	// section, to its length, which is available as `name.len`.
+	dataSizes map[string]int
+
+	// section is the name of the section selected for the data which
+	// follows, either "data" or "bss".
+	section string
 
 	// labels and the corresponding offsets we've seen.
 	labels map[string]int
 
-	// offsets which contain jumps to labels
-	labelTargets map[int]string
+	// addends holds the constants added to the symbols used by the
+	// current instruction, for example 4 for `msg+4`.
+	addends map[string]int
+
+	// fixups holds the references to labels, and data, within our
+	// code which are patched once the code has been generated.
+	fixups []fixup
+
+	// 64-bit offsets within the data which hold the address of a
+	// label, or of other data.
+	dataRefs map[int]string
+
+	// custom holds the encoders for instructions registered by the
+	// user of the compiler.
+	custom map[string]func(c *Compiler, i parser.Instruction) error
+
+	// lengths holds the number of operands accepted by the registered
+	// instructions which aren't built-in, for our parser.
+	lengths map[string]int
+
+	// parts records the part of an instruction to which each byte of
+	// our code belongs, when recording is set by EncodeInstruction.
+	parts     []part
+	recording bool
+
+	// onInstruction is invoked after each instruction is compiled,
+	// if it has been set.
+	onInstruction func(i parser.Instruction, start int, end int)
+
+	// collect is set when we're collecting all the errors in the
+	// program, via CompileAll, rather than stopping at the first.
+	collect bool
+
+	// errors holds the errors we've collected.
+	errors []error
+
+	// maxErrors is the number of errors we'll collect before giving up.
+	maxErrors int
+
+	// warnings holds the non-fatal issues we've found, and line the
+	// line of the instruction being compiled, which they refer to.
+	warnings []string
+	line     int
+
+	// warningsAsErrors is true if any warning causes compilation to
+	// fail, once it is complete.
+	warningsAsErrors bool
+
+	// stdout is where we write output whose path is "-".
+	stdout io.Writer
+
+	// debugSource is the name of the source file, which is set when
+	// we're generating debugging information.
+	debugSource string
+
+	// buildID is true if the generated ELF binary contains notes,
+	// holding our version and a build-id.
+	buildID bool
+
+	// codeAlign is the alignment of the code within ELF binaries, or
+	// zero if it immediately follows the headers.
+	codeAlign int
+
+	// shared is the label exported by the ELF shared object we
+	// generate, if it has been set, rather than an executable.
+	shared string
+
+	// sourcePath is the path of the source file, against which the
+	// files embedded via `.incbin` are found.
+	sourcePath string
+
+	// lastLabel holds the name of the label defined by the previous
+	// statement, if any, which refers to any file embedded next.
+	lastLabel string
+
+	// autoExit is true if we append code to exit the program, when it
+	// might otherwise run past the end of its code, and last holds the
+	// name of the last instruction which generated code.
+	autoExit bool
+	last     string
+
+	// stdlib is true if the constants of the standard prelude, such
+	// as SYS_exit, are defined.
+	stdlib bool
+
+	// lines maps the code generated for each instruction to the line
+	// it was found upon, for the debugging information.
+	lines []elf.Line
+
+	// mainLabel is the label which our generated entry-point calls,
+	// if it has been set.
+	mainLabel string
+
+	// listing is where we write the JSON listing of our instructions,
+	// if it has been set, and listed holds the entries we've recorded.
+	listing io.Writer
+	listed  []ListingEntry
+
+	// timings holds the approximate cost of each instruction, used by
+	// EstimateCycles.
+	timings []timing
+
+	// nullFree is true if the generated code must not contain any
+	// null bytes, as is often required of shellcode.
+	nullFree bool
+
+	// twoPass is true if the jumps are sized by a first pass over the
+	// program, so that each may use the short form if its target is
+	// near enough, or the long form otherwise.
+	//
+	// During the first pass sizing is true, and jumps records the
+	// target of each jump and the offset following it.  short holds
+	// the jumps which may then use the short form.
+	twoPass bool
+	sizing  bool
+	jumps   []jump
+	short   map[int]bool
+}
+
+// jump records the target of a jump, and the offset of the end of the
+// jump, during the first pass.
+type jump struct {
+	target string
+	end    int
+}
+
+// ListingEntry describes a single instruction, and the code generated for
+// it, within the JSON listing written via SetListingJSON.
+type ListingEntry struct {
+	// Line is the line of the source upon which the instruction
+	// was found, counting from one.
+	Line int `json:"line"`
+
+	// Offset is the position of the code within the code section.
+	Offset int `json:"offset"`
 
-	// 8-bit offsets for relative label-jumps
-	jmps map[int]string
+	// Mnemonic is the name of the instruction, including any prefix.
+	Mnemonic string `json:"mnemonic"`
 
-	// 32-bit offsets for calls
-	calls map[int]string
+	// Operands holds the textual form of each operand.
+	Operands []string `json:"operands"`
+
+	// Bytes holds the generated code, as a string of hex digits.
+	Bytes string `json:"bytes"`
+
+	// size is the length of the generated code.
+	size int
 }
 
+// errTooMany is returned by Compile when the maximum number of errors
+// have been collected.
+var errTooMany = errors.New("too many errors")
+
 // New creates a new instance of the compiler
 func New(src string) *Compiler {
 
-	c := &Compiler{p: parser.New(src), output: "a.out"}
+	c := &Compiler{src: src, output: "a.out", arch: "amd64", maxErrors: 20, stdout: os.Stdout}
+	c.defines = make(map[string]int64)
+	c.strings = make(map[string]string)
 	c.dataOffsets = make(map[string]int)
-	c.patches = make(map[int]int)
+	c.bssOffsets = make(map[string]int)
+	c.dataSizes = make(map[string]int)
 
 	// mapping of "label -> XXX"
 	c.labels = make(map[string]int)
 
-	// fixups we need to make offset-of-code -> label
-	c.labelTargets = make(map[int]string)
+	// fixups we need to make within the data
+	c.dataRefs = make(map[int]string)
 
-	// jump-fixups
-	c.jmps = make(map[int]string)
+	// user-defined instructions
+	c.custom = make(map[string]func(c *Compiler, i parser.Instruction) error)
+	c.lengths = make(map[string]int)
 
-	// call-fixups
-	c.calls = make(map[int]string)
+	return c
+}
 
+// NewMulti creates a new instance of the compiler, whose program is made
+// up of the given fragments of source, which are compiled as a single
+// unit, as if each had been passed to Append in turn.
+func NewMulti(srcs ...string) *Compiler {
+	c := New("")
+	for _, src := range srcs {
+		c.Append(src)
+	}
 	return c
 }
 
+// Append adds a fragment of source to the end of our program, which is
+// useful for tools which generate code in pieces.  The fragments are
+// compiled as a single unit, so the labels, data, and constants defined
+// in one fragment may be used within any other.
+//
+// Each fragment begins upon a new line, and line numbers within errors
+// refer to the combined program.
+func (c *Compiler) Append(src string) {
+	if c.src != "" && !strings.HasSuffix(c.src, "\n") {
+		c.src += "\n"
+	}
+	c.src += src
+}
+
+// NewFromReader creates a new instance of the compiler, reading the
+// source of the program from the given reader.
+func NewFromReader(r io.Reader) (*Compiler, error) {
+
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source: %s", err)
+	}
+
+	return New(string(src)), nil
+}
+
 // SetOutput sets the path to the executable we create.
 //
-// If no output has been specified we default to `./a.out`.
+// If no output has been specified we default to `./a.out`.  If the path
+// is "-" the output is written to STDOUT instead.
 func (c *Compiler) SetOutput(path string) {
 	c.output = path
 }
 
-// Compile walks over the parser-generated AST and assembles the source
-// program.
-//
-// Once the program has been completed an ELF executable will be produced
-func (c *Compiler) Compile() error {
-
-	//
-	// Walk over the parser-output
-	//
-	stmt := c.p.Next()
-	for stmt != nil {
-
-		switch stmt := stmt.(type) {
+// SetStdout changes the writer to which output is written when the path
+// of the output is "-", which defaults to os.Stdout.
+func (c *Compiler) SetStdout(w io.Writer) {
+	c.stdout = w
+}
 
-		case parser.Data:
-			c.handleData(stmt)
+// SetDebug causes the generated ELF binary to contain debugging
+// information, mapping the code to the lines of the named source file,
+// so that it may be stepped through by line within `gdb`.
+func (c *Compiler) SetDebug(source string) {
+	c.debugSource = source
+}
 
-		case parser.Error:
-			return fmt.Errorf("error compiling - parser returned error %s", stmt.Value)
+// SetCodeAlignment causes the code of ELF binaries to begin upon a
+// multiple of the given alignment, both within the file and in memory,
+// for example 0x1000 to begin it upon a fresh page.  The addresses of
+// the labels, and data, take the padding into account.
+//
+// The alignment must be a power of two, no larger than 0x200000.
+func (c *Compiler) SetCodeAlignment(n int) error {
+	if n < 0 {
+		return fmt.Errorf("code alignment %d is negative", n)
+	}
+	err := elf.New().SetCodeAlignment(uint64(n))
+	if err != nil {
+		return err
+	}
+	c.codeAlign = n
+	return nil
+}
 
-		case parser.Label:
-			// So now we know the label with the given name
-			// corresponds to the CURRENT position in the
-			// generated binary-code.
-			//
-			// If anything refers to this we'll have to patch
-			// it up
-			c.labels[stmt.Name] = len(c.code)
+// SetEmitBuildID causes the generated ELF binary to contain a PT_NOTE
+// segment, and the matching sections, holding the version of the
+// assembler and a build-id, the SHA-1 hash of the code followed by the
+// data, as may be shown by `file` or `readelf -n`.
+func (c *Compiler) SetEmitBuildID(enabled bool) {
+	c.buildID = enabled
+}
 
-		case parser.Instruction:
-			err := c.compileInstruction(stmt)
-			if err != nil {
-				return err
-			}
+// SetShared causes an ELF shared object to be generated, rather than an
+// executable, which exports the given label as a function in its dynamic
+// symbol table, so that it may be found via `dlopen` and `dlsym`.
+//
+// Shared objects are loaded at an address chosen by the loader, so the
+// code must not refer to the absolute address of any label, or data, but
+// may use jumps, calls, and RIP-relative addressing such as `[rel msg]`.
+// Only 64-bit shared objects may be generated.
+func (c *Compiler) SetShared(label string) {
+	c.shared = label
+}
 
-		default:
-			return fmt.Errorf("unhandled node-type %v", stmt)
-		}
+// SetWarningsAsErrors causes compilation to fail if any warnings were
+// found, with an error for each.  The whole program is compiled first,
+// so Warnings returns the complete list, but no output is written.
+func (c *Compiler) SetWarningsAsErrors(enabled bool) {
+	c.warningsAsErrors = enabled
+}
 
-		stmt = c.p.Next()
-	}
+// SetTwoPass causes the program to be compiled twice.  The first pass
+// uses the long, 32-bit, form of every jump to a label, and finds the
+// distance to each target.  The second pass then uses the two-byte short
+// form of those jumps whose targets are within range, and the long form
+// of the others.
+//
+// Without this jumps always use the short form, and targets more than
+// 128 bytes away are an error.
+func (c *Compiler) SetTwoPass(enabled bool) {
+	c.twoPass = enabled
+}
 
-	//
-	// Apply data-patches.
-	//
-	// This is horrid.
-	//
-	for o, v := range c.patches {
+// SetNullFree causes compilation to fail if the generated code contains
+// any null bytes, reporting each instruction which generated them, as is
+// useful when writing shellcode for use with Raw output.  Only the code
+// is checked, not the data.
+func (c *Compiler) SetNullFree(enabled bool) {
+	c.nullFree = enabled
+}
 
-		// start of virtual sectoin
-		//  + offset
-		//  + len of code segment
-		//  + elf header
-		//  + 2 * program header
-		// life is hard
-		v = 0x400000 + v + len(c.code) + 0x40 + (2 * 0x38)
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(v))
+// SetSourcePath records the path of the source file, which is used to
+// find the files embedded via `.incbin`.  Relative paths are found in
+// the directory containing the source, or the current directory if this
+// has not been called.
+func (c *Compiler) SetSourcePath(path string) {
+	c.sourcePath = path
+}
 
-		for i, x := range buf {
-			c.code[i+o] = x
-		}
-	}
+// SetAutoExit causes code which exits the program, with a status of zero,
+// to be appended after the code of the program unless its final
+// instruction is one which doesn't continue, such as `ret`, `jmp`, or
+// `syscall`.
+//
+// Any data, or labels, following the final instruction are ignored when
+// finding it, however if a label refers to the end of the code the exit
+// is always appended, since jumping to it would otherwise run past the
+// end of the code.
+func (c *Compiler) SetAutoExit(enabled bool) {
+	c.autoExit = enabled
+}
 
-	//
-	// OK now we need to patch references to labels
-	//
-	for o, s := range c.labelTargets {
+// SetStdlib causes the constants of a standard prelude to be defined,
+// as if via Define, so that programs may use names rather than numbers:
+//
+//	mov rax, SYS_write
+//	mov rdi, STDOUT
+//
+// The numbers of common Linux system calls, such as SYS_write and
+// SYS_exit, are defined for our architecture, along with the file
+// descriptors STDIN, STDOUT, and STDERR, and EXIT_SUCCESS and
+// EXIT_FAILURE.  Any constant defined via Define takes precedence.
+func (c *Compiler) SetStdlib(enabled bool) {
+	c.stdlib = enabled
+}
 
-		offset := c.labels[s]
+// SetMainLabel causes an entry-point to be generated, before the code
+// of the program, which calls the named label and then exits, using the
+// value returned in rax as the exit status.
+//
+// This allows programs to be written in the style of C, with a `:main`
+// function which returns, rather than exiting itself.
+func (c *Compiler) SetMainLabel(name string) {
+	c.mainLabel = name
+}
 
-		offset = 0x400000 + offset + 0x40 + (2 * 0x38)
+// SetListingJSON causes a listing of the program to be written to the
+// given writer, once it has been compiled, as a JSON array with an entry
+// for each instruction, describing the code generated for it.
+//
+// The listing is intended to be consumed by tools, such as editors, and
+// each entry may be decoded into a ListingEntry.
+func (c *Compiler) SetListingJSON(w io.Writer) {
+	c.listing = w
+}
 
-		// So we have a new offset.
+// SetFormat sets the type of output we generate.
+//
+// By default we generate an ELF executable, but we may also generate
+// a raw binary which is assumed to be loaded at address zero.
+func (c *Compiler) SetFormat(format Format) {
+	c.format = format
+}
 
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(offset))
+// AddOutput requests that an output of the given format be written to
+// the specified path.  It may be called multiple times, and each output
+// will be written from the same compiled code and data.
+//
+// Note that addresses are resolved according to the format specified
+// via SetFormat, regardless of the format of each output.
+//
+// If any outputs are added then the path given to SetOutput is ignored.
+func (c *Compiler) AddOutput(format Format, path string) {
+	c.outputs = append(c.outputs, output{format: format, path: path})
+}
 
-		for i, x := range buf {
-			c.code[i+o] = x
-		}
+// SetArch sets the architecture we generate code for.
+//
+// By default we generate 64-bit x86-64 executables, but it is possible
+// to select "i386" to produce a 32-bit executable instead.  Only the
+// subset of instructions which don't require a REX prefix, operating
+// upon the 32-bit registers, may be used when targeting i386.
+func (c *Compiler) SetArch(arch string) error {
+	switch arch {
+	case "amd64", "x86_64", "x86-64":
+		c.arch = "amd64"
+	case "i386", "x86":
+		c.arch = "i386"
+	default:
+		return fmt.Errorf("unknown architecture %s", arch)
 	}
+	return nil
+}
 
-	// Patchup the jumps
-	for o, s := range c.jmps {
+// Define defines a numeric constant, with the specified value, which may
+// be used in expressions and tested via `%ifdef`, or `%if`, in the source.
+//
+// For example `c.Define("VERSION", 3)` allows `mov rax, VERSION`.
+func (c *Compiler) Define(name string, value int64) {
+	c.defines[name] = value
+}
 
-		// the offset of the instruction to we should jump to
-		offset := c.labels[s]
+// DefineString defines a string constant, which may be used as the
+// contents of a data declaration and tested via `%ifdef` in the source.
+//
+// For example `c.DefineString("NAME", "steve")` allows `.name DB NAME`.
+func (c *Compiler) DefineString(name string, value string) {
+	c.strings[name] = value
+}
 
-		// the offset of the position is a byte
-		diff := uint(o - offset)
+// OnInstruction registers a function which is invoked after each
+// instruction has been compiled, with the offsets of the first byte
+// generated for it and of the byte following it, in the code.
+//
+// The callback is invoked before any fixups are applied, so while the
+// offsets are correct the bytes referring to labels, or data, will not
+// yet have their final values.
+func (c *Compiler) OnInstruction(fn func(i parser.Instruction, start int, end int)) {
+	c.onInstruction = fn
+}
 
-		c.code[o] = byte(0xff - byte(diff))
+// RegisterInstruction registers a function which will be used to encode
+// the named instruction, replacing any built-in support for it.
+//
+// New instructions accept any number of operands, which must be upon the
+// same line as the instruction.  The function should append the encoded
+// instruction to the output via Emit, or return an error.
+//
+// The instruction is known only to this compiler.
+func (c *Compiler) RegisterInstruction(name string, fn func(c *Compiler, i parser.Instruction) error) {
+	if _, ok := instructions.InstructionLengths[name]; !ok {
+		c.lengths[name] = instructions.Variable
 	}
+	c.custom[name] = fn
+}
 
-	// Patchup the calls
-	for o, s := range c.calls {
+// newParser returns a parser for the given source, which knows about any
+// instructions registered via RegisterInstruction.
+func (c *Compiler) newParser(src string) *parser.Parser {
+	p := parser.New(src)
+	p.SetInstructions(c.lengths)
+	return p
+}
 
-		// the offset of the instruction to which we should call
-		offset := c.labels[s]
+// Emit appends the given bytes to the generated code.
+//
+// This is intended for use by instructions registered via
+// RegisterInstruction.
+func (c *Compiler) Emit(bytes ...byte) {
+	c.code = append(c.code, bytes...)
+}
 
-		// the offset of the position is a byte
-		diff := uint32(o - offset + 4)
-		x := uint32(0xffffffff) - uint32(diff-1)
+// Compile walks over the parser-generated AST and assembles the source
+// program.
+//
+// Once the program has been completed an ELF executable will be produced
+func (c *Compiler) Compile() error {
 
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, x)
+	//
+	// Run the preprocessor, to handle any conditional assembly.
+	//
+	// The prelude is defined now, as our architecture may have been
+	// changed after it was requested.
+	if c.stdlib {
+		c.defineStdlib()
+	}
+	pp := preprocessor.New(c.src)
+	for name, value := range c.defines {
+		pp.Define(name, fmt.Sprintf("%d", value))
+	}
+	for name, value := range c.strings {
+		pp.Define(name, value)
+	}
+	src, err := pp.Process()
+	if err != nil {
+		return fmt.Errorf("error preprocessing: %s", err)
+	}
 
-		// overwrite the instruction
-		for i, x := range buf {
-			c.code[i+o] = x
+	// Values given via `%define` in the source are constants, as if
+	// they'd been defined via Define.
+	for name, value := range pp.Defines() {
+		if value == "" || c.strings[name] == value {
+			continue
+		}
+		v, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("error preprocessing: the value of %s, %s, is not a number", name, value)
 		}
+		c.defines[name] = v
 	}
+	c.p = c.newParser(src)
+	c.warnings = nil
+	c.line = 0
 
 	//
-	// Write.  The.  Elf.  Output.
+	// Size the jumps, if requested, and then generate our code.
 	//
-	e := elf.New()
-	err := e.WriteContent(c.output, c.code, c.data)
+	if c.twoPass {
+		c.sizeJumps(src)
+	}
+	err = c.assemble()
 	if err != nil {
-		return fmt.Errorf("error writing elf: %s", err.Error())
+		return err
 	}
 
-	return nil
-
-}
-
-// handleData appends the data to the data-section of our binary,
-// and stores the offset appropriately
-func (c *Compiler) handleData(d parser.Data) {
+	// If we've collected any errors then we're done.
+	if len(c.errors) > 0 {
+		return c.errors[0]
+	}
 
-	// Offset of the start of the data is the current
-	// length of the existing data.
-	offset := len(c.data)
+	//
+	// Ensure the program exits, if requested.
+	//
+	if c.autoExit && c.needsExit() {
+		err = c.assembleSyscallExit(parser.Instruction{
+			Instruction: "syscall_exit",
+			Operands:    []parser.Operand{{Token: token.Token{Type: token.NUMBER, Literal: "0"}}},
+		})
+		if err != nil {
+			return fmt.Errorf("error generating exit: %s", err)
+		}
+	}
 
-	// Add
-	c.data = append(c.data, d.Contents...)
+	c.line = 0
+	c.unreferenced()
 
-	// Save
-	c.dataOffsets[d.Name] = offset
+	// In strict builds every warning is an error, which means we
+	// generate no output.
+	if c.warningsAsErrors {
+		for _, w := range c.warnings {
+			err = c.fail(fmt.Errorf("warning treated as an error: %s", w))
+			if err != nil {
+				return err
+			}
+		}
+		if len(c.errors) > 0 {
+			return c.errors[0]
+		}
+	}
 
-	// TODO: Do we care about alignment?  We might
-	// in the future.
-}
+	// A shared object must export a function we've defined.
+	if c.shared != "" {
+		if c.arch != "amd64" {
+			return fmt.Errorf("shared objects may only be generated for amd64")
+		}
+		if _, ok := c.labels[c.shared]; !ok {
+			return c.undefined(c.shared)
+		}
+	}
 
-// compileInstruction handles the instruction generation
-func (c *Compiler) compileInstruction(i parser.Instruction) error {
+	// The bss follows all of our data.
+	for name, offset := range c.bssOffsets {
+		c.dataOffsets[name] = len(c.data) + offset
+	}
 
-	switch i.Instruction {
+	//
+	// The addresses at which our code, and data, are loaded, which
+	// depend upon the size of the headers which precede them.
+	//
+	base := int(c.codeAddress())
+	dataBase := int(c.dataAddress())
 
-	case "add":
-		err := c.assembleADD(i)
+	//
+	// Now we know the final size of our code, and the position of
+	// each label, we can patch the references to them.
+	//
+	for _, f := range c.fixups {
+		err = c.applyFixup(f, base, dataBase)
 		if err != nil {
 			return err
 		}
-		return nil
+	}
 
-	case "call":
-		err := c.assembleCALL(i)
-		if err != nil {
-			return err
+	// Patchup the addresses stored within the data
+	for o, s := range c.dataRefs {
+
+		if c.shared != "" {
+			return fmt.Errorf("the address of %s cannot be stored within the data of a shared object", s)
 		}
-		return nil
 
-	case "clc":
-		c.code = append(c.code, 0xf8)
-		return nil
+		var addr int
+		if offset, ok := c.labels[s]; ok {
+			addr = base + offset
+		} else if offset, ok := c.dataOffsets[s]; ok {
+			addr = dataBase + offset
+		} else {
+			return c.undefined(s)
+		}
 
-	case "cld":
-		c.code = append(c.code, 0xfc)
-		return nil
+		binary.LittleEndian.PutUint64(c.data[o:], uint64(addr))
+	}
 
-	case "cli":
-		c.code = append(c.code, 0xfa)
-		return nil
+	//
+	// Now the code is complete we can look for null bytes.
+	//
+	if c.nullFree {
+		err = c.checkNullFree()
+		if err != nil {
+			return err
+		}
+	}
 
-	case "cmp":
-		err := c.assembleCMP(i)
+	//
+	// Now the code is complete we can write the listing.
+	//
+	if c.listing != nil {
+		err = c.writeListing()
 		if err != nil {
 			return err
 		}
-		return nil
+	}
 
-	case "cmc":
-		c.code = append(c.code, 0xf5)
+	//
+	// Write each of our outputs, defaulting to the single one
+	// configured via SetOutput and SetFormat.
+	//
+	outputs := c.outputs
+	if len(outputs) == 0 {
+		outputs = []output{{format: c.format, path: c.output}}
+	}
+	for _, out := range outputs {
+		err = c.write(out)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// sizeJumps compiles the given source, without writing any output, using
+// the long form of every jump, and records those which may use the short
+// form when the program is compiled again.
+//
+// Since the second pass only makes code shorter a jump which is in range
+// here will also be in range then.  Any errors are ignored, as they will
+// be found again, and reported, by the second pass.
+func (c *Compiler) sizeJumps(src string) {
+
+	probe := *c
+	probe.p = c.newParser(src)
+	probe.sizing = true
+	probe.jumps = nil
+	probe.collect = false
+	probe.errors, probe.warnings = nil, nil
+	probe.section, probe.lastLabel, probe.last = "", "", ""
+	probe.onInstruction = nil
+	probe.listing = nil
+	probe.code, probe.data, probe.bss = nil, nil, 0
+	probe.fixups, probe.lines, probe.listed, probe.timings = nil, nil, nil, nil
+	probe.labels = make(map[string]int)
+	probe.dataOffsets = make(map[string]int)
+	probe.bssOffsets = make(map[string]int)
+	probe.dataSizes = make(map[string]int)
+	probe.dataRefs = make(map[int]string)
+
+	c.short = make(map[int]bool)
+	if probe.assemble() != nil {
+		return
+	}
+
+	for n, j := range probe.jumps {
+		if target, ok := probe.labels[j.target]; ok {
+			diff := target - j.end
+			c.short[n] = diff >= math.MinInt8 && diff <= math.MaxInt8
+		}
+	}
+}
+
+// assemble generates the code, and data, for each of the statements
+// returned by our parser, after any entry-point which calls main.
+func (c *Compiler) assemble() error {
+
+	var err error
+
+	//
+	// Generate the entry-point which calls main, if requested.
+	//
+	if c.mainLabel != "" {
+		err = c.entryStub()
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// Walk over the parser-output
+	//
+	stmt := c.p.Next()
+	for stmt != nil {
+
+		// Only a label immediately preceding `.incbin` refers to it.
+		label := c.lastLabel
+		c.lastLabel = ""
+
+		switch stmt := stmt.(type) {
+
+		case parser.Data:
+			err = c.handleData(stmt)
+			if err != nil {
+				if err = c.fail(err); err != nil {
+					return err
+				}
+			}
+
+		case parser.Error:
+			// The parser can't recover from errors, so we stop
+			// here even if we're collecting them.
+			err = parseError(stmt)
+			if e := c.fail(err); e != nil {
+				return e
+			}
+			return c.errors[0]
+
+		case parser.Incbin:
+			err = c.handleIncbin(stmt, label)
+			if err != nil {
+				if err = c.fail(err); err != nil {
+					return err
+				}
+			}
+
+		case parser.Hotpatch:
+			err = c.handleHotpatch(label)
+			if err != nil {
+				if err = c.fail(err); err != nil {
+					return err
+				}
+			}
+
+		case parser.Section:
+			// Instructions are always placed in our code, so
+			// only the data sections are tracked.
+			if stmt.Name != "text" {
+				c.section = stmt.Name
+			}
+
+		case parser.Label:
+			// So now we know the label with the given name
+			// corresponds to the CURRENT position in the
+			// generated binary-code.
+			//
+			// If anything refers to this we'll have to patch
+			// it up
+			c.labels[stmt.Name] = len(c.code)
+			c.lastLabel = stmt.Name
+
+		case parser.Instruction:
+			start := len(c.code)
+
+			// The listing describes the operands as written,
+			// before any are replaced during compilation.
+			var entry ListingEntry
+			if c.listing != nil || c.nullFree {
+				entry = listingEntry(stmt, start)
+			}
+
+			c.line = stmt.Line
+			err := c.compileInstruction(stmt)
+			if err != nil {
+				if err = c.fail(err); err != nil {
+					return err
+				}
+			}
+			if c.onInstruction != nil {
+				c.onInstruction(stmt, start, len(c.code))
+			}
+			if len(c.code) > start {
+				c.lines = append(c.lines, elf.Line{Offset: uint64(start), Line: stmt.Line})
+				c.last = stmt.Instruction
+			}
+			c.timings = append(c.timings, timing{offset: start, cycles: cycles(stmt)})
+			if c.listing != nil || c.nullFree {
+				entry.size = len(c.code) - start
+				c.listed = append(c.listed, entry)
+			}
+
+		default:
+			return fmt.Errorf("unhandled node-type %v", stmt)
+		}
+
+		stmt = c.p.Next()
+	}
+
+	return nil
+}
+
+// build returns the output of the given format, for writing to STDOUT.
+func (c *Compiler) build(format Format) ([]byte, error) {
+	switch format {
+	case Raw:
+		return append(append([]byte{}, c.code...), c.dataImage()...), nil
+	case IntelHex:
+		data := append(append([]byte{}, c.code...), c.dataImage()...)
+		return []byte(ihex.Encode(uint32(c.codeAddress()), data)), nil
+	case PE:
+		return c.newPE().Build(c.code, c.dataImage()), nil
+	case MachO:
+		if c.arch == "i386" {
+			return nil, fmt.Errorf("Mach-O output is only available for amd64")
+		}
+		return macho.New().Build(c.code, c.dataImage()), nil
+	}
+	return c.newElf().Build(c.code, c.data), nil
+}
+
+// CompileAll compiles the program, as Compile does, but rather than
+// stopping at the first error it continues, and returns all the errors
+// which were found.
+//
+// Once the maximum number of errors, set via SetMaxErrors, have been
+// found we give up, and the final error notes that there were more.
+func (c *Compiler) CompileAll() []error {
+
+	c.collect = true
+	c.errors = nil
+	defer func() { c.collect = false }()
+
+	err := c.Compile()
+	if err == errTooMany {
+		return append(c.errors, fmt.Errorf("...and more errors"))
+	}
+	if len(c.errors) > 0 {
+		return c.errors
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// SetMaxErrors sets the maximum number of errors which CompileAll will
+// collect, which defaults to 20.  A limit of zero means there is no limit.
+func (c *Compiler) SetMaxErrors(n int) {
+	c.maxErrors = n
+}
+
+// Warnings returns the non-fatal issues found while compiling, such as
+// labels, or data, which are never referred to, or instructions which
+// have a shorter encoding.
+//
+// This is only valid after Compile has been called.
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
+// warn records a warning about the instruction being compiled.
+func (c *Compiler) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if c.line > 0 {
+		msg = fmt.Sprintf("line %d: %s", c.line, msg)
+	}
+	c.warnings = append(c.warnings, msg)
+}
+
+// unreferenced records a warning for each label, and each piece of
+// data, which is never referred to.
+func (c *Compiler) unreferenced() {
+
+	used := make(map[string]bool)
+	for _, f := range c.fixups {
+		used[f.target] = true
+	}
+	for _, name := range c.dataRefs {
+		used[name] = true
+	}
+
+	var labels, data []string
+	for name := range c.labels {
+		if !used[name] {
+			labels = append(labels, name)
+		}
+	}
+	for name := range c.dataOffsets {
+		if !used[name] {
+			data = append(data, name)
+		}
+	}
+	for name := range c.bssOffsets {
+		if !used[name] {
+			data = append(data, name)
+		}
+	}
+	sort.Strings(labels)
+	sort.Strings(data)
+
+	for _, name := range labels {
+		c.warnings = append(c.warnings, fmt.Sprintf("label %s is never referenced", name))
+	}
+	for _, name := range data {
+		c.warnings = append(c.warnings, fmt.Sprintf("data %s is never referenced", name))
+	}
+}
+
+// fail handles an error found while compiling.  Unless we're collecting
+// errors it is returned, to abort the compilation, otherwise it is recorded
+// and nil is returned so that we continue.
+func (c *Compiler) fail(err error) error {
+	if !c.collect {
+		return err
+	}
+	if c.maxErrors > 0 && len(c.errors) >= c.maxErrors {
+		return errTooMany
+	}
+	c.errors = append(c.errors, err)
+	return nil
+}
+
+// write generates the given output, from our code and data.
+func (c *Compiler) write(out output) error {
+
+	//
+	// Writing to STDOUT?
+	//
+	if out.path == "-" {
+		bin, err := c.build(out.format)
+		if err != nil {
+			return err
+		}
+		_, err = c.stdout.Write(bin)
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err.Error())
+		}
+		return nil
+	}
+
+	//
+	// Raw output is just our code, followed by our data.
+	//
+	if out.format == Raw {
+		bin := append([]byte{}, c.code...)
+		bin = append(bin, c.dataImage()...)
+		err := ioutil.WriteFile(out.path, bin, 0644)
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err.Error())
+		}
+		return nil
+	}
+
+	if out.format == IntelHex {
+		err := ihex.WriteContent(out.path, uint32(c.codeAddress()), c.code, c.dataImage())
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err.Error())
+		}
+		return nil
+	}
+
+	if out.format == PE {
+		err := c.newPE().WriteContent(out.path, c.code, c.dataImage())
+		if err != nil {
+			return fmt.Errorf("error writing PE: %s", err.Error())
+		}
+		return nil
+	}
+
+	if out.format == MachO {
+		if c.arch == "i386" {
+			return fmt.Errorf("Mach-O output is only available for amd64")
+		}
+		err := macho.New().WriteContent(out.path, c.code, c.dataImage())
+		if err != nil {
+			return fmt.Errorf("error writing Mach-O: %s", err.Error())
+		}
+		return nil
+	}
+
+	//
+	// Write.  The.  Elf.  Output.
+	//
+	e := c.newElf()
+	err := e.WriteContent(out.path, c.code, c.data)
+	if err != nil {
+		return fmt.Errorf("error writing elf: %s", err.Error())
+	}
+	return nil
+}
+
+// listingEntry returns the entry describing the given instruction, whose
+// code begins at the specified offset, within the listing.
+func listingEntry(i parser.Instruction, start int) ListingEntry {
+
+	entry := ListingEntry{
+		Line:     i.Line,
+		Offset:   start,
+		Mnemonic: i.Instruction,
+		Operands: []string{},
+	}
+	if i.Prefix != "" {
+		entry.Mnemonic = i.Prefix + " " + i.Instruction
+	}
+	for _, op := range i.Operands {
+		entry.Operands = append(entry.Operands, format.Operand(op))
+	}
+	return entry
+}
+
+// checkNullFree returns an error for each instruction whose code contains
+// a null byte, suggesting an alternative where there is a common one.
+//
+// Code which we generate ourselves, such as the exit appended via
+// SetAutoExit, is reported by its offset.
+func (c *Compiler) checkNullFree() error {
+
+	checked := make([]bool, len(c.code))
+
+	for _, entry := range c.listed {
+		code := c.code[entry.Offset : entry.Offset+entry.size]
+		for n := range code {
+			checked[entry.Offset+n] = true
+		}
+		if bytes.IndexByte(code, 0) < 0 {
+			continue
+		}
+
+		text := strings.TrimSpace(entry.Mnemonic + " " + strings.Join(entry.Operands, ", "))
+		msg := fmt.Sprintf("line %d: %s contains a null byte", entry.Line, text)
+		if entry.Mnemonic == "mov" && len(entry.Operands) == 2 && entry.Operands[1] == "0" {
+			reg := entry.Operands[0]
+			msg += fmt.Sprintf(", use xor %s, %s instead", reg, reg)
+		}
+
+		err := c.fail(errors.New(msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	for offset, b := range c.code {
+		if b == 0 && !checked[offset] {
+			err := c.fail(fmt.Errorf("generated code at offset %d contains a null byte", offset))
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if len(c.errors) > 0 {
+		return c.errors[0]
+	}
+	return nil
+}
+
+// writeListing writes the JSON listing of our instructions, including
+// the final code generated for each, after all fixups have been applied.
+func (c *Compiler) writeListing() error {
+
+	entries := []ListingEntry{}
+	for _, entry := range c.listed {
+		entry.Bytes = hex.EncodeToString(c.code[entry.Offset : entry.Offset+entry.size])
+		entries = append(entries, entry)
+	}
+
+	err := json.NewEncoder(c.listing).Encode(entries)
+	if err != nil {
+		return fmt.Errorf("error writing listing: %s", err)
+	}
+	return nil
+}
+
+// Symbols returns the virtual address of each label, and each piece of
+// named data, in the program.
+//
+// This is only valid after Compile has been called.
+func (c *Compiler) Symbols() map[string]uint64 {
+
+	base := uint64(c.codeAddress())
+	dataBase := uint64(c.dataAddress())
+
+	symbols := make(map[string]uint64)
+	for name, offset := range c.labels {
+		symbols[name] = base + uint64(offset)
+	}
+	for name, offset := range c.dataOffsets {
+		symbols[name] = dataBase + uint64(offset)
+	}
+	return symbols
+}
+
+// EntryAddress returns the virtual address at which execution of the
+// program begins, which is the e_entry field of an ELF binary.  The code
+// begins with the entry-point, so this is also the address of the code.
+//
+// This is only valid after Compile has been called.
+func (c *Compiler) EntryAddress() uint64 {
+	if c.format == ELF {
+		return c.newElf().Layout(uint64(len(c.code)), uint64(len(c.data))).Entry
+	}
+	return uint64(c.codeAddress())
+}
+
+// parseError returns the error reported by the parser, including its
+// position if that is known.
+func parseError(e parser.Error) error {
+	if e.Line == 0 {
+		return fmt.Errorf("error compiling - parser returned error %s", e.Value)
+	}
+	if e.Token.Literal == "" {
+		return fmt.Errorf("error compiling - line %d, column %d: %s", e.Line, e.Column, e.Value)
+	}
+	return fmt.Errorf("error compiling - line %d, column %d, near %q: %s", e.Line, e.Column, e.Token.Literal, e.Value)
+}
+
+// ParseOnly parses the given program, after running the preprocessor,
+// and returns the resulting nodes without generating any code, which is
+// useful for tools such as linters.
+//
+// The parser cannot recover from errors, so if the program is malformed
+// the nodes preceding the error are returned, along with the error.
+func ParseOnly(src string) ([]parser.Node, []error) {
+
+	src, err := preprocessor.New(src).Process()
+	if err != nil {
+		return nil, []error{fmt.Errorf("error preprocessing: %s", err)}
+	}
+
+	var nodes []parser.Node
+
+	p := parser.New(src)
+	for node := p.Next(); node != nil; node = p.Next() {
+		if e, ok := node.(parser.Error); ok {
+			return nodes, []error{parseError(e)}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// AssembleRange compiles the given program, and returns only the code
+// which lies between the start label and the end label, which is useful
+// for testing a single function in isolation.  If the end label is empty
+// the code up to the end of the program is returned.
+//
+// The whole program is compiled, so constants and the like may be used,
+// but the returned code is standalone: references to labels within the
+// range are resolved as if the code were loaded at address zero, and any
+// reference to code outside the range, or to data, is an error.
+func AssembleRange(src string, startLabel string, endLabel string) ([]byte, error) {
+
+	c := New(src)
+	c.SetFormat(Raw)
+	c.SetStdout(ioutil.Discard)
+	c.SetOutput("-")
+
+	err := c.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	start, ok := c.labels[startLabel]
+	if !ok {
+		return nil, c.undefined(startLabel)
+	}
+	end := len(c.code)
+	if endLabel != "" {
+		end, ok = c.labels[endLabel]
+		if !ok {
+			return nil, c.undefined(endLabel)
+		}
+	}
+	if end < start {
+		return nil, fmt.Errorf("label %s precedes label %s", endLabel, startLabel)
+	}
+
+	inRange := func(offset int) bool {
+		return offset >= start && offset < end
+	}
+
+	code := append([]byte{}, c.code[start:end]...)
+
+	for _, f := range c.fixups {
+		if !inRange(f.offset) {
+			continue
+		}
+
+		// The data isn't included
+		if f.kind == absoluteData || f.kind == relativeData {
+			return nil, fmt.Errorf("data cannot be referenced within the range %s-%s", startLabel, endLabel)
+		}
+
+		target := c.labels[f.target]
+		if target < start || target > end {
+			return nil, fmt.Errorf("label %s is outside the range %s-%s", f.target, startLabel, endLabel)
+		}
+
+		// Relative references are unaffected by moving the code,
+		// so long as their targets are moved too, but absolute
+		// references are relative to the start of the range.
+		if f.kind == absoluteCode {
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(target-start+f.addend))
+			copy(code[f.offset-start:], buf[:f.size])
+		}
+	}
+
+	return code, nil
+}
+
+// ExportC returns the generated code as a C array, with the given name,
+// for example:
+//
+//	unsigned char code[] = { 0x90, 0xc3 };
+//
+// This is only valid after Compile has been called.
+func (c *Compiler) ExportC(varName string) string {
+	var out []string
+	for _, b := range c.code {
+		out = append(out, fmt.Sprintf("0x%02x", b))
+	}
+	return fmt.Sprintf("unsigned char %s[] = { %s };", varName, strings.Join(out, ", "))
+}
+
+// ExportHex returns the generated code as a string of hex digits, for
+// example "90c3".
+//
+// This is only valid after Compile has been called.
+func (c *Compiler) ExportHex() string {
+	return fmt.Sprintf("%x", c.code)
+}
+
+// newElf returns an ELF-generator configured for our architecture.
+func (c *Compiler) newElf() *elf.Elf {
+	e := elf.New()
+	if elfBase != 0 {
+		e.SetBase(uint64(elfBase))
+	}
+	e.SetBss(uint64(c.bss))
+	if c.arch == "i386" {
+		e.SetClass(32)
+	}
+	if c.debugSource != "" {
+		e.SetDebugLines(c.debugSource, c.lines)
+	}
+	if c.buildID {
+		e.SetNotes(Version)
+	}
+	if c.codeAlign != 0 {
+		e.SetCodeAlignment(uint64(c.codeAlign))
+	}
+	if c.shared != "" {
+		e.SetShared([]elf.Export{{Name: c.shared, Offset: uint64(c.labels[c.shared])}})
+	}
+	return e
+}
+
+// newPE returns a PE-generator configured for our architecture.
+func (c *Compiler) newPE() *pe.PE {
+	p := pe.New()
+	if c.arch == "i386" {
+		p.SetClass(32)
+	}
+	return p
+}
+
+// codeAddress returns the virtual address at which our code begins.
+//
+// Raw, and Intel HEX, output is assumed to be loaded at address zero.
+func (c *Compiler) codeAddress() int64 {
+	switch c.format {
+	case Raw, IntelHex:
+		return 0
+	case PE:
+		return int64(c.newPE().CodeAddress())
+	case MachO:
+		return int64(macho.New().CodeAddress())
+	}
+	return int64(c.newElf().Layout(uint64(len(c.code)), 0).CodeAddress)
+}
+
+// dataAddress returns the virtual address at which our data begins.
+//
+// ELF binaries load the data into its own, non-executable, segment,
+// otherwise the data immediately follows the code.
+//
+// This is only valid once all the code has been generated.
+func (c *Compiler) dataAddress() int64 {
+	switch c.format {
+	case Raw, IntelHex, PE, MachO:
+		return c.codeAddress() + int64(len(c.code))
+	}
+	return int64(c.newElf().Layout(uint64(len(c.code)), uint64(len(c.data))).DataAddress)
+}
+
+// evaluate returns the value of an operand which is an expression, or
+// one of the special symbols:
+//
+//	$  - The address of the current instruction.
+//	$$ - The address of the start of the code section.
+//
+// So `$ - $$` is the size of the code which precedes the instruction.
+func (c *Compiler) evaluate(op parser.Operand) (int64, error) {
+
+	terms := op.Expression
+	if terms == nil {
+		terms = []token.Token{op.Token}
+	}
+
+	total := int64(0)
+	sign := int64(1)
+
+	for _, t := range terms {
+		switch t.Type {
+		case token.PLUS:
+			sign = 1
+		case token.MINUS:
+			sign = -1
+		case token.NUMBER:
+			n, err := strconv.ParseInt(t.Literal, 0, 64)
+			if err != nil {
+				return 0, fmt.Errorf("unable to convert %s to number %s", t.Literal, err)
+			}
+			total += sign * n
+		case token.IDENTIFIER:
+			v, err := c.resolve(t.Literal)
+			if err != nil {
+				return 0, err
+			}
+			total += sign * v
+		default:
+			return 0, fmt.Errorf("unexpected token in expression %v", t)
+		}
+	}
+
+	return total, nil
+}
+
+// symbolOffset returns the label, or data, referred to by an expression
+// which adds a constant to it, such as `msg+4`, along with the value of
+// the constant.
+func (c *Compiler) symbolOffset(op parser.Operand) (string, int64, bool) {
+
+	if op.Type != token.EXPRESSION {
+		return "", 0, false
+	}
+
+	// Find the single symbol, which must be added rather than
+	// subtracted, and replace it with zero to find the offset.  It
+	// may be a label which is defined later, so it isn't looked up
+	// until the fixup is applied.
+	name := ""
+	terms := make([]token.Token, len(op.Expression))
+	for n, t := range op.Expression {
+		terms[n] = t
+		if t.Type != token.IDENTIFIER || c.isConstant(t.Literal) {
+			continue
+		}
+		if name != "" || (n > 0 && op.Expression[n-1].Type == token.MINUS) {
+			return "", 0, false
+		}
+		name = t.Literal
+		terms[n] = token.Token{Type: token.NUMBER, Literal: "0"}
+	}
+	if name == "" {
+		return "", 0, false
+	}
+
+	offset, err := c.evaluate(parser.Operand{Expression: terms})
+	if err != nil {
+		return "", 0, false
+	}
+	return name, offset, true
+}
+
+// isConstant returns true if the given identifier is one of the special
+// symbols, a constant which has been defined, or the length of data.
+func (c *Compiler) isConstant(name string) bool {
+	if name == "$" || name == "$$" {
+		return true
+	}
+	if _, ok := c.dataLength(name); ok {
+		return true
+	}
+	_, ok := c.defines[name]
+	return ok
+}
+
+// dataLength returns the length of the data whose name precedes `.len`
+// in the given identifier, such as `msg.len`, if it has been declared.
+func (c *Compiler) dataLength(name string) (int64, bool) {
+	if !strings.HasSuffix(name, ".len") {
+		return 0, false
+	}
+	size, ok := c.dataSizes[strings.TrimSuffix(name, ".len")]
+	return int64(size), ok
+}
+
+// resolve returns the value of a symbol used within an expression.
+func (c *Compiler) resolve(name string) (int64, error) {
+	switch name {
+	case "$":
+		return c.codeAddress() + int64(len(c.code)), nil
+	case "$$":
+		return c.codeAddress(), nil
+	}
+
+	if val, ok := c.defines[name]; ok {
+		return val, nil
+	}
+	if val, ok := c.dataLength(name); ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("unknown symbol %s in expression", name)
+}
+
+// undefined returns the error for a reference to an unknown symbol,
+// suggesting a similarly-named symbol if there is one.
+func (c *Compiler) undefined(name string) error {
+
+	// Data which is declared after its use is only known once our
+	// code has been generated, when references to it are treated as
+	// references to labels.
+	_, data := c.dataOffsets[name]
+	_, bss := c.bssOffsets[name]
+	if data || bss {
+		return fmt.Errorf("undefined symbol %q, data must be declared before it is used", name)
+	}
+
+	// Consider all the names we know, in a consistent order.
+	var known []string
+	for n := range c.dataOffsets {
+		known = append(known, n)
+	}
+	for n := range c.bssOffsets {
+		known = append(known, n)
+	}
+	for n := range c.labels {
+		known = append(known, n)
+	}
+	for n := range c.defines {
+		known = append(known, n)
+	}
+	sort.Strings(known)
+
+	// Allow roughly one typo for every three characters.
+	best := ""
+	limit := 1 + len(name)/3
+	for _, n := range known {
+		d := distance(name, n)
+		if d <= limit && (best == "" || d < distance(name, best)) {
+			best = n
+		}
+	}
+
+	if best != "" {
+		return fmt.Errorf("undefined symbol %q, did you mean %s?", name, best)
+	}
+	return fmt.Errorf("undefined symbol %q", name)
+}
+
+// distance returns the Levenshtein distance between two strings; the
+// number of single-character edits required to change one into the other.
+func distance(a, b string) int {
+
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// min returns the smallest of the given values.
+func min(vals ...int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// checkAddress ensures that an absolute address fits within the 32-bit
+// field in which it is stored.  Upon x86-64 those fields are sign-extended
+// so the address must also be below 0x80000000.
+func (c *Compiler) checkAddress(kind string, addr int) error {
+	limit := int64(math.MaxInt32)
+	if c.arch == "i386" {
+		limit = math.MaxUint32
+	}
+	if int64(addr) > limit {
+		return fmt.Errorf("%s address 0x%x exceeds the 32-bit limit", kind, addr)
+	}
+	return nil
+}
+
+// rel32 returns the displacement from the end of the 32-bit field at the
+// given offset to the target, ensuring that it fits in a signed 32-bit
+// value rather than silently wrapping.
+func rel32(offset int, target int) (int32, error) {
+	diff := int64(target) - int64(offset+4)
+	if diff < math.MinInt32 || diff > math.MaxInt32 {
+		return 0, fmt.Errorf("jump target too far")
+	}
+	return int32(diff), nil
+}
+
+// fixupKind describes how the value of a fixup is calculated.
+type fixupKind int
+
+const (
+	// absoluteCode is the address of a label.
+	absoluteCode fixupKind = iota
+
+	// absoluteData is the address of named data.
+	absoluteData
+
+	// relativeCode is the distance to a label, from the end of the
+	// fixup, as used by jumps and calls.
+	relativeCode
+
+	// relativeData is the distance to named data, from the end of
+	// the fixup, as used by RIP-relative addressing.
+	relativeData
+)
+
+// String returns the description of the fixup, used in error messages.
+func (k fixupKind) String() string {
+	switch k {
+	case absoluteCode:
+		return "label"
+	case absoluteData, relativeData:
+		return "data"
+	}
+	return "jump"
+}
+
+// fixup records a reference, within our code, to a label or to data,
+// which is patched once the code has been generated.
+type fixup struct {
+	// offset is the position of the reference within the code, and
+	// size the number of bytes it occupies.
+	offset int
+	size   int
+
+	// target is the name of the label, or data, referred to, and
+	// addend is added to its address, as in `msg+4`.
+	target string
+	addend int
+
+	// kind describes how the value is calculated.
+	kind fixupKind
+}
+
+// addFixup records a reference of the given kind, and size, to the named
+// label or data, at the current position in the code.
+func (c *Compiler) addFixup(kind fixupKind, target string, size int) {
+	c.fixups = append(c.fixups, fixup{offset: len(c.code), size: size, target: target, kind: kind, addend: c.addends[target]})
+}
+
+// applyFixup patches the given reference, now that we know the position
+// of everything in our program, given the addresses at which our code
+// and data are loaded.
+func (c *Compiler) applyFixup(f fixup, base int, dataBase int) error {
+
+	if err := c.checkPatch(f.kind.String(), f.offset, f.size); err != nil {
+		return err
+	}
+
+	// The position of the target, relative to the start of our code.
+	var target int
+	var ok bool
+	switch f.kind {
+	case absoluteCode, relativeCode:
+		target, ok = c.labels[f.target]
+	case absoluteData, relativeData:
+		target, ok = c.dataOffsets[f.target]
+		target += dataBase - base
+	}
+	if !ok {
+		return c.undefined(f.target)
+	}
+	target += f.addend
+
+	var value int64
+	switch f.kind {
+	case absoluteCode, absoluteData:
+		if c.shared != "" {
+			return fmt.Errorf("the absolute address of %s cannot be used within a shared object", f.target)
+		}
+		if err := c.checkAddress(f.kind.String(), base+target); err != nil {
+			return err
+		}
+		value = int64(base + target)
+
+	case relativeCode, relativeData:
+		// The displacement is relative to the end of the fixup,
+		// which is also the end of the instruction.
+		if f.size == 1 {
+			diff := target - (f.offset + 1)
+			if diff < math.MinInt8 || diff > math.MaxInt8 {
+				return fmt.Errorf("jump target too far: %s", f.target)
+			}
+			value = int64(diff)
+		} else {
+			diff, err := rel32(f.offset, target)
+			if err != nil {
+				return fmt.Errorf("%s: %s", err, f.target)
+			}
+			value = int64(diff)
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(value))
+	copy(c.code[f.offset:], buf[:f.size])
+	return nil
+}
+
+// checkPatch ensures that a fixup of the given size, at the specified
+// offset, lies entirely within the code we've generated.
+func (c *Compiler) checkPatch(kind string, offset int, size int) error {
+	if offset < 0 || offset+size > len(c.code) {
+		return fmt.Errorf("%s patch at offset %d (size %d) exceeds code length %d", kind, offset, size, len(c.code))
+	}
+	return nil
+}
+
+// handleData appends the data to the data-section of our binary,
+// and stores the offset appropriately
+func (c *Compiler) handleData(d parser.Data) error {
+
+	// Data within the bss only reserves space.
+	if c.section == "bss" {
+		return c.handleBss(d)
+	}
+
+	// Offset of the start of the data is the current
+	// length of the existing data.
+	offset := len(c.data)
+
+	// Is the content a string-constant?
+	if d.Constant != "" {
+		str, ok := c.strings[d.Constant]
+		if !ok {
+			return fmt.Errorf("reference to unknown string-constant %s in data %s", d.Constant, d.Name)
+		}
+		d.Contents = []byte(str)
+	}
+
+	// Add
+	c.data = append(c.data, d.Contents...)
+
+	// Constants are known now, but the addresses of labels, and
+	// data, are patched once we've compiled the whole program.
+	for o, name := range d.References {
+		if val, ok := c.defines[name]; ok {
+			binary.LittleEndian.PutUint64(c.data[offset+o:], uint64(val))
+			continue
+		}
+		c.dataRefs[offset+o] = name
+	}
+
+	// Save, unless the data is anonymous
+	if d.Name != "" {
+		c.dataOffsets[d.Name] = offset
+		c.dataSizes[d.Name] = len(d.Contents)
+	}
+
+	// TODO: Do we care about alignment?  We might
+	// in the future.
+	return nil
+}
+
+// handleIncbin appends the contents of the given file to the current
+// data section.  If the directive immediately follows a label then the
+// label refers to the data, rather than to the code.
+func (c *Compiler) handleIncbin(i parser.Incbin, label string) error {
+
+	path := i.Path
+	if !filepath.IsAbs(path) && c.sourcePath != "" {
+		path = filepath.Join(filepath.Dir(c.sourcePath), path)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading .incbin file: %s", err)
+	}
+
+	if label != "" {
+		delete(c.labels, label)
+	}
+	return c.handleData(parser.Data{Name: label, Contents: contents})
+}
+
+// Functions prepared for patching are preceded by at least hotpatchSize
+// bytes of padding, enough for a jump with a 32-bit displacement, and
+// begin upon a multiple of hotpatchAlign within our code.
+const (
+	hotpatchSize  = 5
+	hotpatchAlign = 16
+)
+
+// handleHotpatch prepares the function whose label immediately precedes
+// the directive for live-patching.  The function is preceded by no-ops,
+// and the label moved past them, and it begins with a two-byte no-op,
+// which may be replaced by a short jump back into the padding.
+//
+// The conventional `mov edi, edi` is used on i386, but on amd64 it would
+// clear the upper half of rdi so `xchg ax, ax` is used instead.
+func (c *Compiler) handleHotpatch(label string) error {
+
+	if label == "" {
+		return fmt.Errorf(".hotpatch must immediately follow the label of a function")
+	}
+
+	// When sizing jumps the padding is as large as it can be, so
+	// that the code cannot grow when it is compiled again.
+	n := hotpatchSize
+	for (len(c.code)+n)%hotpatchAlign != 0 || (c.sizing && n < hotpatchSize+hotpatchAlign-1) {
+		n++
+	}
+	c.code = append(c.code, bytes.Repeat([]byte{0x90}, n)...)
+	c.labels[label] = len(c.code)
+
+	if c.arch == "i386" {
+		c.code = append(c.code, 0x8b, 0xff)
+	} else {
+		c.code = append(c.code, 0x66, 0x90)
+	}
+	return nil
+}
+
+// handleBss reserves space for the given data within the bss, which
+// is zero-filled when the program is loaded, so the data must be zero.
+func (c *Compiler) handleBss(d parser.Data) error {
+
+	if d.Constant != "" || len(d.References) > 0 {
+		return fmt.Errorf("data %s within the .bss section must be zero", d.Name)
+	}
+	for _, b := range d.Contents {
+		if b != 0 {
+			return fmt.Errorf("data %s within the .bss section must be zero", d.Name)
+		}
+	}
+
+	if d.Name != "" {
+		c.bssOffsets[d.Name] = c.bss
+		c.dataSizes[d.Name] = len(d.Contents)
+	}
+	c.bss += len(d.Contents)
+	return nil
+}
+
+// isData returns true if the given name refers to data, including data
+// within the bss.
+func (c *Compiler) isData(name string) bool {
+	_, data := c.dataOffsets[name]
+	_, bss := c.bssOffsets[name]
+	return data || bss
+}
+
+// dataImage returns our data, followed by the zero-filled bss, for
+// those formats which cannot reserve memory without storing it.
+func (c *Compiler) dataImage() []byte {
+	return append(append([]byte{}, c.data...), make([]byte, c.bss)...)
+}
+
+// compileInstruction handles the instruction generation
+func (c *Compiler) compileInstruction(i parser.Instruction) error {
+
+	// Resolve any expressions, constants, and the special symbols
+	// `$` and `$$`, into numbers.  An expression which adds a constant
+	// to a label, or data, is replaced by the symbol, and the constant
+	// is added to its address once that is known.
+	c.addends = nil
+	for n, op := range i.Operands {
+		if op.Indirection {
+			continue
+		}
+		if name, offset, ok := c.symbolOffset(op); ok {
+			if c.addends == nil {
+				c.addends = make(map[string]int)
+			}
+			c.addends[name] = int(offset)
+			i.Operands[n].Token = token.Token{Type: token.IDENTIFIER, Literal: name}
+			i.Operands[n].Expression = nil
+			continue
+		}
+		if op.Type == token.EXPRESSION ||
+			(op.Type == token.IDENTIFIER && c.isConstant(op.Literal)) {
+			v, err := c.evaluate(op)
+			if err != nil {
+				return err
+			}
+			i.Operands[n].Token = token.Token{Type: token.NUMBER, Literal: fmt.Sprintf("%d", v)}
+			i.Operands[n].Expression = nil
+		}
+	}
+
+	// Instructions registered by our user take precedence.
+	if fn, ok := c.custom[i.Instruction]; ok {
+		return fn(c, i)
+	}
+
+	// Ensure the registers used are available upon our target.
+	if c.arch == "i386" {
+		for _, op := range i.Operands {
+			if op.Type == token.REGISTER && c.regSize(op.Literal) == 64 && !c.isSystemReg(op.Literal) {
+				return fmt.Errorf("register %s is not available on i386", op.Literal)
+			}
+		}
+	}
+
+	// Only a few instructions support the 8-bit registers, although
+	// the arithmetic instructions accept them as the destination of an
+	// immediate.
+	immediate := byteImmediates[i.Instruction] && len(i.Operands) == 2 && i.Operands[1].Type == token.NUMBER
+	if !byteRegisters[i.Instruction] {
+		for n, op := range i.Operands {
+			if n == 0 && immediate {
+				continue
+			}
+			if op.Type == token.REGISTER && c.regSize(op.Literal) == 8 {
+				return fmt.Errorf("8-bit register %s is not supported by %s", op.Literal, i.Instruction)
+			}
+		}
+	}
+
+	// The SSE registers may only be used by the SSE instructions.
+	if i.Instruction != "movsd" {
+		for _, op := range i.Operands {
+			if op.Type == token.REGISTER && c.regSize(op.Literal) == 128 {
+				return fmt.Errorf("SSE register %s is not supported by %s", op.Literal, i.Instruction)
+			}
+		}
+	}
+
+	// The control and debug registers may only be moved to, or from,
+	// and only when generating raw output for bare-metal use.
+	for _, op := range i.Operands {
+		if op.Type == token.REGISTER && c.isSystemReg(op.Literal) {
+			if i.Instruction != "mov" {
+				return fmt.Errorf("register %s is not supported by %s", op.Literal, i.Instruction)
+			}
+			if c.format != Raw {
+				return fmt.Errorf("register %s may only be used when generating raw output", op.Literal)
+			}
+		}
+	}
+
+	// Ensure the operands are of a valid type.
+	if len(i.Operands) > 0 {
+		if desc, ok := destinations[i.Instruction]; ok && i.Operands[0].Type == token.NUMBER && !i.Operands[0].Indirection {
+			return fmt.Errorf("cannot %s an immediate operand", desc)
+		}
+	}
+	if len(i.Operands) == 2 && i.Operands[0].Indirection && i.Operands[1].Indirection {
+		return fmt.Errorf("%s cannot use two memory operands", i.Instruction)
+	}
+	for _, op := range i.Operands {
+		if op.Indirection && (op.Index != "" || op.Displacement != 0) && !addressing[i.Instruction] {
+			return fmt.Errorf("%s does not support a displacement, or an index, in memory operands", i.Instruction)
+		}
+	}
+
+	// Emit any prefix, after ensuring it is valid for the instruction.
+	if i.Prefix != "" {
+		prefix, ok := prefixes[i.Prefix]
+		if !ok {
+			return fmt.Errorf("unknown prefix %s", i.Prefix)
+		}
+		valid := false
+		for _, name := range prefix.valid {
+			if strings.HasPrefix(i.Instruction, name) {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("prefix %s cannot be used with %s", i.Prefix, i.Instruction)
+		}
+		c.emit(partPrefix, prefix.value)
+	}
+
+	// Emit any segment-override for a memory operand.
+	for _, op := range i.Operands {
+		switch op.Segment {
+		case "":
+		case "fs":
+			c.emit(partPrefix, 0x64)
+		case "gs":
+			c.emit(partPrefix, 0x65)
+		default:
+			return fmt.Errorf("unknown segment %s", op.Segment)
+		}
+	}
+
+	// Instructions without operands are simple.
+	if e, ok := simple[i.Instruction]; ok && len(i.Operands) == 0 {
+		if c.arch == "i386" && e.REX != 0 {
+			return fmt.Errorf("instruction %s is not available on i386", i.Instruction)
+		}
+		c.emitEncoding(e)
+		return nil
+	}
+
+	switch i.Instruction {
+
+	case "add":
+		err := c.assembleADD(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "and":
+		err := c.assembleAND(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "bswap":
+		err := c.assembleBSWAP(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "call":
+		err := c.assembleCALL(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "cmp":
+		err := c.assembleCMP(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "dec":
+		err := c.assembleDEC(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "div":
+		// 0xf7 /6
+		err := c.assembleUnary(0xf7, 6, i.Operands[0])
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "idiv":
+		// 0xf7 /7
+		err := c.assembleUnary(0xf7, 7, i.Operands[0])
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "imul":
+		err := c.assembleIMUL(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "in", "out":
+		err := c.assembleIO(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "inc":
+		err := c.assembleINC(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "int":
+		n, err := c.argToByte(i.Operands[0].Token)
+		if err != nil {
+			return err
+		}
+		c.emit(partOpcode, 0xcd)
+		c.emit(partImmediate, n)
+		return nil
+
+	case "jmp", "jne", "je", "jz", "jnz":
+		err := c.assembleJMP(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "mov":
+		if len(i.Operands) == 2 && (c.isSystemReg(i.Operands[0].Literal) || c.isSystemReg(i.Operands[1].Literal)) {
+			return c.assembleMovSystem(i)
+		}
+		err := c.assembleMov(i, "")
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "movsd":
+		err := c.assembleMOVSD(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "lea":
+		err := c.assembleLEA(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "mul":
+		// 0xf7 /4
+		err := c.assembleUnary(0xf7, 4, i.Operands[0])
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "neg":
+		// 0xf7 /3
+		err := c.assembleUnary(0xf7, 3, i.Operands[0])
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "not":
+		// 0xf7 /2
+		err := c.assembleUnary(0xf7, 2, i.Operands[0])
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "or":
+		err := c.assembleOR(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "pop":
+		err := c.assemblePop(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "push":
+		err := c.assemblePush(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "ret":
+		err := c.assembleRET(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "seta", "setae", "setb", "setbe", "sete", "setg", "setge", "setl", "setle", "setne", "setnz", "setz":
+		err := c.assembleSET(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "sub":
+		err := c.assembleSUB(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "syscall_exit":
+		err := c.assembleSyscallExit(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "test":
+		err := c.assembleTEST(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "xchg":
+		err := c.assembleXCHG(i)
+		if err != nil {
+			return err
+		}
+		return nil
+	case "xor":
+		err := c.assembleXOR(i)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown instruction %q", i.Instruction)
+}
+
+// return register number - used for `dec`, `inc`, and `mov`.
+func (c *Compiler) getreg(reg string) int {
+
+	// registers
+	registers := []string{
+		"rax",
+		"rcx",
+		"rdx",
+		"rbx",
+		"rsp",
+		"rbp",
+		"rsi",
+		"rdi"}
+
+	for i, name := range registers {
+		if reg == name {
+			return i
+		}
+	}
+
+	// 32-bit registers
+	registers = []string{
+		"eax",
+		"ecx",
+		"edx",
+		"ebx",
+		"esp",
+		"ebp",
+		"esi",
+		"edi"}
+
+	for i, name := range registers {
+		if reg == name {
+			return i
+		}
+	}
+
+	// 16-bit registers
+	registers = []string{
+		"ax",
+		"cx",
+		"dx",
+		"bx",
+		"sp",
+		"bp",
+		"si",
+		"di"}
+
+	for i, name := range registers {
+		if reg == name {
+			return i
+		}
+	}
+
+	// 8-bit registers
+	registers = []string{
+		"al",
+		"cl",
+		"dl",
+		"bl",
+		"ah",
+		"ch",
+		"dh",
+		"bh"}
+
+	for i, name := range registers {
+		if reg == name {
+			return i
+		}
+	}
+
+	panic(fmt.Sprintf("failed to lookup register: %s", reg))
+}
+
+// getExtendedReg returns the number of one of the extended registers,
+// r8-r15, along with a flag to show whether the register was found.
+func (c *Compiler) getExtendedReg(reg string) (int, bool) {
+
+	for i := 8; i <= 15; i++ {
+		if reg == fmt.Sprintf("r%d", i) {
+			return i - 8, true
+		}
+	}
+	return 0, false
+}
+
+// regSize returns the size of the given register, in bits.
+func (c *Compiler) regSize(reg string) int {
+	if strings.HasPrefix(reg, "xmm") {
+		return 128
+	}
+	if len(reg) == 2 && (reg[1] == 'l' || reg[1] == 'h') {
+		return 8
+	}
+	if len(reg) == 2 && reg[0] != 'r' {
+		return 16
+	}
+	if len(reg) == 3 && reg[0] == 'e' {
+		return 32
+	}
+	return 64
+}
+
+// prefix returns the prefix which is required to operate upon the given
+// register: REX.W for 64-bit registers, and the operand-size override
+// for 16-bit registers.  32-bit registers need no prefix.
+func (c *Compiler) prefix(reg string) []byte {
+	switch c.regSize(reg) {
+	case 16:
+		return []byte{0x66}
+	case 32:
+		return nil
+	}
+	return []byte{0x48}
+}
+
+// regRegEncode returns the encoding of an instruction which operates upon
+// two registers, of the same size, with the source in the `reg` field of
+// the ModRM byte and the destination in the `r/m` field.  This is the form
+// used by add (0x01), or (0x09), and (0x21), sub (0x29), xor (0x31), cmp
+// (0x39), test (0x85), and mov (0x89).
+//
+// The extended registers, r8-r15, are encoded via the REX prefix.
+func (c *Compiler) regRegEncode(opcode byte, dst, src string) (Encoding, error) {
+
+	var e Encoding
+	if c.regSize(dst) != c.regSize(src) {
+		return e, fmt.Errorf("register size mismatch: %s, %s", dst, src)
+	}
+
+	// Find the number of each register, and whether it is extended
+	number := func(reg string) (int, bool, error) {
+		if n, ok := c.getExtendedReg(reg); ok {
+			return n, true, nil
+		}
+		switch c.regSize(reg) {
+		case 16, 32, 64:
+			return c.getreg(reg), false, nil
+		}
+		return 0, false, fmt.Errorf("register %s cannot be used here", reg)
+	}
+	d, dExt, err := number(dst)
+	if err != nil {
+		return e, err
+	}
+	s, sExt, err := number(src)
+	if err != nil {
+		return e, err
+	}
+
+	// The operand-size override, or REX prefix
+	rex := byte(0x40)
+	switch c.regSize(dst) {
+	case 16:
+		e.Prefixes = []byte{0x66}
+	case 64:
+		rex |= 0x08
+	}
+	if sExt {
+		rex |= 0x04
+	}
+	if dExt {
+		rex |= 0x01
+	}
+	if rex != 0x40 {
+		e.REX = rex
+	}
+
+	e.Opcode = []byte{opcode}
+	e.ModRM = []byte{byte(0xc0 + s*8 + d)}
+	return e, nil
+}
+
+// assembleRegReg emits an instruction which operates upon two registers,
+// via regRegEncode.
+func (c *Compiler) assembleRegReg(opcode byte, dst, src string) error {
+	e, err := c.regRegEncode(opcode, dst, src)
+	if err != nil {
+		return err
+	}
+	c.emitEncoding(e)
+	return nil
+}
+
+// addressReg returns the number, 0-15, and size of a register which is
+// used as the base, or index, of a memory operand.  Only the 64-bit, and
+// 32-bit, general-purpose registers may be used, and only the latter upon
+// i386.
+func (c *Compiler) addressReg(reg string) (int, int, error) {
+
+	if n, ok := c.getExtendedReg(reg); ok {
+		if c.arch == "i386" {
+			return 0, 0, fmt.Errorf("register %s is not available on i386", reg)
+		}
+		return n + 8, 64, nil
+	}
+	if c.isSystemReg(reg) || (c.regSize(reg) != 32 && c.regSize(reg) != 64) ||
+		(c.arch == "i386" && c.regSize(reg) == 64) {
+		return 0, 0, fmt.Errorf("indirection via %s is not supported", reg)
+	}
+	return c.getreg(reg), c.regSize(reg), nil
+}
+
+// isMemory returns true if the operand is a memory operand which may be
+// encoded via emitMemory, addressed by registers or a fixed address.
+func isMemory(op parser.Operand) bool {
+	return op.Indirection && !op.Relative &&
+		(op.Type == token.REGISTER || op.Type == token.NUMBER)
+}
+
+// emitMemory emits an instruction which operates upon a register, or an
+// opcode extension, and a memory operand:
+//
+//	[0x67] [0x66] [prefixes] [REX] opcode ModRM [SIB] [displacement]
+//
+// The size selects the operand-size override for 16-bit operations, or
+// REX.W for 64-bit ones.  The prefixes are any mandatory prefixes, such
+// as 0xf2 for movsd, which must precede the REX prefix.  The register
+// is stored in the reg-field of the ModRM byte, and may be 8-15.
+//
+// The memory operand may be a base register, with an optional scaled
+// index and displacement, such as `[rbx+rcx*4+8]`, or a number which is
+// an absolute address, again with an optional scaled index.
+func (c *Compiler) emitMemory(prefixes []byte, size int, opcode []byte, reg int, mem parser.Operand) error {
+
+	rex := byte(0)
+	if size == 64 {
+		if c.arch == "i386" {
+			return fmt.Errorf("qword memory operands are not available on i386")
+		}
+		rex |= 0x08
+	}
+	if reg >= 8 {
+		rex |= 0x04
+	}
+
+	// The base, and index, registers, or -1 if absent.
+	base, index := -1, -1
+	addrSize := 0
+	disp := mem.Displacement
+
+	switch mem.Type {
+	case token.REGISTER:
+		n, s, err := c.addressReg(mem.Literal)
+		if err != nil {
+			return err
+		}
+		base, addrSize = n, s
+	case token.NUMBER:
+		addr, err := strconv.ParseInt(mem.Literal, 0, 64)
+		if err != nil {
+			return err
+		}
+		if addr < math.MinInt32 || addr > math.MaxUint32 || (c.arch != "i386" && addr > math.MaxInt32) {
+			return fmt.Errorf("address %s does not fit in 32 bits", mem.Literal)
+		}
+		disp = addr
+	default:
+		return fmt.Errorf("unsupported memory operand %v", mem)
+	}
+
+	if mem.Index != "" {
+		n, s, err := c.addressReg(mem.Index)
+		if err != nil {
+			return err
+		}
+		if n == 4 {
+			return fmt.Errorf("%s cannot be used as an index", mem.Index)
+		}
+		if addrSize != 0 && s != addrSize {
+			return fmt.Errorf("address registers %s and %s have different sizes", mem.Literal, mem.Index)
+		}
+		index, addrSize = n, s
+	}
+	// The displacement is sign-extended upon amd64, so it must fit
+	// in a signed 32-bit value, while upon i386 it may also wrap
+	// around the 32-bit address space.
+	if disp < math.MinInt32 || disp > math.MaxUint32 {
+		return fmt.Errorf("displacement %d does not fit in 32 bits", disp)
+	}
+	if c.arch != "i386" && disp > math.MaxInt32 {
+		return fmt.Errorf("displacement %d does not fit in a sign-extended 32-bit value", disp)
+	}
+
+	// The ModRM byte, any SIB byte, and the size of the displacement.
+	var modrm, sib []byte
+	dispSize := 4
+	switch {
+	case base == -1 && index == -1:
+		// An absolute 32-bit address is [disp32] upon i386, but
+		// that means [rip+disp32] upon x86-64, where a SIB byte is
+		// required instead.
+		if c.arch == "i386" {
+			modrm = []byte{byte(0x05 + (reg&7)*8)}
+		} else {
+			modrm, sib = []byte{byte(0x04 + (reg&7)*8)}, []byte{0x25}
+		}
+
+	default:
+		// mod=00 has no displacement, but when the base is rbp,
+		// or r13, it means there is no base, so a displacement of
+		// zero is used instead.  Otherwise mod=01 has a signed
+		// 8-bit displacement, and mod=10 a 32-bit one.
+		mod := byte(0x80)
+		switch {
+		case base == -1:
+			mod = 0x00
+		case disp == 0 && base&7 != 5:
+			mod, dispSize = 0x00, 0
+		case disp >= math.MinInt8 && disp <= math.MaxInt8:
+			mod, dispSize = 0x40, 1
+		}
+
+		// The SIB byte is needed for an index, when there is no
+		// base, or when the base is rsp, or r12.
+		if index == -1 && base != -1 && base&7 != 4 {
+			modrm = []byte{mod + byte((reg&7)*8+base&7)}
+			break
+		}
+
+		scales := map[int]byte{1: 0x00, 2: 0x40, 4: 0x80, 8: 0xc0}
+		s := scales[mem.Scale]
+		if index == -1 {
+			s += 0x04 << 3
+		} else {
+			s += byte(index&7) << 3
+			if index >= 8 {
+				rex |= 0x02
+			}
+		}
+		if base == -1 {
+			s += 0x05
+		} else {
+			s += byte(base & 7)
+		}
+		modrm, sib = []byte{mod + byte((reg&7)*8+4)}, []byte{s}
+	}
+	if base >= 8 {
+		rex |= 0x01
+	}
+
+	e := Encoding{Opcode: opcode, ModRM: modrm, SIB: sib}
+
+	// Using a 32-bit address?
+	if c.arch == "amd64" && addrSize == 32 {
+		e.Prefixes = append(e.Prefixes, 0x67)
+	}
+	if size == 16 {
+		e.Prefixes = append(e.Prefixes, 0x66)
+	}
+	e.Prefixes = append(e.Prefixes, prefixes...)
+	if rex != 0 {
+		e.REX = 0x40 | rex
+	}
+
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(disp))
+	e.Displacement = buf[:dispSize]
+	c.emitEncoding(e)
+	return nil
+}
+
+// used by `int`
+func (c *Compiler) argToByte(t token.Token) (byte, error) {
+
+	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to convert %s to number %s", t.Literal, err)
+	}
+
+	return byte(num), nil
+}
+
+// used by `mov`, `add`, and `sub`.
+//
+// The size is the width of the immediate we're generating, in bits, so
+// the result will be either 2, 4, or 8 bytes long.
+func (c *Compiler) argToByteArray(t token.Token, size int) ([]byte, error) {
+
+	// Store the result here
+	buf := make([]byte, 8)
+
+	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	if err != nil {
+		return buf, fmt.Errorf("unable to convert %s to number for register %s", t.Literal, err)
+	}
+
+	// Ensure the value fits, allowing both signed and unsigned values.
+	if size < 64 {
+		min := -(int64(1) << uint(size-1))
+		max := (int64(1) << uint(size)) - 1
+		if num < min || num > max {
+			return buf, fmt.Errorf("value %s is too large for a %d-bit immediate", t.Literal, size)
+		}
+	}
+
+	binary.LittleEndian.PutUint64(buf, uint64(num))
+	return buf[:size/8], nil
+}
+
+// immSize returns the size of the immediate used when operating upon
+// the given register.  64-bit registers use a sign-extended 32-bit value.
+func (c *Compiler) immSize(reg string) int {
+	if c.regSize(reg) == 16 {
+		return 16
+	}
+	return 32
+}
+
+// assembleImmediate handles the group of arithmetic instructions which
+// operate upon a register, or memory, and an immediate value.  These are
+// distinguished by the value of ext, which is stored in the reg-field of
+// the ModRM byte - 0 for add, 5 for sub, 7 for cmp, etc.
+//
+// When the value fits in a signed byte the shorter, sign-extended, 0x83
+// form is used.  Otherwise a register destination of rax/eax/ax uses the
+// accumulator opcode, if one is given, and other destinations use 0x81.
+//
+// 8-bit destinations use 0x80, with an 8-bit immediate, or for `al` the
+// opcode preceding the accumulator opcode.
+func (c *Compiler) assembleImmediate(ext byte, accumulator byte, dst parser.Operand, imm token.Token) error {
+
+	if _, ok := c.getExtendedReg(dst.Literal); ok && !dst.Indirection {
+		return fmt.Errorf("immediate operations upon %s are not implemented", dst.Literal)
+	}
+
+	size := dst.Size
+	if !dst.Indirection {
+		size = c.regSize(dst.Literal)
+	}
+
+	num, err := strconv.ParseInt(imm.Literal, 0, 64)
+	if err != nil {
+		return err
+	}
+
+	// The opcode, and the immediate value
+	var opcode byte
+	var n []byte
+	switch {
+	case size == 8:
+		n, err = c.argToByteArray(imm, 8)
+		if err != nil {
+			return err
+		}
+		opcode = 0x80
+
+	case size == 0 && dst.Indirection:
+		return fmt.Errorf("the size of the memory operand %v must be specified", dst)
+
+	case size != 16 && size != 32 && size != 64:
+		return fmt.Errorf("unknown size for %v", dst)
+
+	case num >= math.MinInt8 && num <= math.MaxInt8:
+		opcode = 0x83
+		n = []byte{byte(num)}
+
+	case size == 64 && (num < math.MinInt32 || num > math.MaxInt32):
+		// The 32-bit immediate is sign-extended, so 0xffffffff
+		// would become -1.
+		return fmt.Errorf("the immediate %s does not fit in a signed 32-bit value", imm.Literal)
+
+	default:
+		width := 32
+		if size == 16 {
+			width = 16
+		}
+		n, err = c.argToByteArray(imm, width)
+		if err != nil {
+			return err
+		}
+		opcode = 0x81
+	}
+
+	if dst.Indirection {
+		err = c.emitMemory(nil, size, []byte{opcode}, int(ext), dst)
+		if err != nil {
+			return err
+		}
+		c.emit(partImmediate, n...)
 		return nil
+	}
 
-	case "dec":
-		err := c.assembleDEC(i)
+	reg := byte(c.getreg(dst.Literal))
+
+	if size != 8 {
+		c.emitPrefix(dst.Literal)
+	}
+	if opcode == 0x81 && reg == 0 && accumulator != 0 {
+		c.emit(partOpcode, accumulator)
+	} else if opcode == 0x80 && reg == 0 && accumulator != 0 {
+		c.emit(partOpcode, accumulator-1)
+	} else {
+		c.emit(partOpcode, opcode)
+		c.emit(partModRM, 0xc0+ext<<3+reg)
+	}
+	c.emit(partImmediate, n...)
+	return nil
+}
+
+// assembleUnary handles the groups of instructions which operate upon a
+// single register, or memory, operand - `neg` and `not` use the opcode
+// 0xf7, while `inc` and `dec` use 0xff.  The instructions within a group
+// are distinguished by the value of ext, which is stored in the reg-field
+// of the ModRM byte.
+//
+// Byte-sized memory operands use the preceding opcode, 0xf6 or 0xfe.
+//
+// Memory operands must specify their size, for example `neg qword [rax]`.
+func (c *Compiler) assembleUnary(opcode byte, ext byte, dst parser.Operand) error {
+
+	if dst.Indirection {
+		switch dst.Size {
+		case 8:
+			opcode--
+		case 16, 32, 64:
+		default:
+			return fmt.Errorf("the size of the memory operand %v must be specified", dst)
+		}
+		return c.emitMemory(nil, dst.Size, []byte{opcode}, int(ext), dst)
+	}
+
+	if dst.Type != token.REGISTER {
+		return fmt.Errorf("expected a register, or memory, operand, got %v", dst)
+	}
+	if _, ok := c.getExtendedReg(dst.Literal); ok {
+		return fmt.Errorf("operations upon %s are not implemented", dst.Literal)
+	}
+
+	reg := byte(c.getreg(dst.Literal))
+
+	c.emitPrefix(dst.Literal)
+	c.emit(partOpcode, opcode)
+	c.emit(partModRM, 0xc0+ext<<3+reg)
+	return nil
+}
+
+// assembleADD handles addition.
+func (c *Compiler) assembleADD(i parser.Instruction) error {
+
+	// Two registers added?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x01, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
+
+	// OK number added to a register?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[1].Type == token.NUMBER {
+
+		// 0x81 /0, or 0x05 for the accumulator
+		return c.assembleImmediate(0, 0x05, i.Operands[0], i.Operands[1].Token)
+	}
+
+	return fmt.Errorf("unhandled ADD instruction %v", i)
+}
+
+// assembleAND handles bitwise and.
+func (c *Compiler) assembleAND(i parser.Instruction) error {
+
+	// Two registers and'd?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x21, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
+
+	// A register and memory, in either order?
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x23, i.Operands[0].Literal, i.Operands[1])
+	}
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x21, i.Operands[1].Literal, i.Operands[0])
+	}
+
+	// A register, or memory, and a number?
+	if (i.Operands[0].Type == token.REGISTER || isMemory(i.Operands[0])) &&
+		i.Operands[1].Type == token.NUMBER {
+
+		// 0x81 /4, or 0x25 for the accumulator
+		return c.assembleImmediate(4, 0x25, i.Operands[0], i.Operands[1].Token)
+	}
+
+	return fmt.Errorf("unhandled AND instruction %v", i)
+}
+
+// assembleBSWAP handles reversing the byte-order of a register.
+func (c *Compiler) assembleBSWAP(i parser.Instruction) error {
+
+	if i.Operands[0].Type != token.REGISTER ||
+		i.Operands[0].Indirection {
+		return fmt.Errorf("we only support BSWAP with a register")
+	}
+
+	reg := i.Operands[0].Literal
+
+	// r8-r15 require REX.W + REX.B
+	if n, ok := c.getExtendedReg(reg); ok {
+		c.emit(partREX, 0x49)
+		c.emit(partOpcode, 0x0f, byte(0xc8+n))
+		return nil
+	}
+
+	if c.regSize(reg) == 16 {
+		return fmt.Errorf("BSWAP is undefined for 16-bit registers")
+	}
+
+	c.emitPrefix(reg)
+	c.emit(partOpcode, 0x0f, byte(0xc8+c.getreg(reg)))
+	return nil
+}
+
+// Handle a call instruction, either to a label or to the address stored
+// in memory, such as `call [rbx+rcx*8]`.
+func (c *Compiler) assembleCALL(i parser.Instruction) error {
+
+	// 0xff /2
+	if isMemory(i.Operands[0]) {
+		return c.emitMemory(nil, 0, []byte{0xff}, 2, i.Operands[0])
+	}
+
+	if i.Operands[0].Type != token.IDENTIFIER {
+		return fmt.Errorf("we only support CALL to labels, or memory, at the moment")
+	}
+
+	// emit the call
+	c.emit(partOpcode, 0xe8)
+
+	c.addFixup(relativeCode, i.Operands[0].Literal, 4)
+	c.emit(partDisplacement, 0x00, 0x00, 0x00, 0x00)
+
+	return nil
+}
+
+// Handle a comparison
+func (c *Compiler) assembleCMP(i parser.Instruction) error {
+
+	// Two registers compared?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x39, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
+
+	// A register compared with memory, or memory with a register?
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x3b, i.Operands[0].Literal, i.Operands[1])
+	}
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x39, i.Operands[1].Literal, i.Operands[0])
+	}
+
+	if i.Operands[0].Type != token.REGISTER ||
+		i.Operands[1].Type != token.NUMBER {
+		return fmt.Errorf("we only support CMP reg,reg, reg,[mem], [mem],reg, reg,NUMBER, and size ptr [reg],NUMBER at the moment")
+	}
+
+	// 0x81 /7, or 0x3d for the accumulator
+	return c.assembleImmediate(7, 0x3d, i.Operands[0], i.Operands[1].Token)
+}
+
+// assembleDEC handles dec rax, dec byte [rbx], etc.
+func (c *Compiler) assembleDEC(i parser.Instruction) error {
+	// 0xff /1, or 0xfe /1 for a byte in memory
+	return c.assembleUnary(0xff, 1, i.Operands[0])
+}
+
+// assembleIMUL handles the signed multiplication, either of a register
+// by a register, or of a register, or memory, by an immediate, storing
+// the result in the destination register:
+//
+//	imul rax, rbx
+//	imul rax, rbx, 10
+//	imul rax, [rbx+8], 10
+//
+// Unlike `mul` neither form modifies rdx.
+func (c *Compiler) assembleIMUL(i parser.Instruction) error {
+
+	if len(i.Operands) == 2 {
+		return c.assembleIMULRegReg(i)
+	}
+	if len(i.Operands) != 3 {
+		return fmt.Errorf("imul requires two or three operands, got %d", len(i.Operands))
+	}
+
+	dst, src, imm := i.Operands[0], i.Operands[1], i.Operands[2]
+	if dst.Type != token.REGISTER || dst.Indirection ||
+		!(isMemory(src) || (src.Type == token.REGISTER && !src.Indirection)) ||
+		imm.Type != token.NUMBER || imm.Indirection {
+		return fmt.Errorf("we only support IMUL reg, reg, number, or IMUL reg, [mem], number at the moment")
+	}
+	reg := dst.Literal
+
+	// The number we're multiplying by, which is sign-extended to
+	// 64 bits.
+	n, err := strconv.ParseInt(imm.Literal, 0, 64)
+	if err != nil {
+		return err
+	}
+	if c.regSize(reg) == 64 && (n < math.MinInt32 || n > math.MaxInt32) {
+		return fmt.Errorf("the immediate %s does not fit in a signed 32-bit value", imm.Literal)
+	}
+
+	// Use the short-form if the value fits in a signed byte
+	opcode := byte(0x69)
+	var buf []byte
+	if n >= -128 && n <= 127 {
+		opcode = 0x6b
+		buf = []byte{byte(n)}
+	} else {
+		buf, err = c.argToByteArray(imm.Token, c.immSize(reg))
+		if err != nil {
+			return err
+		}
+	}
+
+	// The destination is in the `reg` field, and the source in `r/m`
+	if isMemory(src) {
+		err = c.assembleRegMem(opcode, reg, src)
+	} else {
+		err = c.assembleRegReg(opcode, src.Literal, reg)
+	}
+	if err != nil {
+		return err
+	}
+	c.emit(partImmediate, buf...)
+	return nil
+}
+
+// assembleIMULRegReg handles the two-operand form of imul, which
+// multiplies the destination register by the source register.
+func (c *Compiler) assembleIMULRegReg(i parser.Instruction) error {
+
+	dst, src := i.Operands[0], i.Operands[1]
+	if dst.Type != token.REGISTER || dst.Indirection ||
+		src.Type != token.REGISTER || src.Indirection {
+		return fmt.Errorf("we only support IMUL reg, reg at the moment")
+	}
+
+	// The destination is in the `reg` field of the ModRM byte, so the
+	// operands are swapped, and the opcode is 0x0f 0xaf.
+	e, err := c.regRegEncode(0xaf, src.Literal, dst.Literal)
+	if err != nil {
+		return err
+	}
+	e.Opcode = []byte{0x0f, 0xaf}
+	c.emitEncoding(e)
+	return nil
+}
+
+// assembleINC handles inc rax, inc qword [rax], etc.
+func (c *Compiler) assembleINC(i parser.Instruction) error {
+	// 0xff /0, or 0xfe /0 for a byte in memory
+	return c.assembleUnary(0xff, 0, i.Operands[0])
+}
+
+// assembleIO handles the port I/O instructions, which are only useful
+// when generating raw output:
+//
+//	in  al, dx
+//	in  al, 0x60
+//	out dx, al
+//	out 0x60, al
+//
+// The accumulator may be `al`, `ax`, or `eax`.
+func (c *Compiler) assembleIO(i parser.Instruction) error {
+
+	if c.format != Raw {
+		return fmt.Errorf("%s is only supported when generating raw output", i.Instruction)
+	}
+
+	// For `in` the accumulator is the destination, for `out` the source.
+	acc := i.Operands[0]
+	port := i.Operands[1]
+	if i.Instruction == "out" {
+		acc, port = port, acc
+	}
+
+	accumulators := map[string]bool{"al": true, "ax": true, "eax": true}
+	if acc.Type != token.REGISTER || !accumulators[acc.Literal] || acc.Indirection {
+		return fmt.Errorf("%s requires al, ax, or eax, got %s", i.Instruction, acc.Literal)
+	}
+
+	// Base opcodes for the immediate-port forms, the port in dx
+	// forms are 8 higher.
+	op := byte(0xe4)
+	if i.Instruction == "out" {
+		op = 0xe6
+	}
+
+	// The 16/32-bit forms are one higher than the byte forms
+	if c.regSize(acc.Literal) != 8 {
+		c.emitPrefix(acc.Literal)
+		op++
+	}
+
+	// Port in dx?
+	if port.Type == token.REGISTER && port.Literal == "dx" && !port.Indirection {
+		c.emit(partOpcode, op+8)
+		return nil
+	}
+
+	// Immediate port
+	if port.Type == token.NUMBER {
+		n, err := strconv.ParseInt(port.Literal, 0, 64)
 		if err != nil {
 			return err
 		}
+		if n < 0 || n > 255 {
+			return fmt.Errorf("port %s is out of range", port.Literal)
+		}
+		c.emit(partOpcode, op)
+		c.emit(partImmediate, byte(n))
 		return nil
+	}
+
+	return fmt.Errorf("%s requires a port in dx, or a number, got %s", i.Instruction, port.Literal)
+}
+
+// assembleJMP handles all the jump instructions
+//
+// NOTE We have to fixup the offsets here.
+func (c *Compiler) assembleJMP(i parser.Instruction) error {
+
+	// An unconditional jump may use the address stored in memory, as
+	// jump tables do, via 0xff /4.
+	if i.Instruction == "jmp" && isMemory(i.Operands[0]) {
+		return c.emitMemory(nil, 0, []byte{0xff}, 4, i.Operands[0])
+	}
+
+	var byte byte
+
+	switch i.Instruction {
+	case "jmp":
+		byte = 0xeb
+	case "je", "jz":
+		byte = 0x74
+	case "jne", "jnz":
+		byte = 0x75
+	default:
+		return fmt.Errorf("unknown jmp type")
+	}
+
+	// Ensure we're jumping to a label
+	if i.Operands[0].Type != token.IDENTIFIER {
+		return fmt.Errorf("we only support jumps to labels, or jmp to memory, at the moment")
+	}
 
-	case "inc":
-		err := c.assembleINC(i)
-		if err != nil {
-			return err
+	// In the two-pass mode we use the long form, with a 32-bit
+	// displacement, unless the first pass found the target to be
+	// near enough for the short form.
+	if c.twoPass {
+		n := len(c.jumps)
+		if c.sizing || !c.short[n] {
+			if byte == 0xeb {
+				c.emit(partOpcode, 0xe9)
+			} else {
+				c.emit(partOpcode, 0x0f, byte+0x10)
+			}
+			c.addFixup(relativeCode, i.Operands[0].Literal, 4)
+			c.emit(partDisplacement, 0x00, 0x00, 0x00, 0x00)
+			c.jumps = append(c.jumps, jump{target: i.Operands[0].Literal, end: len(c.code)})
+			return nil
 		}
-		return nil
+		c.jumps = append(c.jumps, jump{target: i.Operands[0].Literal, end: len(c.code) + 2})
+	}
 
-	case "int":
-		n, err := c.argToByte(i.Operands[0].Token)
-		if err != nil {
-			return err
-		}
-		c.code = append(c.code, 0xcd)
-		c.code = append(c.code, n)
-		return nil
+	// emit the instruction and make a note of the fixup to make
+	c.emit(partOpcode, byte)
+	c.addFixup(relativeCode, i.Operands[0].Literal, 1)
+	c.emit(partDisplacement, 0x00) // empty displacement
 
-	case "jmp", "jne", "je", "jz", "jnz":
-		err := c.assembleJMP(i)
-		if err != nil {
-			return err
-		}
-		return nil
+	return nil
+}
 
-	case "mov":
-		err := c.assembleMov(i, false)
-		if err != nil {
-			return err
+// assembleMov handles the various forms of mov.
+//
+// If data is set then the immediate value is a placeholder for the
+// address of the named data.
+func (c *Compiler) assembleMov(i parser.Instruction, data string) error {
+
+	//
+	// Are we moving a register to another register?
+	//
+	// No indirection
+	//
+	// Either 0x89 or 0x8b could be used, with the registers swapped
+	// within the ModRM byte, but we always use 0x89 as other
+	// assemblers do.  Moves to, and from, memory always use 0x89 to
+	// store a register, and 0x8b to load one.
+	//
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x89, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
+
+	//
+	// Are we moving a number to a register ?
+	//
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.NUMBER &&
+		i.Operands[1].Indirection == false {
+
+		reg := i.Operands[0].Literal
+
+		if v, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64); err == nil && v == 0 && data == "" {
+			c.warn("mov %s, 0 could be the shorter xor %s, %s, if the flags may be changed", reg, reg, reg)
 		}
-		return nil
 
-	case "nop":
-		c.code = append(c.code, 0x90)
-		return nil
+		// The 64-bit forms use REX.W, along with REX.B for the
+		// extended registers.
+		rex, number := byte(0x48), 0
+		if n, ok := c.getExtendedReg(reg); ok {
+			rex, number = 0x49, n
+		} else if c.regSize(reg) == 64 {
+			number = c.getreg(reg)
+		}
 
-	case "pop":
-		err := c.assemblePop(i)
-		if err != nil {
-			return err
+		// The REX.W 0xc7 form sign-extends its 32-bit immediate, so
+		// values outside the signed 32-bit range, such as 0xffffffff,
+		// are loaded via REX.W 0xb8+reg with a full 64-bit immediate.
+		if c.regSize(reg) == 64 && data == "" {
+			num, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
+			if err == nil && (num < math.MinInt32 || num > math.MaxInt32) {
+				n, err := c.argToByteArray(i.Operands[1].Token, 64)
+				if err != nil {
+					return err
+				}
+				c.emit(partREX, rex)
+				c.emit(partOpcode, byte(0xb8+number))
+				c.emit(partImmediate, n...)
+				return nil
+			}
 		}
-		return nil
 
-	case "push":
-		err := c.assemblePush(i)
+		// value
+		n, err := c.argToByteArray(i.Operands[1].Token, c.immSize(reg))
 		if err != nil {
 			return err
 		}
-		return nil
 
-	case "ret":
-		c.code = append(c.code, 0xc3)
-		return nil
-
-	case "stc":
-		c.code = append(c.code, 0xf9)
-		return nil
-
-	case "std":
-		c.code = append(c.code, 0xfd)
-		return nil
-
-	case "sti":
-		c.code = append(c.code, 0xfb)
-		return nil
+		// Data addresses are always 32-bit
+		if data != "" && len(n) != 4 {
+			return fmt.Errorf("cannot store the address of data in %s", reg)
+		}
 
-	case "sub":
-		err := c.assembleSUB(i)
-		if err != nil {
-			return err
+		if c.regSize(reg) == 64 {
+			// REX.W 0xc7 /0 - sign-extended 32-bit value
+			c.emit(partREX, rex)
+			c.emit(partOpcode, 0xc7)
+			c.emit(partModRM, byte(0xc0+number))
+		} else {
+			// 0xb8+reg - a 16, or 32-bit value
+			c.emitPrefix(reg)
+			c.emit(partOpcode, byte(0xb8+c.getreg(reg)))
 		}
-		return nil
-	case "xor":
-		err := c.assembleXOR(i)
-		if err != nil {
-			return err
+
+		if data != "" {
+			c.addFixup(absoluteData, data, 4)
 		}
+		c.emit(partImmediate, n...)
 		return nil
 	}
 
-	return fmt.Errorf("unknown instruction %v", i)
-}
+	// mov $reg, [rel $id]
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Relative {
+		return c.assembleRelative(0x8b, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
 
-// return register number - used for `dec`, `inc`, and `mov`.
-func (c *Compiler) getreg(reg string) int {
+	// mov [rel $id], $reg
+	if i.Operands[0].Relative &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRelative(0x89, i.Operands[1].Literal, i.Operands[0].Literal)
+	}
 
-	// registers
-	registers := []string{
-		"rax",
-		"rcx",
-		"rdx",
-		"rbx",
-		"rsp",
-		"rbp",
-		"rsi",
-		"rdi"}
+	// mov $reg, [$id]
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.IDENTIFIER &&
+		i.Operands[1].Indirection {
+		return c.assembleMovData(0x8b, i.Operands[0].Literal, i.Operands[1])
+	}
 
-	for i, name := range registers {
-		if reg == name {
-			return i
-		}
+	// mov [$id], $reg
+	if i.Operands[0].Type == token.IDENTIFIER &&
+		i.Operands[0].Indirection &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleMovData(0x89, i.Operands[1].Literal, i.Operands[0])
 	}
 
-	panic(fmt.Sprintf("failed to lookup register: %s", reg))
-}
+	// mov $reg, $id
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.IDENTIFIER {
 
-// get magic value for two-register operations (`add`, `sub`, `xor`).
-func (c *Compiler) calcRM(dest string, src string) byte {
+		//
+		// Lookup the identifier, and if we can find it
+		// then we will move its address, which is patched
+		// once we know it, into the register.
+		//
+		name := i.Operands[1].Literal
+		if c.isData(name) {
 
-	// registers
-	registers := []string{
-		"rax",
-		"rcx",
-		"rdx",
-		"rbx",
-		"rsp",
-		"rbp",
-		"rsi",
-		"rdi"}
+			i.Operands[1].Type = token.NUMBER
+			i.Operands[1].Literal = "0"
+			return c.assembleMov(i, name)
+		}
 
-	dN := -1
-	sN := -1
+		// Otherwise it is the address of a label, which might not
+		// have been defined yet, so it is patched later.
+		return c.assembleMovLabel(i.Operands[0].Literal, name)
+	}
 
-	for i, reg := range registers {
-		if reg == dest {
-			dN = i
-		}
-		if reg == src {
-			sN = i
+	// Storing a value in an address
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection &&
+		i.Operands[1].Type == token.NUMBER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleMovStore(i.Operands[0], i.Operands[1].Token)
+	}
 
-		}
+	// mov rax, [$number], and mov [$number], rax, via moffs
+	if i.Operands[0].Literal == "rax" && c.isMoffs(i.Operands[1]) {
+		return c.assembleMoffs(0xa1, i.Operands[1])
+	}
+	if i.Operands[1].Literal == "rax" && !i.Operands[1].Indirection && c.isMoffs(i.Operands[0]) {
+		return c.assembleMoffs(0xa3, i.Operands[0])
 	}
 
-	if dN < 0 || sN < 0 {
-		panic(fmt.Sprintf("failed to lookup registers: %s %s", src, dest))
+	// mov $reg, [$reg+$index*$scale+$disp], or mov $reg, [$number]
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		(i.Operands[1].Type == token.REGISTER || i.Operands[1].Type == token.NUMBER) &&
+		i.Operands[1].Indirection {
+		return c.assembleRegMem(0x8b, i.Operands[0].Literal, i.Operands[1])
 	}
 
-	out := 0xc0 + (8 * sN) + dN
-	if out > 255 {
-		panic("calcRM received out of bounds value")
+	// mov [$reg+$index*$scale+$disp], $reg, or mov [$number], $reg
+	if (i.Operands[0].Type == token.REGISTER || i.Operands[0].Type == token.NUMBER) &&
+		i.Operands[0].Indirection &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegMem(0x89, i.Operands[1].Literal, i.Operands[0])
 	}
-	return byte(out)
+
+	return fmt.Errorf("unknown MOV instruction: %v", i)
+
 }
 
-// used by `int`
-func (c *Compiler) argToByte(t token.Token) (byte, error) {
+// assembleMovStore handles storing an immediate value in memory, the size
+// of which must be specified:
+//
+//	mov byte  [rax], 1     ; 0xc6 /0 ib
+//	mov word  [rax], 1     ; 0x66 0xc7 /0 iw
+//	mov dword [rax], 1     ; 0xc7 /0 id
+//	mov qword [rax], 1     ; REX.W 0xc7 /0 id
+//
+// There is no 64-bit immediate form, the 32-bit value is sign-extended,
+// so a qword store must use a value which fits in a signed 32-bit value.
+func (c *Compiler) assembleMovStore(dst parser.Operand, imm token.Token) error {
+
+	// The opcode, and the size of the immediate value
+	opcode := byte(0xc7)
+	size := dst.Size
+	switch dst.Size {
+	case 8:
+		opcode = 0xc6
+	case 16, 32:
+	case 64:
+		num, err := strconv.ParseInt(imm.Literal, 0, 64)
+		if err == nil && (num < math.MinInt32 || num > math.MaxInt32) {
+			return fmt.Errorf("value %s cannot be stored in memory, as it doesn't fit in a sign-extended 32-bit immediate", imm.Literal)
+		}
+		size = 32
+	default:
+		return fmt.Errorf("the size of the memory operand %v must be specified", dst)
+	}
 
-	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	n, err := c.argToByteArray(imm, size)
 	if err != nil {
-		return 0, fmt.Errorf("unable to convert %s to number %s", t.Literal, err)
+		return err
 	}
 
-	return byte(num), nil
+	err = c.emitMemory(nil, dst.Size, []byte{opcode}, 0, dst)
+	if err != nil {
+		return err
+	}
+	c.emit(partImmediate, n...)
+	return nil
 }
 
-// used by `mov`
-func (c *Compiler) argToByteArray(t token.Token) ([]byte, error) {
+// assembleMOVSD handles the SSE move of a double-precision value, between
+// two SSE registers, or between an SSE register and memory.
+//
+// The string instruction of the same name, which has no operands, is
+// handled via our table of simple instructions.
+func (c *Compiler) assembleMOVSD(i parser.Instruction) error {
 
-	// Store the result here
-	buf := make([]byte, 4)
+	if len(i.Operands) != 2 {
+		return fmt.Errorf("movsd requires two operands, or none, got %d", len(i.Operands))
+	}
 
-	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	// Find the SSE register, and the other operand.  Loads use 0x10,
+	// and stores 0x11.
+	reg, other := i.Operands[0], i.Operands[1]
+	opcode := byte(0x10)
+	if reg.Indirection || reg.Relative {
+		reg, other = other, reg
+		opcode = 0x11
+	}
+	if reg.Type != token.REGISTER || c.regSize(reg.Literal) != 128 {
+		return fmt.Errorf("movsd requires an SSE register, got %s", reg.Literal)
+	}
+	x, err := c.getSSEReg(reg.Literal)
 	if err != nil {
-		return buf, fmt.Errorf("unable to convert %s to number for register %s", t.Literal, err)
+		return err
 	}
 
-	binary.LittleEndian.PutUint32(buf, uint32(num))
-	return buf, nil
-}
+	// movsd xmm, [reg], or movsd xmm, [rbx+rcx*8], etc.
+	if (other.Type == token.REGISTER || other.Type == token.NUMBER) && other.Indirection {
+		return c.emitMemory([]byte{0xf2}, 0, []byte{0x0f, opcode}, x, other)
+	}
 
-// assembleADD handles addition.
-func (c *Compiler) assembleADD(i parser.Instruction) error {
+	// The registers xmm8-xmm15 require a REX prefix, which must
+	// follow the 0xf2 prefix.
+	rex := byte(0x40)
+	if x >= 8 {
+		rex |= 0x04
+		x -= 8
+	}
 
-	// Two registers added?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x01}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
+	// movsd xmm, xmm
+	if other.Type == token.REGISTER && !other.Indirection {
+		if c.regSize(other.Literal) != 128 {
+			return fmt.Errorf("movsd cannot use register %s", other.Literal)
+		}
+		y, err := c.getSSEReg(other.Literal)
+		if err != nil {
+			return err
+		}
+		if y >= 8 {
+			rex |= 0x01
+			y -= 8
+		}
+		c.emit(partPrefix, 0xf2)
+		if rex != 0x40 {
+			c.emit(partREX, rex)
+		}
+		c.emit(partOpcode, 0x0f, opcode)
+		c.emit(partModRM, byte(0xc0+x*8+y))
 		return nil
 	}
 
-	// OK number added to a register?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.NUMBER {
+	// movsd xmm, [rel name]
+	if other.Relative {
+		if !c.isData(other.Literal) {
+			return c.undefined(other.Literal)
+		}
 
-		// Convert the integer to a four-byte/64-bit value
-		n, err := c.argToByteArray(i.Operands[1].Token)
-		if err != nil {
-			return err
+		c.emit(partPrefix, 0xf2)
+		if rex != 0x40 {
+			c.emit(partREX, rex)
 		}
 
-		// Work out the register
-		switch i.Operands[0].Literal {
-		case "rax":
-			c.code = append(c.code, []byte{0x48, 0x05}...)
-		case "rbx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc3}...)
-		case "rcx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc1}...)
-		case "rdx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc2}...)
-		default:
-			return fmt.Errorf("add %s, number not implemented", i.Operands[0].Literal)
+		// mod=00, rm=101 means [rip+disp32], but there is no
+		// RIP-relative addressing upon i386 where it is [disp32],
+		// so the absolute address is used instead.
+		c.emit(partOpcode, 0x0f, opcode)
+		c.emit(partModRM, byte(0x05+x*8))
+		if c.arch == "i386" {
+			c.addFixup(absoluteData, other.Literal, 4)
+		} else {
+			c.addFixup(relativeData, other.Literal, 4)
+		}
+		c.emit(partDisplacement, 0x00, 0x00, 0x00, 0x00)
+		return nil
+	}
+
+	// movsd xmm, [name]
+	if other.Type == token.IDENTIFIER && other.Indirection {
+		if !c.isData(other.Literal) {
+			return c.undefined(other.Literal)
 		}
 
-		// Now append the value
-		c.code = append(c.code, n...)
+		c.emit(partPrefix, 0xf2)
+		if rex != 0x40 {
+			c.emit(partREX, rex)
+		}
+		c.emit(partOpcode, 0x0f, opcode)
+
+		// An absolute 32-bit address is [disp32] upon i386, but
+		// that means [rip+disp32] upon x86-64, where a SIB byte
+		// is required instead.
+		if c.arch == "i386" {
+			c.emit(partModRM, byte(0x05+x*8))
+		} else {
+			c.emit(partModRM, byte(0x04+x*8))
+			c.emit(partSIB, 0x25)
+		}
+		c.addFixup(absoluteData, other.Literal, 4)
+		c.emit(partDisplacement, 0x00, 0x00, 0x00, 0x00)
 		return nil
 	}
 
-	return fmt.Errorf("unhandled ADD instruction %v", i)
+	return fmt.Errorf("unknown MOVSD instruction: %v", i)
 }
 
-// Handle a call instruction
-func (c *Compiler) assembleCALL(i parser.Instruction) error {
+// getSSEReg returns the number of the given SSE register, xmm0-xmm15.
+//
+// Only xmm0-xmm7 are available upon i386.
+func (c *Compiler) getSSEReg(reg string) (int, error) {
 
-	if i.Operands[0].Type != token.IDENTIFIER {
-		return fmt.Errorf("we only support CALL to labels at the moment")
+	n, err := strconv.Atoi(strings.TrimPrefix(reg, "xmm"))
+	if err != nil || n < 0 || n > 15 {
+		return 0, fmt.Errorf("unknown SSE register %s", reg)
 	}
+	if n >= 8 && c.arch == "i386" {
+		return 0, fmt.Errorf("register %s is not available on i386", reg)
+	}
+	return n, nil
+}
 
-	// emit the call
-	c.code = append(c.code, 0xe8)
+// assembleRegMem emits an instruction which operates upon a register
+// and memory, such as moving a register to (0x89), or from (0x8b),
+// memory.  The memory may be addressed via a base register, a scaled
+// index, and a displacement, or be a fixed address, which is most useful
+// with a segment-override:
+//
+//	mov rax, [rbx+rcx*8+16]
+//	mov [rbp-8], rdi
+//	mov rax, fs:[0x10]
+func (c *Compiler) assembleRegMem(opcode byte, reg string, mem parser.Operand) error {
+
+	if c.regSize(reg) == 8 || c.regSize(reg) == 128 || c.isSystemReg(reg) {
+		return fmt.Errorf("register %s cannot be used here", reg)
+	}
+
+	if n, ok := c.getExtendedReg(reg); ok {
+		return c.emitMemory(nil, 64, []byte{opcode}, n+8, mem)
+	}
+	return c.emitMemory(nil, c.regSize(reg), []byte{opcode}, c.getreg(reg), mem)
+}
+
+// isMoffs returns true if the operand is a bare numeric address, which
+// may be used by the moffs forms of mov.
+func (c *Compiler) isMoffs(mem parser.Operand) bool {
+	return c.arch == "amd64" && mem.Type == token.NUMBER && isMemory(mem) &&
+		mem.Index == "" && mem.Segment == "" && mem.Displacement == 0
+}
+
+// assembleMoffs handles loading rax from (0xa1), or storing rax at (0xa3),
+// a fixed address, via the moffs forms whose address is a full 64 bits:
+//
+//	mov rax, [0x600000]    ; REX.W 0xa1 moffs64
+//	mov [0x600000], rax    ; REX.W 0xa3 moffs64
+func (c *Compiler) assembleMoffs(opcode byte, mem parser.Operand) error {
 
-	c.calls[len(c.code)] = i.Operands[0].Literal
-	c.code = append(c.code, []byte{0x00, 0x00, 0x00, 0x00}...)
+	// Negative addresses are those at the top of memory.
+	addr, err := strconv.ParseUint(mem.Literal, 0, 64)
+	if err != nil {
+		n, err := strconv.ParseInt(mem.Literal, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid address %s", mem.Literal)
+		}
+		addr = uint64(n)
+	}
 
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, addr)
+	c.emit(partREX, 0x48)
+	c.emit(partOpcode, opcode)
+	c.emit(partDisplacement, buf...)
 	return nil
 }
 
-// Handle a comparison
-func (c *Compiler) assembleCMP(i parser.Instruction) error {
+// assembleMovData handles moving a register to (0x89), or from (0x8b),
+// the named data, via its absolute address which is patched once it is
+// known:
+//
+//	mov rax, [msg]
+//	mov [msg], rax
+func (c *Compiler) assembleMovData(opcode byte, reg string, data parser.Operand) error {
 
-	// We're only handling indirection at the moment
-	if i.Operands[0].Type != token.REGISTER &&
-		i.Operands[0].Indirection != true &&
-		i.Operands[1].Type != token.NUMBER {
-		return fmt.Errorf("we only support CMP size ptr [reg],NUMBER at the moment")
+	if !c.isData(data.Literal) {
+		return c.undefined(data.Literal)
 	}
 
-	// The number we're comparing
-	n, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
+	mem := data
+	mem.Token = token.Token{Type: token.NUMBER, Literal: "0"}
+	err := c.assembleRegMem(opcode, reg, mem)
 	if err != nil {
 		return err
 	}
 
-	// Register number
-	r := byte(c.getreg(i.Operands[0].Literal))
+	// The address is the final four bytes of the instruction.
+	c.fixups = append(c.fixups, fixup{offset: len(c.code) - 4, size: 4, target: data.Literal, kind: absoluteData})
+	return nil
+}
+
+// assembleMovSystem handles moving a general-purpose register to, or from,
+// one of the control (cr0-cr4) or debug (dr0-dr7) registers.
+func (c *Compiler) assembleMovSystem(i parser.Instruction) error {
 
-	// things we add
-	bytes := []byte{}
+	dst, src := i.Operands[0], i.Operands[1]
+	for _, op := range i.Operands {
+		if op.Type != token.REGISTER || op.Indirection {
+			return fmt.Errorf("mov of %s requires a register", op.Literal)
+		}
+	}
 
-	switch i.Operands[0].Size {
+	// 0x0f 0x20 reads a control register, 0x0f 0x22 writes one,
+	// and 0x0f 0x21/0x23 do the same for the debug registers.
+	opcode := byte(0x20)
+	sys, reg := src.Literal, dst.Literal
+	if c.isSystemReg(dst.Literal) {
+		opcode = 0x22
+		sys, reg = dst.Literal, src.Literal
+	}
+	if c.isSystemReg(reg) {
+		return fmt.Errorf("cannot move %s to %s", src.Literal, dst.Literal)
+	}
+	if sys[0] == 'd' {
+		opcode++
+	}
 
-	case 8:
-		bytes = []byte{0x80, 0x38 + r, byte(n)}
-	case 16:
-		bytes = []byte{0x66, 0x83, 0x38 + r}
+	// The general-purpose register is always the native size
+	size := 64
+	if c.arch == "i386" {
+		size = 32
+	}
+	if c.regSize(reg) != size {
+		return fmt.Errorf("mov of %s requires a %d-bit register, got %s", sys, size, reg)
+	}
+
+	n := int(sys[2] - '0')
+	r, ext := c.getExtendedReg(reg)
+	if ext {
+		c.emit(partREX, 0x41)
+	} else {
+		r = c.getreg(reg)
+	}
+
+	c.emit(partOpcode, 0x0f, opcode)
+	c.emit(partModRM, byte(0xc0+n*8+r))
+	return nil
+}
+
+// isSystemReg returns true if the given register is one of the control,
+// or debug, registers.
+func (c *Compiler) isSystemReg(reg string) bool {
+	return len(reg) == 3 && (strings.HasPrefix(reg, "cr") || strings.HasPrefix(reg, "dr"))
+}
 
-		buf := make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(n))
-		bytes = append(bytes, buf...)
+// assembleMovLabel moves the address of the named label into a register.
+//
+// Addresses are 32-bit, and are sign-extended when moved into 64-bit
+// registers.
+func (c *Compiler) assembleMovLabel(reg string, name string) error {
+
+	if n, ok := c.getExtendedReg(reg); ok {
+		c.emit(partREX, 0x49)
+		c.emit(partOpcode, 0xc7)
+		c.emit(partModRM, byte(0xc0+n))
+	} else if c.regSize(reg) == 64 {
+		c.emit(partREX, 0x48)
+		c.emit(partOpcode, 0xc7)
+		c.emit(partModRM, byte(0xc0+c.getreg(reg)))
+	} else if c.regSize(reg) == 32 {
+		c.emit(partOpcode, byte(0xb8+c.getreg(reg)))
+	} else {
+		return fmt.Errorf("cannot store the address of %s in %s", name, reg)
+	}
+
+	c.addFixup(absoluteCode, name, 4)
+	c.emit(partImmediate, 0x00, 0x00, 0x00, 0x00)
+	return nil
+}
+
+// assembleRelative emits an instruction which operates upon a register,
+// and the named data, which is referred to relative to the instruction
+// pointer:
+//
+//	mov rax, [rel msg]    ; REX.W 0x8b /r, mod=00 rm=101 disp32
+//	lea rsi, [rip+msg]    ; REX.W 0x8d /r, mod=00 rm=101 disp32
+//
+// The displacement, from the end of the instruction, is patched once we
+// know the final size of our code.  There is no RIP-relative addressing
+// upon i386, where the same encoding means an absolute address, so that
+// is patched instead.
+func (c *Compiler) assembleRelative(opcode byte, reg string, name string) error {
+
+	if !c.isData(name) {
+		return c.undefined(name)
+	}
+	if c.regSize(reg) == 8 || c.regSize(reg) == 128 || c.isSystemReg(reg) {
+		return fmt.Errorf("register %s cannot be used here", reg)
+	}
 
-	case 32, 64:
-		bytes = []byte{0x83, 0x38 + r}
+	// The extended registers require REX.R
+	n, extended := c.getExtendedReg(reg)
+	if extended {
+		c.emit(partREX, 0x4c)
+	} else {
+		n = c.getreg(reg)
+		c.emitPrefix(reg)
+	}
 
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(n))
-		bytes = append(bytes, buf...)
+	// mod=00, rm=101 means [rip+disp32]
+	c.emit(partOpcode, opcode)
+	c.emit(partModRM, byte(0x05+(n*8)))
 
-	default:
-		return fmt.Errorf("unknown size in instruction %v", i.Operands[0])
+	if c.arch == "i386" {
+		c.addFixup(absoluteData, name, 4)
+	} else {
+		c.addFixup(relativeData, name, 4)
 	}
-
-	c.code = append(c.code, bytes...)
+	c.emit(partDisplacement, 0x00, 0x00, 0x00, 0x00)
 	return nil
 }
 
-// assembleDEC handles dec rax, rbx, etc.
-func (c *Compiler) assembleDEC(i parser.Instruction) error {
+// assembleLEA handles lea, which loads the address of its memory operand
+// into a register, rather than the contents of the memory:
+//
+//	lea rax, [rbx+rcx*8+16]
+//	lea rsi, [rip+msg]
+//
+// The RIP-relative form is the preferred way to find the address of data
+// in position-independent code.
+func (c *Compiler) assembleLEA(i parser.Instruction) error {
 
-	// Decrement the contents of a register
-	if i.Operands[0].Indirection == false {
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xff}...)
+	dst, src := i.Operands[0], i.Operands[1]
+	if dst.Type != token.REGISTER || dst.Indirection {
+		return fmt.Errorf("lea requires a register destination, got %s", dst.Literal)
+	}
+	if src.Relative {
+		return c.assembleRelative(0x8d, dst.Literal, src.Literal)
+	}
+	if isMemory(src) {
+		return c.assembleRegMem(0x8d, dst.Literal, src)
+	}
+	return fmt.Errorf("lea requires a memory operand, got %s", src.Literal)
+}
 
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+// assembleOR handles bitwise or.
+func (c *Compiler) assembleOR(i parser.Instruction) error {
 
-		return nil
+	// Two registers or'd?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x09, i.Operands[0].Literal, i.Operands[1].Literal)
 	}
 
-	// indirect: byte
-	if i.Operands[0].Size == 8 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xfe}...)
+	// A register and memory, in either order?
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x0b, i.Operands[0].Literal, i.Operands[1])
+	}
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x09, i.Operands[1].Literal, i.Operands[0])
+	}
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
+	// A register, or memory, and a number?
+	if (i.Operands[0].Type == token.REGISTER || isMemory(i.Operands[0])) &&
+		i.Operands[1].Type == token.NUMBER {
 
-		return nil
+		// 0x81 /1, or 0x0d for the accumulator
+		return c.assembleImmediate(1, 0x0d, i.Operands[0], i.Operands[1].Token)
 	}
 
-	// indirect: word
-	if i.Operands[0].Size == 16 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0x66, 0xff}...)
+	return fmt.Errorf("unhandled OR instruction %v", i)
+}
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
+// assemblePop would compile "pop offset", and "push 0x1234"
+func (c *Compiler) assemblePop(i parser.Instruction) error {
 
-		return nil
+	// known pop-types
+	table := make(map[string]Encoding)
+	table["rax"] = Encoding{Opcode: []byte{0x58}}
+	table["rbx"] = Encoding{Opcode: []byte{0x5b}}
+	table["rcx"] = Encoding{Opcode: []byte{0x59}}
+	table["rdx"] = Encoding{Opcode: []byte{0x5a}}
+	table["rbp"] = Encoding{Opcode: []byte{0x5d}}
+	table["rsp"] = Encoding{Opcode: []byte{0x5c}}
+	table["rsi"] = Encoding{Opcode: []byte{0x5e}}
+	table["rdi"] = Encoding{Opcode: []byte{0x5f}}
+	table["r8"] = Encoding{REX: 0x41, Opcode: []byte{0x58}}
+	table["r9"] = Encoding{REX: 0x41, Opcode: []byte{0x59}}
+	table["r10"] = Encoding{REX: 0x41, Opcode: []byte{0x5a}}
+	table["r11"] = Encoding{REX: 0x41, Opcode: []byte{0x5b}}
+	table["r12"] = Encoding{REX: 0x41, Opcode: []byte{0x5c}}
+	table["r13"] = Encoding{REX: 0x41, Opcode: []byte{0x5d}}
+	table["r14"] = Encoding{REX: 0x41, Opcode: []byte{0x5e}}
+	table["r15"] = Encoding{REX: 0x41, Opcode: []byte{0x5f}}
+
+	// Memory operands aren't supported.
+	if i.Operands[0].Indirection {
+		return fmt.Errorf("pop does not support memory operands")
 	}
 
-	// indirect: double word
-	if i.Operands[0].Size == 32 || i.Operands[0].Size == 64 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xff}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
-
+	// On i386 we pop the 32-bit registers.
+	if c.arch == "i386" && i.Operands[0].Type == token.REGISTER {
+		c.emit(partOpcode, byte(0x58+c.getreg(i.Operands[0].Literal)))
 		return nil
 	}
 
-	return fmt.Errorf("unknown argument for DEC %v", i)
-}
+	// Is this "pop rax|rbx..|rdx", or something in the table?
+	if i.Operands[0].Type == token.REGISTER {
+		e, ok := table[i.Operands[0].Literal]
+		if ok {
+			c.emitEncoding(e)
+			return nil
+		}
+		return fmt.Errorf("unknown register in 'pop'")
+	}
 
-// assembleINC handles inc rax, rbx, etc.
-func (c *Compiler) assembleINC(i parser.Instruction) error {
+	return fmt.Errorf("unknown pop-type: %v", i)
 
-	// Increment the contents of a register
-	if i.Operands[0].Indirection == false {
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xff}...)
+}
 
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+// assemblePush would compile "push offset", and "push 0x1234"
+func (c *Compiler) assemblePush(i parser.Instruction) error {
 
-		return nil
+	// Memory operands aren't supported.
+	if i.Operands[0].Indirection {
+		return fmt.Errorf("push does not support memory operands")
 	}
 
-	// indirect: byte
-	if i.Operands[0].Size == 8 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xfe}...)
+	// Is this a number?
+	if i.Operands[0].Type == token.NUMBER {
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+		num, err := strconv.ParseInt(i.Operands[0].Literal, 0, 64)
+		if err != nil {
+			return fmt.Errorf("unable to convert %s to number %s", i.Operands[0].Literal, err)
+		}
+		if num >= math.MinInt8 && num <= math.MaxInt8 {
+			c.warn("push %s uses a 32-bit immediate, although the value fits in a byte", i.Operands[0].Literal)
+		}
 
-		return nil
-	}
+		// On i386 we just push the 32-bit value.
+		if c.arch == "i386" {
+			n, err := c.argToByteArray(i.Operands[0].Token, 32)
+			if err != nil {
+				return err
+			}
+			c.emit(partOpcode, 0x68)
+			c.emit(partImmediate, n...)
+			return nil
+		}
 
-	// indirect: word
-	if i.Operands[0].Size == 16 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0x66, 0xff}...)
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(num))
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+		// The value we push is sign-extended to 64-bits
+		c.emit(partOpcode, 0x68)
+		c.emit(partImmediate, buf[0:4]...)
 
+		// There is no `push imm64`, so if the value doesn't fit
+		// in a sign-extended 32-bit value we have to overwrite the
+		// upper half of what we pushed:
+		//
+		//	mov dword ptr [rsp+4], high
+		//
+		if num < -2147483648 || num > 2147483647 {
+			c.emitEncoding(Encoding{
+				Opcode:       []byte{0xc7},
+				ModRM:        []byte{0x44},
+				SIB:          []byte{0x24},
+				Displacement: []byte{0x04},
+				Immediate:    buf[4:8],
+			})
+		}
 		return nil
 	}
 
-	// indirect: double word
-	if i.Operands[0].Size == 32 || i.Operands[0].Size == 64 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xff}...)
+	// Is this a label?
+	if i.Operands[0].Type == token.IDENTIFIER {
+
+		c.emit(partOpcode, 0x68)
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+		c.addFixup(absoluteCode, i.Operands[0].Literal, 4)
 
+		c.emit(partImmediate, 0x0, 0x0, 0x0, 0x0)
+		return nil
+	}
+
+	// is this a register?
+	table := make(map[string]Encoding)
+	table["rax"] = Encoding{Opcode: []byte{0x50}}
+	table["rcx"] = Encoding{Opcode: []byte{0x51}}
+	table["rdx"] = Encoding{Opcode: []byte{0x52}}
+	table["rbx"] = Encoding{Opcode: []byte{0x53}}
+	table["rsp"] = Encoding{Opcode: []byte{0x54}}
+	table["rbp"] = Encoding{Opcode: []byte{0x55}}
+	table["rsi"] = Encoding{Opcode: []byte{0x56}}
+	table["rdi"] = Encoding{Opcode: []byte{0x57}}
+	table["r8"] = Encoding{REX: 0x41, Opcode: []byte{0x50}}
+	table["r9"] = Encoding{REX: 0x41, Opcode: []byte{0x51}}
+	table["r10"] = Encoding{REX: 0x41, Opcode: []byte{0x52}}
+	table["r11"] = Encoding{REX: 0x41, Opcode: []byte{0x53}}
+	table["r12"] = Encoding{REX: 0x41, Opcode: []byte{0x54}}
+	table["r13"] = Encoding{REX: 0x41, Opcode: []byte{0x55}}
+	table["r14"] = Encoding{REX: 0x41, Opcode: []byte{0x56}}
+	table["r15"] = Encoding{REX: 0x41, Opcode: []byte{0x57}}
+
+	// On i386 we push the 32-bit registers.
+	if c.arch == "i386" && i.Operands[0].Type == token.REGISTER {
+		c.emit(partOpcode, byte(0x50+c.getreg(i.Operands[0].Literal)))
 		return nil
 	}
 
-	return fmt.Errorf("unknown argument for INC %v", i)
+	// Is this "push rax|rbx..|rdx", or something in the table?
+	if i.Operands[0].Type == token.REGISTER {
+		e, ok := table[i.Operands[0].Literal]
+		if ok {
+			c.emitEncoding(e)
+			return nil
+		}
+		return fmt.Errorf("unknown register in 'push'")
+	}
+
+	return fmt.Errorf("unknown push-type: %v", i)
 }
 
-// assembleJMP handles all the jump instructions
+// assembleSET handles the conditional set instructions, which store 1 in
+// an 8-bit register, or a byte of memory, if the condition is true and
+// 0 otherwise:
 //
-// NOTE We have to fixup the offsets here.
-func (c *Compiler) assembleJMP(i parser.Instruction) error {
+//	sete al
+//	setl byte [rbx+8]
+//
+// Only the low byte is written, so the idiom `xor eax, eax` followed by
+// `sete al` is used to get 0 or 1 in the whole of rax.
+func (c *Compiler) assembleSET(i parser.Instruction) error {
 
-	var byte byte
+	opcode := []byte{0x0f, setConditions[i.Instruction]}
+	dst := i.Operands[0]
 
-	switch i.Instruction {
-	case "jmp":
-		byte = 0xeb
-	case "je", "jz":
-		byte = 0x74
-	case "jne", "jnz":
-		byte = 0x75
-	default:
-		return fmt.Errorf("unknown jmp type")
+	if dst.Indirection {
+		if dst.Size != 0 && dst.Size != 8 {
+			return fmt.Errorf("%s requires a byte of memory, got %s", i.Instruction, format.Operand(dst))
+		}
+		return c.emitMemory(nil, 8, opcode, 0, dst)
 	}
 
-	// Ensure we're jumping to a label
-	if i.Operands[0].Type != token.IDENTIFIER {
-		return fmt.Errorf("we only support jumps to labels at the moment")
+	if dst.Type != token.REGISTER || c.regSize(dst.Literal) != 8 {
+		return fmt.Errorf("%s requires an 8-bit register, or memory, operand, got %s", i.Instruction, dst.Literal)
+	}
+	c.emit(partOpcode, opcode...)
+	c.emit(partModRM, 0xc0+byte(c.getreg(dst.Literal)))
+	return nil
+}
+
+// assembleRET handles `ret imm16`, which pops the specified number of
+// bytes from the stack after returning.  A bare `ret` is a simple
+// instruction.
+func (c *Compiler) assembleRET(i parser.Instruction) error {
+
+	if i.Operands[0].Type != token.NUMBER {
+		return fmt.Errorf("expected a number for RET, got %v", i.Operands[0].Literal)
 	}
 
-	// emit the instruction and make a note of the fixup to make
-	c.code = append(c.code, byte)
-	c.jmps[len(c.code)] = i.Operands[0].Literal
-	c.code = append(c.code, 0x00) // empty displacement
+	n, err := strconv.ParseInt(i.Operands[0].Literal, 0, 64)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > 0xffff {
+		return fmt.Errorf("value %s is out of range for RET, which requires a 16-bit unsigned value", i.Operands[0].Literal)
+	}
 
+	c.emit(partOpcode, 0xc2)
+	c.emit(partImmediate, byte(n), byte(n>>8))
 	return nil
 }
 
-func (c *Compiler) assembleMov(i parser.Instruction, label bool) error {
+// assembleSUB handles subtraction.
+func (c *Compiler) assembleSUB(i parser.Instruction) error {
 
-	//
-	// Are we moving a register to another register?
-	//
-	// No indirection
-	//
+	// Two registers subtracted?
 	if i.Operands[0].Type == token.REGISTER &&
 		i.Operands[0].Indirection == false &&
 		i.Operands[1].Type == token.REGISTER &&
 		i.Operands[1].Indirection == false {
-
-		c.code = append(c.code, []byte{0x48, 0x89}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
-
+		return c.assembleRegReg(0x29, i.Operands[0].Literal, i.Operands[1].Literal)
 	}
 
-	//
-	// Are we moving a number to a register ?
-	//
+	// OK number subtracted from a register?
 	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Indirection == false &&
 		i.Operands[1].Type == token.NUMBER {
 
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xc7}...)
+		// 0x81 /5, or 0x2d for the accumulator
+		return c.assembleImmediate(5, 0x2d, i.Operands[0], i.Operands[1].Token)
+	}
 
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+	return fmt.Errorf("unhandled SUB instruction %v", i)
+}
 
-		// value
-		n, err := c.argToByteArray(i.Operands[1].Token)
-		if err != nil {
-			return err
-		}
+// assembleSyscallExit handles the `syscall_exit` pseudo-instruction, which
+// exits the program with the given status.  It expands to the register
+// setup, and the system-call, appropriate for our architecture:
+//
+//	mov rax, 60           mov eax, 1
+//	xor rdi, rdi          xor ebx, ebx
+//	syscall               int 0x80
+//
+// A non-zero status is loaded via mov, rather than xor.
+func (c *Compiler) assembleSyscallExit(i parser.Instruction) error {
 
-		// hack
-		if label {
-			c.patches[len(c.code)], _ = strconv.Atoi(i.Operands[1].Literal)
-		}
-		c.code = append(c.code, n...)
-		return nil
+	status := i.Operands[0]
+	if status.Type != token.NUMBER || status.Indirection {
+		return fmt.Errorf("syscall_exit requires a numeric status, got %v", status)
 	}
 
-	// mov $reg, $id
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Indirection == false &&
-		i.Operands[1].Type == token.IDENTIFIER {
-
-		//
-		// Lookup the identifier, and if we can find it
-		// then we will treat it as a constant
-		//
-		name := i.Operands[1].Literal
-		val, ok := c.dataOffsets[name]
-		if ok {
+	reg := func(name string) parser.Operand {
+		return parser.Operand{Token: token.Token{Type: token.REGISTER, Literal: name}}
+	}
+	num := func(value string) parser.Operand {
+		return parser.Operand{Token: token.Token{Type: token.NUMBER, Literal: value}}
+	}
 
-			i.Operands[1].Type = token.NUMBER
-			i.Operands[1].Literal = fmt.Sprintf("%d", val)
-			return c.assembleMov(i, true)
-		}
-		return fmt.Errorf("reference to unknown label/data: %v", i.Operands[1])
+	// The registers, and system-call numbers, differ between the
+	// 64-bit and 32-bit ABIs.
+	number, arg := reg("rax"), reg("rdi")
+	exit := num("60")
+	call := parser.Instruction{Instruction: "syscall"}
+	if c.arch == "i386" {
+		number, arg = reg("eax"), reg("ebx")
+		exit = num("1")
+		call = parser.Instruction{Instruction: "int", Operands: []parser.Operand{num("0x80")}}
 	}
 
-	// Storing a value in an address
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Indirection &&
-		i.Operands[1].Type == token.NUMBER {
+	expansion := []parser.Instruction{
+		{Instruction: "mov", Operands: []parser.Operand{number, exit}},
+	}
+	if v, err := strconv.ParseInt(status.Literal, 0, 64); err == nil && v == 0 {
+		expansion = append(expansion, parser.Instruction{Instruction: "xor", Operands: []parser.Operand{arg, arg}})
+	} else {
+		expansion = append(expansion, parser.Instruction{Instruction: "mov", Operands: []parser.Operand{arg, status}})
+	}
+	expansion = append(expansion, call)
 
-		// The number we're setting
-		n, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
+	for _, ins := range expansion {
+		err := c.compileInstruction(ins)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// Register number
-		r := byte(c.getreg(i.Operands[0].Literal))
-
-		// things we add
-		bytes := []byte{}
-
-		switch i.Operands[0].Size {
-
-		case 8:
-			bytes = []byte{0xc6, r, byte(n)}
-		case 16:
-			bytes = []byte{0x66, 0xc7, byte(r)}
-
-			buf := make([]byte, 2)
-			binary.LittleEndian.PutUint16(buf, uint16(n))
-			bytes = append(bytes, buf...)
-
-		case 32, 64:
-			bytes = []byte{0xc7, r}
-
-			buf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(buf, uint32(n))
-			bytes = append(bytes, buf...)
+// needsExit returns true if execution might continue past the end of our
+// code, because the final instruction doesn't end the program or jump
+// elsewhere, or because a label refers to the end of the code.
+func (c *Compiler) needsExit() bool {
 
-		default:
-			return fmt.Errorf("unknown size in instruction %v", i.Operands[0])
+	for _, offset := range c.labels {
+		if offset == len(c.code) {
+			return true
 		}
+	}
 
-		c.code = append(c.code, bytes...)
-
-		return nil
+	switch c.last {
+	case "jmp", "ret", "syscall", "syscall_exit":
+		return false
 	}
+	return true
+}
 
-	//
-	// HACK
-	//
-	// mov rax, [REG]
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Literal == "rax" &&
-		i.Operands[1].Type == token.REGISTER &&
-		i.Operands[1].Indirection {
+// entryStub generates the entry-point which calls the main label, and
+// then exits with the value it returned as the status.
+func (c *Compiler) entryStub() error {
 
-		// Register number
-		r := byte(c.getreg(i.Operands[0].Literal))
-		c.code = append(c.code, []byte{0x8a, r}...)
-		return nil
+	reg := func(name string) parser.Operand {
+		return parser.Operand{Token: token.Token{Type: token.REGISTER, Literal: name}}
+	}
+	num := func(value string) parser.Operand {
+		return parser.Operand{Token: token.Token{Type: token.NUMBER, Literal: value}}
+	}
+	main := parser.Operand{Token: token.Token{Type: token.IDENTIFIER, Literal: c.mainLabel}}
+
+	// The registers, and system-call numbers, differ between the
+	// 64-bit and 32-bit ABIs.  The value returned by main is found
+	// in the same register as the system-call number.
+	number, arg := reg("rax"), reg("rdi")
+	exit := num("60")
+	call := parser.Instruction{Instruction: "syscall"}
+	if c.arch == "i386" {
+		number, arg = reg("eax"), reg("ebx")
+		exit = num("1")
+		call = parser.Instruction{Instruction: "int", Operands: []parser.Operand{num("0x80")}}
 	}
 
-	return fmt.Errorf("unknown MOV instruction: %v", i)
+	expansion := []parser.Instruction{
+		{Instruction: "call", Operands: []parser.Operand{main}},
+		{Instruction: "mov", Operands: []parser.Operand{arg, number}},
+		{Instruction: "mov", Operands: []parser.Operand{number, exit}},
+		call,
+	}
 
+	for _, ins := range expansion {
+		err := c.compileInstruction(ins)
+		if err != nil {
+			return fmt.Errorf("error generating entry-point: %s", err)
+		}
+	}
+	return nil
 }
 
-// assemblePop would compile "pop offset", and "push 0x1234"
-func (c *Compiler) assemblePop(i parser.Instruction) error {
-
-	// known pop-types
-	table := make(map[string][]byte)
-	table["rax"] = []byte{0x58}
-	table["rbx"] = []byte{0x5b}
-	table["rcx"] = []byte{0x59}
-	table["rdx"] = []byte{0x5a}
-	table["rbp"] = []byte{0x5d}
-	table["rsp"] = []byte{0x5c}
-	table["rsi"] = []byte{0x5e}
-	table["rdi"] = []byte{0x5f}
-	table["r8"] = []byte{0x41, 0x58}
-	table["r9"] = []byte{0x41, 0x59}
-	table["r10"] = []byte{0x41, 0x5a}
-	table["r11"] = []byte{0x41, 0x5b}
-	table["r12"] = []byte{0x41, 0x5c}
-	table["r13"] = []byte{0x41, 0x5d}
-	table["r14"] = []byte{0x41, 0x5e}
-	table["r15"] = []byte{0x41, 0x5f}
+// assembleTEST handles test, which performs a bitwise and, setting the
+// flags, but discards the result.
+//
+// Unlike the other arithmetic instructions there is no sign-extended
+// 8-bit immediate form, so immediates are always full-width.
+func (c *Compiler) assembleTEST(i parser.Instruction) error {
 
-	// Is this "pop rax|rbx..|rdx", or something in the table?
-	if i.Operands[0].Type == token.REGISTER {
-		bytes, ok := table[i.Operands[0].Literal]
-		if ok {
-			c.code = append(c.code, bytes...)
-			return nil
-		}
-		return fmt.Errorf("unknown register in 'pop'")
+	// Two registers tested?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x85, i.Operands[0].Literal, i.Operands[1].Literal)
 	}
 
-	return fmt.Errorf("unknown pop-type: %v", i)
-
-}
+	// A register and a number?
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.NUMBER {
 
-// assemblePush would compile "push offset", and "push 0x1234"
-func (c *Compiler) assemblePush(i parser.Instruction) error {
+		reg := i.Operands[0].Literal
+		if _, ok := c.getExtendedReg(reg); ok {
+			return fmt.Errorf("immediate operations upon %s are not implemented", reg)
+		}
 
-	// Is this a number?  Just output it
-	if i.Operands[0].Type == token.NUMBER {
-		n, err := c.argToByteArray(i.Operands[1].Token)
+		// The immediate is sign-extended for 64-bit registers.
+		if c.regSize(reg) == 64 {
+			num, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
+			if err == nil && (num < math.MinInt32 || num > math.MaxInt32) {
+				return fmt.Errorf("the immediate %s does not fit in a signed 32-bit value", i.Operands[1].Literal)
+			}
+		}
+		n, err := c.argToByteArray(i.Operands[1].Token, c.immSize(reg))
 		if err != nil {
 			return err
 		}
-		c.code = append(c.code, 0x68)
-		c.code = append(c.code, n...)
+
+		c.emitPrefix(reg)
+		if c.getreg(reg) == 0 {
+			// 0xa9 for the accumulator
+			c.emit(partOpcode, 0xa9)
+		} else {
+			// 0xf7 /0
+			c.emit(partOpcode, 0xf7)
+			c.emit(partModRM, byte(0xc0+c.getreg(reg)))
+		}
+		c.emit(partImmediate, n...)
 		return nil
 	}
 
-	// Is this a label?
-	if i.Operands[0].Type == token.IDENTIFIER {
+	// A register and memory, in either order, which is the same
+	// operation.
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x85, i.Operands[1].Literal, i.Operands[0])
+	}
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x85, i.Operands[0].Literal, i.Operands[1])
+	}
 
-		c.code = append(c.code, 0x68)
+	return fmt.Errorf("unhandled TEST instruction %v", i)
+}
 
-		c.labelTargets[len(c.code)] = i.Operands[0].Literal
+// assembleXCHG handles swapping the contents of two registers, or of a
+// register and memory.
+//
+// Exchanging a register with rax has a special short-form encoding,
+// 0x90+reg, so `xchg rax, rax` is emitted as the canonical `nop`, 0x90,
+// without the REX.W prefix.  Upon amd64 `xchg eax, eax` must clear the
+// upper half of rax, so it uses the long form, 0x87 0xc0, instead.
+func (c *Compiler) assembleXCHG(i parser.Instruction) error {
+
+	// A register and memory, in either order, which is the same
+	// operation.
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x87, i.Operands[1].Literal, i.Operands[0])
+	}
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x87, i.Operands[0].Literal, i.Operands[1])
+	}
 
-		c.code = append(c.code, []byte{0x0, 0x0, 0x0, 0x0}...)
-		return nil
+	if i.Operands[0].Type != token.REGISTER || i.Operands[0].Indirection ||
+		i.Operands[1].Type != token.REGISTER || i.Operands[1].Indirection {
+		return fmt.Errorf("unknown argument for XCHG %v", i)
 	}
 
-	// is this a register?
-	table := make(map[string][]byte)
-	table["rax"] = []byte{0x50}
-	table["rcx"] = []byte{0x51}
-	table["rdx"] = []byte{0x52}
-	table["rbx"] = []byte{0x53}
-	table["rsp"] = []byte{0x54}
-	table["rbp"] = []byte{0x55}
-	table["rsi"] = []byte{0x56}
-	table["rdi"] = []byte{0x57}
-	table["r8"] = []byte{0x41, 0x50}
-	table["r9"] = []byte{0x41, 0x51}
-	table["r10"] = []byte{0x41, 0x52}
-	table["r11"] = []byte{0x41, 0x53}
-	table["r12"] = []byte{0x41, 0x54}
-	table["r13"] = []byte{0x41, 0x55}
-	table["r14"] = []byte{0x41, 0x56}
-	table["r15"] = []byte{0x41, 0x57}
+	dst := i.Operands[0].Literal
+	src := i.Operands[1].Literal
 
-	// Is this "push rax|rbx..|rdx", or something in the table?
-	if i.Operands[0].Type == token.REGISTER {
-		bytes, ok := table[i.Operands[0].Literal]
-		if ok {
-			c.code = append(c.code, bytes...)
-			return nil
+	if c.regSize(dst) != c.regSize(src) {
+		return fmt.Errorf("register size mismatch: %s, %s", dst, src)
+	}
+	for _, reg := range []string{dst, src} {
+		if c.isSystemReg(reg) || (c.regSize(reg) != 16 && c.regSize(reg) != 32 && c.regSize(reg) != 64) {
+			return fmt.Errorf("register %s cannot be used here", reg)
 		}
-		return fmt.Errorf("unknown register in 'push'")
 	}
 
-	return fmt.Errorf("unknown push-type: %v", i)
-}
-
-// assembleSUB handles subtraction.
-func (c *Compiler) assembleSUB(i parser.Instruction) error {
-
-	// Two registers subtracted?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x29}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
+	// The short-form of `xchg rax, rax`, REX.W 0x90, is nop with a
+	// pointless prefix, so we emit the canonical nop instead, which
+	// has the same effect.
+	//
+	// However `xchg eax, eax` must clear the upper half of rax upon
+	// amd64, as other 32-bit operations do, which nop doesn't, so the
+	// long form is used for it.
+	if dst == "rax" && src == "rax" {
+		c.emit(partOpcode, 0x90)
+		return nil
+	}
+	if dst == "eax" && src == "eax" && c.arch == "amd64" {
+		c.emit(partOpcode, 0x87)
+		c.emit(partModRM, 0xc0)
 		return nil
 	}
 
-	// OK number subtracted from a register?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.NUMBER {
-
-		// Convert the integer to a four-byte/64-bit value
-		n, err := c.argToByteArray(i.Operands[1].Token)
-		if err != nil {
-			return err
+	// Short-form if one of the operands is the accumulator, with
+	// REX.B selecting the extended registers.
+	accumulator := func(reg string) bool {
+		_, ext := c.getExtendedReg(reg)
+		return !ext && c.getreg(reg) == 0
+	}
+	other := ""
+	if accumulator(dst) {
+		other = src
+	} else if accumulator(src) {
+		other = dst
+	}
+	if other != "" {
+		rex := byte(0x40)
+		if c.regSize(other) == 16 {
+			c.emit(partPrefix, 0x66)
+		} else if c.regSize(other) == 64 {
+			rex |= 0x08
 		}
-
-		// Work out the register
-		switch i.Operands[0].Literal {
-		case "rax":
-			c.code = append(c.code, []byte{0x48, 0x2d}...)
-		case "rbx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xeb}...)
-		case "rcx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xe9}...)
-		case "rdx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xea}...)
-		default:
-			return fmt.Errorf("SUB %s, number not implemented", i.Operands[0].Literal)
+		n, ext := c.getExtendedReg(other)
+		if ext {
+			rex |= 0x01
+		} else {
+			n = c.getreg(other)
 		}
-
-		// Now append the value
-		c.code = append(c.code, n...)
+		if rex != 0x40 {
+			c.emit(partREX, rex)
+		}
+		c.emit(partOpcode, byte(0x90+n))
 		return nil
 	}
 
-	return fmt.Errorf("unhandled SUB instruction %v", i)
+	return c.assembleRegReg(0x87, dst, src)
 }
 
 // assembleXOR handles xor rax, rbx, etc.
@@ -961,11 +4378,26 @@ func (c *Compiler) assembleXOR(i parser.Instruction) error {
 
 	// Two registers xor'd?
 	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x31}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
+		return c.assembleRegReg(0x31, i.Operands[0].Literal, i.Operands[1].Literal)
+	}
+
+	// A register and memory, in either order?
+	if isMemory(i.Operands[1]) && i.Operands[0].Type == token.REGISTER && !i.Operands[0].Indirection {
+		return c.assembleRegMem(0x33, i.Operands[0].Literal, i.Operands[1])
+	}
+	if isMemory(i.Operands[0]) && i.Operands[1].Type == token.REGISTER && !i.Operands[1].Indirection {
+		return c.assembleRegMem(0x31, i.Operands[1].Literal, i.Operands[0])
+	}
+
+	// A register, or memory, and a number?
+	if (i.Operands[0].Type == token.REGISTER || isMemory(i.Operands[0])) &&
+		i.Operands[1].Type == token.NUMBER {
+
+		// 0x81 /6, or 0x35 for the accumulator
+		return c.assembleImmediate(6, 0x35, i.Operands[0], i.Operands[1].Token)
 	}
 
 	return fmt.Errorf("unknown argument for XOR %v", i)
@@ -0,0 +1,3898 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	goelf "debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/skx/assembler/elf"
+	"github.com/skx/assembler/instructions"
+	"github.com/skx/assembler/parser"
+)
+
+// compile assembles the given source, writing the generated binary into
+// a temporary directory, and returns the compiler so that the results
+// may be examined.
+func compile(t *testing.T, src string, arch string) (*Compiler, string) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c := New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if arch != "" {
+		err = c.SetArch(arch)
+		if err != nil {
+			t.Fatalf("failed to set architecture: %s", err)
+		}
+	}
+
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile %s: %s", src, err)
+	}
+
+	return c, filepath.Join(dir, "a.out")
+}
+
+// expectCode ensures the generated code matches our expectation.
+func expectCode(t *testing.T, c *Compiler, expected []byte) {
+	if len(c.code) != len(expected) {
+		t.Fatalf("code length mismatch, expected=% x, got=% x", expected, c.code)
+	}
+	for i, b := range expected {
+		if c.code[i] != b {
+			t.Fatalf("code mismatch at offset %d, expected=% x, got=% x", i, expected, c.code)
+		}
+	}
+}
+
+func TestArch(t *testing.T) {
+
+	c := New("nop")
+	if c.SetArch("i386") != nil {
+		t.Fatalf("failed to set architecture i386")
+	}
+	if c.SetArch("amd64") != nil {
+		t.Fatalf("failed to set architecture amd64")
+	}
+	if c.SetArch("arm") == nil {
+		t.Fatalf("expected an error with an unknown architecture")
+	}
+}
+
+func TestI386(t *testing.T) {
+
+	src := `
+mov eax, 1
+xor ebx, ebx
+int 0x80
+`
+	c, path := compile(t, src, "i386")
+
+	expectCode(t, c, []byte{
+		0xb8, 0x01, 0x00, 0x00, 0x00, // mov eax, 1
+		0x31, 0xdb, // xor ebx, ebx
+		0xcd, 0x80, // int 0x80
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if data[4] != 0x01 {
+		t.Fatalf("expected ELFCLASS32, got %d", data[4])
+	}
+	if data[18] != 0x03 {
+		t.Fatalf("expected EM_386, got %d", data[18])
+	}
+
+	// 64-bit registers are not available
+	c = New("mov rax, 1")
+	c.SetArch("i386")
+	c.SetOutput(path)
+	if c.Compile() == nil {
+		t.Fatalf("expected error using a 64-bit register on i386")
+	}
+
+	// Run the program, if we can.
+	if runtime.GOOS != "linux" || (runtime.GOARCH != "amd64" && runtime.GOARCH != "386") {
+		t.Skip("skipping execution on non-x86 linux host")
+	}
+	err = exec.Command(path).Run()
+	if err != nil {
+		t.Fatalf("failed to run 32-bit binary: %s", err)
+	}
+}
+
+func TestIMUL(t *testing.T) {
+
+	c, _ := compile(t, "imul rax, rbx, 10", "")
+	expectCode(t, c, []byte{0x48, 0x6b, 0xc3, 0x0a})
+
+	c, _ = compile(t, "imul rax, rbx, 1000", "")
+	expectCode(t, c, []byte{0x48, 0x69, 0xc3, 0xe8, 0x03, 0x00, 0x00})
+
+	c, _ = compile(t, "imul rcx, rdx, 3", "")
+	expectCode(t, c, []byte{0x48, 0x6b, 0xca, 0x03})
+
+	// The extended registers, and memory sources
+	c, _ = compile(t, "imul r8, rax, 10\nimul rax, r9, 1000", "")
+	expectCode(t, c, []byte{0x4c, 0x6b, 0xc0, 0x0a, 0x49, 0x69, 0xc1, 0xe8, 0x03, 0x00, 0x00})
+
+	c, _ = compile(t, "imul rax, [rbx], 10\nimul ecx, [rbx+rcx*8+16], 1000", "")
+	expectCode(t, c, []byte{0x48, 0x6b, 0x03, 0x0a, 0x69, 0x4c, 0xcb, 0x10, 0xe8, 0x03, 0x00, 0x00})
+
+	// The two-operand form
+	c, _ = compile(t, "imul rax, rbx", "")
+	expectCode(t, c, []byte{0x48, 0x0f, 0xaf, 0xc3})
+
+	c, _ = compile(t, "imul r9, rcx\nimul rcx, r10\nimul dx, si", "")
+	expectCode(t, c, []byte{0x4c, 0x0f, 0xaf, 0xc9, 0x49, 0x0f, 0xaf, 0xca, 0x66, 0x0f, 0xaf, 0xd6})
+
+	c, path := compile(t, "imul eax, ebx", "i386")
+	expectCode(t, c, []byte{0x0f, 0xaf, 0xc3})
+
+	for _, src := range []string{"imul rax", "imul rax, ebx", "imul rax, [rbx]", "imul al, bl",
+		"imul [rax], rbx, 10", "imul rax, ebx, 10", "imul rax, rbx, 0xffffffff", "imul rax, rbx, rcx"} {
+		c = New(src)
+		c.SetOutput(path)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestPatchBounds(t *testing.T) {
+
+	type TestCase struct {
+		Name  string
+		Setup func(c *Compiler)
+	}
+
+	tests := []TestCase{
+		{Name: "data", Setup: func(c *Compiler) {
+			c.fixups = append(c.fixups, fixup{offset: 1, size: 4, target: "foo", kind: absoluteData})
+		}},
+		{Name: "label", Setup: func(c *Compiler) {
+			c.fixups = append(c.fixups, fixup{offset: 100, size: 4, target: "foo", kind: absoluteCode})
+		}},
+		{Name: "jump", Setup: func(c *Compiler) {
+			c.fixups = append(c.fixups, fixup{offset: 2, size: 1, target: "foo", kind: relativeCode})
+		}},
+		{Name: "call", Setup: func(c *Compiler) {
+			c.fixups = append(c.fixups, fixup{offset: -1, size: 4, target: "foo", kind: relativeCode})
+		}},
+	}
+
+	for _, test := range tests {
+
+		dir, err := ioutil.TempDir("", "assembler")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// "nop" + "ret" generates only two bytes of code.
+		c := New(":foo\nnop\nret")
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		test.Setup(c)
+
+		err = c.Compile()
+		if err == nil {
+			t.Fatalf("%s: expected error with out of bounds patch", test.Name)
+		}
+		if !strings.Contains(err.Error(), "exceeds code length") {
+			t.Fatalf("%s: unexpected error %s", test.Name, err)
+		}
+	}
+}
+
+func TestXCHG(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "xchg rax, rbx", Output: []byte{0x48, 0x93}},
+		{Input: "xchg rbx, rax", Output: []byte{0x48, 0x93}},
+		{Input: "xchg rax, rdi", Output: []byte{0x48, 0x97}},
+		{Input: "xchg rbx, rcx", Output: []byte{0x48, 0x87, 0xcb}},
+		{Input: "xchg esi, edx", Output: []byte{0x87, 0xd6}},
+
+		// The canonical nop, rather than REX.W 0x90
+		{Input: "xchg rax, rax", Output: []byte{0x90}},
+
+		// Which would leave the upper half of rax unchanged
+		{Input: "xchg eax, eax", Output: []byte{0x87, 0xc0}},
+
+		// The extended registers are selected via REX
+		{Input: "xchg r8, rax", Output: []byte{0x49, 0x90}},
+		{Input: "xchg rax, r8", Output: []byte{0x49, 0x90}},
+		{Input: "xchg r9, rbx", Output: []byte{0x49, 0x87, 0xd9}},
+
+		// Memory, in either order
+		{Input: "xchg [rax], rbx", Output: []byte{0x48, 0x87, 0x18}},
+		{Input: "xchg rbx, [rax]", Output: []byte{0x48, 0x87, 0x18}},
+		{Input: "xchg ecx, [rsi+8]", Output: []byte{0x87, 0x4e, 0x08}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// There is no upper half upon i386
+	c, _ := compile(t, "xchg eax, eax", "i386")
+	expectCode(t, c, []byte{0x90})
+
+	// The registers must be the same size
+	c = New("xchg rax, ebx")
+	c.SetOutput(os.DevNull)
+	err := c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Fatalf("expected a size mismatch, got %v", err)
+	}
+}
+
+func TestRelative(t *testing.T) {
+
+	src := `
+.pad DB "padding"
+.val DB 42, 0, 0, 0, 0, 0, 0, 0
+        mov rbx, [rel val]
+        mov [rel pad], rbx
+        mov rax, 1
+        int 0x80
+`
+	c, path := compile(t, src, "")
+
+	if c.code[0] != 0x48 || c.code[1] != 0x8b || c.code[2] != 0x1d {
+		t.Fatalf("unexpected encoding % x", c.code[0:3])
+	}
+	if c.code[7] != 0x48 || c.code[8] != 0x89 || c.code[9] != 0x1d {
+		t.Fatalf("unexpected encoding % x", c.code[7:10])
+	}
+
+	// Decode the displacements, and ensure they point to the data
+	base := 0x400000 + elf.New().HeaderSize()
+	data := int(elf.New().Layout(uint64(len(c.code)), uint64(len(c.data))).DataAddress)
+
+	disp := int32(binary.LittleEndian.Uint32(c.code[3:]))
+	if base+7+int(disp) != data+c.dataOffsets["val"] {
+		t.Fatalf("displacement %d doesn't refer to val", disp)
+	}
+	disp = int32(binary.LittleEndian.Uint32(c.code[10:]))
+	if base+14+int(disp) != data+c.dataOffsets["pad"] {
+		t.Fatalf("displacement %d doesn't refer to pad", disp)
+	}
+
+	// Unknown data is an error
+	c = New("mov rax, [rel foo]")
+	c.SetOutput(path)
+	if c.Compile() == nil {
+		t.Fatalf("expected error referring to unknown data")
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// The exit-code should be loaded from the data.
+	err := exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+
+	src := `
+nop
+nop
+mov rax, $ - $$
+mov rbx, $$
+mov rcx, $
+add rcx, 2 + 3 - 1
+mov rdx, -2
+`
+	c, _ := compile(t, src, "")
+
+	start := uint32(0x400000 + elf.New().HeaderSize())
+
+	// The size of the code which preceeded the instruction
+	if binary.LittleEndian.Uint32(c.code[5:]) != 2 {
+		t.Fatalf("$ - $$ resulted in the wrong value: % x", c.code[5:9])
+	}
+
+	// The start of the code
+	if binary.LittleEndian.Uint32(c.code[12:]) != start {
+		t.Fatalf("$$ resulted in the wrong value: % x", c.code[12:16])
+	}
+
+	// The address of the current instruction
+	if binary.LittleEndian.Uint32(c.code[19:]) != start+16 {
+		t.Fatalf("$ resulted in the wrong value: % x", c.code[19:23])
+	}
+
+	// Simple arithmetic, using the short immediate form
+	if c.code[26] != 4 {
+		t.Fatalf("2 + 3 - 1 resulted in the wrong value: % x", c.code[23:27])
+	}
+
+	// Negative numbers
+	if int32(binary.LittleEndian.Uint32(c.code[30:])) != -2 {
+		t.Fatalf("-2 resulted in the wrong value: % x", c.code[30:34])
+	}
+
+	// Names may be followed by a minus without spaces, as they may
+	// by a plus.
+	c = New(".msg DB \"hello\"\nmov rax, SIZE-1\nmov rbx, msg-4")
+	c.SetOutput(os.DevNull)
+	c.Define("SIZE", 16)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if c.code[3] != 15 {
+		t.Fatalf("SIZE-1 resulted in the wrong value: % x", c.code)
+	}
+	if int64(binary.LittleEndian.Uint32(c.code[10:])) != c.dataAddress()-4 {
+		t.Fatalf("msg-4 resulted in the wrong value: % x", c.code)
+	}
+
+	// Unknown symbols are an error
+	c = New("mov rax, $ - foo")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error with unknown symbol")
+	}
+
+	// i386 uses a smaller header
+	c, _ = compile(t, "mov eax, $$", "i386")
+	if binary.LittleEndian.Uint32(c.code[1:]) != uint32(0x400000+0x34+0x40) {
+		t.Fatalf("$$ resulted in the wrong value on i386: % x", c.code[1:5])
+	}
+}
+
+func TestSymbolOffset(t *testing.T) {
+
+	src := `.msg DB "hello"
+mov rsi, msg+4
+mov rdi, 2 + msg - 1
+mov rax, end + 1
+:end
+nop`
+
+	c, _ := compile(t, src, "")
+
+	// The address of the data, or label, plus the constant.
+	msg := c.Symbols()["msg"]
+	if got := binary.LittleEndian.Uint32(c.code[3:]); uint64(got) != msg+4 {
+		t.Fatalf("msg+4 resulted in %x, expected %x", got, msg+4)
+	}
+	if got := binary.LittleEndian.Uint32(c.code[10:]); uint64(got) != msg+1 {
+		t.Fatalf("2 + msg - 1 resulted in %x, expected %x", got, msg+1)
+	}
+	end := c.Symbols()["end"]
+	if got := binary.LittleEndian.Uint32(c.code[17:]); uint64(got) != end+1 {
+		t.Fatalf("end + 1 resulted in %x, expected %x", got, end+1)
+	}
+
+	// A symbol may only be added to
+	c = New(".msg DB 1\nmov rax, 4 - msg")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error subtracting a symbol")
+	}
+}
+
+func TestMovImmediate(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mov ax, 0x1234", Output: []byte{0x66, 0xb8, 0x34, 0x12}},
+		{Input: "mov di, 0xffff", Output: []byte{0x66, 0xbf, 0xff, 0xff}},
+		{Input: "mov eax, 0x12345678", Output: []byte{0xb8, 0x78, 0x56, 0x34, 0x12}},
+		{Input: "mov ebx, 1", Output: []byte{0xbb, 0x01, 0x00, 0x00, 0x00}},
+		{Input: "mov rax, 0x12345678", Output: []byte{0x48, 0xc7, 0xc0, 0x78, 0x56, 0x34, 0x12}},
+		{Input: "mov rcx, -1", Output: []byte{0x48, 0xc7, 0xc1, 0xff, 0xff, 0xff, 0xff}},
+
+		// Values which would be sign-extended incorrectly use the
+		// 64-bit immediate form, so 0xffffffff is zero-extended.
+		{Input: "mov rax, 0xffffffff", Output: []byte{0x48, 0xb8, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}},
+		{Input: "mov rdx, 0x123456789", Output: []byte{0x48, 0xba, 0x89, 0x67, 0x45, 0x23, 0x01, 0x00, 0x00, 0x00}},
+		{Input: "mov rbx, -0x80000001", Output: []byte{0x48, 0xbb, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff, 0xff}},
+
+		// The extended registers use REX.B in both forms
+		{Input: "mov r8, 5", Output: []byte{0x49, 0xc7, 0xc0, 0x05, 0x00, 0x00, 0x00}},
+		{Input: "mov r15, -1", Output: []byte{0x49, 0xc7, 0xc7, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "mov r9, 0xffffffff", Output: []byte{0x49, 0xb9, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}},
+
+		{Input: "add ax, 2", Output: []byte{0x66, 0x83, 0xc0, 0x02}},
+		{Input: "add ax, 0x200", Output: []byte{0x66, 0x05, 0x00, 0x02}},
+		{Input: "sub cx, 0x100", Output: []byte{0x66, 0x81, 0xe9, 0x00, 0x01}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Values which are too large for the register
+	for _, src := range []string{"mov ax, 0x10000", "mov eax, 0x100000000"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestMovStore(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mov qword [rax], 1", Output: []byte{0x48, 0xc7, 0x00, 0x01, 0x00, 0x00, 0x00}},
+		{Input: "mov qword [rbx], -1", Output: []byte{0x48, 0xc7, 0x03, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "mov dword [rcx], 0xffffffff", Output: []byte{0xc7, 0x01, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "mov word ptr [rdx], 0x1234", Output: []byte{0x66, 0xc7, 0x02, 0x34, 0x12}},
+		{Input: "mov byte [rax], 1", Output: []byte{0xc6, 0x00, 0x01}},
+		{Input: "mov byte [esi], 0xff", Output: []byte{0x67, 0xc6, 0x06, 0xff}},
+		{Input: "mov dword [eax], 7", Arch: "i386", Output: []byte{0xc7, 0x00, 0x07, 0x00, 0x00, 0x00}},
+		{Input: "mov dword [rbp], 1", Output: []byte{0xc7, 0x45, 0x00, 0x01, 0x00, 0x00, 0x00}},
+		{Input: "mov qword [rbx+rcx*8+8], 2", Output: []byte{0x48, 0xc7, 0x44, 0xcb, 0x08, 0x02, 0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// There are no 64-bit immediates, values must fit in the operand,
+	// and the size must be given.
+	for _, src := range []string{
+		"mov qword [rax], 0x80000000",
+		"mov qword [rax], 0x123456789",
+		"mov byte [rax], 256",
+		"mov word [rax], 0x10000",
+		"mov [rax], 1",
+	} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestBSWAP(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "bswap rax", Output: []byte{0x48, 0x0f, 0xc8}},
+		{Input: "bswap rdi", Output: []byte{0x48, 0x0f, 0xcf}},
+		{Input: "bswap ecx", Output: []byte{0x0f, 0xc9}},
+		{Input: "bswap r9", Output: []byte{0x49, 0x0f, 0xc9}},
+		{Input: "bswap r15", Output: []byte{0x49, 0x0f, 0xcf}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestDefine(t *testing.T) {
+
+	src := `
+%ifdef DEBUG
+        nop
+%else
+        ret
+%endif
+`
+	c, _ := compile(t, src, "")
+	expectCode(t, c, []byte{0xc3})
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c = New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.Define("DEBUG", 1)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0x90})
+
+	// Preprocessor errors are reported
+	c = New("%ifdef DEBUG\nnop")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if c.Compile() == nil {
+		t.Fatalf("expected error with unterminated %%ifdef")
+	}
+
+	// Values defined in the source are constants, like those given
+	// to Define, which the source may replace.
+	c, _ = compile(t, "%define FOO 3\n%if FOO\nmov rax, FOO\n%endif", "")
+	expectCode(t, c, []byte{0x48, 0xc7, 0xc0, 0x03, 0x00, 0x00, 0x00})
+
+	c = New("%define FOO 0x10\nmov rax, FOO + 1")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.Define("FOO", 1)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0x48, 0xc7, 0xc0, 0x11, 0x00, 0x00, 0x00})
+
+	// Only numeric values may be defined
+	c = New("%define FOO bar\nnop")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "not a number") {
+		t.Fatalf("expected error with a non-numeric %%define, got %v", err)
+	}
+}
+
+func TestConstants(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := `
+.name DB NAME
+%ifdef NAME
+        mov rbx, EXIT
+        add rbx, EXIT + 1
+%endif
+`
+	c := New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.Define("EXIT", 3)
+	c.DefineString("NAME", "steve")
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	expectCode(t, c, []byte{
+		0x48, 0xc7, 0xc3, 0x03, 0x00, 0x00, 0x00, // mov rbx, 3
+		0x48, 0x83, 0xc3, 0x04, // add rbx, 4
+	})
+	if string(c.data) != "steve" {
+		t.Fatalf("string-constant not used for data: %v", c.data)
+	}
+
+	// Without the constants we fail
+	c = New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if c.Compile() == nil {
+		t.Fatalf("expected error without string-constant")
+	}
+
+	c = New("mov rbx, EXIT + 1")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if c.Compile() == nil {
+		t.Fatalf("expected error without constant")
+	}
+}
+
+func TestStdlib(t *testing.T) {
+
+	src := "mov rax, SYS_exit\nmov rdi, STDERR"
+
+	// Without the prelude the constants are unknown.
+	c := New(src)
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected an error without the standard prelude")
+	}
+
+	c = New(src)
+	c.SetOutput(os.DevNull)
+	c.SetStdlib(true)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{
+		0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, // mov rax, 60
+		0x48, 0xc7, 0xc7, 0x02, 0x00, 0x00, 0x00, // mov rdi, 2
+	})
+
+	// The numbers depend upon the architecture, and may be tested
+	// by the preprocessor.
+	c = New("%ifdef SYS_exit\nmov eax, SYS_exit\n%endif")
+	c.SetOutput(os.DevNull)
+	c.SetStdlib(true)
+	if err := c.SetArch("i386"); err != nil {
+		t.Fatalf("failed to set architecture: %s", err)
+	}
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0xb8, 0x01, 0x00, 0x00, 0x00})
+
+	// Our own definitions take precedence.
+	c = New(src)
+	c.SetOutput(os.DevNull)
+	c.Define("STDERR", 7)
+	c.SetStdlib(true)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{
+		0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, // mov rax, 60
+		0x48, 0xc7, 0xc7, 0x07, 0x00, 0x00, 0x00, // mov rdi, 7
+	})
+}
+
+func TestPushPop(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "push rbx", Output: []byte{0x53}},
+		{Input: "pop rdi", Output: []byte{0x5f}},
+
+		// The extended registers require REX.B
+		{Input: "push r8", Output: []byte{0x41, 0x50}},
+		{Input: "push r12", Output: []byte{0x41, 0x54}},
+		{Input: "pop r9", Output: []byte{0x41, 0x59}},
+		{Input: "pop r15", Output: []byte{0x41, 0x5f}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Memory operands are not supported
+	for _, src := range []string{"push [rax]", "pop [r12]"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestPushImmediate(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "push 0x12345678",
+			Output: []byte{0x68, 0x78, 0x56, 0x34, 0x12}},
+		{Input: "push -1",
+			Output: []byte{0x68, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "push 0xffffffff",
+			Output: []byte{0x68, 0xff, 0xff, 0xff, 0xff,
+				0xc7, 0x44, 0x24, 0x04, 0x00, 0x00, 0x00, 0x00}},
+		{Input: "push 0x1122334455667788",
+			Output: []byte{0x68, 0x88, 0x77, 0x66, 0x55,
+				0xc7, 0x44, 0x24, 0x04, 0x44, 0x33, 0x22, 0x11}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// Ensure the upper-half of the value is pushed, by moving
+	// the top byte to the bottom and using it as an exit-code.
+	src := `
+push 0x2a00000000000000
+pop rbx
+bswap rbx
+mov rax, 1
+int 0x80
+`
+	_, path := compile(t, src, "")
+	err := exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+
+	src := `
+.hello DB "Hello, world\n"
+.bye   DB "Goodbye, world\n"
+:start
+        mov rcx, hello
+        mov rdx, bye
+        mov rsi, [rel hello]
+        push start
+        call print
+        call print
+        jmp end
+:print
+        nop
+        jmp print
+        ret
+:end
+        push end
+        mov rax, $ - $$
+`
+	var first []byte
+
+	// Map iteration is random, so compile a few times to be sure.
+	for i := 0; i < 10; i++ {
+		_, path := compile(t, src, "")
+
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read output: %s", err)
+		}
+
+		if first == nil {
+			first = out
+			continue
+		}
+		if !bytes.Equal(first, out) {
+			t.Fatalf("compiling the same source resulted in different output")
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.bin")
+
+	src := `
+.msg DB "hi"
+        mov rax, msg
+        push $$
+        ret
+`
+	c := New(src)
+	c.SetOutput(path)
+	c.SetFormat(Raw)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	expected := []byte{
+		0x48, 0xc7, 0xc0, 0x0d, 0x00, 0x00, 0x00, // mov rax, msg
+		0x68, 0x00, 0x00, 0x00, 0x00, // push $$
+		0xc3,     // ret
+		'h', 'i', // data
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("unexpected output, expected=% x, got=% x", expected, out)
+	}
+}
+
+func TestIO(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "out dx, al", Output: []byte{0xee}},
+		{Input: "out dx, ax", Output: []byte{0x66, 0xef}},
+		{Input: "out dx, eax", Output: []byte{0xef}},
+		{Input: "out 0x80, al", Output: []byte{0xe6, 0x80}},
+		{Input: "in al, 0x60", Output: []byte{0xe4, 0x60}},
+		{Input: "in eax, 0x60", Output: []byte{0xe5, 0x60}},
+		{Input: "in al, dx", Output: []byte{0xec}},
+		{Input: "in ax, dx", Output: []byte{0x66, 0xed}},
+	}
+
+	for _, test := range tests {
+
+		c := New(test.Input)
+		c.SetOutput(os.DevNull)
+		c.SetFormat(Raw)
+
+		// Writing to /dev/null is fine for raw output
+		err := c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", test.Input, err)
+		}
+		expectCode(t, c, test.Output)
+	}
+
+	// Invalid forms, or ELF output, are errors
+	bogus := []string{
+		"in bl, dx",
+		"in al, cx",
+		"out 0x100, al",
+		"out dx, rax",
+		"add al, bl",
+		"in r8, dx",
+		"out 0x60, r9",
+		"in ah, dx",
+	}
+	for _, src := range bogus {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		c.SetFormat(Raw)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+
+	c := New("in al, dx")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error using port I/O in an ELF binary")
+	}
+}
+
+func TestSimple(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "hlt", Output: []byte{0xf4}},
+		{Input: "cpuid", Output: []byte{0x0f, 0xa2}},
+		{Input: "cli", Output: []byte{0xfa}},
+		{Input: "sti", Output: []byte{0xfb}},
+		{Input: "cld", Output: []byte{0xfc}},
+		{Input: "std", Output: []byte{0xfd}},
+		{Input: "nop\nret", Output: []byte{0x90, 0xc3}},
+		{Input: "syscall", Output: []byte{0x0f, 0x05}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestSyscallExit(t *testing.T) {
+
+	c, _ := compile(t, "syscall_exit 0", "")
+	expectCode(t, c, []byte{
+		0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, // mov rax, 60
+		0x48, 0x31, 0xff, // xor rdi, rdi
+		0x0f, 0x05, // syscall
+	})
+
+	c, _ = compile(t, "syscall_exit 3", "")
+	expectCode(t, c, []byte{
+		0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, // mov rax, 60
+		0x48, 0xc7, 0xc7, 0x03, 0x00, 0x00, 0x00, // mov rdi, 3
+		0x0f, 0x05, // syscall
+	})
+
+	c, path := compile(t, "syscall_exit 0", "i386")
+	expectCode(t, c, []byte{
+		0xb8, 0x01, 0x00, 0x00, 0x00, // mov eax, 1
+		0x31, 0xdb, // xor ebx, ebx
+		0xcd, 0x80, // int 0x80
+	})
+
+	c = New("syscall_exit rax")
+	c.SetOutput(path)
+	if c.Compile() == nil {
+		t.Fatalf("expected error exiting with a register")
+	}
+}
+
+func TestAutoExit(t *testing.T) {
+
+	exit := []byte{0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, 0x48, 0x31, 0xff, 0x0f, 0x05}
+
+	type TestCase struct {
+		Input string
+		Exit  bool
+	}
+
+	tests := []TestCase{
+		// Trailing data, and labels, are skipped when finding the
+		// final instruction.
+		{Input: "mov rbx, 1\n.msg DB \"hello\"", Exit: true},
+		{Input: "nop\nret\n.msg DB 1\n.table DQ 1, 2", Exit: false},
+		{Input: "rep ret\n.msg DB 1", Exit: false},
+		{Input: ":loop\njmp loop\n.msg DB 1", Exit: false},
+		{Input: "syscall\n.msg DB 1", Exit: false},
+		{Input: "syscall_exit 3\n.msg DB 1", Exit: false},
+
+		// But a label at the end might be jumped to.
+		{Input: "je done\nret\n:done\n.msg DB 1", Exit: true},
+	}
+
+	for _, test := range tests {
+		c := New(test.Input)
+		c.SetAutoExit(true)
+		c.SetFormat(Raw)
+		c.SetOutput("-")
+		c.SetStdout(ioutil.Discard)
+		err := c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", test.Input, err)
+		}
+		if bytes.HasSuffix(c.code, exit) != test.Exit {
+			t.Fatalf("unexpected code for %q: % x", test.Input, c.code)
+		}
+	}
+
+	// Not without being asked.
+	c, path := compile(t, "mov rbx, 1\n.msg DB 1", "")
+	expectCode(t, c, []byte{0x48, 0xc7, 0xc3, 0x01, 0x00, 0x00, 0x00})
+
+	// The exit follows the code, rather than the data.
+	c = New("mov rbx, 1\n.msg DB 1")
+	c.SetAutoExit(true)
+	c.SetOutput(path)
+	err := c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, append([]byte{0x48, 0xc7, 0xc3, 0x01, 0x00, 0x00, 0x00}, exit...))
+	if !bytes.Equal(c.data, []byte{1}) {
+		t.Fatalf("unexpected data % x", c.data)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// Which exits cleanly, rather than crashing.
+	err = exec.Command(path).Run()
+	if err != nil {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestMainLabel(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	src := `
+:main
+        mov rax, 42
+        ret
+`
+	c := New(src)
+	c.SetMainLabel("main")
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	// The entry-point calls main, then exits with its return value
+	expectCode(t, c, []byte{
+		0xe8, 0x0c, 0x00, 0x00, 0x00, // call main
+		0x48, 0x89, 0xc7, // mov rdi, rax
+		0x48, 0xc7, 0xc0, 0x3c, 0x00, 0x00, 0x00, // mov rax, 60
+		0x0f, 0x05, // syscall
+		0x48, 0xc7, 0xc0, 0x2a, 0x00, 0x00, 0x00, // mov rax, 42
+		0xc3, // ret
+	})
+
+	// The main label must exist
+	missing := New("nop")
+	missing.SetMainLabel("main")
+	missing.SetOutput(filepath.Join(dir, "missing"))
+	err = missing.Compile()
+	if err == nil || !strings.Contains(err.Error(), "main") {
+		t.Fatalf("expected error with a missing main, got %v", err)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	err = exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestPE(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.exe")
+
+	c := New(".msg DB \"hi\"\nmov rax, msg\nret")
+	c.SetOutput(path)
+	c.SetFormat(PE)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(out[0:2]) != "MZ" {
+		t.Fatalf("output doesn't begin with MZ")
+	}
+	offset := binary.LittleEndian.Uint32(out[0x3c:])
+	if string(out[offset:offset+4]) != "PE\x00\x00" {
+		t.Fatalf("missing PE signature at offset %x", offset)
+	}
+
+	// The code is loaded at 0x401000, so the data follows it.
+	addr := binary.LittleEndian.Uint32(c.code[3:])
+	if addr != 0x401000+uint32(len(c.code)) {
+		t.Fatalf("unexpected data address %x", addr)
+	}
+}
+
+func TestMachO(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	c := New(".msg DB \"hi\"\nmov rax, msg\nret")
+	c.SetOutput(path)
+	c.SetFormat(MachO)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if binary.LittleEndian.Uint32(out) != 0xfeedfacf {
+		t.Fatalf("missing Mach-O magic")
+	}
+
+	// The data follows the code.
+	addr := binary.LittleEndian.Uint32(c.code[3:])
+	if int64(addr) != c.codeAddress()+int64(len(c.code)) {
+		t.Fatalf("unexpected data address %x", addr)
+	}
+
+	// There is no i386 support
+	c = New("nop")
+	c.SetOutput(path)
+	c.SetFormat(MachO)
+	c.SetArch("i386")
+	if c.Compile() == nil {
+		t.Fatalf("expected error generating i386 Mach-O binary")
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.hex")
+
+	c := New(".msg DB \"hi\"\nmov rax, msg\nret")
+	c.SetOutput(path)
+	c.SetFormat(IntelHex)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+
+	// The data is at offset 8, following the code.
+	expected := ":0A00000048C7C008000000C368698B\n:00000001FF\n"
+	if string(out) != expected {
+		t.Fatalf("unexpected output, expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestExport(t *testing.T) {
+
+	c, _ := compile(t, "nop\nret", "")
+
+	if c.ExportC("code") != "unsigned char code[] = { 0x90, 0xc3 };" {
+		t.Fatalf("unexpected C export: %s", c.ExportC("code"))
+	}
+	if c.ExportHex() != "90c3" {
+		t.Fatalf("unexpected hex export: %s", c.ExportHex())
+	}
+}
+
+func TestMovLabel(t *testing.T) {
+
+	src := `
+        mov rax, done
+        mov ecx, done
+        push rax
+        ret
+:done
+        mov rbx, 7
+        mov rax, 1
+        int 0x80
+`
+	c, path := compile(t, src, "")
+
+	// The label follows the first four instructions
+	addr := uint32(c.codeAddress()) + 7 + 5 + 1 + 1
+	expected := []byte{0x48, 0xc7, 0xc0}
+	expected = append(expected, byte(addr), byte(addr>>8), byte(addr>>16), byte(addr>>24))
+	expected = append(expected, 0xb9)
+	expected = append(expected, byte(addr), byte(addr>>8), byte(addr>>16), byte(addr>>24))
+	if !bytes.Equal(c.code[:12], expected) {
+		t.Fatalf("unexpected code % x, expected % x", c.code[:12], expected)
+	}
+
+	// Labels must be defined, and addresses don't fit in 16-bits
+	for _, src := range []string{"mov rax, nowhere", ":here\nmov ax, here"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// We should have jumped to the label, and exited
+	err := exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 7 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestSections(t *testing.T) {
+
+	// The sections are selected in an unusual order, and the
+	// instructions between them always belong to the code.
+	src := `
+section .bss
+.value DQ 0
+section .text
+mov rbx, value
+section .data
+.msg DB "hi"
+mov qword ptr [rbx], 42
+section .bss
+.buf DB 16 dup 0
+section .data
+.end DB 0xff
+mov rdi, [rbx]
+mov rax, 60
+syscall
+`
+	c, path := compile(t, src, "")
+
+	// Only the initialised data is stored.
+	if !bytes.Equal(c.data, []byte{'h', 'i', 0xff}) {
+		t.Fatalf("unexpected data % x", c.data)
+	}
+
+	// The bss follows the data, in the order it was defined.
+	data := uint64(c.dataAddress())
+	symbols := c.Symbols()
+	if symbols["msg"] != data || symbols["end"] != data+2 ||
+		symbols["value"] != data+3 || symbols["buf"] != data+11 {
+		t.Fatalf("unexpected symbols %v", symbols)
+	}
+	if binary.LittleEndian.Uint32(c.code[3:]) != uint32(data+3) {
+		t.Fatalf("unexpected reference to the bss % x", c.code)
+	}
+
+	// The bss occupies memory, but not the file.
+	f, err := goelf.Open(path)
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	defer f.Close()
+	p := f.Progs[1]
+	if p.Filesz != 3 || p.Memsz != 3+8+16 {
+		t.Fatalf("unexpected data segment %v", p.ProgHeader)
+	}
+
+	// Other formats store the bss as zeros.
+	c = New(src)
+	c.SetOutput("-")
+	c.SetFormat(Raw)
+	var out bytes.Buffer
+	c.SetStdout(&out)
+	if err = c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if out.Len() != len(c.code)+3+8+16 {
+		t.Fatalf("unexpected raw output % x", out.Bytes())
+	}
+
+	// Data within the bss must be zero.
+	for _, bad := range []string{"section .bss\n.x DB 1", "section .bss\n.x DQ x"} {
+		c = New(bad)
+		c.SetOutput(path)
+		err = c.Compile()
+		if err == nil || !strings.Contains(err.Error(), "must be zero") {
+			t.Fatalf("expected error compiling %q, got %v", bad, err)
+		}
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// The value is stored to, and loaded from, the bss.
+	err = exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestIncbin(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob := []byte{0x00, 0xde, 0xad, 0xbe, 0xef, 0x0a}
+	err = ioutil.WriteFile(filepath.Join(dir, "blob.bin"), blob, 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	src := `
+.msg DB "hi"
+:blob
+.incbin "blob.bin"
+.incbin "blob.bin"
+mov rsi, blob
+`
+	c := New(src)
+	c.SetSourcePath(filepath.Join(dir, "prog.asm"))
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	// The contents appear verbatim, after the existing data, and
+	// the second copy is anonymous.
+	expected := append(append([]byte("hi"), blob...), blob...)
+	if !bytes.Equal(c.data, expected) {
+		t.Fatalf("unexpected data % x", c.data)
+	}
+
+	// The label refers to the first copy, rather than the code.
+	addr := uint64(c.dataAddress()) + 2
+	if c.Symbols()["blob"] != addr {
+		t.Fatalf("unexpected symbols %v", c.Symbols())
+	}
+	if binary.LittleEndian.Uint32(c.code[3:]) != uint32(addr) {
+		t.Fatalf("unexpected reference to the data % x", c.code)
+	}
+
+	// Without the source path the file isn't found, unless it is
+	// relative to the current directory.
+	c = New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "error reading .incbin file") {
+		t.Fatalf("expected error reading missing file, got %v", err)
+	}
+
+	// Absolute paths are used as-is.
+	c = New(".incbin \"" + filepath.Join(dir, "blob.bin") + "\"")
+	c.SetSourcePath("/nonexistent/prog.asm")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil || !bytes.Equal(c.data, blob) {
+		t.Fatalf("unexpected result embedding absolute path: %v % x", err, c.data)
+	}
+}
+
+func TestLargeAddress(t *testing.T) {
+
+	// Simulate a binary loaded at a large address
+	old := elfBase
+	defer func() { elfBase = old }()
+
+	type TestCase struct {
+		Base  int64
+		Arch  string
+		Input string
+	}
+
+	tests := []TestCase{
+		{Base: 0x80000000, Arch: "amd64", Input: ".msg DB 1\nmov rax, msg"},
+		{Base: 0x7fe00000, Arch: "amd64", Input: ".msg DB 1\nmov rax, msg"},
+		{Base: 0x80000000, Arch: "amd64", Input: ":here\npush here"},
+		{Base: 0xffe00000, Arch: "i386", Input: ".msg DB 1\nmov eax, msg"},
+	}
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		elfBase = test.Base
+
+		c := New(test.Input)
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		c.SetArch(test.Arch)
+		err := c.Compile()
+		if err == nil || !strings.Contains(err.Error(), "exceeds the 32-bit limit") {
+			t.Fatalf("expected address overflow compiling %s at %x, got %v", test.Input, test.Base, err)
+		}
+	}
+
+	// Addresses within the limit are fine on i386
+	elfBase = 0x80000000
+	c, _ := compile(t, ".msg DB 1\nmov eax, msg", "i386")
+	if binary.LittleEndian.Uint32(c.code[1:]) != 0x80000000+0x200000+0x1000 {
+		t.Fatalf("unexpected address % x", c.code)
+	}
+}
+
+func TestComputedLayout(t *testing.T) {
+
+	// The data addresses must match the binary which is generated,
+	// whatever the size of its headers and its load address.
+	old := elfBase
+	defer func() { elfBase = old }()
+
+	type TestCase struct {
+		Base  int64
+		Arch  string
+		Input string
+	}
+
+	tests := []TestCase{
+		{Base: 0, Arch: "amd64", Input: ".msg DB 1\nmov rax, msg"},
+		{Base: 0, Arch: "i386", Input: ".msg DB 1\nmov eax, msg"},
+		{Base: 0x800000, Arch: "amd64", Input: ".msg DB 1\nmov rax, msg"},
+		{Base: 0x800000, Arch: "i386", Input: ".msg DB 1\nmov eax, msg"},
+	}
+
+	for _, test := range tests {
+		elfBase = test.Base
+
+		c, path := compile(t, test.Input, test.Arch)
+
+		f, err := goelf.Open(path)
+		if err != nil {
+			t.Fatalf("failed to parse ELF: %s", err)
+		}
+
+		var code, data uint64
+		for _, p := range f.Progs {
+			if p.Flags&goelf.PF_W != 0 {
+				data = p.Vaddr
+			} else {
+				code = p.Vaddr
+			}
+		}
+		f.Close()
+
+		// The code follows the headers, which are mapped with it.
+		layout := c.newElf().Layout(uint64(len(c.code)), 1)
+		if f.Entry != code+layout.CodeOffset || uint64(c.codeAddress()) != f.Entry {
+			t.Fatalf("unexpected entry-point %x for %s", f.Entry, test.Arch)
+		}
+
+		// The address of msg is the start of the data segment.
+		addr := uint64(binary.LittleEndian.Uint32(c.code[len(c.code)-4:]))
+		if addr != data || uint64(c.dataAddress()) != data {
+			t.Fatalf("unexpected data address %x for %s, expected %x", addr, test.Arch, data)
+		}
+	}
+}
+
+func TestRegReg(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "add rax, rbx", Output: []byte{0x48, 0x01, 0xd8}},
+		{Input: "add r8, rax", Output: []byte{0x49, 0x01, 0xc0}},
+		{Input: "sub rax, r9", Output: []byte{0x4c, 0x29, 0xc8}},
+		{Input: "sub edi, esi", Output: []byte{0x29, 0xf7}},
+		{Input: "and r10, r11", Output: []byte{0x4d, 0x21, 0xda}},
+		{Input: "and cx, dx", Output: []byte{0x66, 0x21, 0xd1}},
+		{Input: "or ecx, edx", Output: []byte{0x09, 0xd1}},
+		{Input: "or rsp, r15", Output: []byte{0x4c, 0x09, 0xfc}},
+		{Input: "xor bx, si", Output: []byte{0x66, 0x31, 0xf3}},
+		{Input: "xor r12, r12", Output: []byte{0x4d, 0x31, 0xe4}},
+		{Input: "cmp rax, rbx", Output: []byte{0x48, 0x39, 0xd8}},
+		{Input: "cmp r15, rdi", Output: []byte{0x49, 0x39, 0xff}},
+		{Input: "test r12, rsp", Output: []byte{0x49, 0x85, 0xe4}},
+		{Input: "mov r13, rbp", Output: []byte{0x49, 0x89, 0xed}},
+		{Input: "mov eax, ebx", Output: []byte{0x89, 0xd8}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Each instruction uses the same encoding, differing only in
+	// the opcode.
+	c := New("")
+	for _, op := range []byte{0x01, 0x09, 0x21, 0x29, 0x31, 0x39, 0x85, 0x89} {
+		out, err := c.regRegEncode(op, "rdx", "r9")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(out.Bytes(), []byte{0x4c, op, 0xca}) {
+			t.Fatalf("unexpected encoding % x", out.Bytes())
+		}
+	}
+
+	// The registers must be the same size
+	for _, src := range []string{"add rax, ebx", "mov ax, r8", "cmp ecx, si"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestMovWidth(t *testing.T) {
+
+	// A 32-bit move omits the REX.W prefix, which a 64-bit move
+	// requires, otherwise the encodings are identical.
+	c32, _ := compile(t, "mov eax, ebx", "")
+	expectCode(t, c32, []byte{0x89, 0xd8})
+
+	c64, _ := compile(t, "mov rax, rbx", "")
+	expectCode(t, c64, []byte{0x48, 0x89, 0xd8})
+
+	if !bytes.Equal(c64.code[1:], c32.code) {
+		t.Fatalf("encodings differ by more than the prefix: % x, % x", c32.code, c64.code)
+	}
+
+	// 16-bit moves use the operand-size prefix instead
+	c16, _ := compile(t, "mov ax, bx", "")
+	expectCode(t, c16, []byte{0x66, 0x89, 0xd8})
+
+	// The prefix is never needed, or valid, upon i386
+	c, _ := compile(t, "mov eax, ebx", "i386")
+	expectCode(t, c, []byte{0x89, 0xd8})
+}
+
+func TestRel32(t *testing.T) {
+
+	type TestCase struct {
+		Offset int
+		Target int
+		Result int32
+		Error  bool
+	}
+
+	tests := []TestCase{
+		{Offset: 1, Target: 0, Result: -5},
+		{Offset: 1, Target: 10, Result: 5},
+		{Offset: 0, Target: 0x7fffffff + 4, Result: 0x7fffffff},
+		{Offset: 0, Target: 0x7fffffff + 5, Error: true},
+		{Offset: 0x80000000, Target: 4, Result: -0x80000000},
+		{Offset: 0x80000001, Target: 4, Error: true},
+	}
+
+	for _, test := range tests {
+		out, err := rel32(test.Offset, test.Target)
+		if test.Error {
+			if err == nil || err.Error() != "jump target too far" {
+				t.Fatalf("expected overflow from %x to %x, got %v", test.Offset, test.Target, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error from %x to %x: %s", test.Offset, test.Target, err)
+		}
+		if out != test.Result {
+			t.Fatalf("unexpected displacement from %x to %x: %d", test.Offset, test.Target, out)
+		}
+	}
+
+	// Calls must be to defined labels
+	c := New("call nowhere")
+	c.SetOutput(os.DevNull)
+	err := c.Compile()
+	if err == nil || err.Error() != `undefined symbol "nowhere"` {
+		t.Fatalf("expected undefined symbol, got %v", err)
+	}
+}
+
+func TestSystemRegisters(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, cr0", Output: []byte{0x0f, 0x20, 0xc0}},
+		{Input: "mov cr3, rax", Output: []byte{0x0f, 0x22, 0xd8}},
+		{Input: "mov r9, cr4", Output: []byte{0x41, 0x0f, 0x20, 0xe1}},
+		{Input: "mov dr7, rbx", Output: []byte{0x0f, 0x23, 0xfb}},
+		{Input: "mov rdx, dr6", Output: []byte{0x0f, 0x21, 0xf2}},
+		{Input: "mov eax, cr2", Arch: "i386", Output: []byte{0x0f, 0x20, 0xd0}},
+	}
+
+	for _, test := range tests {
+		c := New(test.Input)
+		c.SetOutput(filepath.Join(dir, "a.bin"))
+		c.SetFormat(Raw)
+		if test.Arch != "" {
+			c.SetArch(test.Arch)
+		}
+		err = c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", test.Input, err)
+		}
+		expectCode(t, c, test.Output)
+	}
+
+	// Errors
+	for _, src := range []string{"mov eax, cr0", "mov cr0, cr3", "mov cr0, [rax]", "add rax, cr0", "push cr0"} {
+		c := New(src)
+		c.SetOutput(filepath.Join(dir, "a.bin"))
+		c.SetFormat(Raw)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+
+	// The registers are only available for raw output
+	c := New("mov rax, cr0")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if c.Compile() == nil {
+		t.Fatalf("expected error using control register in ELF output")
+	}
+}
+
+func TestMovOpcodes(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	// Registers are stored via 0x89, and loaded via 0x8b, and a move
+	// between two registers is a store into the destination.
+	tests := []TestCase{
+		{Input: "mov rax, rbx", Output: []byte{0x48, 0x89, 0xd8}},
+		{Input: "mov ecx, edx", Output: []byte{0x89, 0xd1}},
+		{Input: "mov r8, rax", Output: []byte{0x49, 0x89, 0xc0}},
+		{Input: "mov rax, [rbx]", Output: []byte{0x48, 0x8b, 0x03}},
+		{Input: "mov [rbx], rax", Output: []byte{0x48, 0x89, 0x03}},
+		{Input: "mov r9, [rbx]", Output: []byte{0x4c, 0x8b, 0x0b}},
+		{Input: "mov [rbx], r9", Output: []byte{0x4c, 0x89, 0x0b}},
+		{Input: "mov rax, fs:[0x10]", Output: []byte{0x64, 0x48, 0x8b, 0x04, 0x25, 0x10, 0x00, 0x00, 0x00}},
+		{Input: "mov fs:[0x10], rax", Output: []byte{0x64, 0x48, 0x89, 0x04, 0x25, 0x10, 0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Data may be referred to by its absolute address, as well as
+	// relative to the instruction pointer.
+	c, _ := compile(t, ".msg DB 1\nmov rax, [msg]\nmov [msg], rcx\nmov [rel msg], rdx", "")
+	addr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(addr, uint32(c.dataAddress()))
+
+	expected := append([]byte{0x48, 0x8b, 0x04, 0x25}, addr...)
+	expected = append(expected, 0x48, 0x89, 0x0c, 0x25)
+	expected = append(expected, addr...)
+	expected = append(expected, 0x48, 0x89, 0x15)
+	if !bytes.HasPrefix(c.code, expected) {
+		t.Fatalf("unexpected code % x", c.code)
+	}
+
+	c, _ = compile(t, ".msg DB 1\nmov [msg], ebx", "i386")
+	binary.LittleEndian.PutUint32(addr, uint32(c.dataAddress()))
+	expectCode(t, c, append([]byte{0x89, 0x1d}, addr...))
+
+	// Only data may be referred to.
+	c = New("mov [foo], rax")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error referring to unknown data")
+	}
+}
+
+func TestMoffs(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	// rax is loaded from, and stored at, a bare numeric address via
+	// the moffs forms with a full 64-bit address.  Other registers,
+	// and addresses with an index or segment, use the ModRM forms.
+	tests := []TestCase{
+		{Input: "mov rax, [0x600000]", Output: []byte{0x48, 0xa1, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{Input: "mov [0x600000], rax", Output: []byte{0x48, 0xa3, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{Input: "mov rax, [-8]", Output: []byte{0x48, 0xa1, 0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "mov rbx, [0x600000]", Output: []byte{0x48, 0x8b, 0x1c, 0x25, 0x00, 0x00, 0x60, 0x00}},
+		{Input: "mov eax, [0x600000]", Output: []byte{0x8b, 0x04, 0x25, 0x00, 0x00, 0x60, 0x00}},
+		{Input: "mov rax, [0x10+rbx*2]", Output: []byte{0x48, 0x8b, 0x04, 0x5d, 0x10, 0x00, 0x00, 0x00}},
+		{Input: "mov eax, [0x600000]", Arch: "i386", Output: []byte{0x8b, 0x05, 0x00, 0x00, 0x60, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestLEA(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "lea rax, [rbx+rcx*8+16]", Output: []byte{0x48, 0x8d, 0x44, 0xcb, 0x10}},
+		{Input: "lea eax, [rbx+8]", Output: []byte{0x8d, 0x43, 0x08}},
+		{Input: "lea r12, [rsp-8]", Output: []byte{0x4c, 0x8d, 0x64, 0x24, 0xf8}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The displacement is relative to the end of the instruction,
+	// for both forms of RIP-relative reference.
+	for _, src := range []string{"nop\n.msg DB 1\nlea rsi, [rip+msg]", "nop\n.msg DB 1\nlea rsi, [rel msg]"} {
+		c, _ := compile(t, src, "")
+		if !bytes.Equal(c.code[:4], []byte{0x90, 0x48, 0x8d, 0x35}) || len(c.code) != 8 {
+			t.Fatalf("unexpected code % x", c.code)
+		}
+		disp := int32(binary.LittleEndian.Uint32(c.code[4:]))
+		if c.codeAddress()+int64(len(c.code))+int64(disp) != c.dataAddress() {
+			t.Fatalf("displacement %x doesn't refer to msg at %x", disp, c.dataAddress())
+		}
+	}
+
+	// The extended registers require REX.R
+	c, _ := compile(t, ".msg DB 1\nlea r9, [rip+msg]", "")
+	if !bytes.HasPrefix(c.code, []byte{0x4c, 0x8d, 0x0d}) {
+		t.Fatalf("unexpected code % x", c.code)
+	}
+
+	// There is no RIP-relative addressing upon i386, so the address
+	// is absolute.
+	c, _ = compile(t, ".msg DB 1\nlea esi, [rip+msg]", "i386")
+	addr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(addr, uint32(c.dataAddress()))
+	expectCode(t, c, append([]byte{0x8d, 0x35}, addr...))
+
+	for _, src := range []string{"lea rax, rbx", "lea rax, [rip+nope]", "lea [rax], rbx", "lea al, [rax]"} {
+		c = New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestSIB(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, [rbx+rcx*4]", Output: []byte{0x48, 0x8b, 0x04, 0x8b}},
+		{Input: "mov rax, [rax+rdx*8+16]", Output: []byte{0x48, 0x8b, 0x44, 0xd0, 0x10}},
+		{Input: "mov rax, [rbx+0x1000]", Output: []byte{0x48, 0x8b, 0x83, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "mov rax, [rbp+rcx]", Output: []byte{0x48, 0x8b, 0x44, 0x0d, 0x00}},
+		{Input: "mov rax, [r12]", Output: []byte{0x49, 0x8b, 0x04, 0x24}},
+		{Input: "mov r9, [r8+r15*2-4]", Output: []byte{0x4f, 0x8b, 0x4c, 0x78, 0xfc}},
+		{Input: "mov rax, [ebx+ecx*2]", Output: []byte{0x67, 0x48, 0x8b, 0x04, 0x4b}},
+		{Input: "mov [rsp+8], rdi", Output: []byte{0x48, 0x89, 0x7c, 0x24, 0x08}},
+		{Input: "mov eax, [ebx+ecx*4+8]", Arch: "i386", Output: []byte{0x8b, 0x44, 0x8b, 0x08}},
+
+		// Index-only forms have a 32-bit displacement, and no base
+		{Input: "mov rax, [rcx*8]", Output: []byte{0x48, 0x8b, 0x04, 0xcd, 0x00, 0x00, 0x00, 0x00}},
+		{Input: "mov eax, [rcx*4+0x100]", Output: []byte{0x8b, 0x04, 0x8d, 0x00, 0x01, 0x00, 0x00}},
+		{Input: "mov eax, [ecx*2]", Arch: "i386", Output: []byte{0x8b, 0x04, 0x4d, 0x00, 0x00, 0x00, 0x00}},
+
+		// Other instructions with memory operands
+		{Input: "movsd xmm1, [rbx+rcx*8]", Output: []byte{0xf2, 0x0f, 0x10, 0x0c, 0xcb}},
+		{Input: "movsd xmm9, [r10]", Output: []byte{0xf2, 0x45, 0x0f, 0x10, 0x0a}},
+		{Input: "add qword [rbx+8], 1", Output: []byte{0x48, 0x83, 0x43, 0x08, 0x01}},
+		{Input: "cmp byte [rax+rcx], 0x10", Output: []byte{0x80, 0x3c, 0x08, 0x10}},
+		{Input: "inc dword [rdi+rsi*4]", Output: []byte{0xff, 0x04, 0xb7}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, src := range []string{
+		"mov rax, [rsp*2]",
+		"mov rax, [rbx+ecx]",
+		"mov rax, [bx+si]",
+		"mov rax, [rbx+0x100000000]",
+		"push [rax+8]",
+	} {
+		c := New(src)
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestTwoPass(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	nops := strings.Repeat("nop\n", 200)
+	long := func(prefix []byte, suffix ...byte) []byte {
+		out := append([]byte{}, prefix...)
+		out = append(out, bytes.Repeat([]byte{0x90}, 200)...)
+		return append(out, suffix...)
+	}
+
+	tests := []TestCase{
+		// A near forward target uses the two-byte form
+		{Input: "cmp rax, 1\nje done\nnop\n:done\nret",
+			Output: []byte{0x48, 0x83, 0xf8, 0x01, 0x74, 0x01, 0x90, 0xc3}},
+		{Input: ":top\nnop\njmp top\njne next\nnop\n:next\nret",
+			Output: []byte{0x90, 0xeb, 0xfd, 0x75, 0x01, 0x90, 0xc3}},
+
+		// Distant targets use the long form, in either direction
+		{Input: "je far\n" + nops + ":far\nret",
+			Output: long([]byte{0x0f, 0x84, 0xc8, 0x00, 0x00, 0x00}, 0xc3)},
+		{Input: "jmp far\n" + nops + ":far\nret",
+			Output: long([]byte{0xe9, 0xc8, 0x00, 0x00, 0x00}, 0xc3)},
+		{Input: ":top\n" + nops + "jne top\nret",
+			Output: long(nil, 0x0f, 0x85, 0x32, 0xff, 0xff, 0xff, 0xc3)},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "assembler")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		c := New(test.Input)
+		c.SetTwoPass(true)
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		err = c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", test.Input, err)
+		}
+		expectCode(t, c, test.Output)
+	}
+
+	// Errors are still reported by the second pass
+	c := New("je nowhere")
+	c.SetTwoPass(true)
+	c.SetOutput(os.DevNull)
+	err := c.Compile()
+	if err == nil || err.Error() != `undefined symbol "nowhere"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDataLength(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: ".msg DB \"hello\"\nmov rdx, msg.len", Output: []byte{0x48, 0xc7, 0xc2, 0x05, 0x00, 0x00, 0x00}},
+		{Input: ".msg DB \"hello\"\nmov rdx, msg.len - 1", Output: []byte{0x48, 0xc7, 0xc2, 0x04, 0x00, 0x00, 0x00}},
+		{Input: ".msg DB \"hello\"\nmov rdx, msg.len-1", Output: []byte{0x48, 0xc7, 0xc2, 0x04, 0x00, 0x00, 0x00}},
+		{Input: ".tbl DQ 1, 2, 3\ncmp rcx, tbl.len", Output: []byte{0x48, 0x83, 0xf9, 0x18}},
+		{Input: "section .bss\n.buf DB 300 dup 0\nsub rsp, buf.len", Output: []byte{0x48, 0x81, 0xec, 0x2c, 0x01, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The length is loaded when the program runs
+	c, path := compile(t, `.msg DB "hello"
+        mov rdi, msg.len
+        mov rax, 60
+        syscall`, "")
+	if binary.LittleEndian.Uint32(c.code[3:]) != 5 {
+		t.Fatalf("unexpected code % x", c.code)
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		err := exec.Command(path).Run()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 5 {
+			t.Fatalf("unexpected result running binary: %v", err)
+		}
+	}
+
+	// Unknown data has no length
+	c = New("mov rdx, nope.len")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error with an unknown length")
+	}
+}
+
+func TestSet(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "sete al", Output: []byte{0x0f, 0x94, 0xc0}},
+		{Input: "setz al", Output: []byte{0x0f, 0x94, 0xc0}},
+		{Input: "setne bl", Output: []byte{0x0f, 0x95, 0xc3}},
+		{Input: "setl cl", Output: []byte{0x0f, 0x9c, 0xc1}},
+		{Input: "setge ah", Output: []byte{0x0f, 0x9d, 0xc4}},
+		{Input: "seta dl", Output: []byte{0x0f, 0x97, 0xc2}},
+		{Input: "setbe dh", Output: []byte{0x0f, 0x96, 0xc6}},
+		{Input: "sete byte [rax]", Output: []byte{0x0f, 0x94, 0x00}},
+		{Input: "setg [rbx+8]", Output: []byte{0x0f, 0x9f, 0x43, 0x08}},
+		{Input: "sete al", Arch: "i386", Output: []byte{0x0f, 0x94, 0xc0}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// Only a byte may be set
+	for _, src := range []string{"sete rax", "sete eax", "sete dword [rax]", "sete 1"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+// TestSetIdiom ensures that `xor eax, eax` followed by `sete al` leaves
+// a clean 0, or 1, in the whole of rax.
+func TestSetIdiom(t *testing.T) {
+
+	src := `mov rax, -1
+        mov rbx, VALUE
+        xor eax, eax
+        cmp rbx, 5
+        sete al
+        mov rdi, rax
+        mov rax, 60
+        syscall`
+
+	// Each piece of the idiom encodes as expected.
+	c := New("")
+	for _, test := range []struct {
+		Input    string
+		Expected Encoding
+	}{
+		{Input: "xor eax, eax", Expected: Encoding{Opcode: []byte{0x31}, ModRM: []byte{0xc0}}},
+		{Input: "cmp rbx, 5", Expected: Encoding{REX: 0x48, Opcode: []byte{0x83}, ModRM: []byte{0xfb}, Immediate: []byte{0x05}}},
+		{Input: "sete al", Expected: Encoding{Opcode: []byte{0x0f, 0x94}, ModRM: []byte{0xc0}}},
+	} {
+		enc, err := c.EncodeInstruction(parseInstruction(t, test.Input))
+		if err != nil {
+			t.Fatalf("failed to encode %s: %s", test.Input, err)
+		}
+		if !reflect.DeepEqual(enc, test.Expected) {
+			t.Fatalf("%s: unexpected encoding %+v", test.Input, enc)
+		}
+	}
+
+	// The upper bytes of rax are cleared, so the exit status is the
+	// result of the comparison.
+	for value, expected := range map[int]int{5: 1, 6: 0} {
+		c, path := compile(t, strings.Replace(src, "VALUE", fmt.Sprintf("%d", value), 1), "")
+		if !bytes.Contains(c.code, []byte{0x31, 0xc0, 0x48, 0x83, 0xfb, 0x05, 0x0f, 0x94, 0xc0}) {
+			t.Fatalf("unexpected code % x", c.code)
+		}
+
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			continue
+		}
+		err := exec.Command(path).Run()
+		status := 0
+		if e, ok := err.(*exec.ExitError); ok {
+			status = e.ExitCode()
+		} else if err != nil {
+			t.Fatalf("failed to run binary: %s", err)
+		}
+		if status != expected {
+			t.Fatalf("comparing %d gave %d, expected %d", value, status, expected)
+		}
+	}
+}
+
+func TestHotpatch(t *testing.T) {
+
+	src := `:start
+        call handler
+        mov edi, eax
+        mov eax, 60
+        syscall
+:handler
+.hotpatch
+        mov eax, 42
+        ret`
+
+	for _, arch := range []string{"amd64", "i386"} {
+		c, path := compile(t, src, arch)
+
+		// The function is aligned, and preceded by no-ops.
+		handler := c.labels["handler"]
+		if handler%16 != 0 || handler < 5 ||
+			!bytes.Equal(c.code[handler-5:handler], bytes.Repeat([]byte{0x90}, 5)) {
+			t.Fatalf("%s: unexpected padding before %d, code % x", arch, handler, c.code)
+		}
+
+		// The two-byte no-op precedes the first instruction of
+		// the function.
+		expected := []byte{0x66, 0x90, 0xb8}
+		if arch == "i386" {
+			expected = []byte{0x8b, 0xff, 0xb8}
+		}
+		if !bytes.Equal(c.code[handler:handler+3], expected) {
+			t.Fatalf("%s: unexpected code at %d, code % x", arch, handler, c.code)
+		}
+
+		if arch != "amd64" {
+			continue
+		}
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			continue
+		}
+		err := exec.Command(path).Run()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+			t.Fatalf("unexpected result running binary: %v", err)
+		}
+	}
+
+	// The padding may grow when jumps are shortened, by the second
+	// pass, so the first pass must allow for that.
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for n := 90; n < 130; n++ {
+		src := "jmp top\n:top\njmp done\n:handler\n.hotpatch\n" + strings.Repeat("nop\n", n) + ":done\nret"
+		c := New(src)
+		c.SetTwoPass(true)
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		err = c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile with %d no-ops: %s", n, err)
+		}
+		if c.labels["handler"]%16 != 0 {
+			t.Fatalf("unexpected code % x", c.code)
+		}
+	}
+
+	// The directive must follow a label
+	c := New("nop\n.hotpatch\nret")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error without a label")
+	}
+}
+
+func TestStackPointer(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	// rsp, and rbp, need no SIB byte, or displacement, when they're
+	// used directly rather than to address memory.
+	tests := []TestCase{
+		{Input: "add rsp, 8", Output: []byte{0x48, 0x83, 0xc4, 0x08}},
+		{Input: "sub rsp, 16", Output: []byte{0x48, 0x83, 0xec, 0x10}},
+		{Input: "add rsp, 0x1000", Output: []byte{0x48, 0x81, 0xc4, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "add rbp, 16", Output: []byte{0x48, 0x83, 0xc5, 0x10}},
+		{Input: "mov rbp, rsp", Output: []byte{0x48, 0x89, 0xe5}},
+		{Input: "mov rsp, rbp", Output: []byte{0x48, 0x89, 0xec}},
+		{Input: "mov rsp, rax", Output: []byte{0x48, 0x89, 0xc4}},
+		{Input: "cmp rsp, rbp", Output: []byte{0x48, 0x39, 0xec}},
+		{Input: "inc rsp", Output: []byte{0x48, 0xff, 0xc4}},
+		{Input: "xor ebp, ebp", Output: []byte{0x31, 0xed}},
+		{Input: "mov ebp, esp", Arch: "i386", Output: []byte{0x89, 0xe5}},
+		{Input: "sub esp, 16", Arch: "i386", Output: []byte{0x83, 0xec, 0x10}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestDisplacement(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		// No displacement, mod=00
+		{Input: "mov rax, [rbx]", Output: []byte{0x48, 0x8b, 0x03}},
+		{Input: "mov rax, [rbx+0]", Output: []byte{0x48, 0x8b, 0x03}},
+		{Input: "mov rax, [r12]", Output: []byte{0x49, 0x8b, 0x04, 0x24}},
+
+		// rbp, and r13, require a zero displacement, mod=01
+		{Input: "mov rax, [rbp]", Output: []byte{0x48, 0x8b, 0x45, 0x00}},
+		{Input: "mov rax, [r13]", Output: []byte{0x49, 0x8b, 0x45, 0x00}},
+		{Input: "mov rax, [r13+rcx]", Output: []byte{0x49, 0x8b, 0x44, 0x0d, 0x00}},
+		{Input: "mov eax, [ebp]", Arch: "i386", Output: []byte{0x8b, 0x45, 0x00}},
+
+		// Signed 8-bit displacements, mod=01
+		{Input: "mov rax, [rbx+127]", Output: []byte{0x48, 0x8b, 0x43, 0x7f}},
+		{Input: "mov rax, [rbx-128]", Output: []byte{0x48, 0x8b, 0x43, 0x80}},
+		{Input: "mov rax, [rbp-8]", Output: []byte{0x48, 0x8b, 0x45, 0xf8}},
+		{Input: "mov rax, [rsp+8]", Output: []byte{0x48, 0x8b, 0x44, 0x24, 0x08}},
+
+		// 32-bit displacements, mod=10
+		{Input: "mov rax, [rbx+128]", Output: []byte{0x48, 0x8b, 0x83, 0x80, 0x00, 0x00, 0x00}},
+		{Input: "mov rax, [rbx-129]", Output: []byte{0x48, 0x8b, 0x83, 0x7f, 0xff, 0xff, 0xff}},
+		{Input: "mov rax, [rbp+0x7fffffff]", Output: []byte{0x48, 0x8b, 0x85, 0xff, 0xff, 0xff, 0x7f}},
+		{Input: "mov rax, [rbx-0x80000000]", Output: []byte{0x48, 0x8b, 0x83, 0x00, 0x00, 0x00, 0x80}},
+
+		// Upon i386 the address space wraps
+		{Input: "mov eax, [ebx+0x80000000]", Arch: "i386", Output: []byte{0x8b, 0x83, 0x00, 0x00, 0x00, 0x80}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// The displacement is sign-extended upon amd64
+	c := New("mov rax, [rbx+0x80000000]")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected error with a displacement which isn't sign-extended")
+	}
+}
+
+func TestSegment(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, fs:[0x10]", Output: []byte{0x64, 0x48, 0x8b, 0x04, 0x25, 0x10, 0x00, 0x00, 0x00}},
+		{Input: "mov gs:[0x28], rcx", Output: []byte{0x65, 0x48, 0x89, 0x0c, 0x25, 0x28, 0x00, 0x00, 0x00}},
+		{Input: "mov rdx, fs:[rax]", Output: []byte{0x64, 0x48, 0x8b, 0x10}},
+		{Input: "mov ebx, [0x1000]", Output: []byte{0x8b, 0x1c, 0x25, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "mov r8, fs:[0]", Output: []byte{0x64, 0x4c, 0x8b, 0x04, 0x25, 0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Upon i386 no SIB byte is required
+	c, _ := compile(t, "mov eax, gs:[0x14]", "i386")
+	expectCode(t, c, []byte{0x65, 0x8b, 0x05, 0x14, 0x00, 0x00, 0x00})
+
+	// Addresses must fit in 32 bits
+	for _, src := range []string{"mov rax, fs:[0x100000000]", "mov al, fs:[0]"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestCompileAll(t *testing.T) {
+
+	// 50 bad instructions
+	src := strings.Repeat("nop\nmov eax, rbx\n", 50)
+
+	// By default we stop after 20 errors
+	c := New(src)
+	c.SetOutput(os.DevNull)
+	errs := c.CompileAll()
+	if len(errs) != 21 {
+		t.Fatalf("expected 21 errors, got %d", len(errs))
+	}
+	if errs[0].Error() != "register size mismatch: eax, rbx" {
+		t.Fatalf("unexpected error %s", errs[0])
+	}
+	if errs[20].Error() != "...and more errors" {
+		t.Fatalf("expected truncation note, got %s", errs[20])
+	}
+
+	// The limit may be changed
+	c = New(src)
+	c.SetOutput(os.DevNull)
+	c.SetMaxErrors(5)
+	if errs = c.CompileAll(); len(errs) != 6 {
+		t.Fatalf("expected 6 errors, got %d", len(errs))
+	}
+
+	// Or removed
+	c = New(src)
+	c.SetOutput(os.DevNull)
+	c.SetMaxErrors(0)
+	if errs = c.CompileAll(); len(errs) != 50 {
+		t.Fatalf("expected 50 errors, got %d", len(errs))
+	}
+
+	// Parser errors end the collection
+	c = New("mov eax, rbx\nmov eax, rbx\nfoo\nmov eax, rbx")
+	c.SetOutput(os.DevNull)
+	if errs = c.CompileAll(); len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %d", len(errs))
+	}
+
+	// Compile still stops at the first error
+	c = New(src)
+	c.SetOutput(os.DevNull)
+	if err := c.Compile(); err == nil || err.Error() != "register size mismatch: eax, rbx" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// A valid program has no errors
+	_, path := compile(t, "nop", "")
+	c = New("nop")
+	c.SetOutput(path)
+	if errs = c.CompileAll(); errs != nil {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestStdout(t *testing.T) {
+
+	for _, format := range []Format{ELF, Raw, IntelHex, PE, MachO} {
+		var out bytes.Buffer
+
+		c := New(".msg DB \"hi\"\nmov rax, msg\nret")
+		c.SetOutput("-")
+		c.SetFormat(format)
+		c.SetStdout(&out)
+		err := c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile: %s", err)
+		}
+
+		expected, err := c.build(format)
+		if err != nil {
+			t.Fatalf("failed to build output: %s", err)
+		}
+		if out.Len() == 0 || !bytes.Equal(out.Bytes(), expected) {
+			t.Fatalf("unexpected output for format %d: % x", format, out.Bytes())
+		}
+	}
+
+	// The ELF binary was written to our writer
+	var out bytes.Buffer
+	c := New("nop")
+	c.SetOutput("-")
+	c.SetStdout(&out)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte("\x7fELF")) {
+		t.Fatalf("output doesn't look like an ELF binary")
+	}
+
+	// No file should have been created
+	if _, err := os.Stat("-"); !os.IsNotExist(err) {
+		os.Remove("-")
+		t.Fatalf("file named '-' was created")
+	}
+}
+
+// failingWriter is an io.Writer which always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestListingJSON(t *testing.T) {
+
+	src := `.msg DB "hi"
+:start
+        mov rax, msg
+        rep stosb
+        jmp start
+        ret`
+
+	var listing bytes.Buffer
+
+	c := New(src)
+	c.SetFormat(Raw)
+	c.SetOutput("-")
+	c.SetStdout(ioutil.Discard)
+	c.SetListingJSON(&listing)
+	err := c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	var entries []ListingEntry
+	err = json.Unmarshal(listing.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("failed to decode listing %s: %s", listing.String(), err)
+	}
+
+	// The bytes include the resolved address of the data.
+	expected := []ListingEntry{
+		{Line: 3, Offset: 0, Mnemonic: "mov", Operands: []string{"rax", "msg"}, Bytes: "48c7c00c000000"},
+		{Line: 4, Offset: 7, Mnemonic: "rep stosb", Operands: []string{}, Bytes: "f3aa"},
+		{Line: 5, Offset: 9, Mnemonic: "jmp", Operands: []string{"start"}, Bytes: "ebf5"},
+		{Line: 6, Offset: 11, Mnemonic: "ret", Operands: []string{}, Bytes: "c3"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("unexpected listing %+v", entries)
+	}
+
+	// Errors writing the listing are reported
+	c = New(src)
+	c.SetFormat(Raw)
+	c.SetOutput("-")
+	c.SetStdout(ioutil.Discard)
+	c.SetListingJSON(failingWriter{})
+	err = c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "error writing listing") {
+		t.Fatalf("expected error writing listing, got %v", err)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+
+	src := `.msg DB "hi"
+:start
+        nop
+        nop
+:end
+        ret`
+
+	c, _ := compile(t, src, "")
+
+	// The data is loaded upon its own page
+	base := uint64(0x400000 + elf.New().HeaderSize())
+	expected := map[string]uint64{
+		"start": base,
+		"end":   base + 2,
+		"msg":   0x601000,
+	}
+
+	symbols := c.Symbols()
+	if len(symbols) != len(expected) {
+		t.Fatalf("unexpected symbols %v", symbols)
+	}
+	for name, addr := range expected {
+		if symbols[name] != addr {
+			t.Fatalf("symbol %s has address %x, expected %x", name, symbols[name], addr)
+		}
+	}
+}
+
+func TestEntryAddress(t *testing.T) {
+
+	c, path := compile(t, ".msg DB 1\nmov rax, msg\nret", "")
+
+	// The code follows the headers
+	expected := uint64(0x400000 + elf.New().HeaderSize())
+	if c.EntryAddress() != expected {
+		t.Fatalf("unexpected entry-point %x, expected %x", c.EntryAddress(), expected)
+	}
+
+	f, err := goelf.Open(path)
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	defer f.Close()
+	if f.Entry != expected {
+		t.Fatalf("e_entry is %x, expected %x", f.Entry, expected)
+	}
+
+	// i386 has smaller headers
+	c, _ = compile(t, "ret", "i386")
+	e := elf.New()
+	e.SetClass(32)
+	if c.EntryAddress() != uint64(0x400000+e.HeaderSize()) {
+		t.Fatalf("unexpected i386 entry-point %x", c.EntryAddress())
+	}
+
+	// Raw output is loaded at zero
+	c = New("nop")
+	c.SetFormat(Raw)
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil || c.EntryAddress() != 0 {
+		t.Fatalf("unexpected raw entry-point %x, %v", c.EntryAddress(), err)
+	}
+}
+
+func TestDataReferences(t *testing.T) {
+
+	src := `.table DQ handler0, handler1, handler2
+.count DQ COUNT, table
+:handler0
+        nop
+:handler1
+        nop
+        nop
+:handler2
+        ret`
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(src)
+	c.Define("COUNT", 3)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	base := uint64(0x400000 + elf.New().HeaderSize())
+	expected := []uint64{base, base + 1, base + 3, 3, 0x601000}
+	if len(c.data) != len(expected)*8 {
+		t.Fatalf("unexpected data % x", c.data)
+	}
+	for n, val := range expected {
+		got := binary.LittleEndian.Uint64(c.data[n*8:])
+		if got != val {
+			t.Fatalf("value %d mismatch, expected %x, got %x", n, val, got)
+		}
+	}
+
+	// Unknown names are errors
+	c = New(".table DQ handler\n:handle\nret")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "did you mean handle?") {
+		t.Fatalf("expected error for an undefined label, got %v", err)
+	}
+}
+
+func TestDebug(t *testing.T) {
+
+	src := `.msg DB "hi"
+:start
+        nop
+
+        mov rax, 1   ; comment
+        ret`
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(src)
+	c.SetDebug("test.asm")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	expected := []elf.Line{{Offset: 0, Line: 3}, {Offset: 1, Line: 5}, {Offset: 8, Line: 6}}
+	if len(c.lines) != len(expected) {
+		t.Fatalf("unexpected lines %v", c.lines)
+	}
+	for i, l := range expected {
+		if c.lines[i] != l {
+			t.Fatalf("unexpected line %v, expected %v", c.lines[i], l)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a.out"))
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if !bytes.Contains(data, []byte(".debug_line")) || !bytes.Contains(data, []byte("test.asm")) {
+		t.Fatalf("missing debugging information")
+	}
+}
+
+func TestCodeAlignment(t *testing.T) {
+
+	src := `.msg DB 42
+        mov rax, msg
+        mov rdi, [rax]
+        and rdi, 0xff
+        mov rax, 60
+        syscall`
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	c := New(src)
+	for _, n := range []int{-1, 3, 0x400000} {
+		if c.SetCodeAlignment(n) == nil {
+			t.Fatalf("expected error with alignment %d", n)
+		}
+	}
+	err = c.SetCodeAlignment(0x1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	// The code is page-aligned, in the file and in memory.
+	if c.EntryAddress() != 0x401000 {
+		t.Fatalf("unexpected entry-point %x", c.EntryAddress())
+	}
+	f, err := goelf.Open(path)
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	defer f.Close()
+	if f.Entry != 0x401000 {
+		t.Fatalf("unexpected e_entry %x", f.Entry)
+	}
+
+	// The reference to the data follows it.
+	msg := c.Symbols()["msg"]
+	if msg != 0x602000 || binary.LittleEndian.Uint32(c.code[3:]) != uint32(msg) {
+		t.Fatalf("unexpected address of msg %x, code % x", msg, c.code)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+	err = exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestShared(t *testing.T) {
+
+	src := `.msg DB 42
+:answer
+        lea rsi, [rel msg]
+        mov eax, 42
+        ret`
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "libanswer.so")
+
+	c := New(src)
+	c.SetShared("answer")
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	f, err := goelf.Open(path)
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	defer f.Close()
+	if f.Type != goelf.ET_DYN {
+		t.Fatalf("expected a shared object, got %v", f.Type)
+	}
+
+	// The function is exported, at the address of the label.
+	symbols, err := f.DynamicSymbols()
+	if err != nil {
+		t.Fatalf("failed to read the dynamic symbols: %s", err)
+	}
+	answer := c.Symbols()["answer"]
+	if len(symbols) != 1 || symbols[0].Name != "answer" || symbols[0].Value != answer {
+		t.Fatalf("unexpected dynamic symbols %v, expected answer at %x", symbols, answer)
+	}
+
+	// The data is referred to relative to the code.
+	msg := c.Symbols()["msg"]
+	if int64(binary.LittleEndian.Uint32(c.code[3:])) != int64(msg)-int64(answer+7) {
+		t.Fatalf("unexpected reference to msg at %x, code % x", msg, c.code)
+	}
+
+	// Absolute addresses, undefined labels, and i386, are errors.
+	for _, test := range []struct {
+		Input string
+		Arch  string
+	}{
+		{Input: ".msg DB 1\n:answer\nmov rax, msg"},
+		{Input: ":answer\nmov rax, answer"},
+		{Input: ".ptr DQ answer\n:answer\nret"},
+		{Input: ":other\nret"},
+		{Input: ":answer\nret", Arch: "i386"},
+	} {
+		c := New(test.Input)
+		c.SetShared("answer")
+		if test.Arch != "" {
+			c.SetArch(test.Arch)
+		}
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %q", test.Input)
+		}
+	}
+}
+
+func TestBuildID(t *testing.T) {
+
+	src := `.msg DB 42
+        mov rax, msg
+        mov rdi, [rax]
+        and rdi, 0xff
+        mov rax, 60
+        syscall`
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	c := New(src)
+	c.SetEmitBuildID(true)
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	f, err := goelf.Open(path)
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	defer f.Close()
+
+	notes := 0
+	for _, p := range f.Progs {
+		if p.Type == goelf.PT_NOTE {
+			notes++
+		}
+	}
+	if notes != 1 {
+		t.Fatalf("expected a single PT_NOTE segment, found %d", notes)
+	}
+	if f.Entry != uint64(c.codeAddress()) {
+		t.Fatalf("unexpected entry-point %x, expected %x", f.Entry, c.codeAddress())
+	}
+
+	s := f.Section(".note.gnu.build-id")
+	if s == nil || s.Type != goelf.SHT_NOTE {
+		t.Fatalf("missing build-id section")
+	}
+	note, err := s.Data()
+	if err != nil {
+		t.Fatalf("failed to read build-id: %s", err)
+	}
+
+	// The note header, the owner, and the hash of the code and data.
+	hash := sha1.Sum(append(append([]byte{}, c.code...), c.data...))
+	expected := append([]byte{4, 0, 0, 0, 20, 0, 0, 0, 3, 0, 0, 0, 'G', 'N', 'U', 0}, hash[:]...)
+	if !bytes.Equal(note, expected) {
+		t.Fatalf("unexpected build-id note % x, expected % x", note, expected)
+	}
+
+	s = f.Section(".note.assembler")
+	if s == nil {
+		t.Fatalf("missing version section")
+	}
+	note, err = s.Data()
+	if err != nil || !bytes.Contains(note, []byte(Version+"\x00")) {
+		t.Fatalf("missing version in note % x", note)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// The notes move the code, and data, which must still be found.
+	err = exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+
+	src := `
+.msg DB "hello"
+.unused DB 1
+section .bss
+.spare DB 8 dup 0
+section .text
+:start
+mov rax, msg
+:loop
+mov rbx, 0
+push 1
+push 0x1000
+jmp loop
+`
+	c, _ := compile(t, src, "")
+
+	expected := []string{
+		"line 10: mov rbx, 0 could be the shorter xor rbx, rbx, if the flags may be changed",
+		"line 11: push 1 uses a 32-bit immediate, although the value fits in a byte",
+		"label start is never referenced",
+		"data spare is never referenced",
+		"data unused is never referenced",
+	}
+	if !reflect.DeepEqual(c.Warnings(), expected) {
+		t.Fatalf("unexpected warnings:\n%s", strings.Join(c.Warnings(), "\n"))
+	}
+
+	// A clean program has no warnings.
+	c, _ = compile(t, ".msg DB 1\n:top\nmov rax, msg\njmp top", "")
+	if len(c.Warnings()) != 0 {
+		t.Fatalf("unexpected warnings %v", c.Warnings())
+	}
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+	src := ":unused\nnop\nret"
+
+	// Without the option the warning is only recorded.
+	c := New(src)
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil || len(c.Warnings()) != 1 {
+		t.Fatalf("unexpected result %v, warnings %v", err, c.Warnings())
+	}
+	os.Remove(path)
+
+	// With it the build fails, and no output is written.
+	c = New(src)
+	c.SetWarningsAsErrors(true)
+	c.SetOutput(path)
+	err = c.Compile()
+	if err == nil || err.Error() != "warning treated as an error: label unused is never referenced" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Warnings()) != 1 {
+		t.Fatalf("unexpected warnings %v", c.Warnings())
+	}
+	if _, err = os.Stat(path); err == nil {
+		t.Fatalf("output was written despite the warning")
+	}
+
+	// A program without warnings is unaffected.
+	c = New(":top\nnop\njmp top")
+	c.SetWarningsAsErrors(true)
+	c.SetOutput(path)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestParseOnly(t *testing.T) {
+
+	src := `
+.msg DB "hello"
+:start
+%ifdef DEBUG
+int 3
+%endif
+mov rax, msg
+section .bss
+.buf DB 8 dup 0
+`
+	nodes, errs := ParseOnly(src)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	expected := []string{"parser.Data", "parser.Label", "parser.Instruction", "parser.Section", "parser.Data"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	for n, node := range nodes {
+		if reflect.TypeOf(node).String() != expected[n] {
+			t.Fatalf("unexpected node %d, expected %s got %v", n, expected[n], node)
+		}
+	}
+
+	// The nodes preceding an error are returned, with the error.
+	nodes, errs = ParseOnly("nop\nnop\nmov rax, 3 +")
+	if len(nodes) != 2 || len(errs) != 1 {
+		t.Fatalf("unexpected result %v %v", nodes, errs)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "error compiling - line 3, column") {
+		t.Fatalf("unexpected error %s", errs[0])
+	}
+
+	// As are preprocessor errors.
+	_, errs = ParseOnly("%ifdef FOO\nnop")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "error preprocessing") {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestAssembleRange(t *testing.T) {
+
+	src := `.msg DB "hi"
+:main
+        call double
+        mov rsi, msg
+        ret
+:double
+        add rax, rax
+        jmp done
+:done
+        ret
+:next
+        call main`
+
+	code, err := AssembleRange(src, "double", "next")
+	if err != nil {
+		t.Fatalf("failed to assemble range: %s", err)
+	}
+	expected := []byte{
+		0x48, 0x01, 0xc0, // add rax, rax
+		0xeb, 0x00, // jmp done
+		0xc3, // ret
+	}
+	if !bytes.Equal(code, expected) {
+		t.Fatalf("unexpected code, expected % x, got % x", expected, code)
+	}
+
+	// Without an end label we continue to the end of the program
+	code, err = AssembleRange("nop\n:start\nmov rax, start\nret", "start", "")
+	if err != nil {
+		t.Fatalf("failed to assemble range: %s", err)
+	}
+	expected = []byte{0x48, 0xc7, 0xc0, 0x00, 0x00, 0x00, 0x00, 0xc3}
+	if !bytes.Equal(code, expected) {
+		t.Fatalf("unexpected code, expected % x, got % x", expected, code)
+	}
+
+	// An offset from a label is kept
+	code, err = AssembleRange("nop\n:f\nmov rax, f+4\nret", "f", "")
+	if err != nil {
+		t.Fatalf("failed to assemble range: %s", err)
+	}
+	expected = []byte{0x48, 0xc7, 0xc0, 0x04, 0x00, 0x00, 0x00, 0xc3}
+	if !bytes.Equal(code, expected) {
+		t.Fatalf("unexpected code, expected % x, got % x", expected, code)
+	}
+
+	// References outside the range, or to data, are errors
+	for _, r := range [][2]string{{"main", "double"}, {"next", ""}, {"missing", ""}, {"next", "main"}} {
+		_, err = AssembleRange(src, r[0], r[1])
+		if err == nil {
+			t.Fatalf("expected error assembling %s-%s", r[0], r[1])
+		}
+	}
+}
+
+func TestRepeat(t *testing.T) {
+
+	c, _ := compile(t, "rep stosb\nrepne scasb\nrep movsq", "")
+	expectCode(t, c, []byte{0xf3, 0xaa, 0xf2, 0xae, 0xf3, 0x48, 0xa5})
+
+	// As is the return idiom
+	c, _ = compile(t, "rep ret\nrepz ret 8", "")
+	expectCode(t, c, []byte{0xf3, 0xc3, 0xf3, 0xc2, 0x08, 0x00})
+
+	// Prefixes are only valid with the appropriate instructions
+	for _, src := range []string{"rep scasb", "repe movsb", "rep nop"} {
+		c = New(src)
+		c.SetOutput(filepath.Join(os.TempDir(), "unused"))
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+
+	// The classic memory-copy idiom.
+	src := `
+.src DB 42, 0, 0, 0, 0, 0, 0, 0
+.dst DB 0, 0, 0, 0, 0, 0, 0, 0
+        mov rsi, src
+        mov rdi, dst
+        mov rcx, 8
+        cld
+        rep movsb
+        mov rbx, [rel dst]
+        mov rax, 1
+        int 0x80
+`
+	c, path := compile(t, src, "")
+	if !bytes.Contains(c.code, []byte{0xfc, 0xf3, 0xa4}) {
+		t.Fatalf("rep movsb not found in % x", c.code)
+	}
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+
+	// The exit-code should be loaded from the copied data.
+	err := exec.Command(path).Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 42 {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestOnInstruction(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	type Seen struct {
+		Instruction string
+		Start       int
+		End         int
+	}
+	var seen []Seen
+
+	c := New("mov rax, 1\nnop")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.OnInstruction(func(i parser.Instruction, start int, end int) {
+		seen = append(seen, Seen{i.Instruction, start, end})
+	})
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	expected := []Seen{{"mov", 0, 7}, {"nop", 7, 8}}
+	if len(seen) != len(expected) {
+		t.Fatalf("wrong number of callbacks: %v", seen)
+	}
+	for n, s := range expected {
+		if seen[n] != s {
+			t.Fatalf("callback %d: expected %v, got %v", n, s, seen[n])
+		}
+	}
+}
+
+func TestShortImmediate(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		// Values which fit in a signed byte use the short form
+		{Input: "add rax, 1", Output: []byte{0x48, 0x83, 0xc0, 0x01}},
+		{Input: "sub rsp, 8", Output: []byte{0x48, 0x83, 0xec, 0x08}},
+		{Input: "add ebx, -128", Output: []byte{0x83, 0xc3, 0x80}},
+		{Input: "sub edi, 127", Output: []byte{0x83, 0xef, 0x7f}},
+		{Input: "cmp qword ptr [rax], 1", Output: []byte{0x48, 0x83, 0x38, 0x01}},
+		{Input: "cmp word ptr [rbx], -1", Output: []byte{0x66, 0x83, 0x3b, 0xff}},
+
+		// Larger values use the accumulator form, if possible
+		{Input: "add rax, 1000", Output: []byte{0x48, 0x05, 0xe8, 0x03, 0x00, 0x00}},
+		{Input: "sub eax, 128", Output: []byte{0x2d, 0x80, 0x00, 0x00, 0x00}},
+
+		// Otherwise the full form
+		{Input: "add rsi, 1000", Output: []byte{0x48, 0x81, 0xc6, 0xe8, 0x03, 0x00, 0x00}},
+		{Input: "sub rbx, -129", Output: []byte{0x48, 0x81, 0xeb, 0x7f, 0xff, 0xff, 0xff}},
+		{Input: "cmp dword ptr [rcx], 0x1000", Output: []byte{0x81, 0x39, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "cmp byte ptr [rdx], 0x20", Output: []byte{0x80, 0x3a, 0x20}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestImmediateWidth(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		// 8-bit registers use an 8-bit immediate, with the
+		// accumulator form for al
+		{Input: "add al, 1", Output: []byte{0x04, 0x01}},
+		{Input: "cmp al, 0xff", Output: []byte{0x3c, 0xff}},
+		{Input: "sub cl, 5", Output: []byte{0x80, 0xe9, 0x05}},
+		{Input: "and bh, 0x0f", Output: []byte{0x80, 0xe7, 0x0f}},
+		{Input: "or dl, 0x80", Output: []byte{0x80, 0xca, 0x80}},
+		{Input: "xor ah, -1", Output: []byte{0x80, 0xf4, 0xff}},
+		{Input: "add bl, 2", Arch: "i386", Output: []byte{0x80, 0xc3, 0x02}},
+
+		// 16-bit registers have the operand-size override, and a
+		// 16-bit immediate unless the value fits in a signed byte
+		{Input: "add ax, 1", Output: []byte{0x66, 0x83, 0xc0, 0x01}},
+		{Input: "add ax, 0x1000", Output: []byte{0x66, 0x05, 0x00, 0x10}},
+		{Input: "cmp cx, 0x100", Output: []byte{0x66, 0x81, 0xf9, 0x00, 0x01}},
+
+		// 32-bit registers have no prefix, and a 32-bit immediate
+		{Input: "add eax, 1", Output: []byte{0x83, 0xc0, 0x01}},
+		{Input: "add eax, 0x1000", Output: []byte{0x05, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "cmp ecx, 0x100", Output: []byte{0x81, 0xf9, 0x00, 0x01, 0x00, 0x00}},
+		{Input: "add eax, 0xffffffff", Output: []byte{0x05, 0xff, 0xff, 0xff, 0xff}},
+
+		// 64-bit registers sign-extend the 32-bit immediate
+		{Input: "add rax, 0x7fffffff", Output: []byte{0x48, 0x05, 0xff, 0xff, 0xff, 0x7f}},
+		{Input: "sub rbx, -0x80000000", Output: []byte{0x48, 0x81, 0xeb, 0x00, 0x00, 0x00, 0x80}},
+		{Input: "and qword [rax], -256", Output: []byte{0x48, 0x81, 0x20, 0x00, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// The immediate must fit, and only the immediate forms accept
+	// an 8-bit register.  A 64-bit destination may not use a value
+	// which would change when sign-extended.
+	for _, src := range []string{"add al, 0x100", "cmp ax, 0x10000", "add al, bl", "sub rax, cl",
+		"add rax, 0xffffffff", "add rax, 0x80000000", "cmp rbx, 0xfffffff0", "or qword [rax], 0x80000000"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestUnary(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "neg rax", Output: []byte{0x48, 0xf7, 0xd8}},
+		{Input: "not ecx", Output: []byte{0xf7, 0xd1}},
+		{Input: "neg dx", Output: []byte{0x66, 0xf7, 0xda}},
+		{Input: "neg qword [rax]", Output: []byte{0x48, 0xf7, 0x18}},
+		{Input: "not byte [rbx]", Output: []byte{0xf6, 0x13}},
+		{Input: "not word ptr [rsi]", Output: []byte{0x66, 0xf7, 0x16}},
+		{Input: "neg dword ptr [ecx]", Output: []byte{0x67, 0xf7, 0x19}},
+		{Input: "not qword [rsp]", Output: []byte{0x48, 0xf7, 0x14, 0x24}},
+
+		// 32-bit registers have no REX.W prefix
+		{Input: "neg eax", Output: []byte{0xf7, 0xd8}},
+		{Input: "not rcx", Output: []byte{0x48, 0xf7, 0xd1}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Memory operands must have a size
+	for _, src := range []string{"neg [rax]", "neg 3"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestIncDec(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "inc rax", Output: []byte{0x48, 0xff, 0xc0}},
+		{Input: "dec ecx", Output: []byte{0xff, 0xc9}},
+		{Input: "inc qword [rax]", Output: []byte{0x48, 0xff, 0x00}},
+		{Input: "dec byte [rbx]", Output: []byte{0xfe, 0x0b}},
+		{Input: "inc word ptr [rsi]", Output: []byte{0x66, 0xff, 0x06}},
+		{Input: "dec dword ptr [ecx]", Output: []byte{0x67, 0xff, 0x09}},
+		{Input: "inc dword [eax]", Arch: "i386", Output: []byte{0xff, 0x00}},
+		{Input: "dec qword [rbp]", Output: []byte{0x48, 0xff, 0x4d, 0x00}},
+
+		// 32-bit registers have no REX.W prefix
+		{Input: "inc eax", Output: []byte{0xff, 0xc0}},
+		{Input: "dec eax", Output: []byte{0xff, 0xc8}},
+		{Input: "dec rax", Output: []byte{0x48, 0xff, 0xc8}},
+		{Input: "inc ebx", Output: []byte{0xff, 0xc3}},
+		{Input: "inc rbx", Output: []byte{0x48, 0xff, 0xc3}},
+		{Input: "dec edi", Output: []byte{0xff, 0xcf}},
+		{Input: "dec rdi", Output: []byte{0x48, 0xff, 0xcf}},
+		{Input: "inc eax", Arch: "i386", Output: []byte{0xff, 0xc0}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// Memory operands must have a size
+	for _, src := range []string{"inc [rax]"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "mul rbx", Output: []byte{0x48, 0xf7, 0xe3}},
+		{Input: "mul ecx", Output: []byte{0xf7, 0xe1}},
+		{Input: "div rcx", Output: []byte{0x48, 0xf7, 0xf1}},
+		{Input: "div si", Output: []byte{0x66, 0xf7, 0xf6}},
+		{Input: "idiv rdi", Output: []byte{0x48, 0xf7, 0xff}},
+
+		// Memory operands
+		{Input: "div qword [rbx+8]", Output: []byte{0x48, 0xf7, 0x73, 0x08}},
+		{Input: "mul byte ptr [rax]", Output: []byte{0xf6, 0x20}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+}
+
+func TestOperandTypes(t *testing.T) {
+
+	tests := map[string]string{
+		"mov 5, rax":             "cannot move into an immediate operand",
+		"mov 1 + 2, rax":         "cannot move into an immediate operand",
+		"add 3, rbx":             "cannot add to an immediate operand",
+		"sub 0x10, rcx":          "cannot subtract from an immediate operand",
+		"xor 1, 2":               "cannot xor into an immediate operand",
+		"neg 3":                  "cannot negate an immediate operand",
+		"inc 5":                  "cannot increment an immediate operand",
+		"dec 0x10":               "cannot decrement an immediate operand",
+		"not 7":                  "cannot invert an immediate operand",
+		"mul 3":                  "cannot multiply by an immediate operand",
+		"div 2":                  "cannot divide by an immediate operand",
+		"idiv 1 + 1":             "cannot divide by an immediate operand",
+		"mov [rax], [rbx]":       "mov cannot use two memory operands",
+		"mov [rel a], [rel b]":   "mov cannot use two memory operands",
+		"add [rax], qword [rbx]": "add cannot use two memory operands",
+	}
+
+	for src, expected := range tests {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		err := c.Compile()
+		if err == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+		if err.Error() != expected {
+			t.Fatalf("unexpected error compiling %s: %s", src, err)
+		}
+	}
+}
+
+// failingReader is an io.Reader which always fails.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestNewFromReader(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewFromReader(strings.NewReader("mov rax, 1\nnop"))
+	if err != nil {
+		t.Fatalf("failed to create compiler: %s", err)
+	}
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0x48, 0xc7, 0xc0, 0x01, 0x00, 0x00, 0x00, 0x90})
+
+	// Errors reading are reported
+	_, err = NewFromReader(failingReader{})
+	if err == nil {
+		t.Fatalf("expected error reading source")
+	}
+}
+
+func TestAddOutput(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := `
+.msg DB "hello"
+        mov rax, msg
+        nop
+        ret
+`
+	c := New(src)
+	c.AddOutput(ELF, filepath.Join(dir, "a.out"))
+	c.AddOutput(Raw, filepath.Join(dir, "a.bin"))
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	exe, err := ioutil.ReadFile(filepath.Join(dir, "a.out"))
+	if err != nil {
+		t.Fatalf("failed to read ELF output: %s", err)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "a.bin"))
+	if err != nil {
+		t.Fatalf("failed to read raw output: %s", err)
+	}
+
+	// The ELF output contains the same code and data.
+	if !bytes.Equal(exe, elf.New().Build(c.code, c.data)) {
+		t.Fatalf("ELF output doesn't match the compiled code")
+	}
+	layout := elf.New().Layout(uint64(len(c.code)), uint64(len(c.data)))
+	if !bytes.Equal(exe[layout.CodeOffset:layout.CodeOffset+layout.CodeSize], raw[:len(c.code)]) ||
+		!bytes.Equal(exe[layout.DataOffset:], raw[len(c.code):]) {
+		t.Fatalf("raw output doesn't match the ELF code, % x", raw)
+	}
+
+	// The default output isn't written
+	if _, err := os.Stat("a.out"); err == nil {
+		t.Fatalf("default output was written")
+	}
+}
+
+func TestBitwise(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "and rax, rbx", Output: []byte{0x48, 0x21, 0xd8}},
+		{Input: "or ecx, edx", Output: []byte{0x09, 0xd1}},
+		{Input: "test rax, rax", Output: []byte{0x48, 0x85, 0xc0}},
+
+		// Short immediates
+		{Input: "and rax, 0xf", Output: []byte{0x48, 0x83, 0xe0, 0x0f}},
+		{Input: "or rbx, 1", Output: []byte{0x48, 0x83, 0xcb, 0x01}},
+		{Input: "xor ecx, -1", Output: []byte{0x83, 0xf1, 0xff}},
+
+		// Long immediates
+		{Input: "and rax, 0x1000", Output: []byte{0x48, 0x25, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "or rdx, 0x1000", Output: []byte{0x48, 0x81, 0xca, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "xor eax, 0x12345678", Output: []byte{0x35, 0x78, 0x56, 0x34, 0x12}},
+
+		// test has no short form
+		{Input: "test rax, 1", Output: []byte{0x48, 0xa9, 0x01, 0x00, 0x00, 0x00}},
+		{Input: "test bx, 0xff", Output: []byte{0x66, 0xf7, 0xc3, 0xff, 0x00}},
+		{Input: "test eax, 0xffffffff", Output: []byte{0xa9, 0xff, 0xff, 0xff, 0xff}},
+		{Input: "test rax, -1", Output: []byte{0x48, 0xa9, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The immediate is sign-extended for 64-bit registers, and the
+	// extended registers aren't supported.
+	for _, src := range []string{"test rax, 0xffffffff", "test rbx, 0x80000000", "test r8, 5"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestMulti(t *testing.T) {
+
+	// A label defined in the first fragment is the target of a jump
+	// within the second, which also uses the data of the first.
+	first := `.msg DB "hello"
+        jmp start
+:done
+        mov rax, 60
+        syscall`
+	second := `:start
+        mov rdi, msg.len
+        jmp done`
+
+	appended := New(first)
+	appended.Append(second)
+
+	for _, c := range []*Compiler{NewMulti(first, second), appended} {
+		dir, err := ioutil.TempDir("", "assembler")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "a.out")
+		c.SetOutput(path)
+		err = c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile: %s", err)
+		}
+		if c.labels["done"] != 2 || c.code[len(c.code)-2] != 0xeb {
+			t.Fatalf("unexpected code % x", c.code)
+		}
+
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			continue
+		}
+		err = exec.Command(path).Run()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 5 {
+			t.Fatalf("unexpected result running binary: %v", err)
+		}
+	}
+
+	// Each fragment begins upon a new line, so a fragment without a
+	// trailing newline doesn't run into the next.
+	c := NewMulti("nop", "", "ret")
+	c.SetOutput(os.DevNull)
+	err := c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0x90, 0xc3})
+}
+
+func TestStackAlignment(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Arch   string
+		Output []byte
+	}
+
+	// Small negative masks use the sign-extended 8-bit immediate,
+	// with rsp in the r/m field.
+	tests := []TestCase{
+		{Input: "and rsp, -16", Output: []byte{0x48, 0x83, 0xe4, 0xf0}},
+		{Input: "and rsp, -8", Output: []byte{0x48, 0x83, 0xe4, 0xf8}},
+		{Input: "and esp, -16", Output: []byte{0x83, 0xe4, 0xf0}},
+		{Input: "and esp, -16", Arch: "i386", Output: []byte{0x83, 0xe4, 0xf0}},
+		{Input: "and rsp, -4096", Output: []byte{0x48, 0x81, 0xe4, 0x00, 0xf0, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, test.Arch)
+		expectCode(t, c, test.Output)
+	}
+
+	// The stack is aligned, even after pushing a single value.
+	_, path := compile(t, `push rax
+        and rsp, -16
+        mov rdi, rsp
+        and rdi, 15
+        mov rax, 60
+        syscall`, "")
+
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("skipping execution on non-amd64 linux host")
+	}
+	err := exec.Command(path).Run()
+	if err != nil {
+		t.Fatalf("unexpected result running binary: %v", err)
+	}
+}
+
+func TestCompareMemory(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		// A memory source
+		{Input: "cmp rax, [rbx]", Output: []byte{0x48, 0x3b, 0x03}},
+		{Input: "cmp r9, [rax+rcx*2]", Output: []byte{0x4c, 0x3b, 0x0c, 0x48}},
+		{Input: "test rdx, [rsp]", Output: []byte{0x48, 0x85, 0x14, 0x24}},
+
+		// A memory destination
+		{Input: "cmp [rbx+8], ecx", Output: []byte{0x39, 0x4b, 0x08}},
+		{Input: "test [rax], rbx", Output: []byte{0x48, 0x85, 0x18}},
+		{Input: "test [rbp-8], esi", Output: []byte{0x85, 0x75, 0xf8}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// 8-bit registers are not supported
+	c := New("test al, [rbx]")
+	c.SetOutput(os.DevNull)
+	if err := c.Compile(); err == nil {
+		t.Fatalf("expected an error with an 8-bit register")
+	}
+}
+
+func TestNullFree(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each instruction containing a null byte is reported.
+	c := New("xor rdi, rdi\nmov rax, 0\nnop\nmov rbx, 0x100\nsyscall")
+	c.SetNullFree(true)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+
+	errs := c.CompileAll()
+	expected := []string{
+		"line 2: mov rax, 0 contains a null byte, use xor rax, rax instead",
+		"line 4: mov rbx, 0x100 contains a null byte",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	for n, err := range errs {
+		if err.Error() != expected[n] {
+			t.Fatalf("unexpected error %q, expected %q", err, expected[n])
+		}
+	}
+
+	// The null-free equivalent compiles.
+	c = New("xor rdi, rdi\nxor rax, rax\nnop\nxor rbx, rbx\ninc rbx\nsyscall")
+	c.SetNullFree(true)
+	c.SetOutput(filepath.Join(dir, "b.out"))
+	c.SetFormat(Raw)
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if bytes.IndexByte(c.code, 0) >= 0 {
+		t.Fatalf("unexpected null byte in % x", c.code)
+	}
+
+	// Code which we generate is reported by its offset.
+	c = New("nop")
+	c.SetNullFree(true)
+	c.SetAutoExit(true)
+	c.SetOutput(filepath.Join(dir, "c.out"))
+	err = c.Compile()
+	if err == nil || !strings.HasPrefix(err.Error(), "generated code at offset") {
+		t.Fatalf("expected an error from the exit, got %v", err)
+	}
+}
+
+func TestIndirectJump(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "jmp [rax]", Output: []byte{0xff, 0x20}},
+		{Input: "jmp [r12]", Output: []byte{0x41, 0xff, 0x24, 0x24}},
+		{Input: "jmp [0x601000]", Output: []byte{0xff, 0x24, 0x25, 0x00, 0x10, 0x60, 0x00}},
+		{Input: "call [rbx+rcx*8]", Output: []byte{0xff, 0x14, 0xcb}},
+		{Input: "call [rbp-8]", Output: []byte{0xff, 0x55, 0xf8}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The same encoding is used upon i386
+	c, _ := compile(t, "call [ebx+ecx*4]", "i386")
+	expectCode(t, c, []byte{0xff, 0x14, 0x8b})
+
+	// Conditional jumps have no indirect form
+	c = New("je [rax]")
+	c.SetOutput(os.DevNull)
+	if c.Compile() == nil {
+		t.Fatalf("expected an error with a conditional jump to memory")
+	}
+}
+
+func TestBitwiseMemory(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		// A memory destination, and an immediate
+		{Input: "or dword [rax], 1", Output: []byte{0x83, 0x08, 0x01}},
+		{Input: "and qword [rbx+8], 0x1000", Output: []byte{0x48, 0x81, 0x63, 0x08, 0x00, 0x10, 0x00, 0x00}},
+		{Input: "xor byte [rdi], 0x80", Output: []byte{0x80, 0x37, 0x80}},
+		{Input: "or word [rdi], 0x1234", Output: []byte{0x66, 0x81, 0x0f, 0x34, 0x12}},
+
+		// A memory source
+		{Input: "and rbx, [rcx]", Output: []byte{0x48, 0x23, 0x19}},
+		{Input: "or r9, [rax]", Output: []byte{0x4c, 0x0b, 0x08}},
+		{Input: "xor eax, [rsp]", Output: []byte{0x33, 0x04, 0x24}},
+
+		// A memory destination, and a register
+		{Input: "xor [rdx], rax", Output: []byte{0x48, 0x31, 0x02}},
+		{Input: "and [rax+rcx*4], r10", Output: []byte{0x4c, 0x21, 0x14, 0x88}},
+		{Input: "or [rbp-8], esi", Output: []byte{0x09, 0x75, 0xf8}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The size of the memory must be given with an immediate
+	c := New("or [rax], 1")
+	c.SetOutput(os.DevNull)
+	err := c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "must be specified") {
+		t.Fatalf("expected an error without a size, got %v", err)
+	}
+}
+
+func TestParserError(t *testing.T) {
+
+	tests := map[string]string{
+		"nop\n  mov rax, 3 +":       `error compiling - line 2, column 14, near "+": unexpected EOF in expression`,
+		"nop\nnop\n.foo DW 3":       `error compiling - line 3, column 6, near "DW": expected DB or DQ, got 'DW'`,
+		"\n\n\n    3":               `error compiling - line 4, column 5, near "3": unexpected token '3'`,
+		"mov rax, 1\n.foo DB 3 dup": `error compiling - line 2, column 11, near "dup": Unexpected EOF parsing dup`,
+	}
+
+	for src, expected := range tests {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		err := c.Compile()
+		if err == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+		if err.Error() != expected {
+			t.Fatalf("unexpected error compiling %q: %s", src, err)
+		}
+	}
+}
+
+func TestRet(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "ret", Output: []byte{0xc3}},
+		{Input: "ret 8", Output: []byte{0xc2, 0x08, 0x00}},
+		{Input: "ret 0xffff", Output: []byte{0xc2, 0xff, 0xff}},
+		{Input: "ret\nnop", Output: []byte{0xc3, 0x90}},
+		{Input: "ret ; comment\nnop", Output: []byte{0xc3, 0x90}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// The value must fit in 16 bits
+	for _, src := range []string{"ret 0x10000", "ret -1", "ret rax"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestMOVSD(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Output []byte
+	}
+
+	tests := []TestCase{
+		{Input: "movsd", Output: []byte{0xa5}},
+		{Input: "movsd xmm0, xmm1", Output: []byte{0xf2, 0x0f, 0x10, 0xc1}},
+		{Input: "movsd xmm9, xmm2", Output: []byte{0xf2, 0x44, 0x0f, 0x10, 0xca}},
+		{Input: "movsd xmm2, [rsi]", Output: []byte{0xf2, 0x0f, 0x10, 0x16}},
+		{Input: "movsd [rdi], xmm1", Output: []byte{0xf2, 0x0f, 0x11, 0x0f}},
+		{Input: ".pi DQ 3.14159\nmovsd xmm1, [rel pi]", Output: []byte{0xf2, 0x0f, 0x10, 0x0d, 0x48, 0x0f, 0x20, 0x00}},
+	}
+
+	for _, test := range tests {
+		c, _ := compile(t, test.Input, "")
+		expectCode(t, c, test.Output)
+	}
+
+	// Load a double from the data-section, via an absolute address
+	c, _ := compile(t, ".pi DQ 3.14159\nmovsd xmm0, [pi]", "")
+	if !bytes.Equal(c.code[:5], []byte{0xf2, 0x0f, 0x10, 0x04, 0x25}) {
+		t.Fatalf("unexpected encoding % x", c.code)
+	}
+	addr := int64(binary.LittleEndian.Uint32(c.code[5:]))
+	if addr != c.dataAddress() {
+		t.Fatalf("unexpected address %x", addr)
+	}
+	if binary.LittleEndian.Uint64(c.data) != 0x400921f9f01b866e {
+		t.Fatalf("unexpected data % x", c.data)
+	}
+
+	// There is no RIP-relative addressing upon i386, so the absolute
+	// address of the data is used.
+	c, _ = compile(t, ".pi DQ 3.14159\nmovsd xmm0, [rel pi]", "i386")
+	if !bytes.Equal(c.code[:4], []byte{0xf2, 0x0f, 0x10, 0x05}) {
+		t.Fatalf("unexpected encoding % x", c.code)
+	}
+	addr = int64(binary.LittleEndian.Uint32(c.code[4:]))
+	if addr != c.dataAddress() {
+		t.Fatalf("unexpected address %x, expected %x", addr, c.dataAddress())
+	}
+
+	// Invalid operands
+	for _, src := range []string{"movsd xmm0", "movsd rax, xmm0", "movsd xmm0, rax", "mov rax, xmm0", "movsd xmm0, [foo]"} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		if c.Compile() == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+	}
+}
+
+func TestUndefined(t *testing.T) {
+
+	tests := map[string]string{
+		".msg DB \"hi\"\nmov rax, mgs":       `undefined symbol "mgs", did you mean msg?`,
+		".msg DB \"hi\"\nmov rax, [rel msh]": `undefined symbol "msh", did you mean msg?`,
+		".msg DB \"hi\"\nmov rax, foo":       `undefined symbol "foo"`,
+		"mov rax, foo":                       `undefined symbol "foo"`,
+		"mov rax, msg\n.msg DB \"hi\"":       `undefined symbol "msg", data must be declared before it is used`,
+	}
+
+	for src, msg := range tests {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		err := c.Compile()
+		if err == nil {
+			t.Fatalf("expected error compiling %s", src)
+		}
+		if err.Error() != msg {
+			t.Fatalf("unexpected error compiling %s, got %q, expected %q", src, err, msg)
+		}
+	}
+
+	if distance("kitten", "sitting") != 3 {
+		t.Fatalf("unexpected distance")
+	}
+}
+
+func TestRegisterInstruction(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "assembler")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var operands []parser.Operand
+
+	c := New("magic\nmagic 3, rax\nnop\nmagic 1 + 2")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.RegisterInstruction("magic", func(c *Compiler, i parser.Instruction) error {
+		operands = append(operands, i.Operands...)
+		c.Emit(0x0f, 0x0b)
+		return nil
+	})
+
+	// Built-in instructions may be replaced.
+	c.RegisterInstruction("nop", func(c *Compiler, i parser.Instruction) error {
+		c.Emit(0x66, 0x90)
+		return nil
+	})
+
+	err = c.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	expectCode(t, c, []byte{0x0f, 0x0b, 0x0f, 0x0b, 0x66, 0x90, 0x0f, 0x0b})
+
+	// The operands should have been passed to the encoder, with any
+	// expressions evaluated.
+	if len(operands) != 3 ||
+		operands[0].Literal != "3" ||
+		operands[1].Literal != "rax" ||
+		operands[2].Literal != "3" {
+		t.Fatalf("unexpected operands: %v", operands)
+	}
+
+	// Errors are reported
+	c = New("magic")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	c.RegisterInstruction("magic", func(c *Compiler, i parser.Instruction) error {
+		return errors.New("no magic here")
+	})
+	err = c.Compile()
+	if err == nil || err.Error() != "no magic here" {
+		t.Fatalf("expected error from the encoder, got %v", err)
+	}
+
+	// The instruction is known only to the compilers which have
+	// registered it.
+	if _, ok := instructions.InstructionLengths["magic"]; ok {
+		t.Fatalf("registering an instruction changed the global registry")
+	}
+	c = New("magic")
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	if c.Compile() == nil {
+		t.Fatalf("expected error compiling an instruction registered by another compiler")
+	}
+}
+
+func TestUnknownInstruction(t *testing.T) {
+
+	// Instructions registered with this compiler are supported too.
+	c := New("nop\nbogus rax, 1\nnop")
+	c.SetOutput(os.DevNull)
+	c.RegisterInstruction("magic", func(c *Compiler, i parser.Instruction) error {
+		return nil
+	})
+	err := c.Compile()
+	if err == nil {
+		t.Fatalf("expected an error compiling an unknown instruction")
+	}
+
+	prefix := `error compiling - line 2, column 1, near "bogus": unknown instruction "bogus"; supported: `
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+	names := strings.Split(strings.TrimPrefix(msg, prefix), ", ")
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("the supported instructions are not sorted: %s", msg)
+	}
+	for _, name := range []string{"add", "cmp", "dec", "magic", "mov", "nop", "syscall", "xor"} {
+		i := sort.SearchStrings(names, name)
+		if i >= len(names) || names[i] != name {
+			t.Fatalf("instruction %s is missing from %s", name, msg)
+		}
+	}
+	for _, name := range names {
+		if name == "bogus" {
+			t.Fatalf("the unknown instruction is listed as supported: %s", msg)
+		}
+	}
+
+	// The operands of the unknown instruction aren't reported too.
+	c = New("bogus rax, 1\nnop")
+	c.SetOutput(os.DevNull)
+	if errs := c.CompileAll(); len(errs) != 1 {
+		t.Fatalf("expected a single error, got %v", errs)
+	}
+}
+
+func TestFixups(t *testing.T) {
+
+	src := `.msg DB "hi"
+.pi  DQ 3.5
+:start
+        mov rax, msg
+        mov ebx, start
+        push done
+        call done
+        jmp start
+        mov rcx, [rel msg]
+        movsd xmm0, [pi]
+:done
+        ret`
+
+	c, _ := compile(t, src, "")
+
+	base := uint32(0x400000 + elf.New().HeaderSize())
+	addr := func(v uint32) []byte {
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, v)
+		return buf
+	}
+
+	var expected []byte
+	add := func(bs ...[]byte) {
+		for _, b := range bs {
+			expected = append(expected, b...)
+		}
+	}
+
+	// The data is loaded upon its own page.
+	data := uint32(0x601000)
+	add([]byte{0x48, 0xc7, 0xc0}, addr(data))               // mov rax, msg
+	add([]byte{0xbb}, addr(base))                           // mov ebx, start
+	add([]byte{0x68}, addr(base+40))                        // push done
+	add([]byte{0xe8}, addr(40-22))                          // call done
+	add([]byte{0xeb, 0xe8})                                 // jmp start
+	add([]byte{0x48, 0x8b, 0x0d}, addr(data-(base+31)))     // mov rcx, [rel msg]
+	add([]byte{0xf2, 0x0f, 0x10, 0x04, 0x25}, addr(data+2)) // movsd xmm0, [pi]
+	add([]byte{0xc3})                                       // ret
+
+	expectCode(t, c, expected)
+
+	// Short jumps must be to defined labels, which are close enough
+	far := "jmp end\n" + strings.Repeat("nop\n", 128) + ":end\nret"
+	for src, msg := range map[string]string{
+		"jmp nowhere": `undefined symbol "nowhere"`,
+		far:           "jump target too far: end",
+	} {
+		c := New(src)
+		c.SetOutput(os.DevNull)
+		err := c.Compile()
+		if err == nil || err.Error() != msg {
+			t.Fatalf("expected error %s, got %v", msg, err)
+		}
+	}
+}
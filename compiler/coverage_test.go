@@ -0,0 +1,168 @@
+package compiler
+
+import (
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/skx/assembler/parser"
+	asmtoken "github.com/skx/assembler/token"
+)
+
+// knownInstructions returns the instructions which compileInstruction
+// handles, found by reading the cases of its switch, along with those
+// which have no operands and are looked up in the simple table.
+func knownInstructions(t *testing.T) []string {
+
+	f, err := goparser.ParseFile(token.NewFileSet(), "compiler.go", nil, 0)
+	if err != nil {
+		t.Fatalf("failed to parse compiler.go: %s", err)
+	}
+
+	known := make(map[string]bool)
+	for name := range simple {
+		known[name] = true
+	}
+
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "compileInstruction" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			s, ok := n.(*ast.SwitchStmt)
+			if !ok {
+				return true
+			}
+			if tag, ok := s.Tag.(*ast.SelectorExpr); !ok || tag.Sel.Name != "Instruction" {
+				return true
+			}
+			for _, stmt := range s.Body.List {
+				for _, expr := range stmt.(*ast.CaseClause).List {
+					lit, ok := expr.(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						continue
+					}
+					name, err := strconv.Unquote(lit.Value)
+					if err == nil {
+						known[name] = true
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	var names []string
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// operandKind describes the type of an operand, for the coverage report.
+func operandKind(op parser.Operand) string {
+	switch {
+	case op.Relative:
+		return "rel"
+	case op.Indirection:
+		return "mem"
+	case op.Type == asmtoken.REGISTER:
+		return "reg"
+	case op.Type == asmtoken.NUMBER:
+		return "imm"
+	}
+	return "label"
+}
+
+// coverage compiles each of the given source files, and returns the forms
+// of each instruction which were exercised, such as "mov reg, imm", with
+// the number of times each was seen.  The instructions which are known,
+// but were not exercised at all, are also returned.
+func coverage(t *testing.T, paths []string) (map[string]int, []string) {
+
+	forms := make(map[string]int)
+	seen := make(map[string]bool)
+
+	dir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+
+		c := New(string(src))
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		c.OnInstruction(func(i parser.Instruction, start int, end int) {
+			var kinds []string
+			for _, op := range i.Operands {
+				kinds = append(kinds, operandKind(op))
+			}
+			forms[strings.TrimSpace(i.Instruction+" "+strings.Join(kinds, ", "))]++
+			seen[i.Instruction] = true
+		})
+		err = c.Compile()
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", path, err)
+		}
+	}
+
+	var untested []string
+	for _, name := range knownInstructions(t) {
+		if !seen[name] {
+			untested = append(untested, name)
+		}
+	}
+	return forms, untested
+}
+
+func TestCoverage(t *testing.T) {
+
+	known := knownInstructions(t)
+	for _, name := range []string{"add", "call", "jmp", "lea", "mov", "nop", "ret", "syscall", "syscall_exit", "xor"} {
+		i := sort.SearchStrings(known, name)
+		if i >= len(known) || known[i] != name {
+			t.Fatalf("instruction %s is missing from %v", name, known)
+		}
+	}
+
+	paths, err := filepath.Glob("../*.asm")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("failed to find the examples: %v", err)
+	}
+
+	forms, untested := coverage(t, paths)
+	if forms["mov reg, imm"] == 0 || forms["int imm"] == 0 {
+		t.Fatalf("expected the examples to use mov, and int, got %v", forms)
+	}
+
+	// Every instruction is either exercised, or reported.
+	for _, name := range known {
+		used := false
+		for form := range forms {
+			if form == name || strings.HasPrefix(form, name+" ") {
+				used = true
+			}
+		}
+		i := sort.SearchStrings(untested, name)
+		reported := i < len(untested) && untested[i] == name
+		if used == reported {
+			t.Fatalf("instruction %s used=%t, but reported=%t", name, used, reported)
+		}
+	}
+
+	t.Logf("instructions not exercised by the examples: %s", strings.Join(untested, ", "))
+}
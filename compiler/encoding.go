@@ -0,0 +1,147 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/skx/assembler/parser"
+)
+
+// Encoding describes the parts of a single encoded instruction, which
+// makes it obvious which part of an encoding is wrong:
+//
+//	[prefixes] [REX] opcode [ModRM] [SIB] [displacement] [immediate]
+//
+// Each part which is absent is empty, and REX is zero when there is no
+// REX prefix.  The displacement of a relative jump, or call, is stored
+// as the displacement, as is the address used by the moffs forms of mov.
+type Encoding struct {
+	Prefixes     []byte
+	REX          byte
+	Opcode       []byte
+	ModRM        []byte
+	SIB          []byte
+	Displacement []byte
+	Immediate    []byte
+}
+
+// Bytes returns the encoded instruction, flattening its parts.
+func (e Encoding) Bytes() []byte {
+	var out []byte
+	out = append(out, e.Prefixes...)
+	if e.REX != 0 {
+		out = append(out, e.REX)
+	}
+	out = append(out, e.Opcode...)
+	out = append(out, e.ModRM...)
+	out = append(out, e.SIB...)
+	out = append(out, e.Displacement...)
+	out = append(out, e.Immediate...)
+	return out
+}
+
+// part identifies one of the parts of an Encoding, in the order in which
+// they're flattened.
+type part int
+
+const (
+	partPrefix part = iota
+	partREX
+	partOpcode
+	partModRM
+	partSIB
+	partDisplacement
+	partImmediate
+)
+
+// emit appends the given bytes, which form the given part of the
+// instruction we're encoding, to our code.
+func (c *Compiler) emit(p part, bytes ...byte) {
+	c.code = append(c.code, bytes...)
+	if c.recording {
+		for range bytes {
+			c.parts = append(c.parts, p)
+		}
+	}
+}
+
+// emitEncoding appends the given instruction to our code.
+func (c *Compiler) emitEncoding(e Encoding) {
+	c.emit(partPrefix, e.Prefixes...)
+	if e.REX != 0 {
+		c.emit(partREX, e.REX)
+	}
+	c.emit(partOpcode, e.Opcode...)
+	c.emit(partModRM, e.ModRM...)
+	c.emit(partSIB, e.SIB...)
+	c.emit(partDisplacement, e.Displacement...)
+	c.emit(partImmediate, e.Immediate...)
+}
+
+// emitPrefix emits the prefix, if any, which is required to operate upon
+// the given register, as returned by prefix.
+func (c *Compiler) emitPrefix(reg string) {
+	for _, b := range c.prefix(reg) {
+		if b == 0x66 {
+			c.emit(partPrefix, b)
+		} else {
+			c.emit(partREX, b)
+		}
+	}
+}
+
+// EncodeInstruction returns the encoding of the given instruction, for
+// our architecture, separated into its parts.
+//
+// The instruction is compiled in isolation, so any reference to a label,
+// or to data, is left as zero, and it must generate a single machine
+// instruction, so pseudo-instructions such as `syscall_exit` cannot be
+// encoded.  Nor can instructions registered via RegisterInstruction, as
+// the parts of the code they Emit are unknown.
+func (c *Compiler) EncodeInstruction(i parser.Instruction) (Encoding, error) {
+
+	// Compile the instruction with a fresh compiler, so that our own
+	// code is unchanged, and copy the operands as they're replaced
+	// during compilation.
+	tmp := New("")
+	tmp.arch = c.arch
+	tmp.format = c.format
+	tmp.defines = c.defines
+	tmp.custom = c.custom
+	tmp.recording = true
+	i.Operands = append([]parser.Operand{}, i.Operands...)
+
+	err := tmp.compileInstruction(i)
+	if err != nil {
+		return Encoding{}, err
+	}
+	if len(tmp.parts) != len(tmp.code) {
+		return Encoding{}, fmt.Errorf("the parts of %s are unknown: % x", i.Instruction, tmp.code)
+	}
+
+	// The parts of an instruction are emitted in order, so an earlier
+	// part, or a repeated single-byte part, begins another instruction.
+	var e Encoding
+	for n, b := range tmp.code {
+		p := tmp.parts[n]
+		if n > 0 && (p < tmp.parts[n-1] || (p == tmp.parts[n-1] && (p == partREX || p == partModRM || p == partSIB))) {
+			return Encoding{}, fmt.Errorf("%s generates more than one instruction: % x", i.Instruction, tmp.code)
+		}
+		switch p {
+		case partPrefix:
+			e.Prefixes = append(e.Prefixes, b)
+		case partREX:
+			e.REX = b
+		case partOpcode:
+			e.Opcode = append(e.Opcode, b)
+		case partModRM:
+			e.ModRM = append(e.ModRM, b)
+		case partSIB:
+			e.SIB = append(e.SIB, b)
+		case partDisplacement:
+			e.Displacement = append(e.Displacement, b)
+		case partImmediate:
+			e.Immediate = append(e.Immediate, b)
+		}
+	}
+	return e, nil
+}
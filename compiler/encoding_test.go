@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/skx/assembler/parser"
+)
+
+// parseInstruction returns the single instruction in the given source.
+func parseInstruction(t *testing.T, src string) parser.Instruction {
+	nodes, errs := ParseOnly(src)
+	if len(errs) != 0 || len(nodes) != 1 {
+		t.Fatalf("failed to parse %s: %v", src, errs)
+	}
+	i, ok := nodes[0].(parser.Instruction)
+	if !ok {
+		t.Fatalf("%s is not an instruction", src)
+	}
+	return i
+}
+
+func TestEncodeInstruction(t *testing.T) {
+
+	c := New("")
+
+	enc, err := c.EncodeInstruction(parseInstruction(t, "mov rax, 1"))
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	expected := Encoding{
+		REX:       0x48,
+		Opcode:    []byte{0xc7},
+		ModRM:     []byte{0xc0},
+		Immediate: []byte{0x01, 0x00, 0x00, 0x00},
+	}
+	if !reflect.DeepEqual(enc, expected) {
+		t.Fatalf("unexpected encoding %+v", enc)
+	}
+
+	// Memory operands, with a SIB byte and a displacement
+	enc, err = c.EncodeInstruction(parseInstruction(t, "add qword fs:[rbx+rcx*4+8], 0x1000"))
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	expected = Encoding{
+		Prefixes:     []byte{0x64},
+		REX:          0x48,
+		Opcode:       []byte{0x81},
+		ModRM:        []byte{0x44},
+		SIB:          []byte{0x8b},
+		Displacement: []byte{0x08},
+		Immediate:    []byte{0x00, 0x10, 0x00, 0x00},
+	}
+	if !reflect.DeepEqual(enc, expected) {
+		t.Fatalf("unexpected encoding %+v", enc)
+	}
+
+	// The 8-bit accumulator forms have no ModRM byte.
+	for src, op := range map[string]byte{"add al, 1": 0x04, "cmp al, 1": 0x3c} {
+		enc, err = c.EncodeInstruction(parseInstruction(t, src))
+		if err != nil {
+			t.Fatalf("failed to encode %s: %s", src, err)
+		}
+		expected = Encoding{Opcode: []byte{op}, Immediate: []byte{0x01}}
+		if !reflect.DeepEqual(enc, expected) {
+			t.Fatalf("%s: unexpected encoding %+v", src, enc)
+		}
+	}
+
+	// Pseudo-instructions, and pushing a 64-bit value, generate several
+	// instructions.
+	for _, src := range []string{"syscall_exit 3", "push 0x123456789"} {
+		_, err = c.EncodeInstruction(parseInstruction(t, src))
+		if err == nil {
+			t.Fatalf("expected an error encoding %s", src)
+		}
+	}
+}
+
+// TestEncodeForms ensures that every instruction we know about can be
+// encoded, in each of its forms, and that flattening the parts gives the
+// code we generate.
+func TestEncodeForms(t *testing.T) {
+
+	forms := map[string][]string{
+		"add":   {"add rax, rbx", "add r9, rdx", "add ax, cx", "add rax, 1", "add rax, 0x1000", "add rbx, 0x1000", "add al, 1", "add bl, 1", "add qword fs:[rbx+rcx*4+8], 0x1000", "add byte [rax], 1"},
+		"and":   {"and rbx, rcx", "and al, 0x0f", "and eax, 0xff00", "and rbx, [rcx]"},
+		"bswap": {"bswap eax", "bswap rax", "bswap r9"},
+		"call":  {"call foo", "call [rbx+rcx*8]"},
+		"cmp":   {"cmp rax, rbx", "cmp al, 1", "cmp rax, 0x1000", "cmp byte [rax+rcx], 0x10", "cmp rax, [rbp-8]"},
+		"dec":   {"dec rcx", "dec byte [rax]"},
+		"div":   {"div rbx", "div qword [rbx]"},
+		"idiv":  {"idiv ecx", "idiv dword [rbx]"},
+		"imul":  {"imul rax, rbx", "imul r8, r9", "imul rax, rbx, 1000", "imul rax, rbx, 8", "imul rax, [rbx], 8"},
+		"in":    {"in al, dx", "in ax, dx", "in eax, 0x60"},
+		"inc":   {"inc rax", "inc dword [rdi+rsi*4]"},
+		"int":   {"int 0x80"},
+		"je":    {"je foo"},
+		"jmp":   {"jmp foo", "jmp [rax]", "jmp [rax+rcx*8]"},
+		"jne":   {"jne foo"},
+		"jnz":   {"jnz foo"},
+		"jz":    {"jz foo"},
+		"lea":   {"lea rsi, [rax+rbx*2]", "lea rdi, [rsp+8]", "lea r8, [r13]"},
+		"mov":   {"mov rax, 1", "mov r8, 1", "mov ax, 0x1234", "mov eax, 1", "mov rax, 0x123456789", "mov rbx, rcx", "mov rax, foo", "mov r9, foo", "mov eax, foo", "mov [rbp-8], rdi", "mov rax, [0x1000]", "mov [0x1000], rax", "mov rax, fs:[0x28]", "mov word [rax], 1", "mov byte [rax+1], 1", "mov cr0, rax", "mov r8, dr7"},
+		"movsd": {"movsd xmm1, [rbx+rcx*8]", "movsd [rax], xmm9", "movsd xmm0, xmm9"},
+		"mul":   {"mul rbx", "mul byte [rax]"},
+		"neg":   {"neg rax", "neg word [rax]"},
+		"not":   {"not rax", "not qword [rax]"},
+		"or":    {"or rax, rbx", "or al, 1", "or rax, 0x100"},
+		"out":   {"out dx, al", "out 0x60, eax"},
+		"pop":   {"pop rbx", "pop r12"},
+		"push":  {"push rax", "push r12", "push 0x1234", "push foo"},
+		"ret":   {"ret 8"},
+		"sub":   {"sub rsp, 8", "sub eax, 0x1000", "sub al, 1", "sub qword [rbx], 8"},
+		"test":  {"test rax, rbx", "test rax, 0x100", "test rbx, 0x100", "test [rax], rbx"},
+		"xchg":  {"xchg rbx, rcx", "xchg rax, rbx", "xchg r9, rax", "xchg ax, bx", "xchg rax, rax", "xchg eax, eax", "xchg [rsi+8], rax"},
+		"xor":   {"xor rdi, rdi", "xor al, 1", "xor rax, 0x100"},
+	}
+	for name := range setConditions {
+		forms[name] = []string{name + " al", name + " byte [rbx+8]"}
+	}
+	for name := range simple {
+		forms[name] = append(forms[name], name)
+	}
+	for _, src := range []string{"rep movsb", "rep stosq", "repne scasb", "repe cmpsw", "repz ret"} {
+		name := parseInstruction(t, src).Instruction
+		forms[name] = append(forms[name], src)
+	}
+	forms["syscall_exit"] = nil
+
+	// The i386 encodings differ in their prefixes, and addressing.
+	i386 := []string{
+		"mov eax, [0x1000]", "mov [0x1000], eax", "mov eax, 1", "push 0x1234",
+		"push ebx", "pop ebx", "movsd xmm0, [0x1000]", "mov eax, [ebx+ecx*4]", "inc dword [ebx]", "int 0x80",
+	}
+
+	c := New("")
+	c.SetFormat(Raw)
+
+	x86 := New("")
+	x86.SetFormat(Raw)
+	if err := x86.SetArch("i386"); err != nil {
+		t.Fatalf("failed to set architecture: %s", err)
+	}
+
+	check := func(c *Compiler, src string) {
+		i := parseInstruction(t, src)
+		enc, err := c.EncodeInstruction(i)
+		if err != nil {
+			t.Fatalf("failed to encode %s: %s", src, err)
+		}
+
+		tmp := New("")
+		tmp.arch = c.arch
+		tmp.format = c.format
+		i.Operands = append([]parser.Operand{}, i.Operands...)
+		if err := tmp.compileInstruction(i); err != nil {
+			t.Fatalf("failed to compile %s: %s", src, err)
+		}
+		if !bytes.Equal(enc.Bytes(), tmp.code) {
+			t.Fatalf("%s: encoding %+v doesn't match % x", src, enc, tmp.code)
+		}
+	}
+
+	for _, name := range knownInstructions(t) {
+		srcs, ok := forms[name]
+		if !ok {
+			t.Fatalf("there are no forms of %s to encode", name)
+		}
+		for _, src := range srcs {
+			if parseInstruction(t, src).Instruction != name {
+				t.Fatalf("%s is not a form of %s", src, name)
+			}
+			check(c, src)
+		}
+	}
+	for _, src := range i386 {
+		check(x86, src)
+	}
+}
@@ -0,0 +1,144 @@
+package compiler
+
+import (
+	"sort"
+
+	"github.com/skx/assembler/parser"
+)
+
+// latencies holds the approximate number of cycles taken by instructions
+// which are slower than a single cycle, upon a recent x86-64 processor.
+//
+// These are rough figures, for education rather than optimization; the
+// real cost depends upon the processor, and upon the surrounding code.
+var latencies = map[string]int{
+	"call":    3,
+	"cpuid":   100,
+	"div":     25,
+	"hlt":     100,
+	"idiv":    25,
+	"imul":    3,
+	"in":      100,
+	"int":     100,
+	"mul":     3,
+	"out":     100,
+	"ret":     2,
+	"syscall": 100,
+	"xchg":    2,
+}
+
+// memoryLatency is the approximate number of additional cycles taken by
+// an instruction with a memory operand, assuming a hit in the L1 cache.
+const memoryLatency = 4
+
+// repeatLatency is the cost assumed for a string instruction with a rep
+// prefix, whose real cost depends upon the count in rcx.
+const repeatLatency = 20
+
+// timing records the approximate cost of the instruction whose code
+// begins at the given offset.
+type timing struct {
+	offset int
+	cycles int
+}
+
+// cycles returns the approximate number of cycles taken by a single
+// execution of the given instruction.
+func cycles(i parser.Instruction) int {
+
+	n, ok := latencies[i.Instruction]
+	if !ok {
+		n = 1
+	}
+	if i.Prefix != "" {
+		n = repeatLatency
+	}
+	for _, op := range i.Operands {
+		if op.Indirection && i.Instruction != "lea" {
+			n += memoryLatency
+			break
+		}
+	}
+	return n
+}
+
+// region describes the code following a label, up to the next label.
+type region struct {
+	name  string
+	start int
+	end   int
+}
+
+// regions returns the code following each label, and any code before
+// the first label under the empty name.  Labels at the same offset are
+// aliases, and so each describes the same code.
+func (c *Compiler) regions() []region {
+
+	var offsets []int
+	names := make(map[int][]string)
+	for name, offset := range c.labels {
+		if len(names[offset]) == 0 {
+			offsets = append(offsets, offset)
+		}
+		names[offset] = append(names[offset], name)
+	}
+	sort.Ints(offsets)
+
+	var out []region
+	if len(offsets) == 0 || offsets[0] > 0 {
+		end := len(c.code)
+		if len(offsets) > 0 {
+			end = offsets[0]
+		}
+		out = append(out, region{start: 0, end: end})
+	}
+	for n, offset := range offsets {
+		end := len(c.code)
+		if n+1 < len(offsets) {
+			end = offsets[n+1]
+		}
+		for _, name := range names[offset] {
+			out = append(out, region{name: name, start: offset, end: end})
+		}
+	}
+	return out
+}
+
+// EstimateSize returns the size, in bytes, of the code following each
+// label up to the next, keyed by the name of the label.  Any code before
+// the first label, such as the entry-point generated via SetMainLabel, is
+// reported under the empty name.
+//
+// The sizes are exact, and unless labels share an offset they sum to the
+// size of the code.  This is only valid after Compile has been called.
+func (c *Compiler) EstimateSize() map[string]int {
+
+	sizes := make(map[string]int)
+	for _, r := range c.regions() {
+		sizes[r.name] = r.end - r.start
+	}
+	return sizes
+}
+
+// EstimateCycles returns the approximate number of cycles taken by a
+// single pass through the instructions following each label, keyed as
+// for EstimateSize.
+//
+// This is only a rough approximation: each instruction is assumed to take
+// a single cycle, unless it is listed as slower, with a fixed cost for
+// memory operands.  Pipelining, branches, and loops are not considered,
+// and code we generate ourselves isn't counted.  This is only valid after
+// Compile has been called.
+func (c *Compiler) EstimateCycles() map[string]int {
+
+	total := make(map[string]int)
+	for _, r := range c.regions() {
+		total[r.name] = 0
+		for _, t := range c.timings {
+			if t.offset >= r.start && t.offset < r.end {
+				total[r.name] += t.cycles
+			}
+		}
+	}
+	return total
+}
@@ -0,0 +1,89 @@
+package compiler
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+
+	src := `
+        mov rcx, 10
+        xor rax, rax
+:loop
+        add rax, rcx
+        dec rcx
+        jnz loop
+:done
+        mov rdi, rax
+        mov rax, 60
+        syscall
+`
+	c := New(src)
+	c.SetOutput(os.DevNull)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	sizes := c.EstimateSize()
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	if total != len(c.code) {
+		t.Fatalf("sizes %v sum to %d, not %d", sizes, total, len(c.code))
+	}
+	if sizes["loop"] != c.labels["done"]-c.labels["loop"] {
+		t.Fatalf("unexpected size of loop %d", sizes["loop"])
+	}
+	if sizes[""] != c.labels["loop"] {
+		t.Fatalf("unexpected size before the first label %d", sizes[""])
+	}
+
+	cycles := c.EstimateCycles()
+	if cycles["loop"] == 0 {
+		t.Fatalf("the loop has no cycles: %v", cycles)
+	}
+	if cycles["done"] <= cycles["loop"] {
+		t.Fatalf("syscall should be slower than the loop: %v", cycles)
+	}
+}
+
+func TestEstimateCycles(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Cycles int
+	}{
+		{"nop", 1},
+		{"mov rax, [rbx]", 1 + memoryLatency},
+		{"lea rax, [rbx+8]", 1},
+		{"div rbx", 25},
+		{"rep stosb", repeatLatency},
+	}
+
+	for _, test := range tests {
+		i := parseInstruction(t, test.Input)
+		if got := cycles(i); got != test.Cycles {
+			t.Errorf("%s: expected %d cycles, got %d", test.Input, test.Cycles, got)
+		}
+	}
+}
+
+func TestEstimateAlias(t *testing.T) {
+
+	c := New(":main\n:start\nnop\nret")
+	c.SetOutput(os.DevNull)
+	if err := c.Compile(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	sizes := c.EstimateSize()
+	if len(sizes) != 2 || sizes["main"] != 2 || sizes["start"] != 2 {
+		t.Fatalf("unexpected sizes %v", sizes)
+	}
+	cycles := c.EstimateCycles()
+	if cycles["main"] != 1+latencies["ret"] {
+		t.Fatalf("unexpected cycles %v", cycles)
+	}
+}
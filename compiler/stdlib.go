@@ -0,0 +1,57 @@
+package compiler
+
+// syscalls holds the numbers of common Linux system calls, for each of
+// our architectures, which are defined as constants via SetStdlib.
+var syscalls = map[string]map[string]int64{
+	"amd64": {
+		"SYS_read":       0,
+		"SYS_write":      1,
+		"SYS_open":       2,
+		"SYS_close":      3,
+		"SYS_brk":        12,
+		"SYS_nanosleep":  35,
+		"SYS_getpid":     39,
+		"SYS_fork":       57,
+		"SYS_execve":     59,
+		"SYS_exit":       60,
+		"SYS_kill":       62,
+		"SYS_exit_group": 231,
+	},
+	"i386": {
+		"SYS_read":       3,
+		"SYS_write":      4,
+		"SYS_open":       5,
+		"SYS_close":      6,
+		"SYS_brk":        45,
+		"SYS_nanosleep":  162,
+		"SYS_getpid":     20,
+		"SYS_fork":       2,
+		"SYS_execve":     11,
+		"SYS_exit":       1,
+		"SYS_kill":       37,
+		"SYS_exit_group": 252,
+	},
+}
+
+// constants holds the other constants defined via SetStdlib, which are
+// the same upon each architecture.
+var constants = map[string]int64{
+	"STDIN":        0,
+	"STDOUT":       1,
+	"STDERR":       2,
+	"EXIT_SUCCESS": 0,
+	"EXIT_FAILURE": 1,
+}
+
+// defineStdlib defines the constants of the standard prelude, for our
+// architecture, unless they've already been defined via Define.
+func (c *Compiler) defineStdlib() {
+
+	for _, table := range []map[string]int64{syscalls[c.arch], constants} {
+		for name, value := range table {
+			if _, ok := c.defines[name]; !ok {
+				c.Define(name, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package elf
+
+// Line maps the code at the given offset, counting from the start of the
+// code, to the line of the source file which generated it.
+type Line struct {
+	Offset uint64
+	Line   int
+}
+
+// SetDebugLines causes the generated binary to contain a minimal set of
+// DWARF debugging information, mapping the code to the lines of the
+// named source file, which allows `gdb` to step through the program by
+// source line.
+//
+// The lines must be sorted by their offset.
+func (e *Elf) SetDebugLines(source string, lines []Line) {
+	e.source = source
+	e.lines = lines
+}
+
+// sectionTable holds the debugging sections, and the section headers
+// which describe them, any notes, and the tables of any shared object,
+// which are appended to the generated binary.
+type sectionTable struct {
+	// data holds the contents of the sections, followed by the
+	// section headers.
+	data []byte
+
+	// offset is the offset of the section headers within the file,
+	// or zero if there are none.
+	offset uint64
+
+	// count is the number of section headers, and strings the index
+	// of the section containing their names.
+	count   int
+	strings int
+}
+
+// Section types, and flags, used in the section headers.
+const (
+	shtProgbits = 1
+	shtStrtab   = 3
+	shtHash     = 5
+	shtDynamic  = 6
+	shtNote     = 7
+	shtDynsym   = 11
+
+	shfWrite = 0x1
+	shfAlloc = 0x2
+	shfExec  = 0x4
+)
+
+// DWARF constants used in the debugging information.
+const (
+	dwTagCompileUnit = 0x11
+
+	dwAtName     = 0x03
+	dwAtStmtList = 0x10
+	dwAtLowPC    = 0x11
+	dwAtHighPC   = 0x12
+	dwAtLanguage = 0x13
+
+	dwFormAddr      = 0x01
+	dwFormData2     = 0x05
+	dwFormData4     = 0x06
+	dwFormString    = 0x08
+	dwFormSecOffset = 0x17
+
+	dwLangMipsAssembler = 0x8001
+
+	dwLnsCopy        = 0x01
+	dwLnsAdvancePC   = 0x02
+	dwLnsAdvanceLine = 0x03
+
+	dwLneEndSequence = 0x01
+	dwLneSetAddress  = 0x02
+)
+
+// buildSections returns the debugging sections, and the section headers
+// describing them, the given notes, and the given tables of a shared
+// object, which follow the code and data in the binary with the given
+// layout.
+func (e *Elf) buildSections(layout Layout, notes []note, tables dynamicTables) sectionTable {
+
+	if e.lines == nil && notes == nil && tables.dynamic == nil {
+		return sectionTable{}
+	}
+
+	// The size of an address, which is also the size of several
+	// fields within the section headers.
+	size := e.class / 8
+
+	type section struct {
+		name  string
+		kind  uint64
+		flags uint64
+		addr  uint64
+		data  []byte
+
+		// offset is the offset of sections which are already
+		// present within the binary, rather than appended.
+		offset uint64
+
+		// link is the name of the related section, info depends
+		// upon the type of the section, and entry is the size of
+		// each entry of a table.
+		link  string
+		info  uint64
+		entry uint64
+	}
+
+	// The notes follow the program headers.
+	var sections []section
+	offset := layout.NoteOffset
+	for _, n := range notes {
+		sections = append(sections, section{name: n.section, kind: shtNote, flags: shfAlloc,
+			addr: e.base + offset, data: n.data, offset: offset})
+		offset += uint64(len(n.data))
+	}
+
+	// The tables of a shared object follow the program headers, and
+	// the dynamic section begins the data segment.
+	if tables.dynamic != nil {
+		hash := layout.TableOffset
+		symbols := hash + uint64(len(tables.hash))
+		strs := symbols + uint64(len(tables.symbols))
+		sections = append(sections,
+			section{name: ".hash", kind: shtHash, flags: shfAlloc, addr: e.base + hash,
+				data: tables.hash, offset: hash, link: ".dynsym", entry: 4},
+			section{name: ".dynsym", kind: shtDynsym, flags: shfAlloc, addr: e.base + symbols,
+				data: tables.symbols, offset: symbols, link: ".dynstr", info: 1, entry: symbolSize},
+			section{name: ".dynstr", kind: shtStrtab, flags: shfAlloc, addr: e.base + strs,
+				data: tables.strings, offset: strs},
+			section{name: ".dynamic", kind: shtDynamic, flags: shfAlloc | shfWrite, addr: layout.DynamicAddress,
+				data: tables.dynamic, offset: layout.DynamicOffset, link: ".dynstr", entry: dynamicEntrySize})
+	}
+
+	if e.lines != nil {
+		sections = append(sections,
+			section{name: ".debug_abbrev", kind: shtProgbits, data: e.debugAbbrev()},
+			section{name: ".debug_info", kind: shtProgbits, data: e.debugInfo(layout)},
+			section{name: ".debug_line", kind: shtProgbits, data: e.debugLine(layout)})
+	}
+	sections = append(sections, section{name: ".shstrtab", kind: shtStrtab})
+
+	// The section names, with the empty name of the null section
+	// first, followed by the name of our code.
+	names := []byte("\x00.text\x00")
+	offsets := make([]uint64, len(sections))
+	for n, s := range sections {
+		offsets[n] = uint64(len(names))
+		names = append(append(names, s.name...), 0)
+	}
+	sections[len(sections)-1].data = names
+
+	var o Builder
+
+	// The contents of each section, recording where each begins.
+	start := layout.DataOffset + layout.DataSize
+	positions := make([]uint64, len(sections))
+	for n, s := range sections {
+		if s.offset != 0 {
+			positions[n] = s.offset
+			continue
+		}
+		positions[n] = start + uint64(len(o.o))
+		o.WriteBytes(s.data...)
+	}
+
+	// The section headers must be aligned.
+	for (start+uint64(len(o.o)))%8 != 0 {
+		o.WriteBytes(0)
+	}
+	table := start + uint64(len(o.o))
+
+	header := func(name, kind, flags, addr, offset, length, link, info, entry uint64) {
+		o.WriteValue(4, name)
+		o.WriteValue(4, kind)
+		o.WriteValue(size, flags)
+		o.WriteValue(size, addr)
+		o.WriteValue(size, offset)
+		o.WriteValue(size, length)
+		o.WriteValue(4, link)
+		o.WriteValue(4, info)
+		o.WriteValue(size, 1)
+		o.WriteValue(size, entry)
+	}
+
+	// The null section, and the code which is described by the
+	// debugging information.
+	header(0, 0, 0, 0, 0, 0, 0, 0, 0)
+	header(1, shtProgbits, shfAlloc|shfExec, layout.CodeAddress, layout.CodeOffset, layout.CodeSize, 0, 0, 0)
+
+	// Sections are linked by their index, which follows the null
+	// section and the code.
+	index := func(name string) uint64 {
+		for n, s := range sections {
+			if s.name == name {
+				return uint64(n + 2)
+			}
+		}
+		return 0
+	}
+	for n, s := range sections {
+		header(offsets[n], s.kind, s.flags, s.addr, positions[n], uint64(len(s.data)), index(s.link), s.info, s.entry)
+	}
+
+	return sectionTable{
+		data:    o.o,
+		offset:  table,
+		count:   len(sections) + 2,
+		strings: len(sections) + 1,
+	}
+}
+
+// debugAbbrev returns the abbreviations used by the debugging information,
+// describing the single compilation unit.
+func (e *Elf) debugAbbrev() []byte {
+	var o Builder
+
+	o.WriteBytes(uleb128(1)...)
+	o.WriteBytes(uleb128(dwTagCompileUnit)...)
+	o.WriteBytes(0) // No children
+
+	for _, attr := range [][2]uint64{
+		{dwAtName, dwFormString},
+		{dwAtStmtList, dwFormSecOffset},
+		{dwAtLowPC, dwFormAddr},
+		{dwAtHighPC, dwFormData4},
+		{dwAtLanguage, dwFormData2},
+		{0, 0},
+	} {
+		o.WriteBytes(uleb128(attr[0])...)
+		o.WriteBytes(uleb128(attr[1])...)
+	}
+
+	o.WriteBytes(0) // End of abbreviations
+	return o.o
+}
+
+// debugInfo returns the compilation unit, which refers to the line-number
+// program describing our code.
+func (e *Elf) debugInfo(layout Layout) []byte {
+	var body Builder
+
+	body.WriteValue(2, 4) // DWARF version
+	body.WriteValue(4, 0) // Offset of the abbreviations
+	body.WriteBytes(byte(e.class / 8))
+
+	body.WriteBytes(uleb128(1)...) // Our single abbreviation
+	body.WriteBytes(append([]byte(e.source), 0)...)
+	body.WriteValue(4, 0) // Offset of the line-number program
+	body.WriteValue(e.class/8, layout.CodeAddress)
+	body.WriteValue(4, layout.CodeSize)
+	body.WriteValue(2, dwLangMipsAssembler)
+
+	var o Builder
+	o.WriteValue(4, uint64(len(body.o)))
+	o.WriteBytes(body.o...)
+	return o.o
+}
+
+// debugLine returns the line-number program, which maps each of our lines
+// to the address of the code generated from it.
+//
+// We only use the standard opcodes, rather than the more compact special
+// opcodes, for simplicity.
+func (e *Elf) debugLine(layout Layout) []byte {
+
+	// The header, following the header-length field.
+	var header Builder
+	header.WriteBytes(1)    // Minimum instruction length
+	header.WriteBytes(1)    // Maximum operations per instruction
+	header.WriteBytes(1)    // Default is_stmt
+	header.WriteBytes(0xfb) // Line base, -5
+	header.WriteBytes(14)   // Line range
+	header.WriteBytes(13)   // Opcode base
+
+	// The number of arguments of each standard opcode
+	header.WriteBytes(0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1)
+
+	header.WriteBytes(0) // No include directories
+	header.WriteBytes(append([]byte(e.source), 0)...)
+	header.WriteBytes(0, 0, 0) // Directory, modification time, and length
+	header.WriteBytes(0)       // End of files
+
+	// The program itself
+	var program Builder
+	program.WriteBytes(0, byte(1+e.class/8), dwLneSetAddress)
+	program.WriteValue(e.class/8, layout.CodeAddress)
+
+	line, offset := 1, uint64(0)
+	for _, l := range e.lines {
+		if l.Line != line {
+			program.WriteBytes(dwLnsAdvanceLine)
+			program.WriteBytes(sleb128(int64(l.Line - line))...)
+			line = l.Line
+		}
+		if l.Offset != offset {
+			program.WriteBytes(dwLnsAdvancePC)
+			program.WriteBytes(uleb128(l.Offset - offset)...)
+			offset = l.Offset
+		}
+		program.WriteBytes(dwLnsCopy)
+	}
+
+	// The sequence ends after the last of our code
+	if layout.CodeSize > offset {
+		program.WriteBytes(dwLnsAdvancePC)
+		program.WriteBytes(uleb128(layout.CodeSize - offset)...)
+	}
+	program.WriteBytes(0, 1, dwLneEndSequence)
+
+	var o Builder
+	o.WriteValue(4, uint64(2+4+len(header.o)+len(program.o))) // Unit length
+	o.WriteValue(2, 4)                                        // DWARF version
+	o.WriteValue(4, uint64(len(header.o)))                    // Header length
+	o.WriteBytes(header.o...)
+	o.WriteBytes(program.o...)
+	return o.o
+}
+
+// uleb128 returns the unsigned LEB128 encoding of the given value.
+func uleb128(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			return out
+		}
+	}
+}
+
+// sleb128 returns the signed LEB128 encoding of the given value.
+func sleb128(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
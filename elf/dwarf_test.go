@@ -0,0 +1,95 @@
+package elf
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"testing"
+)
+
+func TestDebugLines(t *testing.T) {
+
+	code := []byte{0x90, 0x48, 0xff, 0xc0, 0xc3}
+	lines := []Line{{Offset: 0, Line: 3}, {Offset: 1, Line: 5}, {Offset: 4, Line: 2}}
+
+	for _, class := range []int{32, 64} {
+
+		e := New()
+		e.SetClass(class)
+		e.SetDebugLines("test.asm", lines)
+
+		out := e.Build(code, []byte("data"))
+
+		f, err := elf.NewFile(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to parse ELF: %s", err)
+		}
+
+		layout := e.Layout(uint64(len(code)), 4)
+
+		text := f.Section(".text")
+		if text == nil || text.Addr != layout.CodeAddress || text.Size != uint64(len(code)) {
+			t.Fatalf("unexpected .text section %v", text)
+		}
+		if f.Section(".debug_line") == nil {
+			t.Fatalf("missing .debug_line section")
+		}
+
+		d, err := f.DWARF()
+		if err != nil {
+			t.Fatalf("failed to read DWARF: %s", err)
+		}
+		cu, err := d.Reader().Next()
+		if err != nil || cu == nil {
+			t.Fatalf("failed to read compilation unit: %s", err)
+		}
+		if cu.Val(dwarf.AttrName) != "test.asm" {
+			t.Fatalf("unexpected compilation unit %v", cu)
+		}
+
+		lr, err := d.LineReader(cu)
+		if err != nil || lr == nil {
+			t.Fatalf("failed to read line table: %s", err)
+		}
+
+		var entry dwarf.LineEntry
+		for _, l := range lines {
+			err = lr.Next(&entry)
+			if err != nil {
+				t.Fatalf("failed to read line entry: %s", err)
+			}
+			if entry.Address != layout.CodeAddress+l.Offset || entry.Line != l.Line ||
+				entry.File.Name != "test.asm" {
+				t.Fatalf("unexpected line entry %x:%d, expected %x:%d", entry.Address, entry.Line, layout.CodeAddress+l.Offset, l.Line)
+			}
+		}
+
+		// The sequence ends after our code.
+		err = lr.Next(&entry)
+		if err != nil || !entry.EndSequence || entry.Address != layout.CodeAddress+uint64(len(code)) {
+			t.Fatalf("unexpected end of sequence %v", entry)
+		}
+	}
+
+	// Without debugging information there are no sections.
+	f, err := elf.NewFile(bytes.NewReader(New().Build(code, nil)))
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	if len(f.Sections) != 0 {
+		t.Fatalf("unexpected sections %v", f.Sections)
+	}
+}
+
+func TestLEB128(t *testing.T) {
+
+	if !bytes.Equal(uleb128(624485), []byte{0xe5, 0x8e, 0x26}) {
+		t.Fatalf("unexpected unsigned encoding % x", uleb128(624485))
+	}
+	if !bytes.Equal(sleb128(-123456), []byte{0xc0, 0xbb, 0x78}) {
+		t.Fatalf("unexpected signed encoding % x", sleb128(-123456))
+	}
+	if !bytes.Equal(sleb128(63), []byte{0x3f}) || !bytes.Equal(sleb128(64), []byte{0xc0, 0x00}) {
+		t.Fatalf("unexpected signed encoding")
+	}
+}
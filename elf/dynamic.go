@@ -0,0 +1,143 @@
+package elf
+
+import "sort"
+
+// Program header types used by shared objects.
+const (
+	ptDynamic  = 2
+	ptGnuStack = 0x6474e551
+)
+
+// Dynamic section tags
+const (
+	dtNull   = 0
+	dtHash   = 4
+	dtStrtab = 5
+	dtSymtab = 6
+	dtStrsz  = 10
+	dtSyment = 11
+)
+
+// symbolSize is the size of each entry in the dynamic symbol table, and
+// dynamicEntrySize the size of each entry in the dynamic section.
+const (
+	symbolSize       = 24
+	dynamicEntrySize = 16
+)
+
+// Export is a function exported by a shared object, at the given offset
+// from the start of the code.
+type Export struct {
+	Name   string
+	Offset uint64
+}
+
+// SetShared causes a shared object (ET_DYN) to be generated, rather than
+// an executable, whose dynamic symbol table exports the given functions
+// so that they may be found by `dlopen` and `dlsym`.
+//
+// Shared objects are loaded at an address chosen by the loader, so their
+// addresses are relative to zero, and their code must be position
+// independent.  Only 64-bit shared objects are supported.
+func (e *Elf) SetShared(exports []Export) {
+	e.exports = append([]Export{}, exports...)
+	sort.Slice(e.exports, func(a, b int) bool { return e.exports[a].Name < e.exports[b].Name })
+	e.base = 0
+}
+
+// shared returns true if we generate a shared object.
+func (e *Elf) shared() bool {
+	return len(e.exports) > 0 && e.class == 64
+}
+
+// dynamicTables holds the read-only tables used by the dynamic loader,
+// which follow the program headers, and the dynamic section which refers
+// to them, at the start of the data segment.
+type dynamicTables struct {
+	hash    []byte
+	symbols []byte
+	strings []byte
+	dynamic []byte
+}
+
+// size returns the size of the read-only tables.
+func (d dynamicTables) size() uint64 {
+	return uint64(len(d.hash) + len(d.symbols) + len(d.strings))
+}
+
+// tableSize returns the size of the read-only tables of a shared object,
+// which doesn't depend upon the contents of the binary.
+func (e *Elf) tableSize() uint64 {
+	return e.buildDynamic(Layout{}).size()
+}
+
+// buildDynamic returns the dynamic tables of a shared object with the
+// given layout, if one is to be generated.
+//
+// The sizes of the tables don't depend upon the layout, so they may be
+// built with an empty layout to find them.
+func (e *Elf) buildDynamic(layout Layout) dynamicTables {
+
+	if !e.shared() {
+		return dynamicTables{}
+	}
+
+	var d dynamicTables
+
+	// The names of the symbols, following the empty name of the null
+	// symbol.
+	names := []byte{0}
+	offsets := make([]uint64, len(e.exports))
+	for n, exp := range e.exports {
+		offsets[n] = uint64(len(names))
+		names = append(append(names, exp.Name...), 0)
+	}
+	d.strings = pad(names)
+
+	// The null symbol, followed by each of our functions, which are
+	// global and within the .text section.
+	var o Builder
+	o.WriteBytes(make([]byte, symbolSize)...)
+	for n, exp := range e.exports {
+		o.WriteValue(4, offsets[n])
+		o.WriteBytes(0x12) // STB_GLOBAL, STT_FUNC
+		o.WriteBytes(0)    // Default visibility
+		o.WriteValue(2, 1) // The .text section
+		o.WriteValue(8, layout.CodeAddress+exp.Offset)
+		o.WriteValue(8, 0) // Unknown size
+	}
+	d.symbols = o.o
+
+	// The hash table has a single bucket, which chains the symbols
+	// from the last to the first, so every symbol is found.
+	count := uint64(len(e.exports) + 1)
+	var h Builder
+	h.WriteValue(4, 1)
+	h.WriteValue(4, count)
+	h.WriteValue(4, count-1)
+	h.WriteValue(4, 0)
+	for n := uint64(1); n < count; n++ {
+		h.WriteValue(4, n-1)
+	}
+	d.hash = h.o
+
+	hash := layout.TableOffset
+	symbols := hash + uint64(len(d.hash))
+	strs := symbols + uint64(len(d.symbols))
+
+	var dyn Builder
+	for _, entry := range [][2]uint64{
+		{dtHash, e.base + hash},
+		{dtStrtab, e.base + strs},
+		{dtSymtab, e.base + symbols},
+		{dtStrsz, uint64(len(d.strings))},
+		{dtSyment, symbolSize},
+		{dtNull, 0},
+	} {
+		dyn.WriteValue(8, entry[0])
+		dyn.WriteValue(8, entry[1])
+	}
+	d.dynamic = dyn.o
+
+	return d
+}
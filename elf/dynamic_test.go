@@ -0,0 +1,98 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+func TestShared(t *testing.T) {
+
+	code := []byte{0x90, 0xb8, 0x2a, 0x00, 0x00, 0x00, 0xc3}
+	data := []byte("data")
+
+	e := New()
+	e.SetNotes("1.2.3")
+	e.SetShared([]Export{{Name: "answer", Offset: 1}})
+
+	f, err := elf.NewFile(bytes.NewReader(e.Build(code, data)))
+	if err != nil {
+		t.Fatalf("failed to parse ELF: %s", err)
+	}
+	if f.Type != elf.ET_DYN {
+		t.Fatalf("expected a shared object, got %v", f.Type)
+	}
+
+	// The tables precede the notes, and the dynamic section precedes
+	// the data.
+	layout := e.Layout(uint64(len(code)), uint64(len(data)))
+	if layout.TableOffset+layout.TableSize != layout.NoteOffset ||
+		layout.DynamicOffset+layout.DynamicSize != layout.DataOffset ||
+		layout.CodeAddress != layout.CodeOffset {
+		t.Fatalf("unexpected layout %+v", layout)
+	}
+
+	symbols, err := f.DynamicSymbols()
+	if err != nil {
+		t.Fatalf("failed to read the dynamic symbols: %s", err)
+	}
+	if len(symbols) != 1 ||
+		symbols[0].Name != "answer" ||
+		symbols[0].Value != layout.CodeAddress+1 ||
+		elf.ST_BIND(symbols[0].Info) != elf.STB_GLOBAL ||
+		elf.ST_TYPE(symbols[0].Info) != elf.STT_FUNC {
+		t.Fatalf("unexpected dynamic symbols %v", symbols)
+	}
+
+	var dynamic, stack *elf.Prog
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_DYNAMIC:
+			dynamic = p
+		case ptGnuStack:
+			stack = p
+		}
+	}
+	if dynamic == nil || dynamic.Off != layout.DynamicOffset || dynamic.Vaddr != layout.DynamicAddress {
+		t.Fatalf("unexpected PT_DYNAMIC segment %v", dynamic)
+	}
+	if stack == nil || stack.Flags&elf.PF_X != 0 {
+		t.Fatalf("unexpected PT_GNU_STACK segment %v", stack)
+	}
+
+	// The dynamic section refers to the tables.
+	s := f.Section(".dynamic")
+	contents, err := s.Data()
+	if err != nil || len(contents) != int(layout.DynamicSize) {
+		t.Fatalf("unexpected dynamic section %v", s)
+	}
+	values := make(map[elf.DynTag]uint64)
+	for n := 0; n+16 <= len(contents); n += 16 {
+		tag := elf.DynTag(binary.LittleEndian.Uint64(contents[n:]))
+		values[tag] = binary.LittleEndian.Uint64(contents[n+8:])
+	}
+	for tag, section := range map[elf.DynTag]string{
+		elf.DT_HASH:   ".hash",
+		elf.DT_SYMTAB: ".dynsym",
+		elf.DT_STRTAB: ".dynstr",
+	} {
+		s := f.Section(section)
+		if s == nil || values[tag] != s.Addr {
+			t.Fatalf("unexpected %v 0x%x for %v", tag, values[tag], s)
+		}
+	}
+
+	// The data is unchanged, following the dynamic section.
+	raw := e.Build(code, data)
+	if !bytes.Equal(raw[layout.DataOffset:layout.DataOffset+layout.DataSize], data) {
+		t.Fatalf("the data is not at offset 0x%x", layout.DataOffset)
+	}
+
+	// 32-bit binaries cannot be shared objects.
+	e.SetClass(32)
+	f, err = elf.NewFile(bytes.NewReader(e.Build(code, data)))
+	if err != nil || f.Type != elf.ET_EXEC {
+		t.Fatalf("unexpected 32-bit binary %v %v", f, err)
+	}
+}
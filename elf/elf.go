@@ -2,15 +2,43 @@ package elf
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 )
 
 const (
-	virtualStartAddress     uint64 = 0x400000
-	dataVirtualStartAddress uint64 = 0x600000
-	alignment               uint64 = 0x200000
+	// virtualStartAddress is the default address at which the code
+	// segment, which includes the headers, is loaded.
+	virtualStartAddress uint64 = 0x400000
+
+	// alignment is the alignment of our segments, the data segment
+	// is loaded this far above the code segment.
+	alignment uint64 = 0x200000
+
+	// pageSize is the granularity of memory-protection, the data
+	// begins upon a fresh page so that it isn't executable.
+	pageSize uint64 = 0x1000
+)
+
+// ptNote is the type of the segment containing any notes.
+const ptNote = 4
+
+// Segment permissions
+const (
+	pfX = 0x1
+	pfW = 0x2
+	pfR = 0x4
 )
 
+// write is used to write the generated binary to the given file, it is
+// a variable so that failures may be simulated by our test-cases.
+var write = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
 type Builder struct {
 	o []byte
 }
@@ -20,32 +48,263 @@ func (b *Builder) WriteBytes(bs ...byte) {
 }
 
 func (b *Builder) WriteValue(size int, value uint64) {
-	buf := make([]byte, size)
+	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(buf, value)
-	b.WriteBytes(buf...)
+	b.WriteBytes(buf[:size]...)
+}
+
+// Layout describes where the contents of a generated binary are placed,
+// both within the file and in memory once it has been loaded.
+type Layout struct {
+	// Entry is the virtual address at which execution begins.
+	Entry uint64
+
+	// NoteOffset is the offset of any notes within the file, which
+	// follow the program headers, and NoteAddress their address.
+	NoteOffset  uint64
+	NoteAddress uint64
+	NoteSize    uint64
+
+	// TableOffset is the offset of the read-only tables of a shared
+	// object, its symbols, their names, and their hash table, which
+	// precede any notes.
+	TableOffset uint64
+	TableSize   uint64
+
+	// CodeOffset is the offset of the code within the file, and
+	// CodeAddress the virtual address at which it is loaded.
+	CodeOffset  uint64
+	CodeAddress uint64
+	CodeSize    uint64
+
+	// DataOffset is the offset of the data within the file, and
+	// DataAddress the virtual address of the data segment.
+	DataOffset  uint64
+	DataAddress uint64
+	DataSize    uint64
+
+	// BssSize is the size of the zero-filled memory which follows
+	// the data, which isn't stored within the file.
+	BssSize uint64
+
+	// DynamicOffset is the offset of the dynamic section of a shared
+	// object, which begins the data segment and precedes the data,
+	// and DynamicAddress its address.
+	DynamicOffset  uint64
+	DynamicAddress uint64
+	DynamicSize    uint64
 }
 
 type Elf struct {
+	// class is the ELF-class we generate, either 32 or 64 bits.
+	class int
+
+	// base is the address at which the code segment is loaded.
+	base uint64
+
+	// bss is the size of the zero-filled memory following the data.
+	bss uint64
+
+	// codeAlign is the alignment of the code, both within the file
+	// and in memory, or zero if it immediately follows the headers.
+	codeAlign uint64
+
+	// source is the name of the source file, and lines maps our
+	// code to its lines, for the debugging information.
+	source string
+	lines  []Line
+
+	// notes is true if we generate notes, recording the version of
+	// the assembler and the build-id of the binary.
+	notes   bool
+	version string
+
+	// exports holds the functions exported by a shared object, which
+	// is generated rather than an executable if there are any.
+	exports []Export
 }
 
 func New() *Elf {
-	return &Elf{}
+	return &Elf{class: 64, base: virtualStartAddress}
 }
 
-func (e *Elf) WriteContent(path string, textSection, dataSection []byte) error {
+// SetBase changes the address at which the binary is loaded, which
+// defaults to 0x400000.  It must be a multiple of 0x200000.
+func (e *Elf) SetBase(address uint64) error {
+	if address%alignment != 0 {
+		return fmt.Errorf("base address 0x%x is not aligned to 0x%x", address, alignment)
+	}
+	e.base = address
+	return nil
+}
 
-	data := e.buildELF(textSection, dataSection)
-	if err := ioutil.WriteFile(path, data, 0755); err != nil {
-		return err
+// SetCodeAlignment causes the code to begin upon a multiple of the given
+// alignment, both within the file and in memory, by padding the headers
+// which precede it.  The alignment must be a power of two, no larger
+// than 0x200000, for example 0x1000 to begin the code upon a fresh page.
+func (e *Elf) SetCodeAlignment(n uint64) error {
+	if n == 0 || n&(n-1) != 0 || n > alignment {
+		return fmt.Errorf("code alignment 0x%x is not a power of two up to 0x%x", n, alignment)
 	}
+	e.codeAlign = n
+	return nil
+}
 
+// SetBss reserves the given number of zero-filled bytes after the data,
+// which occupy memory but not space within the file.
+func (e *Elf) SetBss(size uint64) {
+	e.bss = size
+}
+
+// SetClass changes the type of binary we generate, which may be either a
+// 32-bit (i386) executable or a 64-bit (x86-64) one.
+func (e *Elf) SetClass(bits int) error {
+	if bits != 32 && bits != 64 {
+		return fmt.Errorf("unsupported ELF class %d", bits)
+	}
+	e.class = bits
 	return nil
 }
 
+// HeaderSize returns the size of the ELF header, the program headers,
+// the tables of any shared object, and any notes, which precede the code
+// in the generated binary.
+func (e *Elf) HeaderSize() int {
+	if e.class == 32 {
+		return 0x34 + (e.programHeaders() * 0x20) + int(e.noteSize())
+	}
+	return 0x40 + (e.programHeaders() * 0x38) + int(e.tableSize()+e.noteSize())
+}
+
+// Layout returns the layout of a binary containing code, and data, of
+// the given sizes.
+//
+// The code immediately follows the headers, and the data follows the
+// code, beginning upon a fresh page.  The code segment is loaded at the
+// base address, 0x400000 by default, including the headers, so the code
+// is loaded just after that.  The data segment is loaded 0x200000 above
+// the base address, plus its offset within the file.
+//
+// The code segment is readable and executable, and the data segment is
+// readable and writable, so no memory is both writable and executable.
+//
+// Any notes are placed between the program headers and the code, within
+// the code segment, and if the code is aligned it is preceded by padding.
+//
+// Shared objects place the tables used by the dynamic loader before any
+// notes, and the dynamic section, which the loader may modify, at the
+// start of the data segment, before the data.
+func (e *Elf) Layout(textSize, dataSize uint64) Layout {
+	textOffset := uint64(e.HeaderSize())
+	if e.codeAlign > 0 {
+		textOffset = (textOffset + e.codeAlign - 1) / e.codeAlign * e.codeAlign
+	}
+	dataOffset := (textOffset + textSize + pageSize - 1) / pageSize * pageSize
+	dynamicOffset := dataOffset
+	if e.shared() {
+		dataOffset += uint64(len(e.buildDynamic(Layout{}).dynamic))
+	}
+
+	layout := Layout{
+		Entry:       e.base + textOffset,
+		CodeOffset:  textOffset,
+		CodeAddress: e.base + textOffset,
+		CodeSize:    textSize,
+		DataOffset:  dataOffset,
+		DataAddress: e.base + alignment + dataOffset,
+		DataSize:    dataSize,
+		BssSize:     e.bss,
+	}
+
+	if e.notes {
+		layout.NoteSize = e.noteSize()
+		layout.NoteOffset = uint64(e.HeaderSize()) - layout.NoteSize
+		layout.NoteAddress = e.base + layout.NoteOffset
+	}
+	if e.shared() {
+		layout.TableSize = e.tableSize()
+		layout.TableOffset = uint64(e.HeaderSize()) - e.noteSize() - layout.TableSize
+		layout.DynamicOffset = dynamicOffset
+		layout.DynamicAddress = e.base + alignment + dynamicOffset
+		layout.DynamicSize = dataOffset - dynamicOffset
+	}
+	return layout
+}
+
+// WriteContent writes an executable containing the given code and data
+// to the specified path.
+func (e *Elf) WriteContent(path string, textSection, dataSection []byte) error {
+	_, err := e.WriteContentWithLayout(path, textSection, dataSection)
+	return err
+}
+
+// WriteContentWithLayout writes an executable containing the given code
+// and data to the specified path, and returns the layout of the binary.
+func (e *Elf) WriteContentWithLayout(path string, textSection, dataSection []byte) (Layout, error) {
+
+	layout := e.Layout(uint64(len(textSection)), uint64(len(dataSection)))
+
+	data := e.Build(textSection, dataSection)
+
+	// Devices, and pipes, such as /dev/stdout, cannot be replaced
+	// so they are written to directly.
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return Layout{}, err
+		}
+		err = write(f, data)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			return Layout{}, err
+		}
+		return layout, nil
+	}
+
+	// Write to a temporary file, alongside the destination, so that
+	// we only replace any existing binary once we've succeeded.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".elf-")
+	if err != nil {
+		return Layout{}, err
+	}
+
+	err = write(tmp, data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return Layout{}, err
+	}
+
+	return layout, nil
+}
+
+// Build returns the executable containing the given code and data.
+//
+// The output depends only upon the input, there are no timestamps or
+// similar, so identical input will always produce identical output.
+func (e *Elf) Build(textSection, dataSection []byte) []byte {
+	if e.class == 32 {
+		return e.buildELF32(textSection, dataSection)
+	}
+	return e.buildELF(textSection, dataSection)
+}
+
 func (e *Elf) buildELF(textSection, dataSection []byte) []byte {
-	textSize := uint64(len(textSection))
-	// Size of ELF header + 2 * size program header?
-	textOffset := uint64(0x40 + (2 * 0x38))
+	layout := e.Layout(uint64(len(textSection)), uint64(len(dataSection)))
 
 	var o Builder
 
@@ -60,53 +319,216 @@ func (e *Elf) buildELF(textSection, dataSection []byte) []byte {
 
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Unused bytes
 
-	o.WriteBytes(0x02, 0x00)             // Executable type
+	if e.shared() {
+		o.WriteBytes(0x03, 0x00) // Shared object type
+	} else {
+		o.WriteBytes(0x02, 0x00) // Executable type
+	}
 	o.WriteBytes(0x3e, 0x00)             // x86-64 target architecture
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // ELF version
 
 	// 64-bit virtual offsets always start at 0x400000?? https://stackoverflow.com/questions/38549972/why-elf-executables-have-a-fixed-load-address
 	// This seems to be a convention set in the x86_64 system-v abi: https://refspecs.linuxfoundation.org/elf/x86_64-SysV-psABI.pdf P26
-	o.WriteValue(8, virtualStartAddress+textOffset)
+	o.WriteValue(8, layout.Entry)
+
+	// Section headers are only present with debugging information,
+	// notes, or the tables of a shared object
+	notes := e.buildNotes(textSection, dataSection)
+	tables := e.buildDynamic(layout)
+	sections := e.buildSections(layout, notes, tables)
+	headers := uint64(e.programHeaders())
+	sectionSize := uint64(0)
+	if sections.count > 0 {
+		sectionSize = 0x40
+	}
 
 	o.WriteBytes(0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Offset from file to program header
-	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Start of section header table
+	o.WriteValue(8, sections.offset)                             // Start of section header table
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00)                         // Flags
 	o.WriteBytes(0x40, 0x00)                                     // Size of this header
 	o.WriteBytes(0x38, 0x00)                                     // Size of a program header table entry - This should always be the same for 64-bit
-	o.WriteBytes(0x02, 0x00)                                     // Length of sections: data and text for now
-	o.WriteBytes(0x00, 0x00)                                     // Size of section header, which we aren't using
-	o.WriteBytes(0x00, 0x00)                                     // Number of entries section header
-	o.WriteBytes(0x00, 0x00)                                     // Index of section header table entry
+	o.WriteValue(2, headers)                                     // Number of program headers
+	o.WriteValue(2, sectionSize)                                 // Size of a section header
+	o.WriteValue(2, uint64(sections.count))                      // Number of entries section header
+	o.WriteValue(2, uint64(sections.strings))                    // Index of section header table entry
+
+	// The text segment includes the headers, which precede the code.
+	textSize := layout.CodeOffset + layout.CodeSize
 
 	// Build Program Header
 	// Text Segment
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x07, 0x00, 0x00, 0x00) // Flags: 0x4 executable, 0x2 write, 0x1 read
-	o.WriteValue(8, 0)                   // textOffset)          // Offset from the beginning of the file. These values depend on how big the header and segment sizes are.
-	o.WriteValue(8, virtualStartAddress)
-	o.WriteValue(8, virtualStartAddress) // Physical address, irrelavnt on linux.
+	o.WriteValue(4, pfR|pfX)             // Flags: read, and execute
+	o.WriteValue(8, 0)                   // Offset from the beginning of the file. These values depend on how big the header and segment sizes are.
+	o.WriteValue(8, e.base)              // Virtual address.
+	o.WriteValue(8, e.base)              // Physical address, irrelavnt on linux.
 	o.WriteValue(8, textSize)            // Number of bytes in file image of segment, must be larger than or equal to the size of payload in segment. Should be zero for bss data.
 	o.WriteValue(8, textSize)            // Number of bytes in memory image of segment, is not always same size as file image.
 	o.WriteValue(8, alignment)
 
-	dataSize := uint64(len(dataSection))
-	dataOffset := uint64(textOffset + textSize)
-	dataVirtualAddress := dataVirtualStartAddress + dataOffset
+	// Any dynamic section precedes the data, within the data segment.
+	dataSize := layout.DynamicSize + layout.DataSize
+	dataOffset := layout.DataOffset - layout.DynamicSize
+	dataVirtualAddress := layout.DataAddress - layout.DynamicSize
+	memSize := dataSize + layout.BssSize
 
 	// Build Program Header
 	// Data Segment
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x07, 0x00, 0x00, 0x00) // Flags: 0x4 executable, 0x2 write, 0x1 read
+	o.WriteValue(4, pfR|pfW)             // Flags: read, and write
 	o.WriteValue(8, dataOffset)          // Offset address.
 	o.WriteValue(8, dataVirtualAddress)  // Virtual address.
 	o.WriteValue(8, dataVirtualAddress)  // Physical address.
 	o.WriteValue(8, dataSize)            // Number of bytes in file image.
-	o.WriteValue(8, dataSize)            // Number of bytes in memory image.
+	o.WriteValue(8, memSize)             // Number of bytes in memory image, including the bss.
 	o.WriteValue(8, alignment)
 
-	// Output the text segment
+	// Build Program Header
+	// Notes, which are within the text segment
+	if notes != nil {
+		o.WriteValue(4, ptNote)
+		o.WriteValue(4, pfR)
+		o.WriteValue(8, layout.NoteOffset)
+		o.WriteValue(8, layout.NoteAddress)
+		o.WriteValue(8, layout.NoteAddress)
+		o.WriteValue(8, layout.NoteSize)
+		o.WriteValue(8, layout.NoteSize)
+		o.WriteValue(8, 4)
+	}
+
+	// Build Program Header
+	// Dynamic section, and a non-executable stack, of a shared object
+	if e.shared() {
+		o.WriteValue(4, ptDynamic)
+		o.WriteValue(4, pfR|pfW)
+		o.WriteValue(8, layout.DynamicOffset)
+		o.WriteValue(8, layout.DynamicAddress)
+		o.WriteValue(8, layout.DynamicAddress)
+		o.WriteValue(8, layout.DynamicSize)
+		o.WriteValue(8, layout.DynamicSize)
+		o.WriteValue(8, 8)
+
+		o.WriteValue(4, ptGnuStack)
+		o.WriteValue(4, pfR|pfW)
+		o.WriteBytes(make([]byte, 6*8)...)
+	}
+
+	// Output the tables of any shared object, any notes, and any
+	// padding, followed by the text segment
+	o.WriteBytes(tables.hash...)
+	o.WriteBytes(tables.symbols...)
+	o.WriteBytes(tables.strings...)
+	for _, n := range notes {
+		o.WriteBytes(n.data...)
+	}
+	o.WriteBytes(make([]byte, layout.CodeOffset-uint64(len(o.o)))...)
+	o.WriteBytes(textSection...)
+	// Output the data segment, upon its own page
+	o.WriteBytes(make([]byte, dataOffset-textSize)...)
+	o.WriteBytes(tables.dynamic...)
+	o.WriteBytes(dataSection...)
+	// Output any debugging information
+	o.WriteBytes(sections.data...)
+	return o.o
+}
+
+// buildELF32 is the 32-bit equivalent of buildELF, generating an i386
+// executable with the same layout.
+func (e *Elf) buildELF32(textSection, dataSection []byte) []byte {
+	layout := e.Layout(uint64(len(textSection)), uint64(len(dataSection)))
+
+	var o Builder
+
+	// Build ELF Header
+	o.WriteBytes(0x7f, 0x45, 0x4c, 0x46) // ELF magic value
+
+	o.WriteBytes(0x01) // 32-bit executable
+	o.WriteBytes(0x01) // Little endian
+	o.WriteBytes(0x01) // ELF version
+	o.WriteBytes(0x00) // Target OS ABI
+	o.WriteBytes(0x00) // Further specify ABI version
+
+	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Unused bytes
+
+	o.WriteBytes(0x02, 0x00)             // Executable type
+	o.WriteBytes(0x03, 0x00)             // i386 target architecture
+	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // ELF version
+
+	o.WriteValue(4, layout.Entry)
+
+	// Section headers are only present with debugging information,
+	// or notes
+	notes := e.buildNotes(textSection, dataSection)
+	sections := e.buildSections(layout, notes, dynamicTables{})
+	headers := uint64(e.programHeaders())
+	sectionSize := uint64(0)
+	if sections.count > 0 {
+		sectionSize = 0x28
+	}
+
+	o.WriteBytes(0x34, 0x00, 0x00, 0x00)      // Offset from file to program header
+	o.WriteValue(4, sections.offset)          // Start of section header table
+	o.WriteBytes(0x00, 0x00, 0x00, 0x00)      // Flags
+	o.WriteBytes(0x34, 0x00)                  // Size of this header
+	o.WriteBytes(0x20, 0x00)                  // Size of a program header table entry
+	o.WriteValue(2, headers)                  // Number of program headers
+	o.WriteValue(2, sectionSize)              // Size of a section header
+	o.WriteValue(2, uint64(sections.count))   // Number of entries section header
+	o.WriteValue(2, uint64(sections.strings)) // Index of section header table entry
+
+	// The text segment includes the headers, which precede the code.
+	textSize := layout.CodeOffset + layout.CodeSize
+
+	// Build Program Header
+	// Text Segment
+	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment.
+	o.WriteValue(4, 0)                   // Offset from the beginning of the file.
+	o.WriteValue(4, e.base)              // Virtual address.
+	o.WriteValue(4, e.base)              // Physical address, irrelavnt on linux.
+	o.WriteValue(4, textSize)            // Number of bytes in file image.
+	o.WriteValue(4, textSize)            // Number of bytes in memory image.
+	o.WriteValue(4, pfR|pfX)             // Flags: read, and execute
+	o.WriteValue(4, alignment)
+
+	dataSize := layout.DataSize
+	dataOffset := layout.DataOffset
+	dataVirtualAddress := layout.DataAddress
+	memSize := dataSize + layout.BssSize
+
+	// Build Program Header
+	// Data Segment
+	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment.
+	o.WriteValue(4, dataOffset)          // Offset address.
+	o.WriteValue(4, dataVirtualAddress)  // Virtual address.
+	o.WriteValue(4, dataVirtualAddress)  // Physical address.
+	o.WriteValue(4, dataSize)            // Number of bytes in file image.
+	o.WriteValue(4, memSize)             // Number of bytes in memory image, including the bss.
+	o.WriteValue(4, pfR|pfW)             // Flags: read, and write
+	o.WriteValue(4, alignment)
+
+	// Build Program Header
+	// Notes, which are within the text segment
+	if notes != nil {
+		o.WriteValue(4, ptNote)
+		o.WriteValue(4, layout.NoteOffset)
+		o.WriteValue(4, layout.NoteAddress)
+		o.WriteValue(4, layout.NoteAddress)
+		o.WriteValue(4, layout.NoteSize)
+		o.WriteValue(4, layout.NoteSize)
+		o.WriteValue(4, pfR)
+		o.WriteValue(4, 4)
+	}
+
+	// Output any notes, and any padding, followed by the text segment
+	for _, n := range notes {
+		o.WriteBytes(n.data...)
+	}
+	o.WriteBytes(make([]byte, layout.CodeOffset-uint64(len(o.o)))...)
 	o.WriteBytes(textSection...)
-	// Output the data segment
+	// Output the data segment, upon its own page
+	o.WriteBytes(make([]byte, dataOffset-textSize)...)
 	o.WriteBytes(dataSection...)
+	// Output any debugging information
+	o.WriteBytes(sections.data...)
 	return o.o
 }
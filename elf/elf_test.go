@@ -0,0 +1,305 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteContent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	e := New()
+	err = e.WriteContent(path, []byte{0x90}, []byte{})
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read binary: %s", err)
+	}
+	if string(data[0:4]) != "\x7fELF" {
+		t.Fatalf("output doesn't look like an ELF binary")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat binary: %s", err)
+	}
+	if info.Mode()&0100 == 0 {
+		t.Fatalf("binary isn't executable: %v", info.Mode())
+	}
+}
+
+func TestWriteDevice(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping device test on windows")
+	}
+
+	// Devices must be written to, rather than replaced
+	e := New()
+	err := e.WriteContent(os.DevNull, []byte{0x90}, []byte{})
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	info, err := os.Stat(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", os.DevNull, err)
+	}
+	if info.Mode().IsRegular() {
+		t.Fatalf("%s was replaced by a regular file", os.DevNull)
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create an existing "good" binary
+	path := filepath.Join(dir, "a.out")
+	err = ioutil.WriteFile(path, []byte("good"), 0755)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// Simulate a failure writing the new one
+	orig := write
+	defer func() { write = orig }()
+	write = func(f *os.File, data []byte) error {
+		f.Write(data[:len(data)/2])
+		return errors.New("disk full")
+	}
+
+	e := New()
+	err = e.WriteContent(path, []byte{0x90}, []byte{})
+	if err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+
+	// The existing binary must be untouched
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err)
+	}
+	if string(data) != "good" {
+		t.Fatalf("existing output was modified: %v", data)
+	}
+
+	// And no temporary files should remain
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temporary files left behind: %d files present", len(files))
+	}
+}
+
+func TestReproducible(t *testing.T) {
+
+	code := []byte{0x90, 0xc3}
+	data := []byte("Hello, world")
+
+	for _, class := range []int{32, 64} {
+
+		e := New()
+		err := e.SetClass(class)
+		if err != nil {
+			t.Fatalf("failed to set class %d: %s", class, err)
+		}
+
+		a := e.Build(code, data)
+		b := New()
+		b.SetClass(class)
+
+		if !bytes.Equal(a, b.Build(code, data)) {
+			t.Fatalf("output differs between builds for class %d", class)
+		}
+	}
+
+	e := New()
+	if e.SetClass(16) == nil {
+		t.Fatalf("expected error setting an invalid class")
+	}
+}
+
+func TestLayout(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	code := []byte{0x48, 0x31, 0xc0, 0xc3}
+	data := []byte("hello")
+
+	e := New()
+	layout, err := e.WriteContentWithLayout(filepath.Join(dir, "a.out"), code, data)
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	expected := Layout{
+		Entry:       0x4000b0,
+		CodeOffset:  0xb0,
+		CodeAddress: 0x4000b0,
+		CodeSize:    4,
+		DataOffset:  0x1000,
+		DataAddress: 0x601000,
+		DataSize:    5,
+	}
+	if layout != expected {
+		t.Fatalf("unexpected layout, got %+v", layout)
+	}
+
+	// The layout should match the file we've written
+	out, err := ioutil.ReadFile(filepath.Join(dir, "a.out"))
+	if err != nil {
+		t.Fatalf("failed to read binary: %s", err)
+	}
+	if !bytes.Equal(out[layout.CodeOffset:layout.CodeOffset+layout.CodeSize], code) {
+		t.Fatalf("code not found at the expected offset")
+	}
+	if !bytes.Equal(out[layout.DataOffset:], data) {
+		t.Fatalf("data not found at the expected offset")
+	}
+
+	// 32-bit binaries have smaller headers
+	e.SetClass(32)
+	layout, err = e.WriteContentWithLayout(filepath.Join(dir, "a.out"), code, data)
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+	if layout.Entry != 0x400074 || layout.DataAddress != 0x601000 {
+		t.Fatalf("unexpected layout, got %+v", layout)
+	}
+
+	// Failures return an empty layout
+	layout, err = e.WriteContentWithLayout(filepath.Join(dir, "missing", "a.out"), code, data)
+	if err == nil || layout != (Layout{}) {
+		t.Fatalf("expected an error writing to a missing directory")
+	}
+}
+
+func TestCodeAlignment(t *testing.T) {
+
+	code := []byte{0x48, 0x31, 0xc0, 0xc3}
+	data := []byte("hello")
+
+	e := New()
+	for _, n := range []uint64{0, 3, 0x1800, 0x400000} {
+		if e.SetCodeAlignment(n) == nil {
+			t.Fatalf("expected error with alignment 0x%x", n)
+		}
+	}
+	err := e.SetCodeAlignment(0x1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The code begins upon its own page, and so does the data.
+	layout := e.Layout(uint64(len(code)), uint64(len(data)))
+	if layout.CodeOffset != 0x1000 || layout.CodeAddress != 0x401000 || layout.Entry != 0x401000 ||
+		layout.DataOffset != 0x2000 || layout.DataAddress != 0x602000 {
+		t.Fatalf("unexpected layout, got %+v", layout)
+	}
+
+	out := e.Build(code, data)
+	if !bytes.Equal(out[layout.CodeOffset:layout.CodeOffset+layout.CodeSize], code) {
+		t.Fatalf("code not found at the expected offset")
+	}
+	if !bytes.Equal(out[layout.DataOffset:], data) {
+		t.Fatalf("data not found at the expected offset")
+	}
+
+	// Any notes still follow the program headers.
+	e.SetNotes("1.0")
+	layout = e.Layout(uint64(len(code)), uint64(len(data)))
+	if layout.CodeOffset != 0x1000 || layout.NoteOffset+layout.NoteSize != uint64(e.HeaderSize()) {
+		t.Fatalf("unexpected layout, got %+v", layout)
+	}
+	out = e.Build(code, data)
+	if !bytes.Equal(out[layout.CodeOffset:layout.CodeOffset+layout.CodeSize], code) {
+		t.Fatalf("code not found at the expected offset with notes")
+	}
+}
+
+func TestSegmentPermissions(t *testing.T) {
+
+	code := []byte{0x48, 0x31, 0xc0, 0xc3}
+	data := []byte("hello")
+
+	for _, class := range []int{32, 64} {
+
+		e := New()
+		e.SetClass(class)
+
+		f, err := elf.NewFile(bytes.NewReader(e.Build(code, data)))
+		if err != nil {
+			t.Fatalf("failed to parse ELF: %s", err)
+		}
+		if len(f.Progs) != 2 {
+			t.Fatalf("expected two program headers, got %d", len(f.Progs))
+		}
+
+		// The code is readable and executable, but not writable
+		text := f.Progs[0]
+		if text.Type != elf.PT_LOAD || text.Flags != elf.PF_R|elf.PF_X {
+			t.Fatalf("unexpected text segment %+v", text.ProgHeader)
+		}
+
+		// The data is readable and writable, but not executable
+		dat := f.Progs[1]
+		if dat.Type != elf.PT_LOAD || dat.Flags != elf.PF_R|elf.PF_W {
+			t.Fatalf("unexpected data segment %+v", dat.ProgHeader)
+		}
+
+		// The segments must not share a page, and their offsets
+		// must agree with their addresses modulo the page-size.
+		if text.Vaddr+text.Memsz > dat.Vaddr&^(pageSize-1) {
+			t.Fatalf("text and data segments overlap")
+		}
+		for _, p := range f.Progs {
+			if p.Vaddr%pageSize != p.Off%pageSize {
+				t.Fatalf("misaligned segment %+v", p.ProgHeader)
+			}
+		}
+
+		buf := make([]byte, len(data))
+		if _, err := dat.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("data not found in the data segment")
+		}
+	}
+
+	// The base address must be suitably aligned
+	e := New()
+	if e.SetBase(0x401000) == nil {
+		t.Fatalf("expected error setting a misaligned base")
+	}
+	if err := e.SetBase(0x800000); err != nil {
+		t.Fatalf("unexpected error setting base: %s", err)
+	}
+	if l := e.Layout(4, 5); l.CodeAddress != 0x8000b0 || l.DataAddress != 0xa01000 {
+		t.Fatalf("unexpected layout %+v", l)
+	}
+}
@@ -0,0 +1,101 @@
+package elf
+
+import "crypto/sha1"
+
+// Note types
+const (
+	// ntVersion is the type of our note recording the version of the
+	// assembler which generated the binary.
+	ntVersion = 1
+
+	// ntGnuBuildID is the type of the note holding the build-id,
+	// which is read by tools such as `file` and `gdb`.
+	ntGnuBuildID = 3
+)
+
+// noteOwner is the name of the owner of our version note.
+const noteOwner = "assembler"
+
+// SetNotes causes the generated binary to contain a PT_NOTE segment, and
+// a .note section, holding the version of the assembler along with a
+// build-id, which is the SHA-1 hash of the code followed by the data.
+//
+// The notes precede the code, so they change its address.
+func (e *Elf) SetNotes(version string) {
+	e.notes = true
+	e.version = version
+}
+
+// programHeaders returns the number of program headers we generate, one
+// for each of the code and data segments, one for any notes, and two for
+// the dynamic section and stack of a shared object.
+func (e *Elf) programHeaders() int {
+	n := 2
+	if e.notes {
+		n++
+	}
+	if e.shared() {
+		n += 2
+	}
+	return n
+}
+
+// noteSize returns the size of the notes which follow the program
+// headers, which doesn't depend upon the contents of the binary.
+func (e *Elf) noteSize() uint64 {
+	size := uint64(0)
+	for _, n := range e.buildNotes(nil, nil) {
+		size += uint64(len(n.data))
+	}
+	return size
+}
+
+// BuildID returns the build-id of a binary containing the given code,
+// and data.
+func BuildID(textSection, dataSection []byte) []byte {
+	h := sha1.New()
+	h.Write(textSection)
+	h.Write(dataSection)
+	return h.Sum(nil)
+}
+
+// note is a single note, along with the name of the section holding it.
+type note struct {
+	section string
+	data    []byte
+}
+
+// buildNotes returns the notes of a binary containing the given code,
+// and data, if any are to be generated.
+func (e *Elf) buildNotes(textSection, dataSection []byte) []note {
+
+	if !e.notes {
+		return nil
+	}
+
+	// Each note has a header, followed by the name of its owner and
+	// its contents, each of which is padded to a multiple of four.
+	build := func(name string, kind uint64, desc []byte) []byte {
+		var o Builder
+		n := append([]byte(name), 0)
+		o.WriteValue(4, uint64(len(n)))
+		o.WriteValue(4, uint64(len(desc)))
+		o.WriteValue(4, kind)
+		o.WriteBytes(pad(n)...)
+		o.WriteBytes(pad(desc)...)
+		return o.o
+	}
+
+	return []note{
+		{section: ".note.gnu.build-id", data: build("GNU", ntGnuBuildID, BuildID(textSection, dataSection))},
+		{section: ".note.assembler", data: build(noteOwner, ntVersion, append([]byte(e.version), 0))},
+	}
+}
+
+// pad returns the given bytes, padded with zeros to a multiple of four.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
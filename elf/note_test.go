@@ -0,0 +1,66 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+)
+
+func TestNotes(t *testing.T) {
+
+	code := []byte{0x90, 0xc3}
+	data := []byte("data")
+
+	for _, class := range []int{32, 64} {
+
+		e := New()
+		e.SetClass(class)
+		e.SetNotes("1.2.3")
+
+		f, err := elf.NewFile(bytes.NewReader(e.Build(code, data)))
+		if err != nil {
+			t.Fatalf("failed to parse ELF: %s", err)
+		}
+
+		// The notes sit between the program headers and the code.
+		layout := e.Layout(uint64(len(code)), uint64(len(data)))
+		if layout.NoteOffset+layout.NoteSize != layout.CodeOffset || f.Entry != layout.CodeAddress {
+			t.Fatalf("unexpected layout %+v", layout)
+		}
+
+		var note *elf.Prog
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_NOTE {
+				note = p
+			}
+		}
+		if note == nil || note.Off != layout.NoteOffset || note.Vaddr != layout.NoteAddress || note.Filesz != layout.NoteSize {
+			t.Fatalf("unexpected PT_NOTE segment %v", note)
+		}
+
+		s := f.Section(".note.gnu.build-id")
+		if s == nil || s.Addr != layout.NoteAddress {
+			t.Fatalf("unexpected build-id section %v", s)
+		}
+		id, err := s.Data()
+		if err != nil || !bytes.Equal(id[16:], BuildID(code, data)) {
+			t.Fatalf("unexpected build-id % x", id)
+		}
+
+		s = f.Section(".note.assembler")
+		version, err := s.Data()
+		if err != nil || !bytes.Equal(version[12:], []byte("assembler\x00\x00\x001.2.3\x00\x00\x00")) {
+			t.Fatalf("unexpected version note % x", version)
+		}
+
+		text := f.Section(".text")
+		if text == nil || text.Offset != layout.CodeOffset {
+			t.Fatalf("unexpected .text section %v", text)
+		}
+	}
+
+	// The build-id depends upon the code and the data.
+	if bytes.Equal(BuildID(code, data), BuildID(code, nil)) {
+		t.Fatalf("build-id ignores the data")
+	}
+}
@@ -0,0 +1,416 @@
+// Package format re-emits assembly language source in a canonical form.
+//
+// Each line of the input is parsed, and the resulting nodes are written
+// back out with consistent indentation and spacing:
+//
+//	.hello DB "Hello, world\n"
+//	:start
+//	        mov  rax, 1 ; sys_write
+//	        push rbx
+//
+// Labels, and data declarations, begin in the first column, while
+// instructions are indented.  Within each block of consecutive lines
+// the operands, data declarations, and trailing comments are aligned.
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/skx/assembler/parser"
+	"github.com/skx/assembler/token"
+)
+
+// indent is the prefix used for instructions, and for comments which
+// stand alone upon a line.
+const indent = "        "
+
+// line holds a single line of output, before alignment.
+type line struct {
+	// name holds the first part of the line: the mnemonic of an
+	// instruction, the name of data, or the whole of a label.
+	name string
+
+	// rest holds the remainder of the line; the operands of an
+	// instruction, or the contents of a data declaration.
+	rest string
+
+	// comment holds any comment, including the leading semi-colon.
+	comment string
+
+	// kind records the type of the line, which must match for the
+	// alignment to be shared with the previous line.
+	kind string
+}
+
+// Format parses the given source, and returns it in canonical form.
+//
+// Comments are preserved, as are blank lines, although runs of blank
+// lines are reduced to a single one.
+func Format(src string) (string, error) {
+
+	var lines []line
+
+	for n, text := range strings.Split(src, "\n") {
+
+		code, comment := splitComment(text)
+		code = strings.TrimSpace(code)
+		comment = normalizeComment(comment)
+
+		// Blank lines, and comments standing alone.
+		if code == "" {
+			if comment == "" {
+				lines = append(lines, line{kind: "blank"})
+			} else {
+				lines = append(lines, line{comment: comment, kind: "comment"})
+			}
+			continue
+		}
+
+		// Preprocessor directives are left alone.
+		if strings.HasPrefix(code, "%") {
+			lines = append(lines, line{name: strings.Join(strings.Fields(code), " "), comment: comment, kind: "directive"})
+			continue
+		}
+
+		l, err := formatCode(lowercase(code))
+		if err != nil {
+			return "", fmt.Errorf("line %d: %s", n+1, err)
+		}
+		l.comment = comment
+		lines = append(lines, l)
+	}
+
+	return render(lines), nil
+}
+
+// formatCode parses a single line of code, which should contain only
+// one statement.
+func formatCode(code string) (line, error) {
+
+	p := parser.New(code)
+
+	node := p.Next()
+	if node == nil {
+		return line{}, fmt.Errorf("failed to parse %s", code)
+	}
+	if p.Next() != nil {
+		return line{}, fmt.Errorf("multiple statements in %s", code)
+	}
+
+	switch node := node.(type) {
+
+	case parser.Data:
+		if len(node.References) > 0 {
+			return line{name: "." + node.Name, rest: "DQ " + formatQuads(node), kind: "data"}, nil
+		}
+		return line{name: "." + node.Name, rest: "DB " + formatData(node), kind: "data"}, nil
+
+	case parser.Error:
+		return line{}, fmt.Errorf("%s", node.Value)
+
+	case parser.Instruction:
+		name := node.Instruction
+		if node.Prefix != "" {
+			name = node.Prefix + " " + name
+		}
+
+		var ops []string
+		for _, op := range node.Operands {
+			ops = append(ops, Operand(op))
+		}
+		return line{name: name, rest: strings.Join(ops, ", "), kind: "instruction"}, nil
+
+	case parser.Label:
+		return line{name: ":" + node.Name, kind: "label"}, nil
+
+	case parser.Incbin:
+		path, ok := quote([]byte(node.Path))
+		if !ok {
+			return line{}, fmt.Errorf("unprintable path in .incbin %q", node.Path)
+		}
+		return line{name: ".incbin", rest: path, kind: "data"}, nil
+
+	case parser.Hotpatch:
+		return line{name: ".hotpatch", kind: "data"}, nil
+
+	case parser.Section:
+		return line{name: "section", rest: "." + node.Name, kind: "section"}, nil
+	}
+
+	return line{}, fmt.Errorf("unhandled node-type %v", node)
+}
+
+// Operand returns the textual form of an instruction operand.
+func Operand(op parser.Operand) string {
+
+	if op.Relative {
+		return "[rel " + op.Literal + "]"
+	}
+	if !op.Indirection {
+		return op.Literal
+	}
+
+	// The address may include a scaled index, and a displacement,
+	// and if there is no base register the token is the displacement.
+	addr := op.Literal
+	if op.Index != "" {
+		index := op.Index
+		if op.Scale > 1 {
+			index += fmt.Sprintf("*%d", op.Scale)
+		}
+		switch {
+		case op.Type != token.REGISTER && op.Literal == "0":
+			addr = index
+		case op.Type != token.REGISTER && strings.HasPrefix(op.Literal, "-"):
+			addr = index + op.Literal
+		case op.Type != token.REGISTER:
+			addr = index + "+" + op.Literal
+		default:
+			addr += "+" + index
+		}
+	}
+	if op.Displacement > 0 {
+		addr += fmt.Sprintf("+%d", op.Displacement)
+	} else if op.Displacement < 0 {
+		addr += fmt.Sprintf("%d", op.Displacement)
+	}
+
+	mem := "[" + addr + "]"
+	if op.Segment != "" {
+		mem = op.Segment + ":" + mem
+	}
+
+	sizes := map[int]string{8: "byte", 16: "word", 32: "dword", 64: "qword"}
+	if size, ok := sizes[op.Size]; ok {
+		return size + " ptr " + mem
+	}
+	return mem
+}
+
+// formatData returns the contents of a data declaration.
+//
+// Printable contents are written as a string, other contents as a list
+// of bytes with runs of repeated values being written via `dup`.
+func formatData(d parser.Data) string {
+
+	if d.Constant != "" {
+		return d.Constant
+	}
+
+	if str, ok := quote(d.Contents); ok {
+		return str
+	}
+
+	var out []string
+	for i := 0; i < len(d.Contents); {
+		b := d.Contents[i]
+		run := 1
+		for i+run < len(d.Contents) && d.Contents[i+run] == b {
+			run++
+		}
+		if run >= 4 {
+			out = append(out, fmt.Sprintf("%d dup 0x%02x", run, b))
+		} else {
+			run = 1
+			out = append(out, fmt.Sprintf("0x%02x", b))
+		}
+		i += run
+	}
+	return strings.Join(out, ", ")
+}
+
+// formatQuads returns the contents of a quad-word declaration which refers
+// to labels, or constants, which must be preserved by name.
+func formatQuads(d parser.Data) string {
+
+	var out []string
+	for i := 0; i+8 <= len(d.Contents); i += 8 {
+		if name, ok := d.References[i]; ok {
+			out = append(out, name)
+		} else {
+			out = append(out, fmt.Sprintf("0x%x", binary.LittleEndian.Uint64(d.Contents[i:])))
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// quote returns the given data as a string-literal, if it contains only
+// printable characters and those which the lexer understands as escapes.
+func quote(data []byte) (string, bool) {
+
+	if len(data) == 0 {
+		return "", false
+	}
+
+	escapes := map[byte]string{
+		'\n': `\n`,
+		'\r': `\r`,
+		'\t': `\t`,
+		0:    `\0`,
+		'"':  `\"`,
+		'\\': `\\`,
+	}
+
+	out := `"`
+	for _, b := range data {
+		if esc, ok := escapes[b]; ok {
+			out += esc
+		} else if b >= 0x20 && b < 0x7f {
+			out += string(rune(b))
+		} else {
+			return "", false
+		}
+	}
+	return out + `"`, true
+}
+
+// lowercase converts any instructions, prefixes, registers, and sizes,
+// in the given code to lower-case.  Other identifiers are case-sensitive
+// and so are left alone.
+func lowercase(code string) string {
+
+	// Leave data declarations alone; they contain only names and
+	// the data itself.
+	if strings.HasPrefix(code, ".") {
+		return code
+	}
+
+	sizes := map[string]bool{"byte": true, "word": true, "dword": true, "qword": true, "ptr": true, "rel": true}
+
+	out := ""
+	word := ""
+	flush := func() {
+		lower := strings.ToLower(word)
+		if sizes[lower] || token.LookupIdentifier(lower) != token.IDENTIFIER {
+			word = lower
+		}
+		out += word
+		word = ""
+	}
+
+	for _, c := range code {
+		if c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			word += string(c)
+			continue
+		}
+		flush()
+		out += string(c)
+	}
+	flush()
+	return out
+}
+
+// splitComment splits a line into the code and any trailing comment,
+// ignoring semi-colons within strings.
+func splitComment(text string) (string, string) {
+
+	var quote rune
+	escaped := false
+
+	for i, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return text[:i], text[i:]
+		}
+	}
+	return text, ""
+}
+
+// normalizeComment ensures that the text of a comment is separated from
+// the semi-colons which introduce it by a single space, and removes any
+// trailing whitespace.
+func normalizeComment(comment string) string {
+
+	comment = strings.TrimRight(comment, " \t\r")
+	if comment == "" {
+		return ""
+	}
+
+	marker := comment[:len(comment)-len(strings.TrimLeft(comment, ";"))]
+	text := strings.TrimSpace(comment[len(marker):])
+	if text == "" {
+		return marker
+	}
+	return marker + " " + text
+}
+
+// render aligns the lines, and joins them into the output.
+func render(lines []line) string {
+
+	var out []string
+
+	for start := 0; start < len(lines); {
+
+		// Find the block of lines which are aligned together.
+		end := start + 1
+		for end < len(lines) && lines[end].kind == lines[start].kind && lines[end].kind != "blank" {
+			end++
+		}
+		block := lines[start:end]
+
+		// Pad the names, so the rest of the lines align.
+		width := 0
+		for _, l := range block {
+			if l.rest != "" && len(l.name) > width {
+				width = len(l.name)
+			}
+		}
+
+		var code []string
+		for _, l := range block {
+			text := l.name
+			if l.rest != "" {
+				text = fmt.Sprintf("%-*s %s", width, l.name, l.rest)
+			}
+			if l.kind == "instruction" || l.kind == "comment" {
+				text = indent + text
+			}
+			code = append(code, strings.TrimRight(text, " "))
+		}
+
+		// Now align the trailing comments.
+		width = 0
+		for n, l := range block {
+			if l.comment != "" && len(code[n]) > width {
+				width = len(code[n])
+			}
+		}
+		for n, l := range block {
+			switch {
+			case l.comment == "":
+				out = append(out, code[n])
+			case l.kind == "comment":
+				out = append(out, indent+l.comment)
+			default:
+				out = append(out, fmt.Sprintf("%-*s %s", width, code[n], l.comment))
+			}
+		}
+
+		start = end
+	}
+
+	// Remove repeated blank lines, and those at the start and end.
+	var result []string
+	for _, l := range out {
+		if l == "" && (len(result) == 0 || result[len(result)-1] == "") {
+			continue
+		}
+		result = append(result, l)
+	}
+	for len(result) > 0 && result[len(result)-1] == "" {
+		result = result[:len(result)-1]
+	}
+
+	return strings.Join(result, "\n") + "\n"
+}
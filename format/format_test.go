@@ -0,0 +1,50 @@
+package format
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGolden ensures that our messy input is formatted as expected.
+func TestGolden(t *testing.T) {
+
+	input, err := ioutil.ReadFile(filepath.Join("testdata", "messy.asm"))
+	if err != nil {
+		t.Fatalf("failed to read input: %s", err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "messy.golden"))
+	if err != nil {
+		t.Fatalf("failed to read golden output: %s", err)
+	}
+
+	out, err := Format(string(input))
+	if err != nil {
+		t.Fatalf("failed to format: %s", err)
+	}
+	if out != string(expected) {
+		t.Fatalf("unexpected output, got:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	// Formatting canonical output should change nothing.
+	again, err := Format(out)
+	if err != nil {
+		t.Fatalf("failed to format: %s", err)
+	}
+	if again != out {
+		t.Fatalf("formatting is not stable, got:\n%s", again)
+	}
+}
+
+// TestErrors ensures that syntax errors are reported.
+func TestErrors(t *testing.T) {
+
+	_, err := Format("nop\nmov rax, 3 +\n")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("error didn't include the line-number: %s", err)
+	}
+}
@@ -0,0 +1,24 @@
+  ;; A messy program   
+
+
+  section   .data
+.hello DB "Hello; world\n"
+   .zeros    DB 0x00, 0x00, 0x00, 0x00, 0x00, 1
+.table DQ start,16
+:start
+MOV RAX,1 ;sys_write
+  push    rbx
+	mov   rcx,hello   ;;   the message
+ rep  stosb
+inc BYTE PTR [rax]
+mov rbx, [rel hello]
+MOV RAX,[ RBX + RCX*4 + 8 ]
+mov rdx,  qword [rcx*8-16]
+mov [rbp-8],rdi
+mov rdx, $ - $$
+
+%ifdef DEBUG
+  xor rax,rax
+%endif
+
+
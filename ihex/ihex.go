@@ -0,0 +1,86 @@
+// Package ihex generates Intel HEX output, a textual representation of
+// binary data which is commonly used for programming microcontrollers.
+//
+// Each line of output is a record of the form:
+//
+//	:LLAAAATTDD...CC
+//
+// Where LL is the number of data bytes, AAAA the address at which they
+// are loaded, TT the type of the record, DD the data, and CC a checksum.
+package ihex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Record types
+const (
+	dataRecord           = 0x00
+	endOfFileRecord      = 0x01
+	extendedLinearRecord = 0x04
+)
+
+// recordSize is the number of data bytes we write in each record.
+const recordSize = 16
+
+// record returns a single record, including the checksum.
+func record(address uint16, kind byte, data []byte) string {
+
+	bytes := []byte{byte(len(data)), byte(address >> 8), byte(address), kind}
+	bytes = append(bytes, data...)
+
+	// The checksum is the two's complement of the sum of all the
+	// other bytes.
+	sum := byte(0)
+	for _, b := range bytes {
+		sum += b
+	}
+	bytes = append(bytes, -sum)
+
+	return fmt.Sprintf(":%X", bytes)
+}
+
+// Encode returns the Intel HEX representation of the given data, which
+// is to be loaded at the specified address.
+//
+// Addresses above 0xffff are handled via extended linear address
+// records, which specify the upper sixteen bits of the address.
+func Encode(address uint32, data []byte) string {
+
+	var out []string
+
+	upper := uint32(0)
+	for offset := 0; offset < len(data); {
+
+		// The current address, and the number of bytes in this
+		// record, which must not cross a 64k boundary.
+		addr := address + uint32(offset)
+		size := recordSize
+		if offset+size > len(data) {
+			size = len(data) - offset
+		}
+		if remain := 0x10000 - int(addr&0xffff); size > remain {
+			size = remain
+		}
+
+		if addr>>16 != upper {
+			upper = addr >> 16
+			out = append(out, record(0, extendedLinearRecord, []byte{byte(upper >> 8), byte(upper)}))
+		}
+
+		out = append(out, record(uint16(addr), dataRecord, data[offset:offset+size]))
+		offset += size
+	}
+
+	out = append(out, record(0, endOfFileRecord, nil))
+	return strings.Join(out, "\n") + "\n"
+}
+
+// WriteContent writes the Intel HEX representation of the given code,
+// followed by the data, to the specified path.
+func WriteContent(path string, address uint32, textSection, dataSection []byte) error {
+	data := append(append([]byte{}, textSection...), dataSection...)
+	return ioutil.WriteFile(path, []byte(Encode(address, data)), 0644)
+}
@@ -0,0 +1,66 @@
+package ihex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+
+	type TestCase struct {
+		Address uint32
+		Data    []byte
+		Output  string
+	}
+
+	tests := []TestCase{
+		{Address: 0, Data: nil, Output: ":00000001FF\n"},
+		{Address: 0, Data: []byte{0x90, 0xc3}, Output: ":0200000090C3AB\n:00000001FF\n"},
+		{Address: 0x100,
+			Data: []byte{0x21, 0x46, 0x01, 0x36, 0x01, 0x21, 0x47, 0x01,
+				0x36, 0x00, 0x7e, 0xfe, 0x09, 0xd2, 0x19, 0x01, 0x21},
+			Output: ":10010000214601360121470136007EFE09D2190140\n" +
+				":0101100021CD\n" +
+				":00000001FF\n"},
+
+		// Records don't cross 64k boundaries
+		{Address: 0xffff, Data: []byte{0x90, 0xc3},
+			Output: ":01FFFF009071\n" +
+				":020000040001F9\n" +
+				":01000000C33C\n" +
+				":00000001FF\n"},
+	}
+
+	for _, test := range tests {
+		out := Encode(test.Address, test.Data)
+		if out != test.Output {
+			t.Fatalf("unexpected output for % x, expected:\n%s\ngot:\n%s", test.Data, test.Output, out)
+		}
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ihex")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.hex")
+
+	err = WriteContent(path, 0, []byte{0x90}, []byte{0xc3})
+	if err != nil {
+		t.Fatalf("failed to write output: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(data) != ":0200000090C3AB\n:00000001FF\n" {
+		t.Fatalf("unexpected output %s", data)
+	}
+}
@@ -20,6 +20,18 @@ var (
 	// map, and contains the known instruction-types we can lex, parse, and
 	// compile.
 	Instructions []string
+
+	// Variable is the length recorded for instructions which accept
+	// any number of operands, upon the same line.
+	Variable = -1
+
+	// Optional contains the instructions whose final operand may be
+	// omitted, for example `ret` and `ret 8`.
+	Optional = map[string]bool{"ret": true}
+
+	// Prefixes contains the prefixes which may precede an instruction,
+	// for example `rep stosb`.
+	Prefixes = []string{"rep", "repe", "repz", "repne", "repnz"}
 )
 
 func init() {
@@ -28,16 +40,30 @@ func init() {
 	InstructionLengths = make(map[string]int)
 
 	InstructionLengths["add"] = 2
+	InstructionLengths["and"] = 2
+	InstructionLengths["bswap"] = 1
 	InstructionLengths["cmp"] = 2
 	InstructionLengths["dec"] = 1
+	InstructionLengths["div"] = 1
+	InstructionLengths["idiv"] = 1
+	InstructionLengths["imul"] = Variable
+	InstructionLengths["in"] = 2
 	InstructionLengths["inc"] = 1
 	InstructionLengths["int"] = 1
+	InstructionLengths["lea"] = 2
 	InstructionLengths["mov"] = 2
+	InstructionLengths["mul"] = 1
+	InstructionLengths["neg"] = 1
 	InstructionLengths["nop"] = 0
+	InstructionLengths["not"] = 1
+	InstructionLengths["or"] = 2
+	InstructionLengths["out"] = 2
 	InstructionLengths["pop"] = 1
 	InstructionLengths["push"] = 1
-	InstructionLengths["ret"] = 0
+	InstructionLengths["ret"] = 1
 	InstructionLengths["sub"] = 2
+	InstructionLengths["test"] = 2
+	InstructionLengths["xchg"] = 2
 	InstructionLengths["xor"] = 2
 
 	// call
@@ -50,15 +76,38 @@ func init() {
 	InstructionLengths["jnz"] = 1
 	InstructionLengths["jz"] = 1
 
+	// String instructions
+	for _, ins := range []string{"cmps", "lods", "movs", "scas", "stos"} {
+		for _, size := range []string{"b", "w", "d", "q"} {
+			InstructionLengths[ins+size] = 0
+		}
+	}
+
+	// Conditional sets, which store a flag in an 8-bit register
+	for _, cc := range []string{"a", "ae", "b", "be", "e", "g", "ge", "l", "le", "ne", "nz", "z"} {
+		InstructionLengths["set"+cc] = 1
+	}
+
+	// `movsd` is both a string instruction, without operands, and
+	// the SSE move of a double-precision value.
+	InstructionLengths["movsd"] = Variable
+
 	// Processor control instructions
 	InstructionLengths["clc"] = 0
 	InstructionLengths["cld"] = 0
 	InstructionLengths["cli"] = 0
 	InstructionLengths["cmc"] = 0
+	InstructionLengths["cpuid"] = 0
+	InstructionLengths["hlt"] = 0
 	InstructionLengths["stc"] = 0
 	InstructionLengths["std"] = 0
 	InstructionLengths["sti"] = 0
 
+	// System-calls, along with the `syscall_exit` pseudo-instruction
+	// which sets up the registers for, and makes, the exit system-call.
+	InstructionLengths["syscall"] = 0
+	InstructionLengths["syscall_exit"] = 1
+
 	// Now record the known-instructions
 	for k := range InstructionLengths {
 		Instructions = append(Instructions, k)
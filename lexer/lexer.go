@@ -22,19 +22,31 @@ type Lexer struct {
 
 	// A rune slice of our input string
 	characters []rune
+
+	// The line, and column, of the current character
+	line   int
+	column int
 }
 
 // New creates a Lexer instance from the given string
 func New(input string) *Lexer {
 
 	// Line counting starts at one.
-	l := &Lexer{characters: []rune(input)}
+	l := &Lexer{characters: []rune(input), line: 1}
 	l.readChar()
 	return l
 }
 
 // read forward one character.
 func (l *Lexer) readChar() {
+
+	// Moving past a newline takes us to the start of the next line.
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -47,16 +59,41 @@ func (l *Lexer) readChar() {
 
 // NextToken reads and returns the next token, skipping any intervening
 // white space, and swallowing any comments, in the process.
+//
+// The returned token records the line, and column, at which it began.
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
 	l.skipWhitespace()
 
 	// skip single-line comments
-	if l.ch == rune(';') || l.ch == rune('#') {
+	if l.ch == rune(';') || l.ch == rune('#') ||
+		(l.ch == rune('/') && l.peekChar() == rune('/')) {
 		l.skipComment()
 		return (l.NextToken())
 	}
 
+	line, column := l.line, l.column
+
+	// skip block comments, which may span multiple lines
+	if l.ch == rune('/') && l.peekChar() == rune('*') {
+		err := l.skipBlockComment()
+		if err != nil {
+			return token.Token{Type: token.ILLEGAL, Literal: err.Error(), Line: line, Column: column}
+		}
+		return (l.NextToken())
+	}
+
+	tok := l.readToken()
+	if tok.Line == 0 {
+		tok.Line = line
+		tok.Column = column
+	}
+	return tok
+}
+
+// readToken reads the token which begins at the current character.
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 
 	case rune(0):
@@ -84,6 +121,25 @@ func (l *Lexer) NextToken() token.Token {
 	case rune(','):
 		tok = token.Token{Type: token.COMMA, Literal: ","}
 
+	case rune('+'):
+		tok = token.Token{Type: token.PLUS, Literal: "+"}
+
+	case rune('-'):
+		tok = token.Token{Type: token.MINUS, Literal: "-"}
+
+	case rune('*'):
+		tok = token.Token{Type: token.ASTERISK, Literal: "*"}
+
+	case rune('$'):
+		// "$" and "$$" are special, and mustn't swallow any
+		// following characters - e.g. "$-$$".
+		tok.Literal = "$"
+		if l.peekChar() == rune('$') {
+			l.readChar()
+			tok.Literal = "$$"
+		}
+		tok.Type = token.IDENTIFIER
+
 	case rune('['):
 		tok = token.Token{Type: token.LSQUARE, Literal: "["}
 
@@ -112,14 +168,22 @@ func (l *Lexer) NextToken() token.Token {
 		// Instruction/Register
 		tok.Literal = l.readIdentifier()
 		if len(tok.Literal) > 0 {
+
+			// A segment-override, e.g. `fs:[0x10]`
+			if (tok.Literal == "fs" || tok.Literal == "gs") && l.ch == rune(':') {
+				l.readChar()
+				tok.Type = token.SEGMENT
+				return tok
+			}
+
 			tok.Type = token.LookupIdentifier(tok.Literal)
 			return tok
 		}
 
-		// Not an instruction/register (+LABEL)
-		tok.Type = token.IDENTIFIER
-		return tok
-
+		// Not something we recognize, so skip the character to
+		// ensure that we don't loop forever.
+		tok.Literal = string(l.ch)
+		tok.Type = token.ILLEGAL
 	}
 
 	l.readChar()
@@ -134,8 +198,16 @@ func (l *Lexer) readIdentifier() string {
 	id := ""
 
 	for isIdentifier(l.ch) {
+
 		id += string(l.ch)
 		l.readChar()
+
+		// A period followed by a letter continues the name, as
+		// in `msg.len`.
+		if l.ch == rune('.') && unicode.IsLetter(l.peekChar()) {
+			id += string(l.ch)
+			l.readChar()
+		}
 	}
 	return id
 }
@@ -155,13 +227,43 @@ func (l *Lexer) skipComment() {
 	l.skipWhitespace()
 }
 
+// skip a block comment, `/* .. */`, which may span multiple lines.
+//
+// Block comments do not nest, the first `*/` terminates the comment.
+func (l *Lexer) skipBlockComment() error {
+
+	// skip the opening "/*"
+	l.readChar()
+	l.readChar()
+
+	for l.ch != rune(0) {
+		if l.ch == rune('*') && l.peekChar() == rune('/') {
+			l.readChar()
+			l.readChar()
+			l.skipWhitespace()
+			return nil
+		}
+		l.readChar()
+	}
+	return errors.New("unterminated block comment")
+}
+
 // read a number.  We only care about numerical digits here, floats will
 // be handled elsewhere.
 func (l *Lexer) readNumber() string {
 
 	id := ""
+	hex := false
+	float := false
 
-	for isDigit(l.ch) || l.ch == rune('x') {
+	for isDigit(l.ch) || l.ch == rune('x') || (hex && isHexDigit(l.ch)) ||
+		(l.ch == rune('.') && !hex && !float && isDigit(l.peekChar())) {
+		if l.ch == rune('x') {
+			hex = true
+		}
+		if l.ch == rune('.') {
+			float = true
+		}
 		id += string(l.ch)
 		l.readChar()
 	}
@@ -260,8 +362,11 @@ func (l *Lexer) readLabel() (string, error) {
 // determinate ch is identifier or not.  Identifiers may be alphanumeric,
 // but they must start with a letter.  Here that works because we are only
 // called if the first character is alphabetical.
+//
+// A minus ends an identifier, as a plus does, so that `SIZE-1` is an
+// expression.
 func isIdentifier(ch rune) bool {
-	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' || ch == '-' {
+	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' {
 		return true
 	}
 	return false
@@ -269,7 +374,8 @@ func isIdentifier(ch rune) bool {
 
 // is white space
 func isWhitespace(ch rune) bool {
-	return ch == rune(' ') || ch == rune('\t') || ch == rune('\n') || ch == rune('\r')
+	return ch == rune(' ') || ch == rune('\t') || ch == rune('\n') || ch == rune('\r') ||
+		ch == rune('\f') || ch == rune('\v')
 }
 
 // is Digit
@@ -277,6 +383,13 @@ func isDigit(ch rune) bool {
 	return rune('0') <= ch && ch <= rune('9')
 }
 
+// is hexadecimal digit
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) ||
+		(rune('a') <= ch && ch <= rune('f')) ||
+		(rune('A') <= ch && ch <= rune('F'))
+}
+
 // peek character
 func (l *Lexer) peekChar() rune {
 	if l.readPosition >= len(l.characters) {
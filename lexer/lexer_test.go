@@ -9,12 +9,26 @@ import (
 func TestComment(t *testing.T) {
 
 	n := New(`; This is a comment
-# So is this`)
+# So is this
+// As is this
+/* and this,
+   which spans lines */`)
 
 	tok := n.NextToken()
 	if tok.Type != token.EOF {
 		t.Errorf("expected end of file")
 	}
+
+	// An unterminated block comment is an error, reported at its start
+	n = New("nop\n  /* comment")
+	n.NextToken()
+	tok = n.NextToken()
+	if tok.Type != token.ILLEGAL || tok.Literal != "unterminated block comment" {
+		t.Fatalf("expected an unterminated comment, got %v", tok)
+	}
+	if tok.Line != 2 || tok.Column != 3 {
+		t.Fatalf("unexpected position %d:%d", tok.Line, tok.Column)
+	}
 }
 
 func TestData(t *testing.T) {
@@ -44,12 +58,83 @@ func TestData(t *testing.T) {
 
 }
 
+func TestFloat(t *testing.T) {
+
+	input := `.pi DQ 3.14159, 2.5
+movsd xmm0, [pi]`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.DATA, "pi"},
+		{token.DQ, "DQ"},
+		{token.NUMBER, "3.14159"},
+		{token.COMMA, ","},
+		{token.NUMBER, "2.5"},
+		{token.INSTRUCTION, "movsd"},
+		{token.REGISTER, "xmm0"},
+		{token.COMMA, ","},
+		{token.LSQUARE, "["},
+		{token.IDENTIFIER, "pi"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestSegment(t *testing.T) {
+
+	input := `mov rax, fs:[0x10]
+mov gs:[rsi], rbx`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.SEGMENT, "fs"},
+		{token.LSQUARE, "["},
+		{token.NUMBER, "0x10"},
+		{token.INSTRUCTION, "mov"},
+		{token.SEGMENT, "gs"},
+		{token.LSQUARE, "["},
+		{token.REGISTER, "rsi"},
+		{token.COMMA, ","},
+		{token.REGISTER, "rbx"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestMov(t *testing.T) {
 
 	input := `
 ;; Two move instructions
 mov rax, rcx
 mov rbx, 33
+mov rcx, 0xfF
 `
 
 	tests := []struct {
@@ -65,6 +150,11 @@ mov rbx, 33
 		{token.REGISTER, "rbx"},
 		{token.COMMA, ","},
 		{token.NUMBER, "33"},
+
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rcx"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0xfF"},
 		{token.EOF, ""},
 	}
 
@@ -159,10 +249,10 @@ func TestBrackets(t *testing.T) {
 		expectedLiteral string
 	}{
 		{token.INSTRUCTION, "mov"},
-		{token.IDENTIFIER, "eax"},
+		{token.REGISTER, "eax"},
 		{token.COMMA, ","},
 		{token.LSQUARE, "["},
-		{token.IDENTIFIER, "eax"},
+		{token.REGISTER, "eax"},
 		{token.EOF, ""},
 	}
 
@@ -178,3 +268,173 @@ func TestBrackets(t *testing.T) {
 	}
 
 }
+
+func TestAddress(t *testing.T) {
+
+	// A register name doesn't swallow the following "-"
+	input := `mov rax, [rbx+rcx*4-8]`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.LSQUARE, "["},
+		{token.REGISTER, "rbx"},
+		{token.PLUS, "+"},
+		{token.REGISTER, "rcx"},
+		{token.ASTERISK, "*"},
+		{token.NUMBER, "4"},
+		{token.MINUS, "-"},
+		{token.NUMBER, "8"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestExpression(t *testing.T) {
+
+	input := `mov rax, $-$$ + 3`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.IDENTIFIER, "$"},
+		{token.MINUS, "-"},
+		{token.IDENTIFIER, "$$"},
+		{token.PLUS, "+"},
+		{token.NUMBER, "3"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestDataLength(t *testing.T) {
+
+	input := `mov rdx, msg.len+1
+.len DB 1`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rdx"},
+		{token.COMMA, ","},
+		{token.IDENTIFIER, "msg.len"},
+		{token.PLUS, "+"},
+		{token.NUMBER, "1"},
+		{token.DATA, "len"},
+		{token.DB, "DB"},
+		{token.NUMBER, "1"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestMinus(t *testing.T) {
+
+	// A minus ends a name, just as a plus does.
+	input := `mov rdx, SIZE-1
+mov rax, msg.len-1`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rdx"},
+		{token.COMMA, ","},
+		{token.IDENTIFIER, "SIZE"},
+		{token.MINUS, "-"},
+		{token.NUMBER, "1"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.IDENTIFIER, "msg.len"},
+		{token.MINUS, "-"},
+		{token.NUMBER, "1"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestPosition(t *testing.T) {
+
+	input := `; comment
+mov rax, 33
+  .foo DB "bar"
+`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"mov", 2, 1},
+		{"rax", 2, 5},
+		{",", 2, 8},
+		{"33", 2, 10},
+		{"foo", 3, 3},
+		{"DB", 3, 8},
+		{"bar", 3, 11},
+		{"", 4, 1},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong, expected=%d:%d, got=%d:%d", i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
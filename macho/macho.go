@@ -0,0 +1,164 @@
+// Package macho generates minimal Mach-O executables, for macOS upon
+// x86-64.
+//
+// The generated executable is statically linked, with the entry-point
+// being specified via an LC_UNIXTHREAD command, and contains a single
+// segment holding our code followed by our data.
+//
+// Note that system-calls upon macOS differ from those upon Linux; the
+// numbers are offset by 0x2000000, so `exit` is 0x2000001.
+package macho
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+)
+
+const (
+	// virtualStartAddress is the address at which our segment, which
+	// includes the headers, is loaded.  Everything below it is mapped
+	// as the inaccessible __PAGEZERO segment.
+	virtualStartAddress uint64 = 0x400000
+
+	pageSize uint64 = 0x1000
+
+	// The sizes of the header, and each of the load commands.
+	headerSize   = 32
+	segmentSize  = 72
+	sectionSize  = 80
+	threadSize   = 184
+	commandsSize = segmentSize + segmentSize + sectionSize + threadSize
+)
+
+// Builder is used to accumulate the contents of the executable.
+type Builder struct {
+	o []byte
+}
+
+// WriteBytes appends the given bytes.
+func (b *Builder) WriteBytes(bs ...byte) {
+	b.o = append(b.o, bs...)
+}
+
+// WriteValue appends the given value, in little-endian order, using the
+// specified number of bytes.
+func (b *Builder) WriteValue(size int, value uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	b.WriteBytes(buf[:size]...)
+}
+
+// WriteName appends the given name, padded to sixteen bytes.
+func (b *Builder) WriteName(name string) {
+	buf := make([]byte, 16)
+	copy(buf, name)
+	b.WriteBytes(buf...)
+}
+
+// MachO holds our state.
+type MachO struct {
+}
+
+// New returns a new Mach-O generator.
+func New() *MachO {
+	return &MachO{}
+}
+
+// HeaderSize returns the size of the Mach-O header, and the load commands,
+// which precede the code in the generated binary.
+func (m *MachO) HeaderSize() int {
+	return headerSize + commandsSize
+}
+
+// CodeAddress returns the virtual address at which the code is loaded,
+// which is also the entry-point.  The data immediately follows the code.
+func (m *MachO) CodeAddress() uint64 {
+	return virtualStartAddress + uint64(m.HeaderSize())
+}
+
+// WriteContent writes an executable containing the given code and data
+// to the specified path.
+func (m *MachO) WriteContent(path string, textSection, dataSection []byte) error {
+	return ioutil.WriteFile(path, m.Build(textSection, dataSection), 0755)
+}
+
+// Build returns the executable containing the given code and data.
+func (m *MachO) Build(textSection, dataSection []byte) []byte {
+
+	size := uint64(len(textSection) + len(dataSection))
+	fileSize := uint64(m.HeaderSize()) + size
+	memSize := (fileSize + pageSize - 1) / pageSize * pageSize
+
+	var o Builder
+
+	// Mach header
+	o.WriteValue(4, 0xfeedfacf)   // 64-bit magic
+	o.WriteValue(4, 0x01000007)   // x86-64 CPU
+	o.WriteValue(4, 3)            // All x86-64 CPUs
+	o.WriteValue(4, 2)            // MH_EXECUTE
+	o.WriteValue(4, 3)            // Number of load commands
+	o.WriteValue(4, commandsSize) // Size of load commands
+	o.WriteValue(4, 1)            // MH_NOUNDEFS
+	o.WriteValue(4, 0)            // Reserved
+
+	// LC_SEGMENT_64: __PAGEZERO
+	o.WriteValue(4, 0x19)
+	o.WriteValue(4, segmentSize)
+	o.WriteName("__PAGEZERO")
+	o.WriteValue(8, 0)                   // Virtual address
+	o.WriteValue(8, virtualStartAddress) // Virtual size
+	o.WriteValue(8, 0)                   // File offset
+	o.WriteValue(8, 0)                   // File size
+	o.WriteValue(4, 0)                   // Maximum protection
+	o.WriteValue(4, 0)                   // Initial protection
+	o.WriteValue(4, 0)                   // Number of sections
+	o.WriteValue(4, 0)                   // Flags
+
+	// LC_SEGMENT_64: __TEXT, which contains our headers, code, and data.
+	o.WriteValue(4, 0x19)
+	o.WriteValue(4, segmentSize+sectionSize)
+	o.WriteName("__TEXT")
+	o.WriteValue(8, virtualStartAddress) // Virtual address
+	o.WriteValue(8, memSize)             // Virtual size
+	o.WriteValue(8, 0)                   // File offset
+	o.WriteValue(8, fileSize)            // File size
+	o.WriteValue(4, 7)                   // Maximum protection: read, write, execute
+	o.WriteValue(4, 7)                   // Initial protection: read, write, execute
+	o.WriteValue(4, 1)                   // Number of sections
+	o.WriteValue(4, 0)                   // Flags
+
+	// Section: __text
+	o.WriteName("__text")
+	o.WriteName("__TEXT")
+	o.WriteValue(8, m.CodeAddress())        // Address
+	o.WriteValue(8, size)                   // Size
+	o.WriteValue(4, uint64(m.HeaderSize())) // File offset
+	o.WriteValue(4, 0)                      // Alignment
+	o.WriteValue(4, 0)                      // Relocations offset
+	o.WriteValue(4, 0)                      // Number of relocations
+	o.WriteValue(4, 0x80000400)             // Contains instructions
+	o.WriteValue(4, 0)                      // Reserved
+	o.WriteValue(4, 0)                      // Reserved
+	o.WriteValue(4, 0)                      // Reserved
+
+	// LC_UNIXTHREAD: the initial register state, which sets rip to
+	// our entry-point.
+	o.WriteValue(4, 0x5)
+	o.WriteValue(4, threadSize)
+	o.WriteValue(4, 4)  // x86_THREAD_STATE64
+	o.WriteValue(4, 42) // Number of 32-bit words of state
+	for i := 0; i < 21; i++ {
+		// rip is the seventeenth register
+		if i == 16 {
+			o.WriteValue(8, m.CodeAddress())
+		} else {
+			o.WriteValue(8, 0)
+		}
+	}
+
+	// Output the code and data
+	o.WriteBytes(textSection...)
+	o.WriteBytes(dataSection...)
+
+	return o.o
+}
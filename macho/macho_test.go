@@ -0,0 +1,93 @@
+package macho
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+
+	code := []byte{0x90, 0xc3}
+	data := []byte("Hello")
+
+	m := New()
+	out := m.Build(code, data)
+
+	if binary.LittleEndian.Uint32(out) != 0xfeedfacf {
+		t.Fatalf("missing Mach-O magic")
+	}
+
+	// Ensure the standard library is happy with the result.
+	f, err := macho.NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to parse Mach-O: %s", err)
+	}
+	if f.Cpu != macho.CpuAmd64 || f.Type != macho.TypeExec {
+		t.Fatalf("unexpected header %v", f.FileHeader)
+	}
+	if len(f.Loads) != 3 {
+		t.Fatalf("expected three load commands, got %d", len(f.Loads))
+	}
+
+	// The segments
+	zero := f.Segment("__PAGEZERO")
+	if zero == nil || zero.Addr != 0 || zero.Memsz != virtualStartAddress || zero.Filesz != 0 {
+		t.Fatalf("unexpected __PAGEZERO segment %v", zero)
+	}
+	text := f.Segment("__TEXT")
+	if text == nil || text.Addr != virtualStartAddress || text.Offset != 0 || text.Filesz != uint64(len(out)) {
+		t.Fatalf("unexpected __TEXT segment %v", text)
+	}
+
+	// The section contains our code followed by our data.
+	sect := f.Section("__text")
+	if sect == nil || sect.Addr != m.CodeAddress() {
+		t.Fatalf("unexpected __text section %v", sect)
+	}
+	contents, err := sect.Data()
+	if err != nil {
+		t.Fatalf("failed to read section: %s", err)
+	}
+	if !bytes.Equal(contents, append(append([]byte{}, code...), data...)) {
+		t.Fatalf("unexpected section contents % x", contents)
+	}
+
+	// The thread-state sets rip to the code.
+	thread := f.Loads[2].Raw()
+	if binary.LittleEndian.Uint32(thread) != 0x5 {
+		t.Fatalf("expected LC_UNIXTHREAD, got %x", thread[0:4])
+	}
+	if binary.LittleEndian.Uint64(thread[16+16*8:]) != m.CodeAddress() {
+		t.Fatalf("unexpected entry-point in thread state")
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "macho")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.out")
+
+	m := New()
+	err = m.WriteContent(path, []byte{0x90}, []byte{})
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read binary: %s", err)
+	}
+	if !bytes.Equal(data, m.Build([]byte{0x90}, []byte{})) {
+		t.Fatalf("written binary differs from the built one")
+	}
+}
@@ -16,6 +16,14 @@ type Node interface {
 type Error struct {
 	Node
 	Value string
+
+	// Line and Column hold the position of the error, counting from
+	// one, or zero if the position is unknown.
+	Line   int
+	Column int
+
+	// Token holds the token which caused the error.
+	Token token.Token
 }
 
 // String outputs this Error structure as a string.
@@ -36,6 +44,21 @@ type Data struct {
 
 	// Contents holds the string/byte data for the reference
 	Contents []byte
+
+	// Constant holds the name of a string-constant, defined by
+	// the user of the compiler, whose value is used as the contents.
+	//
+	//   .version DB VERSION
+	//
+	Constant string
+
+	// References holds the names of any labels, or constants, used
+	// as the values of quad-words, keyed by their offset within the
+	// contents.  The compiler replaces each with its 64-bit value.
+	//
+	//   .table DQ handler0, handler1
+	//
+	References map[int]string
 }
 
 // String outputs this Data structure as a string.
@@ -70,6 +93,40 @@ type Operand struct {
 	//
 	// i.e. `rax` has no indirection, but `[rax]` does.
 	Indirection bool
+
+	// Is the memory-reference relative to the instruction pointer?
+	//
+	// i.e. `[rel msg]` refers to the data named `msg`, by its
+	// distance from the next instruction.
+	Relative bool
+
+	// Segment holds the segment-override for a memory-reference, if
+	// any.
+	//
+	// i.e. `fs:[0x10]` has the segment `fs`.
+	Segment string
+
+	// Index, and Scale, hold the scaled index register of a
+	// memory-reference, if any.
+	//
+	// i.e. `[rbx+rcx*4]` has the index `rcx`, and the scale 4, while
+	// the token holds the base register `rbx`.  If there is no base
+	// register the token holds the displacement, as a number.
+	Index string
+	Scale int
+
+	// Displacement holds the value added to the base register of a
+	// memory-reference.
+	//
+	// i.e. `[rbp-8]` has the displacement -8.
+	Displacement int64
+
+	// Expression holds the terms of an expression, such as `$ - $$`,
+	// which will be evaluated by the compiler.
+	//
+	// The terms are values, separated by the `+` and `-` operators,
+	// and the Token will have the type EXPRESSION.
+	Expression []token.Token
 }
 
 // Instruction holds a parsed instruction.
@@ -82,14 +139,25 @@ type Instruction struct {
 	// Instruction holds the instruction we've found, as a string.
 	Instruction string
 
+	// Prefix holds any prefix which preceded the instruction, such
+	// as "rep".
+	Prefix string
+
 	// Operands holds the operands for this instruction.
 	//
 	// Operands will include numbers, registers, and indrected registers.
 	Operands []Operand
+
+	// Line holds the line upon which the instruction was found,
+	// counting from one.
+	Line int
 }
 
 // String outputs this Error structure as a string
 func (d Instruction) String() string {
+	if d.Prefix != "" {
+		return fmt.Sprintf("<INSTRUCTION: %s %s args:%v>", d.Prefix, d.Instruction, d.Operands)
+	}
 	return fmt.Sprintf("<INSTRUCTION: %s args:%v>", d.Instruction, d.Operands)
 }
 
@@ -107,3 +175,56 @@ type Label struct {
 func (l Label) String() string {
 	return fmt.Sprintf("<LABEL: %s>", l.Name)
 }
+
+// Section holds a section directive, which selects where the following
+// statements are placed.
+//
+// For example "section .bss" will place the following data within the
+// bss section, which is not stored within the binary.
+type Section struct {
+	Node
+
+	// Name has the name of the section, without the leading period.
+	Name string
+}
+
+// String outputs this Section structure as a string.
+func (s Section) String() string {
+	return fmt.Sprintf("<SECTION: %s>", s.Name)
+}
+
+// Incbin holds a directive which embeds the contents of a file within
+// the data, such as:
+//
+//   :icon
+//   .incbin "icon.bin"
+//
+// A label which immediately precedes the directive refers to the data.
+type Incbin struct {
+	Node
+
+	// Path holds the path of the file to embed.
+	Path string
+}
+
+// String outputs this Incbin structure as a string.
+func (i Incbin) String() string {
+	return fmt.Sprintf("<INCBIN: %s>", i.Path)
+}
+
+// Hotpatch holds a directive which prepares the function whose label it
+// follows for live-patching, such as:
+//
+//   :handler
+//   .hotpatch
+//
+// Padding precedes the function, and it begins with a two-byte no-op,
+// which may be replaced by a short jump into the padding.
+type Hotpatch struct {
+	Node
+}
+
+// String outputs this Hotpatch structure as a string.
+func (h Hotpatch) String() string {
+	return "<HOTPATCH>"
+}
@@ -3,14 +3,23 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/skx/assembler/instructions"
 	"github.com/skx/assembler/lexer"
 	"github.com/skx/assembler/token"
 )
 
+// maxRepeat is the largest repeat-count which may be used via `dup`, which
+// prevents a typo from exhausting our memory.
+const maxRepeat = 16 * 1024 * 1024
+
 // Parser holds our state.
 type Parser struct {
 	// program holds our lexed program, as a series of tokens.
@@ -19,6 +28,10 @@ type Parser struct {
 	// position holds our current offset within the program
 	// above.
 	position int
+
+	// lengths holds the number of operands accepted by instructions
+	// which are known only to this parser, as set via SetInstructions.
+	lengths map[string]int
 }
 
 // New creates a new Parser, which will parse the specified
@@ -44,6 +57,17 @@ func New(input string) *Parser {
 
 }
 
+// SetInstructions registers instructions which are known only to this
+// parser, along with the number of operands each accepts, in addition to
+// those within the instructions package.
+//
+// The lexer doesn't know about these instructions, so their names are
+// lexed as identifiers, which are then parsed as instructions when they
+// begin a statement.
+func (p *Parser) SetInstructions(lengths map[string]int) {
+	p.lengths = lengths
+}
+
 // Next returns the stream of parsed "things" from the input source program.
 //
 // The things we return include:
@@ -55,12 +79,41 @@ func New(input string) *Parser {
 // There might be more things in the future.
 func (p *Parser) Next() Node {
 
+	node := p.next()
+
+	// Record the position of any error, if it isn't already known.
+	//
+	// Errors are generally found when looking at the token which
+	// caused them, or at the end of the input.
+	if e, ok := node.(Error); ok && e.Line == 0 && len(p.program) > 0 {
+		if e.Token.Line == 0 {
+			if p.position < len(p.program) {
+				e.Token = p.program[p.position]
+			} else {
+				e.Token = p.program[len(p.program)-1]
+			}
+		}
+		e.Line = e.Token.Line
+		e.Column = e.Token.Column
+		return e
+	}
+	return node
+}
+
+// next returns the next node from our input, or nil at the end.
+func (p *Parser) next() Node {
+
 	// Loop until we've exhausted our input.
 	for p.position < len(p.program) {
 
 		// The token we're operating upon
 		tok := p.program[p.position]
 
+		// Instructions known only to us are lexed as identifiers.
+		if _, ok := p.lengths[tok.Literal]; ok && tok.Type == token.IDENTIFIER {
+			return p.parseInstruction()
+		}
+
 		switch tok.Type {
 
 		case token.DATA:
@@ -69,27 +122,69 @@ func (p *Parser) Next() Node {
 		case token.INSTRUCTION:
 			return p.parseInstruction()
 
+		case token.PREFIX:
+			return p.parsePrefix()
+
 		case token.LABEL:
 			return p.parseLabel()
 
+		case token.SECTION:
+			return p.parseSection()
+
 		case token.RSQUARE:
 			p.position++
 
+		case token.ILLEGAL:
+			p.position++
+			return Error{Value: fmt.Sprintf("illegal token '%s'", tok.Literal), Token: tok}
+
 		default:
-			fmt.Printf("Unhandled thing - definite bug: %v\n", tok)
+			// skip the token, so that we don't loop forever
+			p.position++
+
+			// An identifier at the start of a line is most likely
+			// an instruction we don't know, so skip its operands.
+			if tok.Type == token.IDENTIFIER && (p.position == 1 || p.program[p.position-2].Line != tok.Line) {
+				for p.position < len(p.program) && p.program[p.position].Line == tok.Line {
+					p.position++
+				}
+				return Error{Value: fmt.Sprintf("unknown instruction %q; supported: %s", tok.Literal, strings.Join(p.supported(), ", ")), Token: tok}
+			}
+			return Error{Value: fmt.Sprintf("unexpected token '%s'", tok.Literal), Token: tok}
 		}
 	}
 
 	return nil
 }
 
+// supported returns the sorted names of the instructions we know about,
+// from the same registry the lexer uses, along with any which are known
+// only to this parser.
+func (p *Parser) supported() []string {
+	var names []string
+	for name := range instructions.InstructionLengths {
+		names = append(names, name)
+	}
+	for name := range p.lengths {
+		if _, ok := instructions.InstructionLengths[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // parseData handles input of the form:
 //
 //  .NAME DB "String content here"
 //
-// TODO:
+// Or:
 //
 //  .NAME DB 0x01, 0x02, 0x03 ...
+//
+// Repeated values may be specified via "COUNT dup VALUE":
+//
+//  .NAME DB 256 dup 0x00
 func (p *Parser) parseData() Node {
 
 	// create the data-structure, with the name.
@@ -98,15 +193,28 @@ func (p *Parser) parseData() Node {
 	// skip the DATA
 	p.position++
 
+	// Preparing a function for patching?  i.e. `.hotpatch`
+	if d.Name == "hotpatch" && (p.position >= len(p.program) ||
+		(p.program[p.position].Type != token.DB && p.program[p.position].Type != token.DQ)) {
+		return Hotpatch{}
+	}
+
 	// ensure we're not out of the program
 	if p.position >= len(p.program) {
 		return Error{Value: "Unexpected EOF parsing data"}
 	}
 
-	// Next token should be DB
+	// Embedding a file?  i.e. `.incbin "file.bin"`
+	if d.Name == "incbin" && p.program[p.position].Type == token.STRING {
+		path := p.program[p.position].Literal
+		p.position++
+		return Incbin{Path: path}
+	}
+
+	// Next token should be DB, or DQ
 	db := p.program[p.position]
-	if db.Type != token.DB {
-		return Error{Value: fmt.Sprintf("expected DB, got %v", db)}
+	if db.Type != token.DB && db.Type != token.DQ {
+		return Error{Value: fmt.Sprintf("expected DB or DQ, got '%s'", db.Literal)}
 	}
 
 	// move forward
@@ -115,6 +223,11 @@ func (p *Parser) parseData() Node {
 		return Error{Value: "Unexpected EOF parsing data"}
 	}
 
+	// Quad-words are handled separately
+	if db.Type == token.DQ {
+		return p.parseQuads(d)
+	}
+
 	//
 	// We support:
 	//   .foo DB "String"
@@ -122,19 +235,39 @@ func (p *Parser) parseData() Node {
 	// Or
 	//   .foo DB 0x03, 0x4...
 	//
+	// Or
+	//   .foo DB CONSTANT
+	//
 	// If the next token is a string handle that.
+	//
+	// Adjacent strings are concatenated, so `"foo" "bar"` is the
+	// same as `"foobar"`.
 	cur := p.program[p.position]
 	if cur.Type == token.STRING {
-		// bump past the string
+		for p.position < len(p.program) &&
+			p.program[p.position].Type == token.STRING {
+
+			d.Contents = append(d.Contents, []byte(p.program[p.position].Literal)...)
+
+			// bump past the string
+			p.position++
+		}
+		return d
+	}
+
+	// If the next token is an identifier then it is a constant,
+	// which the compiler will resolve.
+	if cur.Type == token.IDENTIFIER {
+		// bump past the identifier
 		p.position++
 
-		d.Contents = []byte(cur.Literal)
+		d.Constant = cur.Literal
 		return d
 	}
 
 	// If the type isn't a number that's an error
 	if cur.Type != token.NUMBER {
-		return Error{Value: fmt.Sprintf("expected string|number-array, got %v", cur)}
+		return Error{Value: fmt.Sprintf("expected string|number-array, got '%s'", cur.Literal)}
 	}
 
 	// OK so we've got number
@@ -146,12 +279,49 @@ func (p *Parser) parseData() Node {
 			return Error{Value: fmt.Sprintf("failed to convert '%s' to number:%s", cur.Literal, err)}
 		}
 
-		// Add to the array
-		d.Contents = append(d.Contents, byte(num))
-
 		// skip past the number
 		p.position++
 
+		// Is this a repeated value?  i.e. "256 dup 0x00"
+		if p.position < len(p.program) &&
+			p.program[p.position].Type == token.IDENTIFIER &&
+			p.program[p.position].Literal == "dup" {
+
+			// skip past the dup
+			p.position++
+			if p.position >= len(p.program) {
+				return Error{Value: "Unexpected EOF parsing dup"}
+			}
+
+			val := p.program[p.position]
+			if val.Type != token.NUMBER {
+				return Error{Value: fmt.Sprintf("expected number after dup, got '%s'", val.Literal)}
+			}
+
+			v, err := strconv.ParseInt(val.Literal, 0, 64)
+			if err != nil {
+				return Error{Value: fmt.Sprintf("failed to convert '%s' to number:%s", val.Literal, err)}
+			}
+			if num < 0 || num > maxRepeat {
+				return Error{Value: fmt.Sprintf("invalid repeat-count %d, the limit is %d", num, maxRepeat)}
+			}
+
+			// The value may be signed, or unsigned.
+			if v < math.MinInt8 || v > math.MaxUint8 {
+				return Error{Value: fmt.Sprintf("repeated value %s does not fit in a byte", val.Literal)}
+			}
+
+			// Add the value the appropriate number of times
+			d.Contents = append(d.Contents, bytes.Repeat([]byte{byte(v)}, int(num))...)
+
+			// skip past the value
+			p.position++
+		} else {
+
+			// Add to the array
+			d.Contents = append(d.Contents, byte(num))
+		}
+
 		// end of program?
 		if p.position >= len(p.program) {
 			break
@@ -176,6 +346,82 @@ func (p *Parser) parseData() Node {
 	return d
 }
 
+// parseQuads handles the contents of a DQ statement, which is a list of
+// comma-separated 64-bit values:
+//
+//   .foo DQ 1, -2, 0x10
+//   .pi  DQ 3.14159
+//   .tbl DQ handler0, handler1
+//
+// Integers are stored as-is, and numbers containing a decimal point are
+// stored as IEEE-754 double-precision values.  All are little-endian.
+//
+// Names, such as labels, are recorded as references to be resolved by
+// the compiler.
+func (p *Parser) parseQuads(d Data) Node {
+
+	for {
+		negative := false
+		if p.program[p.position].Type == token.MINUS {
+			negative = true
+			p.position++
+			if p.position >= len(p.program) {
+				return Error{Value: "Unexpected EOF parsing data"}
+			}
+		}
+
+		cur := p.program[p.position]
+
+		literal := cur.Literal
+		if negative {
+			literal = "-" + literal
+		}
+
+		var val uint64
+		if cur.Type == token.IDENTIFIER && !negative {
+			// A label, or constant, is resolved by the compiler,
+			// which will replace our placeholder.
+			if d.References == nil {
+				d.References = make(map[int]string)
+			}
+			d.References[len(d.Contents)] = cur.Literal
+		} else if cur.Type != token.NUMBER {
+			return Error{Value: fmt.Sprintf("expected number, got '%s'", cur.Literal)}
+		} else if strings.Contains(literal, ".") {
+			f, err := strconv.ParseFloat(literal, 64)
+			if err != nil {
+				return Error{Value: fmt.Sprintf("failed to convert '%s' to number:%s", literal, err)}
+			}
+			val = math.Float64bits(f)
+		} else {
+			num, err := strconv.ParseInt(literal, 0, 64)
+			if err != nil {
+				return Error{Value: fmt.Sprintf("failed to convert '%s' to number:%s", literal, err)}
+			}
+			val = uint64(num)
+		}
+
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, val)
+		d.Contents = append(d.Contents, buf...)
+
+		// skip past the number
+		p.position++
+
+		// if the next token is not a comma then we're done
+		if p.position >= len(p.program) ||
+			p.program[p.position].Type != token.COMMA {
+			return d
+		}
+
+		// Otherwise skip over the comma
+		p.position++
+		if p.position >= len(p.program) {
+			return Error{Value: "Unexpected EOF parsing data"}
+		}
+	}
+}
+
 // parseInstruction is our workhorse
 //
 // We either return an `Instruction` or an `Error`
@@ -186,17 +432,39 @@ func (p *Parser) parseInstruction() Node {
 	tok := p.program[p.position]
 
 	// Find out how many arguments it has
-	count, ok := instructions.InstructionLengths[tok.Literal]
+	count, ok := p.lengths[tok.Literal]
+	if !ok {
+		count, ok = instructions.InstructionLengths[tok.Literal]
+	}
 
 	// If that failed then it is an unknown instruction, probably
 	if !ok {
-		return Error{Value: fmt.Sprintf("unknown instructoin %v", tok)}
+		return Error{Value: fmt.Sprintf("unknown instruction %v", tok)}
+	}
+
+	// If the final operand is optional, and absent, then we have one
+	// fewer operand.  Operands must be upon the same line as the
+	// instruction.
+	if instructions.Optional[tok.Literal] {
+		if p.position+1 >= len(p.program) ||
+			p.program[p.position+1].Line != tok.Line {
+			count--
+		}
+	}
+
+	// Some instructions accept any number of operands
+	if count == instructions.Variable {
+		args, err := p.takeVariableArguments(tok.Line)
+		if err != nil {
+			return Error{Value: err.Error()}
+		}
+		return Instruction{Instruction: tok.Literal, Operands: args, Line: tok.Line}
 	}
 
 	// No args?  Just return the instruction and bump the position
 	if count == 0 {
 		p.position++
-		return Instruction{Instruction: tok.Literal}
+		return Instruction{Instruction: tok.Literal, Line: tok.Line}
 	}
 
 	if count == 1 {
@@ -206,7 +474,7 @@ func (p *Parser) parseInstruction() Node {
 
 		}
 
-		return Instruction{Instruction: tok.Literal, Operands: args}
+		return Instruction{Instruction: tok.Literal, Operands: args, Line: tok.Line}
 	}
 	if count == 2 {
 
@@ -215,12 +483,47 @@ func (p *Parser) parseInstruction() Node {
 			return Error{Value: err.Error()}
 
 		}
-		return Instruction{Instruction: tok.Literal, Operands: args}
+		return Instruction{Instruction: tok.Literal, Operands: args, Line: tok.Line}
+	}
+	if count == 3 {
+
+		args, err := p.TakeThreeArguments()
+		if err != nil {
+			return Error{Value: err.Error()}
+
+		}
+		return Instruction{Instruction: tok.Literal, Operands: args, Line: tok.Line}
 	}
 
 	return Error{Value: fmt.Sprintf("unhandled argument-count for token %v", tok)}
 }
 
+// parsePrefix handles an instruction which has a prefix, for example:
+//
+//  rep stosb
+func (p *Parser) parsePrefix() Node {
+
+	prefix := p.program[p.position].Literal
+
+	// skip the prefix
+	p.position++
+
+	if p.position >= len(p.program) {
+		return Error{Value: fmt.Sprintf("unexpected EOF after prefix %s", prefix)}
+	}
+	if p.program[p.position].Type != token.INSTRUCTION {
+		return Error{Value: fmt.Sprintf("expected instruction after prefix %s, got '%s'", prefix, p.program[p.position].Literal)}
+	}
+
+	// Parse the instruction, and add the prefix to it.
+	out := p.parseInstruction()
+	if i, ok := out.(Instruction); ok {
+		i.Prefix = prefix
+		return i
+	}
+	return out
+}
+
 // parseLabel handles input of the form:
 //
 //  :foo
@@ -235,6 +538,36 @@ func (p *Parser) parseLabel() Node {
 	return l
 }
 
+// parseSection handles input of the form:
+//
+//  section .bss
+//
+// The section must be one of .text, .data, or .bss.
+func (p *Parser) parseSection() Node {
+
+	// skip the section keyword
+	p.position++
+
+	if p.position >= len(p.program) {
+		return Error{Value: "unexpected EOF after section"}
+	}
+
+	name := p.program[p.position]
+	if name.Type != token.DATA {
+		return Error{Value: fmt.Sprintf("expected a section name, got '%s'", name.Literal)}
+	}
+	switch name.Literal {
+	case "text", "data", "bss":
+	default:
+		return Error{Value: fmt.Sprintf("unknown section '.%s'", name.Literal)}
+	}
+
+	// skip the name
+	p.position++
+
+	return Section{Name: name.Literal}
+}
+
 // TakeTwoArguments handles fetching two arguments for an instruction.
 //
 // Arguments may be register-names, numbers, or label-values
@@ -250,9 +583,12 @@ func (p *Parser) TakeTwoArguments() ([]Operand, error) {
 	toks = append(toks, one)
 
 	// see if we have a comma
+	if p.position >= len(p.program) {
+		return toks, fmt.Errorf("unexpected EOF")
+	}
 	c := p.program[p.position]
 	if c.Type != token.COMMA {
-		return toks, fmt.Errorf("expected ',', got %v", c)
+		return toks, fmt.Errorf("expected ',', got '%s'", c.Literal)
 	}
 
 	// Get the second argument
@@ -265,6 +601,69 @@ func (p *Parser) TakeTwoArguments() ([]Operand, error) {
 	return toks, nil
 }
 
+// TakeThreeArguments handles fetching three arguments for an instruction.
+//
+// Arguments may be register-names, numbers, or label-values
+func (p *Parser) TakeThreeArguments() ([]Operand, error) {
+
+	// Get the first two arguments
+	toks, err := p.TakeTwoArguments()
+	if err != nil {
+		return toks, err
+	}
+
+	// see if we have a comma
+	if p.position >= len(p.program) {
+		return toks, fmt.Errorf("unexpected EOF")
+	}
+	c := p.program[p.position]
+	if c.Type != token.COMMA {
+		return toks, fmt.Errorf("expected ',', got '%s'", c.Literal)
+	}
+
+	// Get the third argument
+	three, err := p.getOperand()
+	if err != nil {
+		return toks, err
+	}
+	toks = append(toks, three)
+
+	return toks, nil
+}
+
+// takeVariableArguments reads the operands which follow an instruction
+// upon the given line.
+func (p *Parser) takeVariableArguments(line int) ([]Operand, error) {
+
+	var toks []Operand
+
+	for p.position+1 < len(p.program) &&
+		p.program[p.position+1].Line == line {
+
+		op, err := p.getOperand()
+		if err != nil {
+			return toks, err
+		}
+		toks = append(toks, op)
+
+		// Are there more operands?
+		if p.position >= len(p.program) ||
+			p.program[p.position].Line != line {
+			break
+		}
+		c := p.program[p.position]
+		if c.Type != token.COMMA {
+			return toks, fmt.Errorf("expected ',', got '%s'", c.Literal)
+		}
+	}
+
+	// Move past the last operand, or the instruction
+	if len(toks) == 0 {
+		p.position++
+	}
+	return toks, nil
+}
+
 // TakeOneArgument reads the argument for a single-arg instruction.
 //
 // Arguments may be a register-name, number, or a label-value.
@@ -295,6 +694,14 @@ func (p *Parser) getOperand() (Operand, error) {
 
 	// Get the argument
 	thing := p.program[p.position]
+	if thing.Type == token.ILLEGAL {
+		return op, fmt.Errorf("illegal token '%s'", thing.Literal)
+	}
+
+	// An expression?  i.e. `-4`, or `$ - $$`.
+	if thing.Type == token.MINUS || p.isExpression() {
+		return p.getExpression()
+	}
 
 	if thing.Type == token.REGISTER ||
 		thing.Type == token.NUMBER {
@@ -303,6 +710,12 @@ func (p *Parser) getOperand() (Operand, error) {
 		return op, nil
 	}
 
+	// Indirection without a size, e.g. `[rax]`, or `fs:[0x10]`.
+	if thing.Type == token.LSQUARE || thing.Type == token.SEGMENT {
+		err := p.getIndirection(&op)
+		return op, err
+	}
+
 	// Could be "identifer", could be "byte|word|qword ptr"
 	if thing.Literal != "byte" &&
 		thing.Literal != "word" &&
@@ -327,7 +740,7 @@ func (p *Parser) getOperand() (Operand, error) {
 		op.Size = 64
 	}
 
-	// So the next token must be "ptr"
+	// So the next token should be "ptr", or the memory-reference
 	p.position++
 	if p.position >= len(p.program) {
 		return op, fmt.Errorf("unexpected EOF #2")
@@ -335,26 +748,268 @@ func (p *Parser) getOperand() (Operand, error) {
 
 	// Get the next arg
 	next := p.program[p.position]
-	if next.Type != token.IDENTIFIER || next.Literal != "ptr" {
+	if next.Type == token.IDENTIFIER && next.Literal == "ptr" {
+		p.position++
+	} else if next.Type != token.LSQUARE && next.Type != token.SEGMENT {
 		return op, fmt.Errorf("expected ptr after %s", thing.Literal)
 	}
-	p.position++
 
-	if p.program[p.position].Type == token.LSQUARE {
-		op.Indirection = true
+	if p.position >= len(p.program) {
+		return op, fmt.Errorf("unexpected EOF #3")
+	}
 
-		// skip the [
+	if p.program[p.position].Type == token.LSQUARE ||
+		p.program[p.position].Type == token.SEGMENT {
+		err := p.getIndirection(&op)
+		if err != nil {
+			return op, err
+		}
+	} else {
 		p.position++
-
-		// get the register + skip it
 		op.Token = p.program[p.position]
 		p.position++
+	}
+	return op, nil
 
-	} else {
+}
+
+// isExpression returns true if the current token is a value which is
+// followed by an operator, and so begins an expression.
+func (p *Parser) isExpression() bool {
+
+	cur := p.program[p.position]
+	if cur.Type != token.NUMBER && cur.Type != token.IDENTIFIER {
+		return false
+	}
+	if p.position+1 >= len(p.program) {
+		return false
+	}
+
+	next := p.program[p.position+1]
+	return next.Type == token.PLUS || next.Type == token.MINUS
+}
+
+// getExpression reads an expression, which is a series of numbers and
+// identifiers separated by `+` and `-`.  A leading `-` is permitted to
+// allow negative numbers.
+//
+// When we're called the current token is the start of the expression.
+func (p *Parser) getExpression() (Operand, error) {
+
+	var op Operand
+	var terms []token.Token
+
+	// Allow a leading minus
+	if p.program[p.position].Type == token.MINUS {
+		terms = append(terms, p.program[p.position])
 		p.position++
-		op.Token = p.program[p.position]
+	}
+
+	for {
+		if p.position >= len(p.program) {
+			return op, fmt.Errorf("unexpected EOF in expression")
+		}
+
+		// Get the value
+		val := p.program[p.position]
+		if val.Type != token.NUMBER && val.Type != token.IDENTIFIER {
+			return op, fmt.Errorf("expected number or identifier in expression, got '%s'", val.Literal)
+		}
+		terms = append(terms, val)
+		p.position++
+
+		// If there is no operator we're done
+		if p.position >= len(p.program) ||
+			(p.program[p.position].Type != token.PLUS &&
+				p.program[p.position].Type != token.MINUS) {
+			break
+		}
+
+		terms = append(terms, p.program[p.position])
 		p.position++
 	}
+
+	// Build up the literal
+	lit := ""
+	for _, t := range terms {
+		if lit != "" && lit != "-" {
+			lit += " "
+		}
+		lit += t.Literal
+	}
+
+	op.Token = token.Token{Type: token.EXPRESSION, Literal: lit}
+	op.Expression = terms
 	return op, nil
+}
 
+// getIndirection handles reading a memory-reference, which might look
+// like any of these:
+//
+//	[rax]
+//	[rel msg]
+//	[rbx+rcx*4+8]
+//
+// When we're called the current token is the opening "[".
+func (p *Parser) getIndirection(op *Operand) error {
+
+	op.Indirection = true
+
+	// A segment-override?
+	if p.program[p.position].Type == token.SEGMENT {
+		op.Segment = p.program[p.position].Literal
+
+		p.position++
+		if p.position >= len(p.program) ||
+			p.program[p.position].Type != token.LSQUARE {
+			return fmt.Errorf("expected memory reference after %s:", op.Segment)
+		}
+	}
+
+	// skip the [
+	p.position++
+	if p.position >= len(p.program) {
+		return fmt.Errorf("unexpected EOF in memory reference")
+	}
+
+	// RIP-relative reference?  Either `[rel name]` or `[rip+name]`.
+	rip := p.program[p.position].Type == token.IDENTIFIER &&
+		p.program[p.position].Literal == "rip" &&
+		p.position+1 < len(p.program) &&
+		p.program[p.position+1].Type == token.PLUS
+	if rip {
+		p.position++
+	}
+	if rip || (p.program[p.position].Type == token.IDENTIFIER &&
+		p.program[p.position].Literal == "rel") {
+		op.Relative = true
+
+		p.position++
+		if p.position >= len(p.program) {
+			return fmt.Errorf("unexpected EOF in memory reference")
+		}
+		if p.program[p.position].Type != token.IDENTIFIER {
+			return fmt.Errorf("expected name after rel, got '%s'", p.program[p.position].Literal)
+		}
+	}
+
+	// A register, or number, may be part of an address which is
+	// calculated from several terms.
+	cur := p.program[p.position]
+	if !op.Relative && (cur.Type == token.REGISTER || cur.Type == token.NUMBER || cur.Type == token.MINUS) {
+		return p.getAddress(op)
+	}
+
+	// get the name + skip it
+	op.Token = p.program[p.position]
+	p.position++
+
+	return nil
+}
+
+// getAddress reads the terms of a memory-reference, which are separated
+// by `+` and `-`: a base register, an index register which may be scaled
+// by 1, 2, 4, or 8, and numbers which are summed to give a displacement.
+//
+// When we're called the current token is the first term.
+func (p *Parser) getAddress(op *Operand) error {
+
+	first := p.program[p.position]
+	line := first.Line
+
+	var base *token.Token
+	var terms int
+	var disp int64
+	sign := int64(1)
+
+	// Allow a leading minus
+	if first.Type == token.MINUS {
+		sign = -1
+		p.position++
+	}
+
+	for {
+		if p.position >= len(p.program) {
+			return fmt.Errorf("unexpected EOF in memory reference")
+		}
+
+		tok := p.program[p.position]
+		p.position++
+		terms++
+
+		switch tok.Type {
+		case token.NUMBER:
+			n, err := strconv.ParseInt(tok.Literal, 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid displacement %s", tok.Literal)
+			}
+			disp += sign * n
+
+		case token.REGISTER:
+			if sign < 0 {
+				return fmt.Errorf("register %s cannot be subtracted in a memory reference", tok.Literal)
+			}
+
+			// A scaled index?
+			scale := 0
+			if p.position < len(p.program) && p.program[p.position].Type == token.ASTERISK {
+				p.position++
+				if p.position >= len(p.program) {
+					return fmt.Errorf("unexpected EOF in memory reference")
+				}
+				n := p.program[p.position]
+				p.position++
+				switch n.Literal {
+				case "1", "2", "4", "8":
+					scale, _ = strconv.Atoi(n.Literal)
+				default:
+					return fmt.Errorf("invalid scale %s, expected 1, 2, 4, or 8", n.Literal)
+				}
+			}
+
+			// The first unscaled register is the base, and any
+			// other is the index.
+			switch {
+			case scale == 0 && base == nil:
+				t := tok
+				base = &t
+			case op.Index == "":
+				if scale == 0 {
+					scale = 1
+				}
+				op.Index = tok.Literal
+				op.Scale = scale
+			default:
+				return fmt.Errorf("too many registers in memory reference")
+			}
+
+		default:
+			return fmt.Errorf("unexpected '%s' in memory reference", tok.Literal)
+		}
+
+		// Are there more terms?
+		if p.position >= len(p.program) ||
+			p.program[p.position].Line != line ||
+			(p.program[p.position].Type != token.PLUS &&
+				p.program[p.position].Type != token.MINUS) {
+			break
+		}
+		sign = 1
+		if p.program[p.position].Type == token.MINUS {
+			sign = -1
+		}
+		p.position++
+	}
+
+	switch {
+	case base != nil:
+		op.Token = *base
+		op.Displacement = disp
+	case terms == 1 && first.Type == token.NUMBER:
+		// A single number, which is an absolute address
+		op.Token = first
+	default:
+		op.Token = token.Token{Type: token.NUMBER, Literal: strconv.FormatInt(disp, 10), Line: first.Line, Column: first.Column}
+	}
+	return nil
 }
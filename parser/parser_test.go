@@ -1,7 +1,14 @@
 package parser
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
+
+	"github.com/skx/assembler/instructions"
+	"github.com/skx/assembler/token"
 )
 
 func TestComment(t *testing.T) {
@@ -14,6 +21,38 @@ func TestComment(t *testing.T) {
 	}
 }
 
+func TestBlockComment(t *testing.T) {
+
+	p := New(`nop
+/* This comment
+   spans three lines,
+   and is ignored */
+ret // as is this`)
+
+	var out []string
+	for n := p.Next(); n != nil; n = p.Next() {
+		i, ok := n.(Instruction)
+		if !ok {
+			t.Fatalf("expected an instruction, got %v", n)
+		}
+		out = append(out, i.Instruction)
+	}
+	if len(out) != 2 || out[0] != "nop" || out[1] != "ret" {
+		t.Fatalf("unexpected instructions %v", out)
+	}
+
+	// An unterminated comment is an error
+	p = New("nop\n/* never closed\nret")
+	p.Next()
+	e, ok := p.Next().(Error)
+	if !ok {
+		t.Fatalf("expected an error for an unterminated comment")
+	}
+	if e.Value != "illegal token 'unterminated block comment'" || e.Line != 2 {
+		t.Fatalf("unexpected error %v", e)
+	}
+}
+
 func TestData(t *testing.T) {
 
 	type TestCase struct {
@@ -34,6 +73,24 @@ func TestData(t *testing.T) {
 		TestCase{Input: ".foo DB 32, ",
 			Data: []byte{32},
 		},
+		TestCase{Input: ".foo DB 4 dup 0xff",
+			Data: []byte{0xff, 0xff, 0xff, 0xff},
+		},
+		TestCase{Input: ".foo DB 1, 2 dup 3, 4",
+			Data: []byte{1, 3, 3, 4},
+		},
+		TestCase{Input: ".foo DB 0 dup 3",
+			Data: []byte{},
+		},
+		TestCase{Input: ".foo DB 2 dup 255",
+			Data: []byte{0xff, 0xff},
+		},
+		TestCase{Input: ".foo db \"ab\" \"cd\"",
+			Data: []byte("abcd"),
+		},
+		TestCase{Input: ".foo DB \"Hello, \"\n  \"World\"\n.bar DB 1",
+			Data: []byte("Hello, World"),
+		},
 	}
 
 	// For each test
@@ -66,6 +123,19 @@ func TestData(t *testing.T) {
 			}
 		}
 	}
+
+	// Repeat-counts must be reasonable, and the repeated value must
+	// fit in a byte.
+	for _, src := range []string{
+		".x DB 9223372036854775807 dup 0",
+		".x DB 16777217 dup 0",
+		".x DB 1 dup 0x100",
+		".x DB 2 dup 256",
+	} {
+		if _, ok := New(src).Next().(Error); !ok {
+			t.Fatalf("expected an error parsing %s", src)
+		}
+	}
 }
 
 func TestMove(t *testing.T) {
@@ -89,3 +159,576 @@ func TestMove(t *testing.T) {
 		t.Fatalf("mov - wrong second arg")
 	}
 }
+
+func TestThreeArguments(t *testing.T) {
+
+	p := New("imul rax, rbx, 10")
+
+	out := p.Next()
+
+	outI, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+
+	if len(outI.Operands) != 3 {
+		t.Fatalf("imul - wrong arg count")
+	}
+	if outI.Operands[0].Literal != "rax" {
+		t.Fatalf("imul - wrong first arg")
+	}
+	if outI.Operands[1].Literal != "rbx" {
+		t.Fatalf("imul - wrong second arg")
+	}
+	if outI.Operands[2].Literal != "10" {
+		t.Fatalf("imul - wrong third arg")
+	}
+
+	// The final operand is optional, and the following line
+	// isn't consumed
+	p = New("imul rax, rbx\nnop")
+	out = p.Next()
+	outI, ok = out.(Instruction)
+	if !ok || len(outI.Operands) != 2 {
+		t.Fatalf("imul - wrong arg count %v", out)
+	}
+	out = p.Next()
+	if outI, ok = out.(Instruction); !ok || outI.Instruction != "nop" {
+		t.Fatalf("expected nop, got %v", out)
+	}
+}
+
+func TestIndirection(t *testing.T) {
+
+	p := New("mov rax, [rel msg]\nmov rbx, [rcx]\nmov rax, [rel 3]")
+
+	out := p.Next()
+	outI, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if !outI.Operands[1].Indirection || !outI.Operands[1].Relative {
+		t.Fatalf("expected a relative reference: %v", outI.Operands[1])
+	}
+	if outI.Operands[1].Literal != "msg" {
+		t.Fatalf("wrong name for relative reference: %v", outI.Operands[1])
+	}
+
+	out = p.Next()
+	outI, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if !outI.Operands[1].Indirection || outI.Operands[1].Relative {
+		t.Fatalf("expected a register indirection: %v", outI.Operands[1])
+	}
+	if outI.Operands[1].Literal != "rcx" {
+		t.Fatalf("wrong register for indirection: %v", outI.Operands[1])
+	}
+
+	// rel must be followed by a name
+	out = p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+func TestExpression(t *testing.T) {
+
+	type TestCase struct {
+		Input   string
+		Literal string
+		Terms   int
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, $ - $$", Literal: "$ - $$", Terms: 3},
+		{Input: "mov rax, -4", Literal: "-4", Terms: 2},
+		{Input: "mov rax, 1 + 2 - 3", Literal: "1 + 2 - 3", Terms: 5},
+	}
+
+	for _, test := range tests {
+		p := New(test.Input)
+
+		out := p.Next()
+		outI, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure: %v", out)
+		}
+		if outI.Operands[1].Type != token.EXPRESSION {
+			t.Fatalf("expected an expression, got %v", outI.Operands[1])
+		}
+		if outI.Operands[1].Literal != test.Literal {
+			t.Fatalf("expression literal wrong, got %s", outI.Operands[1].Literal)
+		}
+		if len(outI.Operands[1].Expression) != test.Terms {
+			t.Fatalf("wrong number of terms in expression: %v", outI.Operands[1].Expression)
+		}
+	}
+
+	// Trailing operator
+	p := New("mov rax, 3 +")
+	out := p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+// TestQuad ensures quad-words are stored little-endian, and that floating
+// point values use their IEEE-754 representation.
+func TestQuad(t *testing.T) {
+
+	p := New(".pi DQ 3.14159, -2.5, 1, -2, 0x10")
+
+	out := p.Next()
+	d, ok := out.(Data)
+	if !ok {
+		t.Fatalf("didn't get an Data structure: %v", out)
+	}
+
+	expected := []uint64{
+		math.Float64bits(3.14159),
+		math.Float64bits(-2.5),
+		1,
+		0xfffffffffffffffe,
+		0x10,
+	}
+	if len(d.Contents) != len(expected)*8 {
+		t.Fatalf("data length didn't match expectation: % x", d.Contents)
+	}
+	for n, val := range expected {
+		got := binary.LittleEndian.Uint64(d.Contents[n*8:])
+		if got != val {
+			t.Fatalf("value %d mismatch, expected %x, got %x", n, val, got)
+		}
+	}
+
+	// 3.14159 is 0x400921f9f01b866e
+	if d.Contents[0] != 0x6e || d.Contents[7] != 0x40 {
+		t.Fatalf("unexpected encoding of pi: % x", d.Contents[:8])
+	}
+
+	// Names are recorded as references, with placeholder values
+	p = New(".table DQ one, 2, three")
+	d, ok = p.Next().(Data)
+	if !ok {
+		t.Fatalf("didn't get a Data structure")
+	}
+	if len(d.Contents) != 24 || binary.LittleEndian.Uint64(d.Contents[8:]) != 2 {
+		t.Fatalf("unexpected contents % x", d.Contents)
+	}
+	if len(d.References) != 2 || d.References[0] != "one" || d.References[16] != "three" {
+		t.Fatalf("unexpected references %v", d.References)
+	}
+
+	// Errors
+	for _, src := range []string{".foo DQ", ".foo DQ \"str\"", ".foo DQ 1,", ".foo DQ -", ".foo DQ -bar"} {
+		p = New(src)
+		out = p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected error parsing %s, got %v", src, out)
+		}
+	}
+}
+
+func TestDataConstant(t *testing.T) {
+
+	p := New(".version DB VERSION")
+
+	out := p.Next()
+	d, ok := out.(Data)
+	if !ok {
+		t.Fatalf("didn't get an Data structure: %v", out)
+	}
+	if d.Name != "version" || d.Constant != "VERSION" {
+		t.Fatalf("unexpected data structure: %v", d)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+
+	p := New("rep stosb")
+	out := p.Next()
+	i, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction: %v", out)
+	}
+	if i.Prefix != "rep" || i.Instruction != "stosb" {
+		t.Fatalf("unexpected instruction: %v", i)
+	}
+
+	// A prefix must be followed by an instruction
+	for _, src := range []string{"rep", "rep 3", "rep rep stosb"} {
+		p = New(src)
+		out = p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for %s, got %v", src, out)
+		}
+	}
+}
+
+func TestRIP(t *testing.T) {
+
+	for _, src := range []string{"lea rax, [rip+msg]", "lea rax, [rel msg]"} {
+		p := New(src)
+		out := p.Next()
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction: %v", out)
+		}
+		op := i.Operands[1]
+		if !op.Relative || !op.Indirection || op.Literal != "msg" {
+			t.Fatalf("unexpected operand for %s: %v", src, op)
+		}
+	}
+}
+
+func TestIncbin(t *testing.T) {
+
+	p := New(":icon\n.incbin \"icon.bin\"")
+	if _, ok := p.Next().(Label); !ok {
+		t.Fatalf("expected a label")
+	}
+	out := p.Next()
+	i, ok := out.(Incbin)
+	if !ok || i.Path != "icon.bin" {
+		t.Fatalf("didn't get the expected incbin: %v", out)
+	}
+
+	// Data may still be named incbin
+	p = New(".incbin DB 1")
+	out = p.Next()
+	if d, ok := out.(Data); !ok || d.Name != "incbin" {
+		t.Fatalf("didn't get the expected data: %v", out)
+	}
+}
+
+func TestHotpatch(t *testing.T) {
+
+	p := New(":handler\n.hotpatch\nret\n:other\n.hotpatch")
+	if _, ok := p.Next().(Label); !ok {
+		t.Fatalf("expected a label")
+	}
+	out := p.Next()
+	if _, ok := out.(Hotpatch); !ok {
+		t.Fatalf("didn't get the expected hotpatch: %v", out)
+	}
+	if _, ok := p.Next().(Instruction); !ok {
+		t.Fatalf("expected an instruction to follow the hotpatch")
+	}
+	p.Next()
+	out = p.Next()
+	if _, ok := out.(Hotpatch); !ok {
+		t.Fatalf("didn't get the expected hotpatch at the end: %v", out)
+	}
+
+	// Data may still be named hotpatch
+	p = New(".hotpatch DB 1")
+	out = p.Next()
+	if d, ok := out.(Data); !ok || d.Name != "hotpatch" {
+		t.Fatalf("didn't get the expected data: %v", out)
+	}
+}
+
+func TestSection(t *testing.T) {
+
+	p := New("section .bss\n.buf DB 8 dup 0")
+	out := p.Next()
+	s, ok := out.(Section)
+	if !ok || s.Name != "bss" {
+		t.Fatalf("didn't get the expected section: %v", out)
+	}
+	if _, ok := p.Next().(Data); !ok {
+		t.Fatalf("expected data to follow the section")
+	}
+
+	// The name must be a known section
+	for _, src := range []string{"section", "section bss", "section .rodata"} {
+		p = New(src)
+		out = p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for %s, got %v", src, out)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+
+	// The ptr keyword is optional
+	for _, src := range []string{"neg qword ptr [rax]", "neg qword [rax]"} {
+		p := New(src)
+		out := p.Next()
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure: %v", out)
+		}
+		op := i.Operands[0]
+		if op.Size != 64 || !op.Indirection || op.Literal != "rax" {
+			t.Fatalf("unexpected operand for %s: %v", src, op)
+		}
+	}
+
+	// But something must follow the size
+	p := New("neg qword rax")
+	out := p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+func TestSegment(t *testing.T) {
+
+	type TestCase struct {
+		Input   string
+		Segment string
+		Literal string
+		Size    int
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, fs:[0x10]", Segment: "fs", Literal: "0x10"},
+		{Input: "mov rax, gs:[rsi]", Segment: "gs", Literal: "rsi"},
+		{Input: "mov rax, qword ptr fs:[rax]", Segment: "fs", Literal: "rax", Size: 64},
+		{Input: "mov rax, [rax]", Literal: "rax"},
+	}
+
+	for _, test := range tests {
+		p := New(test.Input)
+		out := p.Next()
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure: %v", out)
+		}
+		op := i.Operands[1]
+		if !op.Indirection || op.Segment != test.Segment || op.Literal != test.Literal || op.Size != test.Size {
+			t.Fatalf("unexpected operand for %s: %v", test.Input, op)
+		}
+	}
+
+	// A memory-reference must follow the segment
+	for _, src := range []string{"mov rax, fs:rax", "mov rax, fs:"} {
+		p := New(src)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error parsing %s, got %v", src, out)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+
+	type TestCase struct {
+		Input        string
+		Literal      string
+		Index        string
+		Scale        int
+		Displacement int64
+	}
+
+	tests := []TestCase{
+		{Input: "mov rax, [rbx+rcx*4]", Literal: "rbx", Index: "rcx", Scale: 4},
+		{Input: "mov rax, [rax+rdx*8+16]", Literal: "rax", Index: "rdx", Scale: 8, Displacement: 16},
+		{Input: "mov rax, [rbp-8]", Literal: "rbp", Displacement: -8},
+		{Input: "mov rax, [rbx+rsi]", Literal: "rbx", Index: "rsi", Scale: 1},
+		{Input: "mov rax, [rcx*8+0x10]", Literal: "16", Index: "rcx", Scale: 8},
+		{Input: "mov rax, [rcx*2]", Literal: "0", Index: "rcx", Scale: 2},
+		{Input: "mov rax, [0x10]", Literal: "0x10"},
+		{Input: "mov rax, [-8]", Literal: "-8"},
+	}
+
+	for _, test := range tests {
+		p := New(test.Input)
+		out := p.Next()
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+		op := i.Operands[1]
+		if !op.Indirection || op.Literal != test.Literal || op.Index != test.Index ||
+			op.Scale != test.Scale || op.Displacement != test.Displacement {
+			t.Fatalf("unexpected operand for %s: %+v", test.Input, op)
+		}
+	}
+
+	// The following line isn't part of the address
+	p := New("mov rax, [rbx]\n-")
+	if _, ok := p.Next().(Instruction); !ok {
+		t.Fatalf("failed to parse the instruction")
+	}
+
+	for _, src := range []string{
+		"mov rax, [rbx+rcx*3]",
+		"mov rax, [rbx-rcx]",
+		"mov rax, [rbx+rcx+rdx]",
+		"mov rax, [rbx+msg]",
+		"mov rax, [rbx+",
+	} {
+		p := New(src)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error parsing %s, got %v", src, out)
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+
+	p := New("nop\n.foo DB 3 dup \"x\"")
+
+	out := p.Next()
+	if _, ok := out.(Instruction); !ok {
+		t.Fatalf("didn't get an instruction: %v", out)
+	}
+
+	out = p.Next()
+	e, ok := out.(Error)
+	if !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+	if e.Line != 2 || e.Column != 15 || e.Token.Literal != "x" {
+		t.Fatalf("unexpected error position: %v %d:%d", e.Token, e.Line, e.Column)
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+
+	// parse returns the string-form of all the nodes in the input,
+	// ignoring the positions of the tokens.
+	parse := func(src string) []string {
+		var out []string
+		p := New(src)
+		for n := p.Next(); n != nil; n = p.Next() {
+			i, ok := n.(Instruction)
+			if !ok {
+				out = append(out, fmt.Sprintf("%v", n))
+				continue
+			}
+			str := i.Instruction
+			for _, op := range i.Operands {
+				str += fmt.Sprintf(" %s:%s:%d:%t", op.Type, op.Literal, op.Size, op.Indirection)
+			}
+			out = append(out, str)
+		}
+		return out
+	}
+
+	unix := ".msg DB \"hi\"\n:start\nmov rax, 3\nadd rbx, rcx ; comment\ninc byte ptr [rax]\nret\n"
+	windows := ".msg\tDB\t\"hi\"\r\n:start\r\n\tmov\trax,\t3\r\n\fadd rbx,\trcx\t; comment\r\n\tinc\tbyte ptr [rax]\r\nret\r\n"
+
+	expected := parse(unix)
+	got := parse(windows)
+
+	if len(expected) != 6 {
+		t.Fatalf("unexpected parse of input: %v", expected)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("different number of nodes, expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Fatalf("node %d differs, expected %s, got %s", i, expected[i], got[i])
+		}
+	}
+
+	// Truncated input, and unknown characters, are errors.
+	for _, src := range []string{"mov rax", "mov rax, (", "@"} {
+		p := New(src)
+		if _, ok := p.Next().(Error); !ok {
+			t.Fatalf("expected an error parsing %s", src)
+		}
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+
+	// Blank lines, and those containing only whitespace, between
+	// the statements are skipped without producing any nodes.
+	src := "\n   \nmov rax, 3\n\t\n\n  \t  \nadd rbx, rcx  \t\n\r\n \r\nret\n\n\t \n"
+
+	expected := []struct {
+		Instruction string
+		Operands    int
+		Line        int
+	}{
+		{"mov", 2, 3},
+		{"add", 2, 7},
+		{"ret", 0, 10},
+	}
+
+	p := New(src)
+	for _, e := range expected {
+		n := p.Next()
+		i, ok := n.(Instruction)
+		if !ok {
+			t.Fatalf("expected %s, got %v", e.Instruction, n)
+		}
+		if i.Instruction != e.Instruction || len(i.Operands) != e.Operands {
+			t.Fatalf("expected %s, got %v", e.Instruction, i)
+		}
+		if i.Line != e.Line {
+			t.Fatalf("expected %s upon line %d, got %d", e.Instruction, e.Line, i.Line)
+		}
+	}
+	if n := p.Next(); n != nil {
+		t.Fatalf("unexpected node after the instructions: %v", n)
+	}
+
+	// Input which is entirely blank contains no nodes.
+	for _, src := range []string{"", "\n", " \t ", "\r\n\r\n", "\n  \n\t\n"} {
+		if n := New(src).Next(); n != nil {
+			t.Fatalf("unexpected node parsing %q: %v", src, n)
+		}
+	}
+}
+
+func TestSetInstructions(t *testing.T) {
+
+	src := "magic 1, rax\nmagic\nnop"
+
+	// Without registration the name is an unexpected identifier.
+	if _, ok := New(src).Next().(Error); !ok {
+		t.Fatalf("expected an error parsing an unknown instruction")
+	}
+
+	p := New(src)
+	p.SetInstructions(map[string]int{"magic": instructions.Variable})
+
+	expected := []struct {
+		Instruction string
+		Operands    int
+	}{
+		{"magic", 2},
+		{"magic", 0},
+		{"nop", 0},
+	}
+	for _, e := range expected {
+		n := p.Next()
+		i, ok := n.(Instruction)
+		if !ok || i.Instruction != e.Instruction || len(i.Operands) != e.Operands {
+			t.Fatalf("expected %s with %d operands, got %v", e.Instruction, e.Operands, n)
+		}
+	}
+	if n := p.Next(); n != nil {
+		t.Fatalf("unexpected node %v", n)
+	}
+
+	// An unknown name at the start of a line is reported as such,
+	// listing those which are known.
+	p = New("nop\nmagic rax\nbogus")
+	p.SetInstructions(map[string]int{"magic": instructions.Variable})
+	p.Next()
+	p.Next()
+	e, ok := p.Next().(Error)
+	if !ok || !strings.HasPrefix(e.Value, `unknown instruction "bogus"; supported: `) ||
+		!strings.Contains(e.Value, " magic, ") || !strings.Contains(e.Value, " nop, ") {
+		t.Fatalf("unexpected result parsing an unknown instruction: %v", e)
+	}
+
+	// The name is only an instruction at the start of a statement.
+	p = New("mov rax, magic")
+	p.SetInstructions(map[string]int{"magic": 0})
+	i, ok := p.Next().(Instruction)
+	if !ok || i.Operands[1].Literal != "magic" || i.Operands[1].Type != token.IDENTIFIER {
+		t.Fatalf("unexpected parse of an operand named as an instruction: %v", i)
+	}
+}
@@ -0,0 +1,225 @@
+// Package pe generates minimal PE/COFF executables, for Microsoft Windows.
+//
+// The generated executable contains a single section, holding our code
+// followed by our data, which is readable, writable, and executable.
+// There are no imports, and no relocations, so the image must be loaded
+// at its preferred base-address.
+package pe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	imageBase        uint64 = 0x400000
+	sectionAlignment uint64 = 0x1000
+	fileAlignment    uint64 = 0x200
+
+	// peOffset is the offset of the PE signature, which follows the
+	// DOS header and stub.
+	peOffset = 0x80
+)
+
+// stub is the traditional DOS program which explains that the binary
+// cannot be executed under DOS.
+//
+// It prints the message which follows it, at offset 0x0e, and exits:
+//
+//	push cs
+//	pop ds
+//	mov dx, 0x0e
+//	mov ah, 9
+//	int 0x21
+//	mov ax, 0x4c01
+//	int 0x21
+var stub = []byte{
+	0x0e, 0x1f, 0xba, 0x0e, 0x00, 0xb4, 0x09,
+	0xcd, 0x21, 0xb8, 0x01, 0x4c, 0xcd, 0x21,
+}
+
+// Builder is used to accumulate the contents of the executable.
+type Builder struct {
+	o []byte
+}
+
+// WriteBytes appends the given bytes.
+func (b *Builder) WriteBytes(bs ...byte) {
+	b.o = append(b.o, bs...)
+}
+
+// WriteValue appends the given value, in little-endian order, using the
+// specified number of bytes.
+func (b *Builder) WriteValue(size int, value uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	b.WriteBytes(buf[:size]...)
+}
+
+// Pad appends zeros until the output is the given length.
+func (b *Builder) Pad(length uint64) {
+	for uint64(len(b.o)) < length {
+		b.o = append(b.o, 0x00)
+	}
+}
+
+// PE holds our state.
+type PE struct {
+	// class is the type of executable we generate, either 32 or
+	// 64 bits.
+	class int
+}
+
+// New returns a new PE generator, which will produce 64-bit (PE32+)
+// executables by default.
+func New() *PE {
+	return &PE{class: 64}
+}
+
+// SetClass changes the type of binary we generate, which may be either a
+// 32-bit (PE32) executable or a 64-bit (PE32+) one.
+func (p *PE) SetClass(bits int) error {
+	if bits != 32 && bits != 64 {
+		return fmt.Errorf("unsupported PE class %d", bits)
+	}
+	p.class = bits
+	return nil
+}
+
+// CodeAddress returns the virtual address at which the code is loaded,
+// which is also the entry-point.  The data immediately follows the code.
+func (p *PE) CodeAddress() uint64 {
+	return imageBase + sectionAlignment
+}
+
+// WriteContent writes an executable containing the given code and data
+// to the specified path.
+func (p *PE) WriteContent(path string, textSection, dataSection []byte) error {
+	return ioutil.WriteFile(path, p.Build(textSection, dataSection), 0755)
+}
+
+// Build returns the executable containing the given code and data.
+func (p *PE) Build(textSection, dataSection []byte) []byte {
+
+	size := uint64(len(textSection) + len(dataSection))
+	rawSize := align(size, fileAlignment)
+	imageSize := sectionAlignment + align(size, sectionAlignment)
+
+	var o Builder
+
+	// DOS header
+	o.WriteBytes('M', 'Z')
+	o.WriteValue(2, 0x90)   // Bytes on the last page
+	o.WriteValue(2, 3)      // Pages in the file
+	o.WriteValue(2, 0)      // Relocations
+	o.WriteValue(2, 4)      // Size of header, in paragraphs
+	o.WriteValue(2, 0)      // Minimum extra paragraphs
+	o.WriteValue(2, 0xffff) // Maximum extra paragraphs
+	o.WriteValue(2, 0)      // Initial SS
+	o.WriteValue(2, 0xb8)   // Initial SP
+	o.Pad(0x3c)
+	o.WriteValue(4, peOffset) // Offset of the PE header
+
+	// DOS stub
+	o.WriteBytes(stub...)
+	o.WriteBytes([]byte("This program cannot be run in DOS mode.\r\r\n$")...)
+	o.Pad(peOffset)
+
+	// PE signature
+	o.WriteBytes('P', 'E', 0x00, 0x00)
+
+	// COFF header
+	if p.class == 32 {
+		o.WriteValue(2, 0x14c) // i386
+	} else {
+		o.WriteValue(2, 0x8664) // x86-64
+	}
+	o.WriteValue(2, 1) // Number of sections
+	o.WriteValue(4, 0) // Timestamp
+	o.WriteValue(4, 0) // Symbol table
+	o.WriteValue(4, 0) // Number of symbols
+	if p.class == 32 {
+		o.WriteValue(2, 224)    // Size of optional header
+		o.WriteValue(2, 0x0103) // Relocations stripped, executable, 32-bit
+	} else {
+		o.WriteValue(2, 240)    // Size of optional header
+		o.WriteValue(2, 0x0023) // Relocations stripped, executable, large addresses
+	}
+
+	// Optional header
+	if p.class == 32 {
+		o.WriteValue(2, 0x10b) // PE32
+	} else {
+		o.WriteValue(2, 0x20b) // PE32+
+	}
+	o.WriteBytes(0x00, 0x00)          // Linker version
+	o.WriteValue(4, rawSize)          // Size of code
+	o.WriteValue(4, 0)                // Size of initialized data
+	o.WriteValue(4, 0)                // Size of uninitialized data
+	o.WriteValue(4, sectionAlignment) // Entry point
+	o.WriteValue(4, sectionAlignment) // Base of code
+	if p.class == 32 {
+		o.WriteValue(4, sectionAlignment) // Base of data
+		o.WriteValue(4, imageBase)        // Preferred load address
+	} else {
+		o.WriteValue(8, imageBase) // Preferred load address
+	}
+	o.WriteValue(4, sectionAlignment)
+	o.WriteValue(4, fileAlignment)
+	o.WriteValue(2, 6)             // OS version, major
+	o.WriteValue(2, 0)             // OS version, minor
+	o.WriteValue(2, 0)             // Image version, major
+	o.WriteValue(2, 0)             // Image version, minor
+	o.WriteValue(2, 6)             // Subsystem version, major
+	o.WriteValue(2, 0)             // Subsystem version, minor
+	o.WriteValue(4, 0)             // Reserved
+	o.WriteValue(4, imageSize)     // Size of image
+	o.WriteValue(4, fileAlignment) // Size of headers
+	o.WriteValue(4, 0)             // Checksum
+	o.WriteValue(2, 3)             // Console subsystem
+	o.WriteValue(2, 0)             // DLL characteristics
+
+	// Stack and heap, reserved and committed
+	width := 8
+	if p.class == 32 {
+		width = 4
+	}
+	o.WriteValue(width, 0x100000)
+	o.WriteValue(width, 0x1000)
+	o.WriteValue(width, 0x100000)
+	o.WriteValue(width, 0x1000)
+
+	o.WriteValue(4, 0)  // Loader flags
+	o.WriteValue(4, 16) // Number of data directories
+
+	// The data directories, all of which are empty
+	for i := 0; i < 16; i++ {
+		o.WriteValue(8, 0)
+	}
+
+	// Section header
+	o.WriteBytes('.', 't', 'e', 'x', 't', 0x00, 0x00, 0x00)
+	o.WriteValue(4, size)             // Virtual size
+	o.WriteValue(4, sectionAlignment) // Virtual address
+	o.WriteValue(4, rawSize)          // Size of raw data
+	o.WriteValue(4, fileAlignment)    // Offset of raw data
+	o.WriteValue(4, 0)                // Relocations
+	o.WriteValue(4, 0)                // Line numbers
+	o.WriteValue(2, 0)                // Number of relocations
+	o.WriteValue(2, 0)                // Number of line numbers
+	o.WriteValue(4, 0xe0000060)       // Code, data, executable, readable, writable
+
+	// Output the code and data, padded to the file alignment
+	o.Pad(fileAlignment)
+	o.WriteBytes(textSection...)
+	o.WriteBytes(dataSection...)
+	o.Pad(fileAlignment + rawSize)
+
+	return o.o
+}
+
+// align rounds the given value up to a multiple of the alignment.
+func align(value, alignment uint64) uint64 {
+	return (value + alignment - 1) / alignment * alignment
+}
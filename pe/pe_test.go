@@ -0,0 +1,108 @@
+package pe
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+
+	code := []byte{0x90, 0xc3}
+	data := []byte("Hello")
+
+	for _, class := range []int{32, 64} {
+
+		p := New()
+		err := p.SetClass(class)
+		if err != nil {
+			t.Fatalf("failed to set class: %s", err)
+		}
+		out := p.Build(code, data)
+
+		// The DOS header, and the PE signature it points to.
+		if string(out[0:2]) != "MZ" {
+			t.Fatalf("output doesn't begin with MZ")
+		}
+		offset := binary.LittleEndian.Uint32(out[0x3c:])
+		if string(out[offset:offset+4]) != "PE\x00\x00" {
+			t.Fatalf("missing PE signature at offset %x", offset)
+		}
+
+		// Ensure the standard library is happy with the result.
+		f, err := pe.NewFile(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to parse PE: %s", err)
+		}
+
+		machine := uint16(pe.IMAGE_FILE_MACHINE_AMD64)
+		if class == 32 {
+			machine = pe.IMAGE_FILE_MACHINE_I386
+		}
+		if f.Machine != machine {
+			t.Fatalf("unexpected machine %x", f.Machine)
+		}
+
+		switch hdr := f.OptionalHeader.(type) {
+		case *pe.OptionalHeader32:
+			if class != 32 || hdr.ImageBase+hdr.AddressOfEntryPoint != uint32(p.CodeAddress()) {
+				t.Fatalf("unexpected optional header %v", hdr)
+			}
+		case *pe.OptionalHeader64:
+			if class != 64 || hdr.ImageBase+uint64(hdr.AddressOfEntryPoint) != p.CodeAddress() {
+				t.Fatalf("unexpected optional header %v", hdr)
+			}
+		default:
+			t.Fatalf("unexpected optional header %T", hdr)
+		}
+
+		// The single section contains our code followed by our data.
+		if len(f.Sections) != 1 {
+			t.Fatalf("expected a single section, got %d", len(f.Sections))
+		}
+		contents, err := f.Sections[0].Data()
+		if err != nil {
+			t.Fatalf("failed to read section: %s", err)
+		}
+		expected := append(append([]byte{}, code...), data...)
+		if !bytes.HasPrefix(contents, expected) {
+			t.Fatalf("unexpected section contents % x", contents)
+		}
+		if f.Sections[0].VirtualSize != uint32(len(expected)) {
+			t.Fatalf("unexpected section size %d", f.Sections[0].VirtualSize)
+		}
+	}
+
+	if New().SetClass(16) == nil {
+		t.Fatalf("expected error setting invalid class")
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pe")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.exe")
+
+	p := New()
+	err = p.WriteContent(path, []byte{0x90}, []byte{})
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read binary: %s", err)
+	}
+	if !bytes.Equal(data, p.Build([]byte{0x90}, []byte{})) {
+		t.Fatalf("written binary differs from the built one")
+	}
+}
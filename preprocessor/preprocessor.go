@@ -0,0 +1,187 @@
+// Package preprocessor handles the conditional assembly of our input.
+//
+// The preprocessor operates upon the source, line by line, before it
+// is lexed and parsed.  It allows blocks of code to be included, or
+// excluded, depending upon which symbols have been defined:
+//
+//	%define DEBUG
+//
+//	%ifdef DEBUG
+//	        mov rbx, 1
+//	%else
+//	        mov rbx, 0
+//	%endif
+//
+// Symbols may be defined in the source, via `%define`, or externally
+// via the Define method.  A symbol may be given a value, which is
+// used by `%if`:
+//
+//	%define LEVEL 2
+//
+//	%if LEVEL
+//	        call trace
+//	%endif
+package preprocessor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Preprocessor holds our state.
+type Preprocessor struct {
+	// src holds the source we're processing.
+	src string
+
+	// defines holds the symbols which have been defined, and their
+	// values.
+	defines map[string]string
+}
+
+// condition holds the state of a single %if block.
+type condition struct {
+	// active is true if the lines in this block are included.
+	active bool
+
+	// seenElse is true once we've processed an %else.
+	seenElse bool
+
+	// line holds the line-number the block began upon.
+	line int
+}
+
+// New creates a new preprocessor, for the given source.
+func New(src string) *Preprocessor {
+	return &Preprocessor{src: src, defines: make(map[string]string)}
+}
+
+// Define records that the given symbol is defined, with the specified
+// value.
+func (p *Preprocessor) Define(name string, value string) {
+	p.defines[name] = value
+}
+
+// Defines returns the symbols which have been defined, via Define or by
+// the `%define` directives processed so far, and their values.
+func (p *Preprocessor) Defines() map[string]string {
+	out := make(map[string]string)
+	for name, value := range p.defines {
+		out[name] = value
+	}
+	return out
+}
+
+// Process handles the directives in our source, and returns the result.
+//
+// Lines which are excluded, and the directives themselves, are replaced
+// by empty lines so that the line-numbers of the output match those of
+// the input.
+func (p *Preprocessor) Process() (string, error) {
+
+	var out []string
+	var stack []condition
+
+	for n, line := range strings.Split(p.src, "\n") {
+
+		// Are we including lines at the moment?
+		active := len(stack) == 0 || stack[len(stack)-1].active
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "%") {
+			if active {
+				out = append(out, line)
+			} else {
+				out = append(out, "")
+			}
+			continue
+		}
+
+		// All directives are replaced by blank lines.
+		out = append(out, "")
+
+		switch fields[0] {
+
+		case "%define":
+			if len(fields) < 2 {
+				return "", fmt.Errorf("line %d: missing name for %%define", n+1)
+			}
+			if active {
+				p.defines[fields[1]] = strings.Join(fields[2:], " ")
+			}
+
+		case "%ifdef", "%ifndef", "%if":
+			if len(fields) != 2 {
+				return "", fmt.Errorf("line %d: %s requires a single argument", n+1, fields[0])
+			}
+
+			var result bool
+			switch fields[0] {
+			case "%ifdef":
+				_, result = p.defines[fields[1]]
+			case "%ifndef":
+				_, result = p.defines[fields[1]]
+				result = !result
+			case "%if":
+				val, err := p.value(fields[1])
+				if err != nil {
+					return "", fmt.Errorf("line %d: %s", n+1, err)
+				}
+				result = val != 0
+			}
+
+			stack = append(stack, condition{active: active && result, line: n + 1})
+
+		case "%else":
+			if len(stack) == 0 {
+				return "", fmt.Errorf("line %d: %%else without %%if", n+1)
+			}
+			top := &stack[len(stack)-1]
+			if top.seenElse {
+				return "", fmt.Errorf("line %d: multiple %%else for %%if on line %d", n+1, top.line)
+			}
+			top.seenElse = true
+
+			// The %else is active if the %if wasn't, and the
+			// enclosing block is.
+			parent := len(stack) == 1 || stack[len(stack)-2].active
+			top.active = parent && !top.active
+
+		case "%endif":
+			if len(stack) == 0 {
+				return "", fmt.Errorf("line %d: %%endif without %%if", n+1)
+			}
+			stack = stack[:len(stack)-1]
+
+		default:
+			return "", fmt.Errorf("line %d: unknown directive %s", n+1, fields[0])
+		}
+	}
+
+	if len(stack) > 0 {
+		return "", fmt.Errorf("line %d: unterminated %%if", stack[len(stack)-1].line)
+	}
+
+	return strings.Join(out, "\n"), nil
+}
+
+// value returns the numeric value of the argument to an `%if`, which
+// may be either a number or the name of a defined symbol.
+func (p *Preprocessor) value(arg string) (int64, error) {
+
+	str, ok := p.defines[arg]
+	if !ok {
+		str = arg
+	}
+
+	// Symbols defined without a value are considered to be true.
+	if ok && str == "" {
+		return 1, nil
+	}
+
+	val, err := strconv.ParseInt(str, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %%if: %s", arg)
+	}
+	return val, nil
+}
@@ -0,0 +1,103 @@
+package preprocessor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConditionals(t *testing.T) {
+
+	type TestCase struct {
+		Input   string
+		Defines map[string]string
+		Output  []string
+	}
+
+	tests := []TestCase{
+		{Input: "%ifdef DEBUG\nnop\n%else\nret\n%endif",
+			Output: []string{"ret"}},
+		{Input: "%ifdef DEBUG\nnop\n%else\nret\n%endif",
+			Defines: map[string]string{"DEBUG": ""},
+			Output:  []string{"nop"}},
+		{Input: "%ifndef DEBUG\nnop\n%endif",
+			Output: []string{"nop"}},
+		{Input: "%define DEBUG\n%ifdef DEBUG\nnop\n%endif",
+			Output: []string{"nop"}},
+		{Input: "%if LEVEL\nnop\n%else\nret\n%endif",
+			Defines: map[string]string{"LEVEL": "0"},
+			Output:  []string{"ret"}},
+		{Input: "%if 1\nnop\n%endif",
+			Output: []string{"nop"}},
+		{Input: "%ifdef A\n%ifdef B\nnop\n%else\nret\n%endif\n%else\nclc\n%endif",
+			Defines: map[string]string{"A": ""},
+			Output:  []string{"ret"}},
+		{Input: "%ifdef A\n%ifdef B\nnop\n%else\nret\n%endif\n%else\nclc\n%endif",
+			Defines: map[string]string{"B": ""},
+			Output:  []string{"clc"}},
+		{Input: "%ifdef A\n%define B\n%endif\n%ifdef B\nnop\n%endif",
+			Output: []string{}},
+		{Input: "%define LEVEL 2\n%if LEVEL\nnop\n%endif",
+			Output: []string{"nop"}},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		for k, v := range test.Defines {
+			p.Define(k, v)
+		}
+
+		out, err := p.Process()
+		if err != nil {
+			t.Fatalf("unexpected error processing %s: %s", test.Input, err)
+		}
+
+		// Line-numbers must be preserved
+		if strings.Count(out, "\n") != strings.Count(test.Input, "\n") {
+			t.Fatalf("line count changed processing %s", test.Input)
+		}
+
+		lines := strings.Fields(out)
+		if len(lines) != len(test.Output) {
+			t.Fatalf("unexpected output for %s: %v", test.Input, lines)
+		}
+		for i, l := range lines {
+			if l != test.Output[i] {
+				t.Fatalf("unexpected output for %s: %v", test.Input, lines)
+			}
+		}
+	}
+
+	// The values defined in the source are available afterwards.
+	p := New("%define LEVEL 2\n%define DEBUG")
+	p.Define("VERSION", "3")
+	if _, err := p.Process(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defines := p.Defines()
+	if len(defines) != 3 || defines["LEVEL"] != "2" || defines["DEBUG"] != "" || defines["VERSION"] != "3" {
+		t.Fatalf("unexpected definitions %v", defines)
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	tests := []string{
+		"%else",
+		"%endif",
+		"%ifdef",
+		"%ifdef A\nnop",
+		"%ifdef A\n%else\n%else\n%endif",
+		"%if FOO\n%endif",
+		"%define",
+		"%bogus",
+	}
+
+	for _, test := range tests {
+		p := New(test)
+		_, err := p.Process()
+		if err == nil {
+			t.Fatalf("expected error processing %s", test)
+		}
+	}
+}
@@ -18,12 +18,23 @@ type Token struct {
 
 	// Literal contains the literal text of the token.
 	Literal string
+
+	// Line contains the line upon which the token was found, counting
+	// from one.
+	Line int
+
+	// Column contains the column at which the token began, counting
+	// from one.
+	Column int
 }
 
 // Our known token-types
 const (
 	// Basic things
 	COMMA       = ","
+	PLUS        = "+"
+	MINUS       = "-"
+	ASTERISK    = "*"
 	LSQUARE     = "["
 	RSQUARE     = "]"
 	EOF         = "EOF"
@@ -31,14 +42,23 @@ const (
 	DATA        = "DATA"
 	REGISTER    = "REGISTER"
 	INSTRUCTION = "INSTRUCTION"
+	PREFIX      = "PREFIX"
+	SEGMENT     = "SEGMENT"
 	IDENTIFIER  = "IDENTIFIER"
 
 	// Data statement
 	DB = "DB"
+	DQ = "DQ"
+
+	// Section directive, e.g. "section .bss"
+	SECTION = "SECTION"
 
 	// Number as operand
 	NUMBER = "NUMBER"
 
+	// Expression as operand, e.g. "$ - $$"
+	EXPRESSION = "EXPRESSION"
+
 	// String for DB
 	STRING = "STRING"
 
@@ -50,6 +70,10 @@ const (
 var known = map[string]Type{
 	"DB": DB,
 	"db": DB,
+	"DQ": DQ,
+	"dq": DQ,
+
+	"section": SECTION,
 
 	// Things we parse as registers
 	"rax": REGISTER,
@@ -68,6 +92,68 @@ var known = map[string]Type{
 	"r13": REGISTER,
 	"r14": REGISTER,
 	"r15": REGISTER,
+
+	// 32-bit registers
+	"eax": REGISTER,
+	"ebx": REGISTER,
+	"ecx": REGISTER,
+	"edx": REGISTER,
+	"ebp": REGISTER,
+	"esp": REGISTER,
+	"esi": REGISTER,
+	"edi": REGISTER,
+
+	// 16-bit registers
+	"ax": REGISTER,
+	"bx": REGISTER,
+	"cx": REGISTER,
+	"dx": REGISTER,
+	"bp": REGISTER,
+	"sp": REGISTER,
+	"si": REGISTER,
+	"di": REGISTER,
+
+	// 8-bit registers
+	"al": REGISTER,
+	"bl": REGISTER,
+	"cl": REGISTER,
+	"dl": REGISTER,
+	"ah": REGISTER,
+	"bh": REGISTER,
+	"ch": REGISTER,
+	"dh": REGISTER,
+
+	// Control and debug registers, which may be used with mov
+	"cr0": REGISTER,
+	"cr2": REGISTER,
+	"cr3": REGISTER,
+	"cr4": REGISTER,
+	"dr0": REGISTER,
+	"dr1": REGISTER,
+	"dr2": REGISTER,
+	"dr3": REGISTER,
+	"dr4": REGISTER,
+	"dr5": REGISTER,
+	"dr6": REGISTER,
+	"dr7": REGISTER,
+
+	// SSE registers
+	"xmm0":  REGISTER,
+	"xmm1":  REGISTER,
+	"xmm2":  REGISTER,
+	"xmm3":  REGISTER,
+	"xmm4":  REGISTER,
+	"xmm5":  REGISTER,
+	"xmm6":  REGISTER,
+	"xmm7":  REGISTER,
+	"xmm8":  REGISTER,
+	"xmm9":  REGISTER,
+	"xmm10": REGISTER,
+	"xmm11": REGISTER,
+	"xmm12": REGISTER,
+	"xmm13": REGISTER,
+	"xmm14": REGISTER,
+	"xmm15": REGISTER,
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
@@ -80,6 +166,13 @@ func LookupIdentifier(identifier string) Type {
 		}
 	}
 
+	// Is this an instruction-prefix
+	for _, prefix := range instructions.Prefixes {
+		if identifier == prefix {
+			return PREFIX
+		}
+	}
+
 	if tok, ok := known[identifier]; ok {
 		return tok
 	}